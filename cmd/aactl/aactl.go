@@ -1,186 +1,190 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 
-	"github.com/r3boot/anycast-agent/lib"
-	"github.com/r3boot/anycast-agent/lib/consul"
-	"github.com/r3boot/anycast-agent/lib/structs"
+	"github.com/r3boot/anycast-agent/lib/control"
+	"github.com/r3boot/anycast-agent/lib/store"
 )
 
-const (
-	_d_default_consulEndpoint string = "localhost:8500"
-)
+// aactl [global flags] <command> [flags] [arguments]. Commands are quiet
+// when they succeed, unless they are asked for output; errors go to
+// stderr with a non-zero exit code
+type command struct {
+	args string
+	help string
+	run  func(env *environment, args []string) error
+}
+
+// The global flags, and the store, which is only opened by the commands
+// which need it. Commands which compare the store with a file set diffExit,
+// to exit like diff(1): 0 without changes, 1 with changes and 2 on errors
+type environment struct {
+	name        string
+	args        string
+	storeCfg    store.Config
+	agentSocket string
+	opened      store.Store
+	diffExit    bool
+}
+
+// Returned for bad arguments, which exit with 2 like bad flags do
+type usageError struct {
+	message string
+}
+
+func (e usageError) Error() string {
+	return e.message
+}
+
+var commands = map[string]command{
+	"apply":         {"-f file|dir|- [-prune -l selector]", "Add or update the objects in the files, or show what would change with -dry-run", runApply},
+	"get":           {"type[:name]", "Show the objects of a type, or a single object", runGet},
+	"delete":        {"-f file|dir|- | type[:name]", "Delete the objects in the files, a single object or all objects of a type", runDelete},
+	"diff":          {"-f file|dir|-", "Show how the objects in the files differ from the store", runDiff},
+	"validate":      {"-f file|dir|-", "Check the objects in the files without touching the store", runValidate},
+	"placement":     {"", "Show which nodes run which anycast services", runPlacement},
+	"migrate":       {"", "Convert the objects in the store to the current layout", runMigrate},
+	"status":        {"", "Show the services and neighbours of the local anycast-agent", runStatus},
+	"drain":         {"neighbour", "Administratively shut down the session to a neighbour", runDrain},
+	"undrain":       {"neighbour", "Re-enable the session to a drained neighbour", runUndrain},
+	"rib-in":        {"[neighbour]", "Show the routes the local anycast-agent received from its neighbours", runRIBIn},
+	"flows":         {"", "Show the FlowSpec rules injected via the local anycast-agent", runFlows},
+	"flow-add":      {"-f file", "Inject the FlowSpec rule in file via the local anycast-agent", runFlowAdd},
+	"flow-withdraw": {"name", "Withdraw a FlowSpec rule", runFlowWithdraw},
+	"mrt":           {"", "Show the state of the MRT dump of the local anycast-agent", runMRT},
+	"mrt-start":     {"[path]", "Dump the BGP messages of the local anycast-agent in MRT format", runMRTStart},
+	"mrt-stop":      {"", "Stop the MRT dump of the local anycast-agent", runMRTStop},
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, "Usage: aactl [flags] <command> [flags] [arguments]\n\nCommands:\n")
+
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-15s%s\n", name, commands[name].help)
+	}
+
+	fmt.Fprint(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
 
 func main() {
-	var (
-		consulEndpoint *string
-		apply          *string
-		get            *string
-		delete         *string
-		Consul         *consul.Consul
-		err            error
-	)
-
-	// Global options
-	consulEndpoint = flag.String(
-		"consul",
-		_d_default_consulEndpoint,
-		"Connect to consul on this url",
-	)
-
-	apply = flag.String(
-		"apply",
-		"",
-		"File containing object to apply",
-	)
-
-	get = flag.String(
-		"get",
-		"",
-		"Get object(s) (type:name)",
-	)
-
-	delete = flag.String(
-		"delete",
-		"",
-		"File containing object to delete",
-	)
+	env := &environment{}
+
+	store.RegisterFlags(&env.storeCfg)
+
+	flag.StringVar(&env.agentSocket, "agent", control.DefaultSocket,
+		"Control socket of the local anycast-agent")
 
+	flag.Usage = usage
 	flag.Parse()
 
-	if *apply == "" && *delete == "" && *get == "" {
-		fmt.Println("Nothing to do")
-		os.Exit(1)
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
 	}
 
-	if *consulEndpoint == _d_default_consulEndpoint {
-		for _, kv := range os.Environ() {
-			pair := strings.Split(kv, "=")
-			if pair[0] == "CONSUL_HTTP_ADDR" {
-				*consulEndpoint = pair[1]
-			}
-		}
+	env.name = flag.Arg(0)
+	cmd, ok := commands[env.name]
+	if !ok {
+		fmt.Fprintln(os.Stderr, "aactl: unknown command "+env.name)
+		usage()
+		os.Exit(2)
 	}
+	env.args = cmd.args
 
-	Consul, err = consul.NewConsul(*consulEndpoint)
-	if err != nil {
-		fmt.Println("newclient: " + err.Error())
+	err := cmd.run(env, flag.Args()[1:])
+	switch {
+	case err == nil:
+	case errors.Is(err, flag.ErrHelp):
+	case errors.Is(err, errChangesPending):
+		os.Exit(1)
+	case errors.As(err, &usageError{}):
+		fmt.Fprintln(os.Stderr, "aactl "+env.name+": "+err.Error())
+		fmt.Fprintf(os.Stderr, "Usage: aactl %s [flags] %s\n", env.name, env.args)
+		os.Exit(2)
+	case env.diffExit:
+		fmt.Fprintln(os.Stderr, "aactl "+env.name+": "+err.Error())
+		os.Exit(2)
+	default:
+		fmt.Fprintln(os.Stderr, "aactl "+env.name+": "+err.Error())
 		os.Exit(1)
 	}
+}
 
-	fmt.Printf("Consul.Prefix: %v\n", Consul.Prefix)
-
-	if *apply != "" {
-		object, err := structs.LoadFromYaml(*apply)
-		if err != nil {
-			fmt.Print("apply: " + err.Error())
-			os.Exit(1)
-		}
-		if err = Consul.ApplyObject(object); err != nil {
-			fmt.Print("etcd.ApplyObject: " + err.Error())
-		}
+// Bad flags are reported by the flag set itself
+func (env *environment) flags() *flag.FlagSet {
+	flags := flag.NewFlagSet(env.name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: aactl %s [flags] %s\n", env.name, env.args)
+		flags.PrintDefaults()
 	}
+	return flags
+}
 
-	if *get != "" {
-		objType := *get
-		name := ""
-		if strings.Contains(*get, ":") {
-			tokens := strings.Split(*get, ":")
-			objType = tokens[0]
-			name = tokens[1]
-		}
-
-		prefix := Consul.Prefix
-		switch objType {
-		case structs.TypeBgpPeer:
-			{
-				prefix = prefix + "/peers"
-			}
-		case structs.TypeAnycast:
-			{
-				prefix = prefix + "/anycast"
+// Parses the flags of the command, which can come before or after its
+// arguments, and checks the number of arguments
+func (env *environment) parse(flags *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	remaining := []string{}
+	for {
+		if err := flags.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
 			}
+			os.Exit(2)
 		}
+		if flags.NArg() == 0 {
+			break
+		}
+		remaining = append(remaining, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
 
-		if name != "" {
-			object, err := Consul.GetObject(objType, name)
-			if err != nil {
-				fmt.Println("get: " + err.Error())
-				os.Exit(1)
-			}
-
-			output, err := lib.DumpYaml(object)
-			if err != nil {
-				fmt.Println("get: " + err.Error())
-				os.Exit(1)
-			}
-
-			fmt.Print(string(output))
-		} else {
-			all_objects, err := Consul.GetAllObjects(objType, prefix)
-			if err != nil {
-				fmt.Println("get: " + err.Error())
-				os.Exit(1)
-			}
+	if len(remaining) < min || len(remaining) > max {
+		return nil, usageError{"wrong number of arguments"}
+	}
 
-			output, err := lib.DumpYaml(all_objects)
-			if err != nil {
-				fmt.Println("get: " + err.Error())
-				os.Exit(1)
-			}
+	return remaining, nil
+}
 
-			fmt.Print(string(output))
-		}
+func (env *environment) store() (store.Store, error) {
+	if env.opened != nil {
+		return env.opened, nil
 	}
 
-	/*
-		if *delete != "" {
-			objType := *delete
-			name := ""
-			if strings.Contains(*delete, ":") {
-				tokens := strings.Split(*delete, ":")
-				objType = tokens[0]
-				name = tokens[1]
-			}
+	cfg := env.storeCfg
+	cfg.Warn = func(v ...interface{}) {
+		fmt.Fprintln(os.Stderr, "warning: "+fmt.Sprint(v...))
+	}
+	s, err := store.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	env.opened = s
 
-			prefix := Consul.Prefix
-			switch objType {
-			case structs.TypeBgpPeer:
-				{
-					prefix = prefix + "/peers"
-				}
-			case structs.TypeAnycast:
-				{
-					prefix = prefix + "/anycast"
-				}
-			}
+	return s, nil
+}
 
-			var items []string
-
-			if name != "" {
-				items = append(items, prefix+"/"+name)
-			} else {
-				all_items, err := Consul.Ls(prefix)
-				if err != nil {
-					fmt.Println("delete: " + err.Error())
-					os.Exit(1)
-				}
-				for _, item := range all_items {
-					items = append(items, prefix+"/"+item)
-				}
-			}
+func (env *environment) agent() *control.Client {
+	return control.NewClient(env.agentSocket)
+}
 
-			for _, item := range items {
-				if err = etcd.Rm(item); err != nil {
-					fmt.Println("delete: " + err.Error())
-					os.Exit(1)
-				}
-			}
+// Splits type:name; name is empty for a bare type
+func splitObject(arg string) (string, string) {
+	tokens := strings.SplitN(arg, ":", 2)
+	if len(tokens) == 1 {
+		return tokens[0], ""
+	}
 
-		}
-	*/
+	return tokens[0], tokens[1]
 }
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/r3boot/anycast-agent/lib/bgp/bgp2go"
+	"github.com/r3boot/anycast-agent/lib/control"
+	"gopkg.in/yaml.v2"
+)
+
+// The commands which talk to the local anycast-agent over its control
+// socket
+
+func runStatus(env *environment, args []string) error {
+	flags := env.flags()
+	format := outputFlag(flags)
+	if _, err := env.parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	status := control.AgentStatus{}
+	if err := env.agent().Call(control.EndpointStatus, nil, &status); err != nil {
+		return err
+	}
+
+	return printValue(*format, status, func(w io.Writer, wide bool) {
+		header := []string{"NODE", "ASNUM", "ROUTER ID"}
+		columns := []string{status.Node, strconv.Itoa(status.AsNumber), status.RouterId}
+		if wide {
+			header = append(header, "NEXTHOP", "NEXTHOP6")
+			columns = append(columns, status.NextHop, status.NextHop6)
+		}
+		row(w, header...)
+		row(w, columns...)
+		row(w)
+
+		row(w, "SERVICE", "IP", "IP6", "STATE")
+		for _, service := range status.Services {
+			state := "withdrawn"
+			if service.Announced {
+				state = "announced"
+			}
+			row(w, service.Name, service.IP, service.IP6, state)
+		}
+		row(w)
+
+		row(w, "NEIGHBOUR")
+		for _, neighbour := range status.Neighbours {
+			row(w, neighbour)
+		}
+	})
+}
+
+func runDrain(env *environment, args []string) error {
+	flags := env.flags()
+	message := flags.String("message", "", "Shutdown communication sent to the neighbour")
+	args, err := env.parse(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	request := control.DrainRequest{Neighbour: args[0], Message: *message}
+	return env.agent().Call(control.EndpointDrain, request, nil)
+}
+
+func runUndrain(env *environment, args []string) error {
+	args, err := env.parse(env.flags(), args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	request := control.DrainRequest{Neighbour: args[0]}
+	return env.agent().Call(control.EndpointUndrain, request, nil)
+}
+
+func runRIBIn(env *environment, args []string) error {
+	flags := env.flags()
+	format := outputFlag(flags)
+	args, err := env.parse(flags, args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	endpoint := control.EndpointAdjRIBIn
+	if len(args) == 1 {
+		endpoint += "?" + url.Values{"neighbour": {args[0]}}.Encode()
+	}
+	routes := []bgp2go.AdjRIBInEntry{}
+	if err = env.agent().Call(endpoint, nil, &routes); err != nil {
+		return err
+	}
+
+	return printValue(*format, routes, func(w io.Writer, wide bool) {
+		header := []string{"NEIGHBOUR", "PREFIX", "NEXTHOP", "ASPATH"}
+		if wide {
+			header = append(header, "MED", "LOCALPREF", "COMMUNITIES", "RECEIVED")
+		}
+		row(w, header...)
+
+		for _, route := range routes {
+			path := []string{}
+			for _, as := range route.ASPath {
+				path = append(path, strconv.FormatUint(uint64(as), 10))
+			}
+			columns := []string{route.Neighbour, route.Prefix, route.NextHop, strings.Join(path, " ")}
+			if wide {
+				columns = append(columns, strconv.FormatUint(uint64(route.MED), 10),
+					strconv.FormatUint(uint64(route.LocalPref), 10),
+					strings.Join(route.Communities, " "), route.Received.Format("2006-01-02 15:04:05"))
+			}
+			row(w, columns...)
+		}
+	})
+}
+
+func flowTable(flows []control.FlowStatus) tableFunc {
+	return func(w io.Writer, wide bool) {
+		row(w, "NAME", "MATCH", "ACTION", "RATE", "EXPIRES")
+		for _, flow := range flows {
+			rate := ""
+			if flow.Action == control.FlowActionRateLimit {
+				rate = fmt.Sprint(flow.Rate)
+			}
+			row(w, flow.Name, flow.Match, flow.Action, rate, flow.Expires)
+		}
+	}
+}
+
+func runFlows(env *environment, args []string) error {
+	flags := env.flags()
+	format := outputFlag(flags)
+	if _, err := env.parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	flows := []control.FlowStatus{}
+	if err := env.agent().Call(control.EndpointFlows, nil, &flows); err != nil {
+		return err
+	}
+
+	return printValue(*format, flows, flowTable(flows))
+}
+
+func runFlowAdd(env *environment, args []string) error {
+	flags := env.flags()
+	file := flags.String("f", "", "File containing the FlowSpec rule")
+	if _, err := env.parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errNoFile
+	}
+
+	data, err := ioutil.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	request := control.FlowRequest{}
+	if err = yaml.Unmarshal(data, &request); err != nil {
+		return fmt.Errorf("%s: %v", *file, err)
+	}
+
+	return env.agent().Call(control.EndpointFlowAdd, request, nil)
+}
+
+func runFlowWithdraw(env *environment, args []string) error {
+	args, err := env.parse(env.flags(), args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	request := control.FlowWithdrawRequest{Name: args[0]}
+	return env.agent().Call(control.EndpointFlowWithdraw, request, nil)
+}
+
+func mrtTable(status control.MRTStatus) tableFunc {
+	return func(w io.Writer, wide bool) {
+		row(w, "ENABLED", "PATH", "SIZE", "MAX SIZE", "KEEP", "ERROR")
+		row(w, yesNo(status.Enabled), status.Path, strconv.FormatInt(status.Size, 10),
+			strconv.FormatInt(status.MaxSize, 10), strconv.Itoa(status.Keep), status.Error)
+	}
+}
+
+func runMRT(env *environment, args []string) error {
+	flags := env.flags()
+	format := outputFlag(flags)
+	if _, err := env.parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	status := control.MRTStatus{}
+	if err := env.agent().Call(control.EndpointMRT, nil, &status); err != nil {
+		return err
+	}
+
+	return printValue(*format, status, mrtTable(status))
+}
+
+func runMRTStart(env *environment, args []string) error {
+	flags := env.flags()
+	maxSize := flags.Int64("max-size", control.DefaultMRTMaxSize, "Rotate the MRT dump once it exceeds this many bytes")
+	keep := flags.Int("keep", control.DefaultMRTKeep, "Number of rotated MRT dumps to keep")
+	args, err := env.parse(flags, args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	request := control.MRTRequest{MaxSize: *maxSize, Keep: *keep}
+	if len(args) == 1 {
+		request.Path = args[0]
+	}
+
+	return env.agent().Call(control.EndpointMRTStart, request, nil)
+}
+
+func runMRTStop(env *environment, args []string) error {
+	if _, err := env.parse(env.flags(), args, 0, 0); err != nil {
+		return err
+	}
+
+	return env.agent().Call(control.EndpointMRTStop, struct{}{}, nil)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/r3boot/anycast-agent/lib/store"
+)
+
+// Returned by diff and apply -dry-run when applying the file would change
+// the store, to exit with 1 like diff(1) does
+var errChangesPending = errors.New("changes pending")
+
+func runDiff(env *environment, args []string) error {
+	env.diffExit = true
+
+	flags := env.flags()
+	files := fileFlag(flags, "File containing the objects to compare")
+	if _, err := env.parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	objects, err := loadObjects(*files)
+	if err != nil {
+		return err
+	}
+
+	Store, err := env.store()
+	if err != nil {
+		return err
+	}
+
+	return applyObjects(Store, objects, nil, true)
+}
+
+// Prints the fields of an object which would change, after a line with the
+// object and what would happen to it
+func showDiffs(id, result string, diffs []store.FieldDiff) {
+	fmt.Println(id + ": " + result)
+	for _, diff := range diffs {
+		fmt.Printf("  %s: %s -> %s\n", diff.Path, diff.Old, diff.New)
+	}
+}
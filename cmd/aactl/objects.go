@@ -0,0 +1,611 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/r3boot/anycast-agent/lib/store"
+	"github.com/r3boot/anycast-agent/lib/structs"
+)
+
+// The files given with -f, which can be given more than once. A file can
+// hold several --- separated objects, a directory is read recursively and
+// - is stdin
+type fileList []string
+
+func (f *fileList) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *fileList) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func fileFlag(flags *flag.FlagSet, usage string) *fileList {
+	files := &fileList{}
+	flags.Var(files, "f", usage+"; a directory, - for stdin, can be repeated")
+	return files
+}
+
+// Peers come first, so the services and nodes which list them can be
+// applied once they exist
+var typeOrder = map[string]int{
+	structs.TypeBgpPeer: 0,
+	structs.TypeNode:    1,
+	structs.TypeAnycast: 2,
+}
+
+// Reads the objects in the files given with -f, in the order they are
+// applied in. An object may only be given once. Warnings about valid
+// objects go to stderr
+func loadObjects(files []string) ([]interface{}, error) {
+	if len(files) == 0 {
+		return nil, errNoFile
+	}
+
+	objects := []interface{}{}
+	for _, file := range files {
+		items, err := loadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, items...)
+	}
+
+	seen := make(map[string]bool)
+	for _, object := range objects {
+		objType, name, err := store.ObjectName(object)
+		if err != nil {
+			return nil, err
+		}
+		if seen[objType+":"+name] {
+			return nil, errors.New(objType + ":" + name + " is given more than once")
+		}
+		seen[objType+":"+name] = true
+
+		if anycast, ok := object.(structs.AnycastObject); ok {
+			for _, warning := range structs.AnycastWarnings(anycast) {
+				fmt.Fprintln(os.Stderr, "warning: "+warning)
+			}
+		}
+	}
+
+	sort.SliceStable(objects, func(i, j int) bool {
+		iType, _, _ := store.ObjectName(objects[i])
+		jType, _, _ := store.ObjectName(objects[j])
+		return typeOrder[iType] < typeOrder[jType]
+	})
+
+	return objects, nil
+}
+
+// Directories are read in lexical order, skipping files which do not end
+// in .yaml or .yml. Warnings about deprecated keys go to stderr
+func loadFile(file string) ([]interface{}, error) {
+	if file == "-" {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		objects, warnings, err := structs.DecodeFromYaml(data)
+		for _, warning := range warnings {
+			warning.File = "stdin"
+			fmt.Fprintln(os.Stderr, "warning: "+warning.Error())
+		}
+		if problems, ok := err.(structs.YamlErrors); ok {
+			for i := range problems {
+				problems[i].File = "stdin"
+			}
+		}
+		return objects, err
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return loadYaml(file)
+	}
+
+	objects := []interface{}{}
+	err = filepath.Walk(file, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if ext := filepath.Ext(path); ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
+
+		items, err := loadYaml(path)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, items...)
+
+		return nil
+	})
+
+	return objects, err
+}
+
+func loadYaml(file string) ([]interface{}, error) {
+	objects, warnings, err := structs.LoadAllFromYaml(file)
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "warning: "+warning.Error())
+	}
+
+	return objects, err
+}
+
+// key=value[,key=value]
+func parseSelector(value string) (map[string]string, error) {
+	selector := make(map[string]string)
+	if value == "" {
+		return selector, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		tokens := strings.SplitN(pair, "=", 2)
+		if len(tokens) != 2 {
+			return nil, usageError{"invalid label selector " + value + ", expected key=value[,key=value]"}
+		}
+		selector[tokens[0]] = tokens[1]
+	}
+
+	return selector, structs.ValidateLabels(selector)
+}
+
+func runApply(env *environment, args []string) error {
+	flags := env.flags()
+	files := fileFlag(flags, "File containing the objects to apply")
+	dryRun := flags.Bool("dry-run", false, "Show what would change instead of applying it")
+	prune := flags.Bool("prune", false, "Delete the objects matching -l which are not in the applied files")
+	selector := flags.String("l", "", "Label selector for -prune, as key=value[,key=value]")
+	if _, err := env.parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+	env.diffExit = *dryRun
+
+	labels, err := parseSelector(*selector)
+	if err != nil {
+		return err
+	}
+	if *prune && len(labels) == 0 {
+		return usageError{"-prune needs a label selector given with -l"}
+	}
+
+	objects, err := loadObjects(*files)
+	if err != nil {
+		return err
+	}
+
+	Store, err := env.store()
+	if err != nil {
+		return err
+	}
+
+	pruned := []string{}
+	if *prune {
+		if pruned, err = unlisted(Store, objects, labels); err != nil {
+			return err
+		}
+	}
+
+	return applyObjects(Store, objects, pruned, *dryRun)
+}
+
+// Returns the objects in the store which match the selector, but are not
+// one of objects, as type:name in the order they are deleted in
+func unlisted(Store store.Store, objects []interface{}, selector map[string]string) ([]string, error) {
+	applied := make(map[string]bool)
+	for _, object := range objects {
+		objType, name, err := store.ObjectName(object)
+		if err != nil {
+			return nil, err
+		}
+		applied[objType+":"+name] = true
+	}
+
+	ids := []string{}
+	for _, objType := range []string{structs.TypeAnycast, structs.TypeNode, structs.TypeBgpPeer} {
+		items, err := Store.List(objType)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			_, name, err := store.ObjectName(item)
+			if err != nil {
+				return nil, err
+			}
+			if !applied[objType+":"+name] && structs.MatchLabels(selector, store.ObjectLabels(item)) {
+				ids = append(ids, objType+":"+name)
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+// Writes objects and deletes the objects in pruned, after checking them
+// all against the store, and reports what happened to every object. With
+// dryRun the changes are only shown, and errChangesPending is returned if
+// there are any
+func applyObjects(Store store.Store, objects []interface{}, pruned []string, dryRun bool) error {
+	if err := store.ValidateChanges(Store, objects, pruned); err != nil {
+		return err
+	}
+
+	pending := false
+	for _, object := range objects {
+		objType, name, err := store.ObjectName(object)
+		if err != nil {
+			return err
+		}
+
+		current, err := Store.Get(objType, name)
+		if store.IsNotFound(err) {
+			current = nil
+		} else if err != nil {
+			return err
+		}
+
+		diffs, err := store.DiffObjects(current, object)
+		if err != nil {
+			return err
+		}
+
+		result := "updated"
+		switch {
+		case len(diffs) == 0:
+			result = "unchanged"
+		case current == nil:
+			result = "created"
+		}
+
+		if dryRun {
+			if len(diffs) > 0 {
+				showDiffs(objType+":"+name, result, diffs)
+				pending = true
+			}
+			continue
+		}
+
+		if len(diffs) > 0 {
+			if err = Store.Put(object); err != nil {
+				return err
+			}
+		}
+		fmt.Println(result + " " + objType + ":" + name)
+	}
+
+	for _, id := range pruned {
+		if dryRun {
+			showDiffs(id, "deleted", nil)
+			pending = true
+			continue
+		}
+
+		objType, name := splitObject(id)
+		if err := Store.Delete(objType, name); err != nil {
+			return err
+		}
+		fmt.Println("deleted " + id)
+	}
+
+	if pending {
+		return errChangesPending
+	}
+
+	return nil
+}
+
+func runValidate(env *environment, args []string) error {
+	flags := env.flags()
+	files := fileFlag(flags, "File containing the objects to validate")
+	if _, err := env.parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+
+	_, err := loadObjects(*files)
+	return err
+}
+
+func runGet(env *environment, args []string) error {
+	flags := env.flags()
+	format := outputFlag(flags)
+	args, err := env.parse(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	Store, err := env.store()
+	if err != nil {
+		return err
+	}
+
+	objType, name := splitObject(args[0])
+
+	var (
+		value   interface{}
+		objects []interface{}
+	)
+	if name != "" {
+		object, err := Store.Get(objType, name)
+		if err != nil {
+			return err
+		}
+		value = object
+		objects = []interface{}{object}
+	} else {
+		if objects, err = Store.List(objType); err != nil {
+			return err
+		}
+		value = objects
+	}
+
+	// Only looked up for wide, since it takes a request per object
+	revisions := make(map[string]store.Revision)
+	if *format == formatWide {
+		for _, object := range objects {
+			_, name, err := store.ObjectName(object)
+			if err != nil {
+				return err
+			}
+			if revisions[name], err = Store.Revision(objType, name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return printValue(*format, value, func(w io.Writer, wide bool) {
+		objectTable(w, objType, objects, revisions, wide)
+	})
+}
+
+func objectTable(w io.Writer, objType string, objects []interface{}, revisions map[string]store.Revision, wide bool) {
+	header := []string{"NAME", "ASNUM", "IP", "IP6"}
+	switch objType {
+	case structs.TypeBgpPeer:
+		header = append(header, "DESCRIPTION")
+		if wide {
+			header = append(header, "LABELS", "FAMILIES", "BFD", "FLOWSPEC")
+		}
+	case structs.TypeAnycast:
+		header = append(header, "PEERS")
+		if wide {
+			header = append(header, "PEER SELECTOR", "PLACEMENT", "HEALTHCHECK")
+		}
+	case structs.TypeNode:
+		header = []string{"NAME", "HOSTNAME", "SITE", "PEERS"}
+		if wide {
+			header = append(header, "LABELS", "ROUTER ID", "NEXTHOP", "NEXTHOP6")
+		}
+	}
+	if wide {
+		header = append(header, "GENERATION", "MODIFIED", "AUTHOR")
+	}
+	row(w, header...)
+
+	for _, object := range objects {
+		var columns []string
+		switch object := object.(type) {
+		case structs.BgpPeerObject:
+			spec := object.Spec
+			columns = []string{object.Meta.Name, strconv.Itoa(spec.AsNumber), spec.IP, spec.IP6, spec.Description}
+			if wide {
+				columns = append(columns, labels(object.Meta.Labels), strings.Join(spec.AddressFamilies, ","),
+					yesNo(spec.Bfd.Enabled), yesNo(spec.Flowspec))
+			}
+		case structs.AnycastObject:
+			spec := object.Spec
+			columns = []string{object.Meta.Name, strconv.Itoa(spec.AsNumber), spec.IP, spec.IP6, strings.Join(spec.Peers, ",")}
+			if wide {
+				placement := labels(spec.Placement.NodeSelector)
+				if len(spec.Placement.Sites) > 0 {
+					placement = strings.TrimPrefix(placement+",sites="+strings.Join(spec.Placement.Sites, "|"), ",")
+				}
+				columns = append(columns, labels(spec.PeerSelector), placement, spec.HealthCheck)
+			}
+		case structs.NodeObject:
+			spec := object.Spec
+			columns = []string{object.Meta.Name, structs.NodeHostname(object), spec.Site, strings.Join(spec.Peers, ",")}
+			if wide {
+				columns = append(columns, labels(object.Meta.Labels), spec.RouterId, spec.NextHop, spec.NextHop6)
+			}
+		}
+
+		if wide {
+			_, name, _ := store.ObjectName(object)
+			revision := revisions[name]
+			generation, modified := "", ""
+			if revision.Generation != 0 {
+				generation = strconv.FormatInt(revision.Generation, 10)
+			}
+			if !revision.Modified.IsZero() {
+				modified = revision.Modified.Local().Format(time.RFC3339)
+			}
+			columns = append(columns, generation, modified, revision.Author)
+		}
+		row(w, columns...)
+	}
+}
+
+func runDelete(env *environment, args []string) error {
+	flags := env.flags()
+	files := fileFlag(flags, "File containing the objects to delete")
+	force := flags.Bool("force", false, "Delete bgpPeers which are still used by services or nodes")
+	args, err := env.parse(flags, args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	if (len(*files) == 0) == (len(args) == 0) {
+		return usageError{"give either -f or type[:name]"}
+	}
+
+	Store, err := env.store()
+	if err != nil {
+		return err
+	}
+
+	if len(*files) > 0 {
+		objects, err := loadObjects(*files)
+		if err != nil {
+			return err
+		}
+		return deleteObjects(Store, objects, "", *force)
+	}
+
+	return deleteObjects(Store, nil, args[0], *force)
+}
+
+// Deletes objects, or target, which is type:name or a type for all objects
+// of that type. Every object is checked before the first one is deleted
+func deleteObjects(Store store.Store, objects []interface{}, target string, force bool) error {
+	type item struct{ objType, name string }
+	items := []item{}
+
+	if target == "" {
+		// Services and nodes go before the peers they list
+		for i := len(objects) - 1; i >= 0; i-- {
+			objType, name, err := store.ObjectName(objects[i])
+			if err != nil {
+				return err
+			}
+			items = append(items, item{objType, name})
+		}
+	} else if objType, name := splitObject(target); name != "" {
+		items = append(items, item{objType, name})
+	} else {
+		objects, err := Store.List(objType)
+		if err != nil {
+			return err
+		}
+		for _, object := range objects {
+			objType, name, err := store.ObjectName(object)
+			if err != nil {
+				return err
+			}
+			items = append(items, item{objType, name})
+		}
+	}
+
+	deleted := make(map[string]bool)
+	for _, i := range items {
+		deleted[i.objType+":"+i.name] = true
+	}
+
+	for _, i := range items {
+		if i.objType != structs.TypeBgpPeer || force {
+			continue
+		}
+		users, err := store.BgpPeerUsers(Store, i.name)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			if !deleted[user] {
+				return errors.New("bgpPeer " + i.name + " is used by " + user + ", use -force to delete it anyway")
+			}
+		}
+	}
+
+	for _, i := range items {
+		if err := Store.Delete(i.objType, i.name); err != nil {
+			return err
+		}
+		fmt.Println("deleted " + i.objType + ":" + i.name)
+	}
+
+	return nil
+}
+
+func runMigrate(env *environment, args []string) error {
+	if _, err := env.parse(env.flags(), args, 0, 0); err != nil {
+		return err
+	}
+
+	Store, err := env.store()
+	if err != nil {
+		return err
+	}
+
+	migrated, err := store.Migrate(Store)
+	for _, item := range migrated {
+		fmt.Println("migrated " + item)
+	}
+
+	return err
+}
+
+func runPlacement(env *environment, args []string) error {
+	if _, err := env.parse(env.flags(), args, 0, 0); err != nil {
+		return err
+	}
+
+	Store, err := env.store()
+	if err != nil {
+		return err
+	}
+
+	return showPlacement(Store)
+}
+
+// Prints a matrix of services and the nodes they are placed on
+func showPlacement(Store store.Store) error {
+	services, err := store.GetAnycastServices(Store)
+	if err != nil {
+		return err
+	}
+	nodes, err := store.GetNodes(Store)
+	if err != nil {
+		return err
+	}
+
+	return printValue(formatTable, nil, func(w io.Writer, wide bool) {
+		header := []string{"SERVICE"}
+		for _, node := range nodes {
+			header = append(header, node.Meta.Name)
+		}
+		header = append(header, "STATUS")
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+
+		for _, service := range services {
+			row := []string{service.Meta.Name}
+			placed, err := structs.PlaceService(service, nodes)
+			for _, node := range nodes {
+				cell := "-"
+				for _, name := range placed {
+					if name == node.Meta.Name {
+						cell = "x"
+					}
+				}
+				row = append(row, cell)
+			}
+			switch {
+			case err != nil:
+				row = append(row, fmt.Sprintf("below minNodes (%d/%d), withdrawn",
+					len(placed), service.Spec.Placement.MinNodes))
+			case !structs.HasPlacement(service.Spec.Placement):
+				row = append(row, "not placed")
+			default:
+				row = append(row, "ok")
+			}
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+	})
+}
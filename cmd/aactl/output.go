@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/r3boot/anycast-agent/lib"
+)
+
+const (
+	formatYaml  = "yaml"
+	formatJson  = "json"
+	formatTable = "table"
+	formatWide  = "wide"
+)
+
+func outputFlag(flags *flag.FlagSet) *string {
+	return flags.String("o", formatTable, "Output format: yaml, json, table or wide")
+}
+
+// Writes the rows of a table, with wide set for -o wide
+type tableFunc func(w io.Writer, wide bool)
+
+// yaml and json show value as is; table and wide are left to table
+func printValue(format string, value interface{}, table tableFunc) error {
+	var (
+		output []byte
+		err    error
+	)
+
+	switch format {
+	case formatYaml:
+		output, err = lib.DumpYaml(value)
+	case formatJson:
+		output, err = lib.DumpJson(value)
+	case formatTable, formatWide:
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		table(w, format == formatWide)
+		return w.Flush()
+	default:
+		return usageError{"unknown output format " + format}
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(output)
+	return err
+}
+
+func row(w io.Writer, columns ...string) {
+	for i, column := range columns {
+		if column == "" {
+			columns[i] = "-"
+		}
+	}
+	fmt.Fprintln(w, strings.Join(columns, "\t"))
+}
+
+// key=value pairs, sorted
+func labels(values map[string]string) string {
+	pairs := []string{}
+	for key, value := range values {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+var errNoFile = usageError{"no file given with -f"}
@@ -4,52 +4,94 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"strings"
+	"time"
 
 	_ "github.com/r3boot/anycast-agent/lib"
 	"github.com/r3boot/anycast-agent/lib/agent"
+	"github.com/r3boot/anycast-agent/lib/control"
+	"github.com/r3boot/anycast-agent/lib/store"
 )
 
 const (
-	_d_consulEndpoint string = "http://localhost:8500"
+	_d_adjRIBInLimit int = 100000
+	_d_bmpStats          = 60 * time.Second
 )
 
 func main() {
 	var (
-		consulEndpoint *string
-		name           *string
-		err            error
+		storeCfg      store.Config
+		name          *string
+		node          *string
+		controlSocket *string
+		adjRIBIn      *bool
+		adjRIBInLimit *int
+		bmpCollector  *string
+		bmpStats      *time.Duration
+		err           error
 	)
 
-	consulEndpoint = flag.String(
-		"consul",
-		_d_consulEndpoint,
-		"Connect to consul on this url",
-	)
+	store.RegisterFlags(&storeCfg)
 
 	name = flag.String(
 		"name",
 		"",
-		"Anycast profile to use",
+		"Anycast profile to use, instead of the services placed on this node",
+	)
+
+	hostname, _ := os.Hostname()
+	node = flag.String(
+		"node",
+		hostname,
+		"Name or hostname of the node object of this host",
+	)
+
+	controlSocket = flag.String(
+		"control",
+		control.DefaultSocket,
+		"Listen for aactl requests on this unix socket",
+	)
+
+	adjRIBIn = flag.Bool(
+		"adj-rib-in",
+		true,
+		"Keep the routes received from the bgp peers",
+	)
+
+	adjRIBInLimit = flag.Int(
+		"adj-rib-in-limit",
+		_d_adjRIBInLimit,
+		"Maximum number of received prefixes to keep per bgp peer (0 is unlimited)",
+	)
+
+	bmpCollector = flag.String(
+		"bmp-collector",
+		"",
+		"Stream the state of the bgp sessions to this BMP collector (host:port)",
+	)
+
+	bmpStats = flag.Duration(
+		"bmp-stats-interval",
+		_d_bmpStats,
+		"Interval between BMP statistics reports",
 	)
 
 	flag.Parse()
 
-	if *name == "" {
+	if *name == "" && *node == "" {
 		fmt.Println("Nothing to do")
 		os.Exit(1)
 	}
 
-	if *consulEndpoint == _d_consulEndpoint {
-		for _, kv := range os.Environ() {
-			pair := strings.Split(kv, "=")
-			if pair[0] == "CONSUL_HTTP_ADDR" {
-				*consulEndpoint = pair[1]
-			}
-		}
-	}
-
-	anycastAgent, err := agent.NewAnycastAgent(*consulEndpoint, *name)
+	anycastAgent, err := agent.NewAnycastAgent(agent.AnycastAgentConfig{
+		Store:         storeCfg,
+		Profile:       *name,
+		Node:          *node,
+		ControlSocket: *controlSocket,
+		AdjRIBIn:      *adjRIBIn,
+		AdjRIBInLimit: *adjRIBInLimit,
+		BMPCollector:  *bmpCollector,
+		BMPStats:      *bmpStats,
+	})
 	if err != nil {
 		fmt.Println("newclient: " + err.Error())
 		os.Exit(1)
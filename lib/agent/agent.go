@@ -3,40 +3,102 @@ package agent
 import (
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/r3boot/anycast-agent/lib"
 	"github.com/r3boot/anycast-agent/lib/bgp"
-	"github.com/r3boot/anycast-agent/lib/consul"
+	"github.com/r3boot/anycast-agent/lib/bgp/bfd"
+	"github.com/r3boot/anycast-agent/lib/bgp/bgp2go"
 	"github.com/r3boot/anycast-agent/lib/healthcheck"
+	"github.com/r3boot/anycast-agent/lib/store"
 	"github.com/r3boot/anycast-agent/lib/structs"
 )
 
+var errNoServices = errors.New("no services placed")
+
 type AnycastAgent struct {
+	Name          string
+	Logger        lib.Logger
+	LocalAs       int
+	RouterId      string
+	NextHopIP     string
+	NextHopIP6    string
+	Services      []*AnycastService
+	BgpPeers      []string
+	NeighborCfg   map[string]bgp2go.BGPNeighbourCfg
+	BfdCfg        map[string]bfd.Config
+	ControlSocket string
+	Config        AnycastAgentConfig
+	bgpService    *bgp.BGP
+	store         store.Store
+	// Guards Services, BgpPeers, NeighborCfg and BfdCfg, which change
+	// when the store changes
+	configLock sync.Mutex
+}
+
+// A service announced by the agent while its health check succeeds
+type AnycastService struct {
 	Name        string
-	Logger      lib.Logger
-	LocalAs     int
-	NextHopIP   string
-	NextHopIP6  string
 	IP          string
 	IP6         string
-	BgpPeers    []string
-	bgpService  *bgp.BGP
 	healthCheck *healthcheck.HealthCheck
+	stop        chan struct{}
+
+	// Guards announced, which is read by the control socket
+	lock      sync.Mutex
+	announced bool
+}
+
+func (svc *AnycastService) isAnnounced() bool {
+	svc.lock.Lock()
+	defer svc.lock.Unlock()
+
+	return svc.announced
+}
+
+// With a Profile only that service is run; the node object is then only
+// used for its overrides if it exists. Without a Profile the agent runs
+// all services placed on its node
+type AnycastAgentConfig struct {
+	Store         store.Config
+	Profile       string
+	Node          string
+	ControlSocket string
+	AdjRIBIn      bool
+	AdjRIBInLimit int
+	BMPCollector  string
+	BMPStats      time.Duration
+}
+
+// The configuration of the agent, as derived from the objects in the store
+type agentConfig struct {
+	name        string
+	localAs     int
+	routerId    string
+	nextHopIP   string
+	nextHopIP6  string
+	services    []structs.AnycastObject
+	peers       []structs.BgpPeerObject
+	bgpPeers    []string
+	neighborCfg map[string]bgp2go.BGPNeighbourCfg
+	bfdCfg      map[string]bfd.Config
 }
 
-func NewAnycastAgent(endpoint string, profile string) (*AnycastAgent, error) {
+func NewAnycastAgent(cfg AnycastAgentConfig) (*AnycastAgent, error) {
 	var (
 		agent *AnycastAgent
 		err   error
 	)
 
 	agent = &AnycastAgent{
-		Name:   profile,
-		Logger: lib.NewLogger(true),
+		Name:          cfg.Node,
+		Logger:        lib.NewLogger(true),
+		ControlSocket: cfg.ControlSocket,
+		Config:        cfg,
 	}
 
-	if err = agent.Initialize(endpoint); err != nil {
+	if err = agent.Initialize(cfg.Store); err != nil {
 		err = errors.New("NewAnycastAgent: " + err.Error())
 		return nil, err
 	}
@@ -44,180 +106,531 @@ func NewAnycastAgent(endpoint string, profile string) (*AnycastAgent, error) {
 	return agent, nil
 }
 
-func (aa *AnycastAgent) Initialize(endpoint string) error {
+func (aa *AnycastAgent) Initialize(storeCfg store.Config) error {
 	var (
-		Consul       *consul.Consul
-		hcResultChan chan bool
-		err          error
+		err error
 	)
 
-	if Consul, err = consul.NewConsul(endpoint); err != nil {
+	storeCfg.Warn = aa.Logger.Warn
+	if aa.store, err = store.New(storeCfg); err != nil {
 		return fmt.Errorf("AnycastAgeent.Initialize: %v", err)
 	}
 
-	object, err := Consul.GetObject(structs.TypeAnycast, aa.Name)
+	cfg, err := aa.loadConfig()
 	if err != nil {
-		err = errors.New("Initialize: " + err.Error())
-		return err
+		return fmt.Errorf("AnycastAgent.Initialize: %v", err)
+	}
+
+	aa.Name = cfg.name
+	aa.LocalAs = cfg.localAs
+	aa.RouterId = cfg.routerId
+	aa.NextHopIP = cfg.nextHopIP
+	aa.NextHopIP6 = cfg.nextHopIP6
+
+	for _, service := range cfg.services {
+		aa.Services = append(aa.Services, aa.newService(service))
+		aa.Logger.Info("AnycastAgent: Running service " + service.Meta.Name)
+	}
+	if len(cfg.peers) == 0 {
+		aa.Logger.Warn("AnycastAgent: No bgp peers selected for " + aa.Name)
 	}
+	for _, peer := range cfg.peers {
+		aa.Logger.Info("AnycastAgent: Using bgp peer " + peer.Meta.Name)
+	}
+
+	aa.BgpPeers = cfg.bgpPeers
+	aa.NeighborCfg = cfg.neighborCfg
+	aa.BfdCfg = cfg.bfdCfg
 
-	aa.LocalAs = object.(structs.AnycastObject).Spec.AsNumber
-	aa.IP = object.(structs.AnycastObject).Spec.IP
-	aa.IP6 = object.(structs.AnycastObject).Spec.IP6
+	if aa.bgpService, err = bgp.NewBGP(aa.Logger); err != nil {
+		aa.Logger.Error("AnycastAgent: Failed to get BGP service: " + err.Error())
+	}
 
-	if aa.NextHopIP, err = lib.GetNextHopAddress(lib.AF_INET); err != nil {
+	var bmpCfg *bgp.BMPConfig
+	if aa.Config.BMPCollector != "" {
+		bmpCfg = &bgp.BMPConfig{
+			Collector:     aa.Config.BMPCollector,
+			StatsInterval: aa.Config.BMPStats,
+		}
+	}
+
+	// The bgp service gets its own copies, since the agent replaces its
+	// configuration when the store changes
+	neighborCfg := make(map[string]bgp2go.BGPNeighbourCfg)
+	for peer, peerCfg := range aa.NeighborCfg {
+		neighborCfg[peer] = peerCfg
+	}
+	bfdCfg := make(map[string]bfd.Config)
+	for peer, peerCfg := range aa.BfdCfg {
+		bfdCfg[peer] = peerCfg
+	}
+
+	err = aa.bgpService.Initialize(&bgp.BGPConfig{
+		Asnum:         aa.LocalAs,
+		RouterId:      aa.RouterId,
+		NextHopIP:     aa.NextHopIP,
+		NextHopIP6:    aa.NextHopIP6,
+		LocalPref:     100,
+		BgpPeers:      append([]string{}, aa.BgpPeers...),
+		AdjRIBIn:      aa.Config.AdjRIBIn,
+		AdjRIBInLimit: aa.Config.AdjRIBInLimit,
+		Neighbors:     neighborCfg,
+		BFD:           bfdCfg,
+		BMP:           bmpCfg,
+	})
+	if err != nil {
+		aa.Logger.Error("AnycastAgent: Failed to initialize BGP service: " + err.Error())
+	}
+
+	return nil
+}
+
+// Reads the node, the services placed on it and their bgp peers from the
+// store, and derives the configuration of the agent from them
+func (aa *AnycastAgent) loadConfig() (*agentConfig, error) {
+	cfg := &agentConfig{
+		name:        aa.Config.Node,
+		neighborCfg: make(map[string]bgp2go.BGPNeighbourCfg),
+		bfdCfg:      make(map[string]bfd.Config),
+	}
+
+	var node *structs.NodeObject
+	if aa.Config.Node != "" {
+		object, err := store.FindNode(aa.store, aa.Config.Node)
+		if err == nil {
+			node = &object
+			cfg.name = object.Meta.Name
+		} else if aa.Config.Profile == "" {
+			return nil, err
+		}
+	}
+
+	services, err := aa.placedServices(node)
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range services {
+		if err = structs.ValidateAnycastYaml(service); err != nil {
+			return nil, err
+		}
+		for _, warning := range structs.AnycastWarnings(service) {
+			aa.Logger.Warn("AnycastAgent: " + warning)
+		}
+	}
+	cfg.services = services
+
+	// All services share a single bgp speaker
+	cfg.localAs = services[0].Spec.AsNumber
+	for _, service := range services {
+		if service.Spec.AsNumber != cfg.localAs {
+			return nil, fmt.Errorf("services %s and %s use a different asnum",
+				services[0].Meta.Name, service.Meta.Name)
+		}
+	}
+
+	if node != nil && node.Spec.NextHop != "" {
+		cfg.nextHopIP = node.Spec.NextHop
+	} else if cfg.nextHopIP, err = lib.GetNextHopAddress(lib.AF_INET); err != nil {
 		aa.Logger.Warn("AnycastAgent: No ipv4 next-hop address found: " + err.Error())
 	}
 
-	if aa.NextHopIP6, err = lib.GetNextHopAddress(lib.AF_INET6); err != nil {
+	if node != nil && node.Spec.NextHop6 != "" {
+		cfg.nextHopIP6 = node.Spec.NextHop6
+	} else if cfg.nextHopIP6, err = lib.GetNextHopAddress(lib.AF_INET6); err != nil {
 		aa.Logger.Warn("AnycastAgent: No ipv6 next-hop address found: " + err.Error())
 	}
 
-	all_objects, err := Consul.GetAllObjects(structs.TypeBgpPeer, Consul.Prefix+"/peers")
+	cfg.routerId = cfg.nextHopIP
+	if node != nil && node.Spec.RouterId != "" {
+		cfg.routerId = node.Spec.RouterId
+	}
+
+	for _, service := range services {
+		addresses := []string{cfg.routerId, cfg.nextHopIP, cfg.nextHopIP6}
+		if err = structs.ValidateAnycastAddresses(service, addresses); err != nil {
+			return nil, err
+		}
+	}
+
+	all_peers, err := store.GetBgpPeers(aa.store)
 	if err != nil {
-		aa.Logger.Error("AnycastAgent: Failed to retrieve bgp peers: " + err.Error())
+		return nil, fmt.Errorf("Failed to retrieve bgp peers: %v", err)
+	}
+
+	// Only the peers of the services and the node are used, not everything
+	// under peers/. Each peer is sent the services which selected it, the
+	// peers of the node get all of them
+	announced := make(map[string]map[string]bool)
+	addPeers := func(found []structs.BgpPeerObject, services []structs.AnycastObject) {
+		for _, peer := range found {
+			if announced[peer.Meta.Name] == nil {
+				cfg.peers = append(cfg.peers, peer)
+				announced[peer.Meta.Name] = make(map[string]bool)
+			}
+			for _, service := range services {
+				announced[peer.Meta.Name][service.Meta.Name] = true
+			}
+		}
+	}
+	if node != nil {
+		found, err := structs.SelectNodeBgpPeers(*node, all_peers)
+		if err != nil {
+			return nil, err
+		}
+		addPeers(found, services)
+	}
+
+	hasIPv4 := false
+	for _, service := range services {
+		found, err := structs.SelectBgpPeers(service, all_peers)
+		if err != nil {
+			return nil, err
+		}
+		addPeers(found, []structs.AnycastObject{service})
+
+		if service.Spec.IP != "" {
+			hasIPv4 = true
+		}
 	}
 
-	for _, peer := range all_objects {
-		spec := peer.(structs.BgpPeerObject).Spec
+	for _, peer := range cfg.peers {
+		spec := peer.Spec
+		neighborCfg := bgp2go.BGPNeighbourCfg{
+			MaxPrefix: bgp2go.MaxPrefixCfg{
+				Limit:            spec.MaxPrefix.Limit,
+				WarningThreshold: spec.MaxPrefix.WarningThreshold,
+				Action:           spec.MaxPrefix.Action,
+				RestartInterval:  time.Duration(spec.MaxPrefix.RestartInterval) * time.Minute,
+			},
+			InboundPolicy:  structs.BuildPolicy(spec.Policy.Import),
+			OutboundPolicy: exportPolicy(spec.Policy.Export, services, announced[peer.Meta.Name]),
+			NextHop:        spec.NextHop,
+			NextHopV6:      spec.NextHop6,
+			RemoteASN:      uint32(spec.AsNumber),
+			LocalASN:       uint32(spec.LocalAsNumber),
+			HoldTime:       uint32(spec.HoldTime),
+			KeepaliveTime:  uint32(spec.Keepalive),
+			Passive:        spec.Passive,
+			Description:    spec.Description,
+			Shutdown:       spec.Shutdown,
+		}
 		if spec.IP != "" {
-			aa.BgpPeers = append(aa.BgpPeers, spec.IP)
+			cfg.bgpPeers = append(cfg.bgpPeers, spec.IP)
+			ipv4Cfg := neighborCfg
+			ipv4Cfg.AFIs = peerAddressFamilies(spec, structs.AddressFamilyInet, false)
+			ipv4Cfg.AddPath = peerAddPath(spec, ipv4Cfg.AFIs)
+			cfg.neighborCfg[spec.IP] = ipv4Cfg
+			if spec.Bfd.Enabled {
+				cfg.bfdCfg[spec.IP] = structs.BuildBfdConfig(spec.Bfd)
+			}
 		}
 		if spec.IP6 != "" {
-			aa.BgpPeers = append(aa.BgpPeers, spec.IP6)
+			cfg.bgpPeers = append(cfg.bgpPeers, spec.IP6)
+			// Peers without an IPv4 address get the IPv4 VIP over the
+			// IPv6 session
+			v4Routes := spec.IP == "" && hasIPv4
+			neighborCfg.AFIs = peerAddressFamilies(spec, structs.AddressFamilyInet6, v4Routes)
+			for _, afi := range neighborCfg.AFIs {
+				if afi == structs.AddressFamilyInet {
+					neighborCfg.ExtendedNextHop = true
+				}
+			}
+			neighborCfg.AddPath = peerAddPath(spec, neighborCfg.AFIs)
+			cfg.neighborCfg[spec.IP6] = neighborCfg
+			if spec.Bfd.Enabled {
+				cfg.bfdCfg[spec.IP6] = structs.BuildBfdConfig(spec.Bfd)
+			}
 		}
 	}
 
-	hcResultChan = make(chan bool, 10)
-	aa.healthCheck = healthcheck.NewHealthCheck(aa.Logger, healthcheck.HealthCheckConfig{
-		Command:     object.(structs.AnycastObject).Spec.HealthCheck,
-		Interval:    3 * time.Second,
-		InitDamping: 2,
-		MaxRetries:  5,
-		ResultChan:  hcResultChan,
-	})
+	return cfg, nil
+}
 
-	if aa.bgpService, err = bgp.NewBGP(aa.Logger); err != nil {
-		aa.Logger.Error("AnycastAgent: Failed to get BGP service: " + err.Error())
+func (aa *AnycastAgent) newService(service structs.AnycastObject) *AnycastService {
+	return &AnycastService{
+		Name: service.Meta.Name,
+		IP:   service.Spec.IP,
+		IP6:  service.Spec.IP6,
+		healthCheck: healthcheck.NewHealthCheck(aa.Logger, healthcheck.HealthCheckConfig{
+			Command:     service.Spec.HealthCheck,
+			Interval:    3 * time.Second,
+			InitDamping: 2,
+			MaxRetries:  5,
+			ResultChan:  make(chan bool, 10),
+		}),
+		stop: make(chan struct{}),
+	}
+}
+
+// Returns the services to run: the profile given on the command line, or
+// else the services placed on the node
+func (aa *AnycastAgent) placedServices(node *structs.NodeObject) ([]structs.AnycastObject, error) {
+	if aa.Config.Profile != "" {
+		object, err := aa.store.Get(structs.TypeAnycast, aa.Config.Profile)
+		if err != nil {
+			return nil, errors.New("placedServices: " + err.Error())
+		}
+		return []structs.AnycastObject{object.(structs.AnycastObject)}, nil
 	}
 
-	err = aa.bgpService.Initialize(&bgp.BGPConfig{
-		Asnum:      aa.LocalAs,
-		RouterId:   aa.NextHopIP,
-		NextHopIP:  aa.NextHopIP,
-		NextHopIP6: aa.NextHopIP6,
-		LocalPref:  100,
-		BgpPeers:   aa.BgpPeers,
-	})
+	if node == nil {
+		return nil, errors.New("placedServices: neither a profile or a node given")
+	}
+
+	all_services, err := store.GetAnycastServices(aa.store)
 	if err != nil {
-		aa.Logger.Error("AnycastAgent: Failed to initialize BGP service: " + err.Error())
+		return nil, errors.New("placedServices: " + err.Error())
+	}
+	all_nodes, err := store.GetNodes(aa.store)
+	if err != nil {
+		return nil, errors.New("placedServices: " + err.Error())
 	}
 
-	return nil
+	services := []structs.AnycastObject{}
+	for _, service := range all_services {
+		placed, err := structs.PlaceService(service, all_nodes)
+		if err != nil {
+			aa.Logger.Warn("AnycastAgent: Not running " + service.Meta.Name + ": " + err.Error())
+			continue
+		}
+		for _, name := range placed {
+			if name == node.Meta.Name {
+				services = append(services, service)
+			}
+		}
+	}
+
+	if len(services) == 0 {
+		return nil, fmt.Errorf("placedServices: %w on node %s", errNoServices, node.Meta.Name)
+	}
+
+	return services, nil
 }
 
-func (aa *AnycastAgent) isHealthy(results []bool) bool {
-	if aa.healthCheck.Health {
-		for i := 0; i < aa.healthCheck.Config.MaxRetries; i++ {
+// Returns the address families negotiated over the session with the peer.
+// By default these are the family of the session, IPv4 unicast over an
+// IPv6 only peering if the service has an IPv4 VIP, and the matching
+// flow families if flowspec is enabled. Configured families are split
+// between the sessions the same way: IPv4 families go over the IPv4
+// session if the peer has one
+func peerAddressFamilies(spec structs.BgpPeerSpecObject, afi string, v4Routes bool) []string {
+	afis := []string{}
+	if len(spec.AddressFamilies) > 0 {
+		for _, configured := range spec.AddressFamilies {
+			v4Family := configured == structs.AddressFamilyInet ||
+				configured == structs.AddressFamilyFlow
+			if afi == structs.AddressFamilyInet && !v4Family {
+				continue
+			}
+			if afi == structs.AddressFamilyInet6 && v4Family && spec.IP != "" {
+				continue
+			}
+			afis = append(afis, configured)
+		}
+		return afis
+	}
+
+	afis = append(afis, afi)
+	if v4Routes {
+		afis = append(afis, structs.AddressFamilyInet)
+	}
+	if spec.Flowspec {
+		if afi == structs.AddressFamilyInet {
+			afis = append(afis, structs.AddressFamilyFlow)
+		} else {
+			afis = append(afis, structs.AddressFamilyFlow6)
+			if spec.IP == "" {
+				afis = append(afis, structs.AddressFamilyFlow)
+			}
+		}
+	}
+	return afis
+}
+
+// Returns the export policy of a peer. All services share the bgp speaker,
+// so the routes of the services which did not select the peer are rejected
+// before the configured terms are applied
+func exportPolicy(terms []structs.PolicyTermObject, services []structs.AnycastObject, announced map[string]bool) *bgp2go.Policy {
+	others := []string{}
+	for _, service := range services {
+		if !announced[service.Meta.Name] {
+			others = append(others, service.Meta.Name)
+		}
+	}
+
+	policy := structs.BuildPolicy(terms)
+	if len(others) == 0 {
+		return policy
+	}
+	if policy == nil {
+		policy = &bgp2go.Policy{}
+	}
+	reject := bgp2go.PolicyTerm{
+		Name:   "other-services",
+		Match:  bgp2go.PolicyMatch{Services: others},
+		Action: bgp2go.POLICY_REJECT,
+	}
+	policy.Terms = append([]bgp2go.PolicyTerm{reject}, policy.Terms...)
+
+	return policy
+}
+
+// Returns the ADD-PATH families of the peer which are negotiated over the
+// session with the given families
+func peerAddPath(spec structs.BgpPeerSpecObject, afis []string) []string {
+	addPath := []string{}
+	for _, afi := range spec.AddPath {
+		for _, negotiated := range afis {
+			if afi == negotiated {
+				addPath = append(addPath, afi)
+			}
+		}
+	}
+	return addPath
+}
+
+func (svc *AnycastService) isHealthy(results []bool) bool {
+	if svc.healthCheck.Health {
+		for i := 0; i < svc.healthCheck.Config.MaxRetries; i++ {
 			if results[i] {
 				return true
 			}
 		}
 		return false
 	} else {
-		for i := 0; i < aa.healthCheck.Config.InitDamping; i++ {
+		for i := 0; i < svc.healthCheck.Config.InitDamping; i++ {
 			if !results[i] {
 				return false
 			}
 		}
 		return true
 	}
-
-	return false
 }
 
 func (aa *AnycastAgent) RunAnycastService() {
+	go aa.bgpService.ServerRoutine()
+	go aa.ControlRoutine()
+
+	aa.configLock.Lock()
+	for _, svc := range aa.Services {
+		go aa.serviceRoutine(svc)
+	}
+	aa.configLock.Unlock()
+
+	go aa.reconcileRoutine()
+
+	select {}
+}
+
+// Announces the service while its health check succeeds, until it is
+// stopped
+func (aa *AnycastAgent) serviceRoutine(svc *AnycastService) {
 	var (
 		lastResults []bool
 		health      bool
+		announced   bool
 		stateChan   chan bool
-		err         error
 	)
 
-	numItems := aa.healthCheck.Config.MaxRetries
+	numItems := svc.healthCheck.Config.MaxRetries
 	lastResults = make([]bool, numItems, numItems)
-	aa.healthCheck.Health = false
+	svc.healthCheck.Health = false
 	health = false
 
 	stateChan = make(chan bool, 1)
 
-	go aa.healthCheck.CheckRoutine()
-	go aa.bgpService.ServerRoutine()
+	go svc.healthCheck.CheckRoutine()
 
 	for {
 		select {
-		case result := <-aa.healthCheck.Config.ResultChan:
+		case result := <-svc.healthCheck.Config.ResultChan:
 			{
-				numItems := aa.healthCheck.Config.MaxRetries
+				numItems := svc.healthCheck.Config.MaxRetries
 
 				for i := numItems - 1; i > 0; i-- {
 					lastResults[i] = lastResults[i-1]
 				}
 				lastResults[0] = result
 
-				if aa.healthCheck.Health {
+				if svc.healthCheck.Health {
 					health = false
-					for i := 0; i < aa.healthCheck.Config.MaxRetries; i++ {
+					for i := 0; i < svc.healthCheck.Config.MaxRetries; i++ {
 						if lastResults[i] {
 							health = true
 						}
 					}
 				} else {
 					health = true
-					for i := 0; i < aa.healthCheck.Config.InitDamping; i++ {
+					for i := 0; i < svc.healthCheck.Config.InitDamping; i++ {
 						if !lastResults[i] {
 							health = false
 						}
 					}
 				}
 
-				if health != aa.healthCheck.Health {
-					aa.healthCheck.Health = health
+				if health != svc.healthCheck.Health {
+					svc.healthCheck.Health = health
 					stateChan <- health
 				}
 			}
 		case curState := <-stateChan:
 			{
 				if curState {
-					aa.Logger.Debug("AnycastAgent: State changed to UP")
-					if aa.IP != "" {
-						if err = lib.AddAnycastAddress(aa.IP); err != nil {
-							aa.Logger.Warn("AnycastAgent: Failed to add ipv4 address: " + err.Error())
-						}
-						aa.bgpService.AddRoute(aa.IP)
-					}
-					if aa.IP6 != "" {
-						if err = lib.AddAnycastAddress(aa.IP6); err != nil {
-							aa.Logger.Warn("AnycastAgent: Failed to add ipv6 address: " + err.Error())
-						}
-						aa.bgpService.AddRoute(aa.IP6)
-					}
+					aa.Logger.Debug("AnycastAgent: " + svc.Name + ": State changed to UP")
+					aa.announce(svc)
+					announced = true
 				} else {
-					aa.Logger.Debug("AnycastAgent: State changed to DOWN")
-					if aa.IP != "" {
-						aa.bgpService.RemoveRoute(aa.IP)
-						if err = lib.RemoveAnycastAddress(aa.IP); err != nil {
-							aa.Logger.Warn("AnycastAgent: Failed to remove ipv4 address: " + err.Error())
-						}
-					}
-					if aa.IP6 != "" {
-						aa.bgpService.RemoveRoute(aa.IP6)
-						if err = lib.RemoveAnycastAddress(aa.IP6); err != nil {
-							aa.Logger.Warn("AnycastAgent: Failed to remove ipv6 address: " + err.Error())
-						}
-					}
+					aa.Logger.Debug("AnycastAgent: " + svc.Name + ": State changed to DOWN")
+					aa.withdraw(svc)
+					announced = false
+				}
+			}
+		case <-svc.stop:
+			{
+				svc.healthCheck.Stop()
+				if announced {
+					aa.withdraw(svc)
 				}
+				return
 			}
 		}
 	}
 }
+
+func (aa *AnycastAgent) announce(svc *AnycastService) {
+	if svc.IP != "" {
+		if err := lib.AddAnycastAddress(svc.IP); err != nil {
+			aa.Logger.Warn("AnycastAgent: Failed to add ipv4 address: " + err.Error())
+		}
+		aa.bgpService.AddRoute(svc.IP, svc.Name)
+	}
+	if svc.IP6 != "" {
+		if err := lib.AddAnycastAddress(svc.IP6); err != nil {
+			aa.Logger.Warn("AnycastAgent: Failed to add ipv6 address: " + err.Error())
+		}
+		aa.bgpService.AddRoute(svc.IP6, svc.Name)
+	}
+
+	svc.lock.Lock()
+	svc.announced = true
+	svc.lock.Unlock()
+}
+
+func (aa *AnycastAgent) withdraw(svc *AnycastService) {
+	svc.lock.Lock()
+	svc.announced = false
+	svc.lock.Unlock()
+
+	if svc.IP != "" {
+		aa.bgpService.RemoveRoute(svc.IP)
+		if err := lib.RemoveAnycastAddress(svc.IP); err != nil {
+			aa.Logger.Warn("AnycastAgent: Failed to remove ipv4 address: " + err.Error())
+		}
+	}
+	if svc.IP6 != "" {
+		aa.bgpService.RemoveRoute(svc.IP6)
+		if err := lib.RemoveAnycastAddress(svc.IP6); err != nil {
+			aa.Logger.Warn("AnycastAgent: Failed to remove ipv6 address: " + err.Error())
+		}
+	}
+}
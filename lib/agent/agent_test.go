@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/r3boot/anycast-agent/lib"
+	"github.com/r3boot/anycast-agent/lib/bgp/bgp2go"
+	"github.com/r3boot/anycast-agent/lib/store"
+	"github.com/r3boot/anycast-agent/lib/structs"
+)
+
+func testPeer(name, ip string) structs.BgpPeerObject {
+	return structs.BgpPeerObject{
+		ApiVersion: 1,
+		Type:       structs.TypeBgpPeer,
+		Meta:       structs.BgpPeerMetaObject{Name: name},
+		Spec:       structs.BgpPeerSpecObject{AsNumber: 65342, IP: ip},
+	}
+}
+
+func testService(name, ip string, peers []string) structs.AnycastObject {
+	return structs.AnycastObject{
+		ApiVersion: 1,
+		Type:       structs.TypeAnycast,
+		Meta:       structs.AnycastMetaObject{Name: name},
+		Spec: structs.AnycastSpecObject{
+			AsNumber:    65001,
+			IP:          ip,
+			HealthCheck: "true",
+			Peers:       peers,
+			Placement:   structs.PlacementObject{Sites: []string{"ams"}},
+		},
+	}
+}
+
+func testNode(name string) structs.NodeObject {
+	return structs.NodeObject{
+		ApiVersion: 1,
+		Type:       structs.TypeNode,
+		Meta:       structs.NodeMetaObject{Name: name},
+		Spec: structs.NodeSpecObject{
+			Site:     "ams",
+			RouterId: "10.0.4.10",
+			NextHop:  "10.0.4.10",
+			NextHop6: "2001:db8:4::10",
+		},
+	}
+}
+
+// Returns an agent for node1 on a store with objects
+func testAgent(t *testing.T, objects ...interface{}) *AnycastAgent {
+	s := store.NewKVStore(store.NewMemory(), store.DefaultPrefix)
+	for _, object := range objects {
+		if err := s.Put(object); err != nil {
+			t.Fatalf("cant put object: %v", err)
+		}
+	}
+
+	return &AnycastAgent{
+		Logger: lib.NewLogger(false),
+		Config: AnycastAgentConfig{Node: "node1"},
+		store:  s,
+	}
+}
+
+func TestLoadConfigServicePeers(t *testing.T) {
+	aa := testAgent(t,
+		testPeer("router-a", "10.0.4.1"),
+		testPeer("router-b", "10.0.4.2"),
+		testService("dns", "192.0.2.53", []string{"router-a"}),
+		testService("ntp", "192.0.2.123", []string{"router-b"}),
+		testNode("node1"),
+	)
+	cfg, err := aa.loadConfig()
+	if err != nil {
+		t.Fatalf("cant load config: %v", err)
+	}
+
+	exported := func(peer, prefix, service string) bool {
+		neighborCfg, ok := cfg.neighborCfg[peer]
+		if !ok {
+			t.Fatalf("no neighbor config for %s", peer)
+		}
+		ip, _ := bgp2go.IPv4ToUint32(prefix)
+		route := bgp2go.BGPRoute{Routes: []bgp2go.IPV4_NLRI{{Prefix: ip, Length: 32}}}
+		meta := map[string]string{bgp2go.ROUTE_META_SERVICE: service}
+		return neighborCfg.OutboundPolicy.Apply(&route, meta, 65001)
+	}
+
+	tests := []struct {
+		peer    string
+		prefix  string
+		service string
+		allowed bool
+	}{
+		{"10.0.4.1", "192.0.2.53", "dns", true},
+		{"10.0.4.1", "192.0.2.123", "ntp", false},
+		{"10.0.4.2", "192.0.2.53", "dns", false},
+		{"10.0.4.2", "192.0.2.123", "ntp", true},
+	}
+	for _, test := range tests {
+		if allowed := exported(test.peer, test.prefix, test.service); allowed != test.allowed {
+			t.Errorf("%s: route of %s exported: %v, want %v", test.peer, test.service, allowed, test.allowed)
+		}
+	}
+}
+
+func TestLoadConfigMinNodes(t *testing.T) {
+	dns := testService("dns", "192.0.2.53", []string{"router-a"})
+	ntp := testService("ntp", "192.0.2.123", []string{"router-a"})
+	ntp.Spec.Placement.MinNodes = 2
+
+	aa := testAgent(t, testPeer("router-a", "10.0.4.1"), dns, ntp, testNode("node1"))
+	cfg, err := aa.loadConfig()
+	if err != nil {
+		t.Fatalf("cant load config: %v", err)
+	}
+	if len(cfg.services) != 1 || cfg.services[0].Meta.Name != "dns" {
+		t.Errorf("got services %v, want only dns", cfg.services)
+	}
+
+	// Without any service left the running services are stopped
+	dns.Spec.Placement.MinNodes = 2
+	if err = aa.store.Put(dns); err != nil {
+		t.Fatalf("cant put object: %v", err)
+	}
+	if _, err = aa.loadConfig(); !errors.Is(err, errNoServices) {
+		t.Errorf("got %v, want %v", err, errNoServices)
+	}
+
+	if err = aa.store.Put(testNode("node2")); err != nil {
+		t.Fatalf("cant put object: %v", err)
+	}
+	if cfg, err = aa.loadConfig(); err != nil {
+		t.Fatalf("cant load config: %v", err)
+	}
+	if len(cfg.services) != 2 {
+		t.Errorf("got services %v, want dns and ntp", cfg.services)
+	}
+}
@@ -0,0 +1,172 @@
+package agent
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/r3boot/anycast-agent/lib/bgp/bgp2go"
+	"github.com/r3boot/anycast-agent/lib/control"
+)
+
+func (aa *AnycastAgent) ControlRoutine() {
+	server, err := control.NewServer(aa.ControlSocket)
+	if err != nil {
+		aa.Logger.Warn("AnycastAgent: Control socket disabled: " + err.Error())
+		return
+	}
+
+	server.HandleFunc(control.EndpointDrain, aa.handleDrain)
+	server.HandleFunc(control.EndpointUndrain, aa.handleUndrain)
+	server.HandleFunc(control.EndpointAdjRIBIn, aa.handleAdjRIBIn)
+	server.HandleFunc(control.EndpointFlows, aa.handleFlows)
+	server.HandleFunc(control.EndpointFlowAdd, aa.handleFlowAdd)
+	server.HandleFunc(control.EndpointFlowWithdraw, aa.handleFlowWithdraw)
+	server.HandleFunc(control.EndpointMRT, aa.handleMRT)
+	server.HandleFunc(control.EndpointMRTStart, aa.handleMRTStart)
+	server.HandleFunc(control.EndpointMRTStop, aa.handleMRTStop)
+	server.HandleFunc(control.EndpointStatus, aa.handleStatus)
+
+	aa.Logger.Debug("AnycastAgent: Listening for control requests on " + aa.ControlSocket)
+	if err = server.Serve(); err != nil {
+		aa.Logger.Warn("AnycastAgent: Control socket failed: " + err.Error())
+	}
+}
+
+func (aa *AnycastAgent) isBgpPeer(ipaddr string) bool {
+	aa.configLock.Lock()
+	defer aa.configLock.Unlock()
+
+	for _, peer := range aa.BgpPeers {
+		if peer == ipaddr {
+			return true
+		}
+	}
+	return false
+}
+
+func (aa *AnycastAgent) handleStatus(w http.ResponseWriter, r *http.Request) {
+	aa.configLock.Lock()
+	defer aa.configLock.Unlock()
+
+	status := control.AgentStatus{
+		Node:       aa.Name,
+		AsNumber:   aa.LocalAs,
+		RouterId:   aa.RouterId,
+		NextHop:    aa.NextHopIP,
+		NextHop6:   aa.NextHopIP6,
+		Services:   []control.ServiceStatus{},
+		Neighbours: append([]string{}, aa.BgpPeers...),
+	}
+	for _, svc := range aa.Services {
+		status.Services = append(status.Services, control.ServiceStatus{
+			Name:      svc.Name,
+			IP:        svc.IP,
+			IP6:       svc.IP6,
+			Announced: svc.isAnnounced(),
+		})
+	}
+
+	control.WriteResponse(w, status)
+}
+
+func (aa *AnycastAgent) readDrainRequest(w http.ResponseWriter, r *http.Request) (*control.DrainRequest, bool) {
+	request := &control.DrainRequest{}
+	if err := control.ReadRequest(r, request); err != nil {
+		control.WriteError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	if !aa.isBgpPeer(request.Neighbour) {
+		control.WriteError(w, http.StatusNotFound,
+			errors.New("no such neighbour: "+request.Neighbour))
+		return nil, false
+	}
+	return request, true
+}
+
+func (aa *AnycastAgent) handleDrain(w http.ResponseWriter, r *http.Request) {
+	request, ok := aa.readDrainRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := aa.bgpService.DrainNeighbor(request.Neighbour, request.Message); err != nil {
+		control.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	control.WriteResponse(w, request)
+}
+
+func (aa *AnycastAgent) handleUndrain(w http.ResponseWriter, r *http.Request) {
+	request, ok := aa.readDrainRequest(w, r)
+	if !ok {
+		return
+	}
+	aa.bgpService.UndrainNeighbor(request.Neighbour)
+	control.WriteResponse(w, request)
+}
+
+func (aa *AnycastAgent) handleAdjRIBIn(w http.ResponseWriter, r *http.Request) {
+	neighbour := r.URL.Query().Get("neighbour")
+	if neighbour != "" && !aa.isBgpPeer(neighbour) {
+		control.WriteError(w, http.StatusNotFound,
+			errors.New("no such neighbour: "+neighbour))
+		return
+	}
+	routes, err := aa.bgpService.AdjRIBIn(neighbour)
+	if err != nil {
+		control.WriteError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	control.WriteResponse(w, routes)
+}
+
+func mrtStatus(status bgp2go.MRTStatus) control.MRTStatus {
+	return control.MRTStatus{
+		Enabled: status.Enabled,
+		Path:    status.Path,
+		Size:    status.Size,
+		MaxSize: status.MaxSize,
+		Keep:    status.Keep,
+		Error:   status.Error,
+	}
+}
+
+func (aa *AnycastAgent) handleMRT(w http.ResponseWriter, r *http.Request) {
+	control.WriteResponse(w, mrtStatus(aa.bgpService.MRTDumpStatus()))
+}
+
+func (aa *AnycastAgent) handleMRTStart(w http.ResponseWriter, r *http.Request) {
+	request := &control.MRTRequest{}
+	if err := control.ReadRequest(r, request); err != nil {
+		control.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if request.Path == "" {
+		request.Path = control.DefaultMRTFile
+	}
+	if request.MaxSize == 0 {
+		request.MaxSize = control.DefaultMRTMaxSize
+	}
+	if request.MaxSize < 0 || request.Keep < 0 {
+		control.WriteError(w, http.StatusBadRequest,
+			errors.New("maxSize and keep cannot be negative"))
+		return
+	}
+	if err := aa.bgpService.StartMRTDump(request.Path, request.MaxSize, request.Keep); err != nil {
+		control.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	control.WriteResponse(w, mrtStatus(aa.bgpService.MRTDumpStatus()))
+}
+
+func (aa *AnycastAgent) handleMRTStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		control.WriteError(w, http.StatusBadRequest,
+			errors.New("method "+r.Method+" not allowed"))
+		return
+	}
+	if err := aa.bgpService.StopMRTDump(); err != nil {
+		control.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	control.WriteResponse(w, mrtStatus(aa.bgpService.MRTDumpStatus()))
+}
@@ -0,0 +1,204 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/r3boot/anycast-agent/lib/bgp"
+	"github.com/r3boot/anycast-agent/lib/bgp/bgp2go"
+	"github.com/r3boot/anycast-agent/lib/control"
+)
+
+var flowProtocols = map[string]uint64{
+	"icmp":   1,
+	"tcp":    6,
+	"udp":    17,
+	"gre":    47,
+	"icmpv6": 58,
+}
+
+// Returns the prefix of ipaddr, adding a host mask if it has none
+func parsePrefix(ipaddr string) (*net.IPNet, error) {
+	if !strings.Contains(ipaddr, "/") {
+		if strings.Contains(ipaddr, ":") {
+			ipaddr += "/128"
+		} else {
+			ipaddr += "/32"
+		}
+	}
+	_, prefix, err := net.ParseCIDR(ipaddr)
+	return prefix, err
+}
+
+// Flow rules can only target the prefixes announced by this agent
+func (aa *AnycastAgent) ownsPrefix(prefix *net.IPNet) bool {
+	aa.configLock.Lock()
+	defer aa.configLock.Unlock()
+
+	length, bits := prefix.Mask.Size()
+	for _, svc := range aa.Services {
+		for _, ipaddr := range []string{svc.IP, svc.IP6} {
+			if ipaddr == "" {
+				continue
+			}
+			owned, err := parsePrefix(ipaddr)
+			if err != nil {
+				continue
+			}
+			ownedLength, ownedBits := owned.Mask.Size()
+			if bits == ownedBits && length >= ownedLength && owned.Contains(prefix.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseFlowMatches(exprs []string, names map[string]uint64) ([]bgp2go.FlowSpecNumeric, error) {
+	matches := []bgp2go.FlowSpecNumeric{}
+	for _, expr := range exprs {
+		if value, ok := names[strings.ToLower(expr)]; ok {
+			expr = strconv.FormatUint(value, 10)
+		}
+		numeric, err := bgp2go.ParseFlowSpecNumeric(expr)
+		if err != nil {
+			return nil, errors.New(strings.TrimSpace(err.Error()))
+		}
+		// Every expression is an alternative to the previous ones
+		numeric[0].And = false
+		matches = append(matches, numeric...)
+	}
+	return matches, nil
+}
+
+// Translates request into a FlowSpec rule and its expiry
+func (aa *AnycastAgent) buildFlowRule(request *control.FlowRequest) (bgp2go.FlowSpecRule, time.Duration, error) {
+	rule := bgp2go.FlowSpecRule{AFI: bgp2go.MP_AFI_IPV4}
+
+	if request.Name == "" {
+		return rule, 0, errors.New("name is not set")
+	}
+
+	destination, err := parsePrefix(request.Destination)
+	if err != nil {
+		return rule, 0, fmt.Errorf("destination: %v", err)
+	}
+	rule.Destination = destination
+	if destination.IP.To4() == nil {
+		rule.AFI = bgp2go.MP_AFI_IPV6
+	}
+
+	if request.Source != "" {
+		if rule.Source, err = parsePrefix(request.Source); err != nil {
+			return rule, 0, fmt.Errorf("source: %v", err)
+		}
+		if (rule.Source.IP.To4() == nil) != (rule.AFI == bgp2go.MP_AFI_IPV6) {
+			return rule, 0, errors.New("source and destination are of a different address family")
+		}
+	}
+
+	for _, match := range []struct {
+		name   string
+		exprs  []string
+		names  map[string]uint64
+		target *[]bgp2go.FlowSpecNumeric
+	}{
+		{"protocols", request.Protocols, flowProtocols, &rule.Protocols},
+		{"ports", request.Ports, nil, &rule.Ports},
+		{"destinationPorts", request.DestinationPorts, nil, &rule.DestinationPorts},
+		{"sourcePorts", request.SourcePorts, nil, &rule.SourcePorts},
+		{"packetLengths", request.PacketLengths, nil, &rule.PacketLengths},
+	} {
+		if *match.target, err = parseFlowMatches(match.exprs, match.names); err != nil {
+			return rule, 0, fmt.Errorf("%s: %v", match.name, err)
+		}
+	}
+
+	switch request.Action {
+	case control.FlowActionDiscard:
+		rule.RateLimit = 0
+	case control.FlowActionRateLimit:
+		if request.Rate <= 0 {
+			return rule, 0, errors.New("rate-limit needs a positive rate")
+		}
+		rule.RateLimit = request.Rate
+	default:
+		return rule, 0, errors.New("unknown action: " + request.Action)
+	}
+
+	ttl := control.DefaultFlowExpiry
+	if request.Expires != "" {
+		if ttl, err = time.ParseDuration(request.Expires); err != nil || ttl <= 0 {
+			return rule, 0, errors.New("invalid expiry: " + request.Expires)
+		}
+	}
+
+	return rule, ttl, nil
+}
+
+func flowStatus(flowRule bgp.FlowRule) control.FlowStatus {
+	status := control.FlowStatus{
+		Name:    flowRule.Name,
+		Match:   flowRule.Rule.String(),
+		Action:  control.FlowActionDiscard,
+		Expires: flowRule.Expires.Format(time.RFC3339),
+	}
+	if flowRule.Rule.RateLimit > 0 {
+		status.Action = control.FlowActionRateLimit
+		status.Rate = flowRule.Rule.RateLimit
+	}
+	return status
+}
+
+func (aa *AnycastAgent) handleFlowAdd(w http.ResponseWriter, r *http.Request) {
+	request := &control.FlowRequest{}
+	if err := control.ReadRequest(r, request); err != nil {
+		control.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	rule, ttl, err := aa.buildFlowRule(request)
+	if err != nil {
+		control.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !aa.ownsPrefix(rule.Destination) {
+		control.WriteError(w, http.StatusForbidden,
+			errors.New("destination is not announced by this agent: "+request.Destination))
+		return
+	}
+	if err = aa.bgpService.AddFlowRule(request.Name, rule, ttl); err != nil {
+		control.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	control.WriteResponse(w, flowStatus(bgp.FlowRule{
+		Name:    request.Name,
+		Rule:    rule,
+		Expires: time.Now().Add(ttl),
+	}))
+}
+
+func (aa *AnycastAgent) handleFlowWithdraw(w http.ResponseWriter, r *http.Request) {
+	request := &control.FlowWithdrawRequest{}
+	if err := control.ReadRequest(r, request); err != nil {
+		control.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := aa.bgpService.RemoveFlowRule(request.Name); err != nil {
+		control.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+	control.WriteResponse(w, request)
+}
+
+func (aa *AnycastAgent) handleFlows(w http.ResponseWriter, r *http.Request) {
+	flows := []control.FlowStatus{}
+	for _, flowRule := range aa.bgpService.FlowRules() {
+		flows = append(flows, flowStatus(flowRule))
+	}
+	control.WriteResponse(w, flows)
+}
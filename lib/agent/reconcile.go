@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/r3boot/anycast-agent/lib/bgp/bfd"
+	"github.com/r3boot/anycast-agent/lib/store"
+	"github.com/r3boot/anycast-agent/lib/structs"
+)
+
+const (
+	// Changes arrive an object, or a file, at a time; these are gathered
+	// before the configuration is applied
+	reconcileDelay = 2 * time.Second
+)
+
+// Applies the changes made to the store while the agent runs
+func (aa *AnycastAgent) reconcileRoutine() {
+	changes := make(chan string, 1)
+	stop := make(chan struct{})
+	for _, objType := range []string{structs.TypeBgpPeer, structs.TypeAnycast, structs.TypeNode} {
+		events, err := aa.store.Watch(objType, stop)
+		if err != nil {
+			aa.Logger.Warn("AnycastAgent: Not watching " + aa.store.URL() + " for changes: " + err.Error())
+			return
+		}
+
+		go func() {
+			for event := range events {
+				if event.Type == store.EventError {
+					aa.Logger.Warn("AnycastAgent: Failed to read the changed configuration: " + event.Err.Error())
+					continue
+				}
+				aa.Logger.Debug("AnycastAgent: " + event.ObjType + " " + event.Name + ": " + event.Type)
+				select {
+				case changes <- event.ObjType:
+				default:
+				}
+			}
+		}()
+	}
+
+	aa.Logger.Debug("AnycastAgent: Watching " + aa.store.URL() + " for changes")
+	for range changes {
+		time.Sleep(reconcileDelay)
+		select {
+		case <-changes:
+		default:
+		}
+
+		aa.reconcile()
+	}
+}
+
+// Brings the running services and bgp neighbors in line with the store.
+// The asnum, router id and next hops of the bgp speaker can not be
+// changed while it runs
+func (aa *AnycastAgent) reconcile() {
+	cfg, err := aa.loadConfig()
+	if errors.Is(err, errNoServices) {
+		// The services were moved away, or fell below their minNodes
+		aa.Logger.Warn("AnycastAgent: " + err.Error())
+		aa.stopServices()
+		return
+	}
+	if err != nil {
+		aa.Logger.Warn("AnycastAgent: Not applying the changed configuration: " + err.Error())
+		return
+	}
+
+	if cfg.localAs != aa.LocalAs || cfg.routerId != aa.RouterId ||
+		cfg.nextHopIP != aa.NextHopIP || cfg.nextHopIP6 != aa.NextHopIP6 {
+		aa.Logger.Warn("AnycastAgent: The asnum, router id or next hops changed, restart to apply them")
+	}
+
+	aa.configLock.Lock()
+	defer aa.configLock.Unlock()
+
+	wanted := make(map[string]structs.AnycastObject)
+	for _, service := range cfg.services {
+		wanted[service.Meta.Name] = service
+	}
+
+	services := []*AnycastService{}
+	for _, svc := range aa.Services {
+		service, ok := wanted[svc.Name]
+		if ok && svc.IP == service.Spec.IP && svc.IP6 == service.Spec.IP6 &&
+			svc.healthCheck.Config.Command == service.Spec.HealthCheck {
+			services = append(services, svc)
+			delete(wanted, svc.Name)
+			continue
+		}
+		aa.Logger.Info("AnycastAgent: Stopping service " + svc.Name)
+		close(svc.stop)
+	}
+	for _, service := range cfg.services {
+		if _, ok := wanted[service.Meta.Name]; !ok {
+			continue
+		}
+		svc := aa.newService(service)
+		aa.Logger.Info("AnycastAgent: Running service " + svc.Name)
+		go aa.serviceRoutine(svc)
+		services = append(services, svc)
+	}
+	aa.Services = services
+
+	for _, peer := range aa.BgpPeers {
+		if _, ok := cfg.neighborCfg[peer]; !ok {
+			aa.Logger.Info("AnycastAgent: Removing bgp neighbor " + peer)
+			aa.bgpService.DeleteNeighbor(peer)
+		}
+	}
+	for _, peer := range cfg.bgpPeers {
+		neighborCfg := cfg.neighborCfg[peer]
+		var bfdCfg *bfd.Config
+		if peerBfdCfg, ok := cfg.bfdCfg[peer]; ok {
+			bfdCfg = &peerBfdCfg
+		}
+
+		oldCfg, exists := aa.NeighborCfg[peer]
+		oldBfdCfg, hadBfd := aa.BfdCfg[peer]
+		if exists && reflect.DeepEqual(oldCfg, neighborCfg) &&
+			hadBfd == (bfdCfg != nil) && (bfdCfg == nil || oldBfdCfg == *bfdCfg) {
+			continue
+		}
+
+		if exists {
+			aa.Logger.Info("AnycastAgent: Reconfiguring bgp neighbor " + peer)
+		} else {
+			aa.Logger.Info("AnycastAgent: Adding bgp neighbor " + peer)
+		}
+		aa.bgpService.SetNeighbor(peer, neighborCfg, bfdCfg)
+	}
+	aa.BgpPeers = cfg.bgpPeers
+	aa.NeighborCfg = cfg.neighborCfg
+	aa.BfdCfg = cfg.bfdCfg
+}
+
+// Stops and withdraws all services; the bgp neighbors are kept, so the
+// services are announced again as soon as they are placed on the node
+func (aa *AnycastAgent) stopServices() {
+	aa.configLock.Lock()
+	defer aa.configLock.Unlock()
+
+	for _, svc := range aa.Services {
+		aa.Logger.Info("AnycastAgent: Stopping service " + svc.Name)
+		close(svc.stop)
+	}
+	aa.Services = nil
+}
@@ -0,0 +1,204 @@
+package bfd
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestControlPacketMarshal(t *testing.T) {
+	packet := ControlPacket{
+		Diag:                  DiagNeighborDown,
+		State:                 StateUp,
+		Poll:                  true,
+		DetectMult:            3,
+		MyDiscriminator:       1,
+		YourDiscriminator:     2,
+		DesiredMinTxInterval:  300 * time.Millisecond,
+		RequiredMinRxInterval: 200 * time.Millisecond,
+	}
+
+	data := packet.Marshal()
+	if len(data) != PacketSize {
+		t.Fatalf("unexpected packet size: %d", len(data))
+	}
+
+	decoded, err := UnmarshalControlPacket(data)
+	if err != nil {
+		t.Fatalf("cant decode packet: %v", err)
+	}
+	if *decoded != packet {
+		t.Errorf("decoded packet differs: %+v != %+v", *decoded, packet)
+	}
+
+	// Up state requires your discriminator to be known
+	packet.YourDiscriminator = 0
+	if _, err := UnmarshalControlPacket(packet.Marshal()); err == nil {
+		t.Errorf("packet w/o your discriminator in Up state was accepted")
+	}
+
+	data = packet.Marshal()
+	data[0] = 2<<5 | data[0]&0x1f
+	if _, err := UnmarshalControlPacket(data); err == nil {
+		t.Errorf("packet w/ wrong version was accepted")
+	}
+}
+
+func waitForState(t *testing.T, server *Server, peer string, state State) Event {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event := <-server.Events:
+			if event.Peer == peer && event.State == state {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("session to %s did not reach state %v", peer, state)
+		}
+	}
+}
+
+func newLoopbackServers(t *testing.T) (*Server, *Server) {
+	serverA, err := NewServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("cant start server: %v", err)
+	}
+	serverB, err := NewServer("127.0.0.2", serverA.port)
+	if err != nil {
+		serverA.Close()
+		t.Skipf("cant listen on 127.0.0.2: %v", err)
+	}
+
+	go serverA.Serve()
+	go serverB.Serve()
+
+	return serverA, serverB
+}
+
+func TestSessionUpDown(t *testing.T) {
+	serverA, serverB := newLoopbackServers(t)
+	defer serverA.Close()
+
+	cfg := Config{
+		DesiredMinTx:  50 * time.Millisecond,
+		RequiredMinRx: 50 * time.Millisecond,
+		DetectMult:    3,
+		Multihop:      true,
+	}
+
+	sessionA, err := serverA.AddSession("127.0.0.2", cfg)
+	if err != nil {
+		t.Fatalf("cant add session: %v", err)
+	}
+	if _, err := serverB.AddSession("127.0.0.1", cfg); err != nil {
+		t.Fatalf("cant add session: %v", err)
+	}
+
+	if _, err := serverA.AddSession("127.0.0.2", cfg); err == nil {
+		t.Errorf("duplicate session was accepted")
+	}
+
+	waitForState(t, serverA, "127.0.0.2", StateUp)
+	waitForState(t, serverB, "127.0.0.1", StateUp)
+
+	// Give the poll sequence some time to switch to the fast timers
+	time.Sleep(500 * time.Millisecond)
+	if state := sessionA.State(); state != StateUp {
+		t.Fatalf("session went %v after switching timers", state)
+	}
+
+	serverB.Close()
+	event := waitForState(t, serverA, "127.0.0.2", StateDown)
+	if event.Diag != DiagNeighborDown || event.RemoteState != StateAdminDown {
+		t.Errorf("unexpected diag: %v (remote %v)", event.Diag, event.RemoteState)
+	}
+}
+
+func TestSessionDetectionTimeout(t *testing.T) {
+	serverA, serverB := newLoopbackServers(t)
+	defer serverA.Close()
+	defer serverB.Close()
+
+	cfg := Config{
+		DesiredMinTx:  50 * time.Millisecond,
+		RequiredMinRx: 50 * time.Millisecond,
+		DetectMult:    3,
+	}
+
+	if _, err := serverA.AddSession("127.0.0.2", cfg); err != nil {
+		t.Fatalf("cant add session: %v", err)
+	}
+	sessionB, err := serverB.AddSession("127.0.0.1", cfg)
+	if err != nil {
+		t.Fatalf("cant add session: %v", err)
+	}
+
+	waitForState(t, serverA, "127.0.0.2", StateUp)
+
+	// Silently drop all packets sent by B
+	sessionB.conn.Close()
+
+	event := waitForState(t, serverA, "127.0.0.2", StateDown)
+	if event.Diag != DiagControlDetectExpired {
+		t.Errorf("unexpected diag: %v", event.Diag)
+	}
+}
+
+func TestSingleHopTTL(t *testing.T) {
+	server, err := NewServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("cant start server: %v", err)
+	}
+	defer server.Close()
+	go server.Serve()
+
+	cfg := Config{
+		DesiredMinTx:  time.Second,
+		RequiredMinRx: time.Second,
+		DetectMult:    3,
+	}
+	if _, err := server.AddSession("127.0.0.2", cfg); err != nil {
+		t.Fatalf("cant add session: %v", err)
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.2")})
+	if err != nil {
+		t.Skipf("cant listen on 127.0.0.2: %v", err)
+	}
+	defer conn.Close()
+
+	packet := ControlPacket{
+		State:                 StateDown,
+		DetectMult:            3,
+		MyDiscriminator:       1,
+		DesiredMinTxInterval:  time.Second,
+		RequiredMinRxInterval: time.Second,
+	}
+	send := func(ttl int) {
+		rawConn, err := conn.SyscallConn()
+		if err != nil {
+			t.Fatalf("cant get raw conn: %v", err)
+		}
+		rawConn.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+		})
+		if err != nil {
+			t.Fatalf("cant set ttl: %v", err)
+		}
+		if _, err = conn.WriteToUDP(packet.Marshal(), &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: server.port}); err != nil {
+			t.Fatalf("cant send packet: %v", err)
+		}
+	}
+
+	// A packet which may have been routed is dropped
+	send(64)
+	select {
+	case event := <-server.Events:
+		t.Fatalf("packet with ttl 64 changed the session to %v", event.State)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	send(ttlSingleHop)
+	waitForState(t, server, "127.0.0.2", StateInit)
+}
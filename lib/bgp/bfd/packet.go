@@ -0,0 +1,178 @@
+package bfd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	Version    uint8 = 1
+	PacketSize int   = 24
+
+	// Ports used for single-hop (RFC 5881) and multihop (RFC 5883) sessions
+	PortSingleHop int = 3784
+	PortMultiHop  int = 4784
+)
+
+type State uint8
+
+const (
+	StateAdminDown State = 0
+	StateDown      State = 1
+	StateInit      State = 2
+	StateUp        State = 3
+)
+
+func (s State) String() string {
+	switch s {
+	case StateAdminDown:
+		return "AdminDown"
+	case StateDown:
+		return "Down"
+	case StateInit:
+		return "Init"
+	case StateUp:
+		return "Up"
+	}
+	return fmt.Sprintf("State(%d)", uint8(s))
+}
+
+type Diag uint8
+
+const (
+	DiagNone                 Diag = 0
+	DiagControlDetectExpired Diag = 1
+	DiagEchoFailed           Diag = 2
+	DiagNeighborDown         Diag = 3
+	DiagForwardingReset      Diag = 4
+	DiagPathDown             Diag = 5
+	DiagConcatPathDown       Diag = 6
+	DiagAdminDown            Diag = 7
+)
+
+func (d Diag) String() string {
+	switch d {
+	case DiagNone:
+		return "No Diagnostic"
+	case DiagControlDetectExpired:
+		return "Control Detection Time Expired"
+	case DiagEchoFailed:
+		return "Echo Function Failed"
+	case DiagNeighborDown:
+		return "Neighbor Signaled Session Down"
+	case DiagForwardingReset:
+		return "Forwarding Plane Reset"
+	case DiagPathDown:
+		return "Path Down"
+	case DiagConcatPathDown:
+		return "Concatenated Path Down"
+	case DiagAdminDown:
+		return "Administratively Down"
+	}
+	return fmt.Sprintf("Diag(%d)", uint8(d))
+}
+
+const (
+	flagPoll          uint8 = 0x20
+	flagFinal         uint8 = 0x10
+	flagCPIndependent uint8 = 0x08
+	flagAuth          uint8 = 0x04
+	flagDemand        uint8 = 0x02
+	flagMultipoint    uint8 = 0x01
+)
+
+// BFD Control packet (RFC 5880 section 4.1), without authentication
+type ControlPacket struct {
+	Diag                  Diag
+	State                 State
+	Poll                  bool
+	Final                 bool
+	DetectMult            uint8
+	MyDiscriminator       uint32
+	YourDiscriminator     uint32
+	DesiredMinTxInterval  time.Duration
+	RequiredMinRxInterval time.Duration
+	RequiredMinEchoRx     time.Duration
+}
+
+func durationToMicroseconds(d time.Duration) uint32 {
+	return uint32(d / time.Microsecond)
+}
+
+func microsecondsToDuration(us uint32) time.Duration {
+	return time.Duration(us) * time.Microsecond
+}
+
+func (p *ControlPacket) Marshal() []byte {
+	data := make([]byte, PacketSize)
+
+	data[0] = Version<<5 | uint8(p.Diag)&0x1f
+	data[1] = uint8(p.State) << 6
+	if p.Poll {
+		data[1] |= flagPoll
+	}
+	if p.Final {
+		data[1] |= flagFinal
+	}
+	data[2] = p.DetectMult
+	data[3] = uint8(PacketSize)
+	binary.BigEndian.PutUint32(data[4:], p.MyDiscriminator)
+	binary.BigEndian.PutUint32(data[8:], p.YourDiscriminator)
+	binary.BigEndian.PutUint32(data[12:], durationToMicroseconds(p.DesiredMinTxInterval))
+	binary.BigEndian.PutUint32(data[16:], durationToMicroseconds(p.RequiredMinRxInterval))
+	binary.BigEndian.PutUint32(data[20:], durationToMicroseconds(p.RequiredMinEchoRx))
+
+	return data
+}
+
+// Decodes a control packet and performs the checks of RFC 5880 section
+// 6.8.6 that do not depend on session state
+func UnmarshalControlPacket(data []byte) (*ControlPacket, error) {
+	if len(data) < PacketSize {
+		return nil, errors.New("UnmarshalControlPacket: packet too short")
+	}
+
+	if version := data[0] >> 5; version != Version {
+		return nil, fmt.Errorf("UnmarshalControlPacket: unsupported version %d", version)
+	}
+
+	length := int(data[3])
+	if length < PacketSize || length > len(data) {
+		return nil, fmt.Errorf("UnmarshalControlPacket: invalid length %d", length)
+	}
+
+	flags := data[1] & 0x3f
+	if flags&flagAuth != 0 {
+		return nil, errors.New("UnmarshalControlPacket: authentication is not supported")
+	}
+	if flags&flagMultipoint != 0 {
+		return nil, errors.New("UnmarshalControlPacket: multipoint bit set")
+	}
+
+	p := &ControlPacket{
+		Diag:                  Diag(data[0] & 0x1f),
+		State:                 State(data[1] >> 6),
+		Poll:                  flags&flagPoll != 0,
+		Final:                 flags&flagFinal != 0,
+		DetectMult:            data[2],
+		MyDiscriminator:       binary.BigEndian.Uint32(data[4:]),
+		YourDiscriminator:     binary.BigEndian.Uint32(data[8:]),
+		DesiredMinTxInterval:  microsecondsToDuration(binary.BigEndian.Uint32(data[12:])),
+		RequiredMinRxInterval: microsecondsToDuration(binary.BigEndian.Uint32(data[16:])),
+		RequiredMinEchoRx:     microsecondsToDuration(binary.BigEndian.Uint32(data[20:])),
+	}
+
+	if p.DetectMult == 0 {
+		return nil, errors.New("UnmarshalControlPacket: detect multiplier is zero")
+	}
+	if p.MyDiscriminator == 0 {
+		return nil, errors.New("UnmarshalControlPacket: my discriminator is zero")
+	}
+	if p.YourDiscriminator == 0 && p.State != StateDown && p.State != StateAdminDown {
+		return nil, errors.New("UnmarshalControlPacket: your discriminator is zero")
+	}
+
+	return p, nil
+}
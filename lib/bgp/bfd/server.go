@@ -0,0 +1,303 @@
+package bfd
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+)
+
+const (
+	// Source ports used for outgoing packets (RFC 5881 section 4)
+	minSourcePort = 49152
+	maxSourcePort = 65535
+
+	// TTL/Hop Limit used for outgoing packets (RFC 5881 section 5)
+	ttlSingleHop = 255
+)
+
+// Handles all BFD sessions using a single listening port
+type Server struct {
+	listenIP net.IP
+	port     int
+	conn     *net.UDPConn
+	Events   chan Event
+
+	mutex    sync.Mutex
+	sessions map[string]*Session
+	discrs   map[uint32]*Session
+	closed   bool
+}
+
+func NewServer(listenAddr string, port int) (*Server, error) {
+	var listenIP net.IP
+	if listenAddr != "" {
+		listenIP = net.ParseIP(listenAddr)
+		if listenIP == nil {
+			return nil, fmt.Errorf("NewServer: invalid listen address: %s", listenAddr)
+		}
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: listenIP, Port: port})
+	if err != nil {
+		return nil, errors.New("NewServer: " + err.Error())
+	}
+
+	if err = setRecvTTL(conn); err != nil {
+		conn.Close()
+		return nil, errors.New("NewServer: " + err.Error())
+	}
+
+	s := &Server{
+		listenIP: listenIP,
+		port:     conn.LocalAddr().(*net.UDPAddr).Port,
+		conn:     conn,
+		Events:   make(chan Event, 64),
+		sessions: make(map[string]*Session),
+		discrs:   make(map[uint32]*Session),
+	}
+
+	return s, nil
+}
+
+// Reads packets and hands them to the matching session, until Close is
+// called. Packets for single-hop sessions which were not sent with a TTL or
+// Hop Limit of 255 can come from off-link, and are dropped (RFC 5881
+// section 5)
+func (s *Server) Serve() {
+	buf := make([]byte, 1500)
+	oob := make([]byte, 128)
+	for {
+		n, oobn, _, src, err := s.conn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return
+			}
+			continue
+		}
+
+		packet, err := UnmarshalControlPacket(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		session := s.lookupSession(packet, src)
+		if session == nil {
+			continue
+		}
+
+		if !session.cfg.Multihop && receivedTTL(oob[:oobn]) != ttlSingleHop {
+			continue
+		}
+
+		select {
+		case session.rxChan <- packet:
+		default:
+		}
+	}
+}
+
+func (s *Server) lookupSession(packet *ControlPacket, src *net.UDPAddr) *Session {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var session *Session
+	if packet.YourDiscriminator != 0 {
+		session = s.discrs[packet.YourDiscriminator]
+	} else {
+		session = s.sessions[src.IP.String()]
+	}
+
+	if session == nil || !session.peer.IP.Equal(src.IP) {
+		return nil
+	}
+
+	return session
+}
+
+func (s *Server) newDiscriminator() uint32 {
+	for {
+		discr := rand.Uint32()
+		if discr == 0 {
+			continue
+		}
+		if _, ok := s.discrs[discr]; !ok {
+			return discr
+		}
+	}
+}
+
+func setTTL(conn *net.UDPConn, ipv6 bool) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		if ipv6 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6,
+				syscall.IPV6_UNICAST_HOPS, ttlSingleHop)
+		} else {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP,
+				syscall.IP_TTL, ttlSingleHop)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+// Asks for the TTL or Hop Limit of the received packets. A dual stack
+// socket gets both, so only one of them has to work
+func setRecvTTL(conn *net.UDPConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		errV4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTTL, 1)
+		errV6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6RecvHopLimit, 1)
+		if errV4 != nil && errV6 != nil {
+			sockErr = errV4
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return sockErr
+}
+
+// Returns the TTL or Hop Limit from the control messages of a received
+// packet, or -1 if it is not there
+func receivedTTL(oob []byte) int {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return -1
+	}
+
+	for _, message := range messages {
+		header := message.Header
+		if (header.Level == syscall.IPPROTO_IP && header.Type == syscall.IP_TTL) ||
+			(header.Level == syscall.IPPROTO_IPV6 && header.Type == ipv6HopLimit) {
+			if len(message.Data) < 4 {
+				return -1
+			}
+			// An int in host byte order of at most 255, so the value is in
+			// the first byte on little endian and the last on big endian
+			// machines, and the others are zero
+			return int(message.Data[0]) | int(message.Data[3])
+		}
+	}
+
+	return -1
+}
+
+// Opens the socket used to send packets to a peer. Every session uses
+// its own source port
+func (s *Server) dialSession(peer net.IP, multihop bool) (*net.UDPConn, error) {
+	var err error
+	for i := 0; i < 16; i++ {
+		port := minSourcePort + rand.Intn(maxSourcePort-minSourcePort+1)
+
+		var conn *net.UDPConn
+		conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: s.listenIP, Port: port})
+		if err != nil {
+			continue
+		}
+
+		if !multihop {
+			if err = setTTL(conn, peer.To4() == nil); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+
+		return conn, nil
+	}
+
+	return nil, err
+}
+
+func (s *Server) AddSession(peer string, cfg Config) (*Session, error) {
+	peerIP := net.ParseIP(peer)
+	if peerIP == nil {
+		return nil, fmt.Errorf("Server.AddSession: invalid peer address: %s", peer)
+	}
+
+	if cfg.DetectMult == 0 {
+		return nil, errors.New("Server.AddSession: detect multiplier is zero")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil, errors.New("Server.AddSession: server is closed")
+	}
+
+	if _, ok := s.sessions[peerIP.String()]; ok {
+		return nil, fmt.Errorf("Server.AddSession: session for %s already exists", peer)
+	}
+
+	conn, err := s.dialSession(peerIP, cfg.Multihop)
+	if err != nil {
+		return nil, fmt.Errorf("Server.AddSession: %v", err)
+	}
+
+	discr := s.newDiscriminator()
+	session := newSession(&net.UDPAddr{IP: peerIP, Port: s.port}, cfg, conn,
+		discr, s.Events)
+	s.sessions[peerIP.String()] = session
+	s.discrs[discr] = session
+
+	go session.run()
+
+	return session, nil
+}
+
+func (s *Server) RemoveSession(peer string) {
+	peerIP := net.ParseIP(peer)
+	if peerIP == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	session, ok := s.sessions[peerIP.String()]
+	if ok {
+		delete(s.sessions, peerIP.String())
+		delete(s.discrs, session.localDiscr)
+	}
+	s.mutex.Unlock()
+
+	if ok {
+		session.stop()
+	}
+}
+
+// Stops all sessions and the listener. Peers are told the sessions
+// are administratively down
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	sessions := s.sessions
+	s.sessions = make(map[string]*Session)
+	s.discrs = make(map[uint32]*Session)
+	s.mutex.Unlock()
+
+	for _, session := range sessions {
+		session.stop()
+	}
+
+	return s.conn.Close()
+}
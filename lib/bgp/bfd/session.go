@@ -0,0 +1,257 @@
+package bfd
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Until a session is Up, packets are sent at most once per second
+// (RFC 5880 section 6.8.3)
+const slowTxInterval = 1 * time.Second
+
+type Config struct {
+	DesiredMinTx  time.Duration
+	RequiredMinRx time.Duration
+	DetectMult    uint8
+	// Use RFC 5883 multihop instead of RFC 5881 single-hop
+	Multihop bool
+}
+
+// Sent on every state change of a session
+type Event struct {
+	Peer  string
+	State State
+	Diag  Diag
+	// Last state reported by the peer. A peer going AdminDown should not
+	// bring down the protocols using the session (RFC 5882 section 3.2)
+	RemoteState State
+}
+
+type Session struct {
+	peer     *net.UDPAddr
+	cfg      Config
+	conn     *net.UDPConn
+	events   chan Event
+	rxChan   chan *ControlPacket
+	stopChan chan struct{}
+	stopOnce sync.Once
+
+	mutex sync.Mutex
+	state State
+
+	// Only accessed from the run loop
+	localDiscr         uint32
+	remoteDiscr        uint32
+	localDiag          Diag
+	remoteState        State
+	remoteMinRx        time.Duration
+	remoteDesiredMinTx time.Duration
+	remoteDetectMult   uint8
+	desiredMinTx       time.Duration
+	pollActive         bool
+	// Set when the timers changed and the next packet must be sent
+	// right away
+	txNow bool
+}
+
+func newSession(peer *net.UDPAddr, cfg Config, conn *net.UDPConn,
+	localDiscr uint32, events chan Event) *Session {
+	return &Session{
+		peer:         peer,
+		cfg:          cfg,
+		conn:         conn,
+		events:       events,
+		rxChan:       make(chan *ControlPacket, 16),
+		stopChan:     make(chan struct{}),
+		state:        StateDown,
+		localDiscr:   localDiscr,
+		remoteState:  StateDown,
+		remoteMinRx:  time.Microsecond,
+		desiredMinTx: slowInterval(cfg.DesiredMinTx),
+	}
+}
+
+func slowInterval(interval time.Duration) time.Duration {
+	if interval < slowTxInterval {
+		return slowTxInterval
+	}
+	return interval
+}
+
+func (s *Session) Peer() string {
+	return s.peer.IP.String()
+}
+
+func (s *Session) State() State {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state
+}
+
+func (s *Session) stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopChan)
+	})
+}
+
+// Interval between two packets, including the jitter of RFC 5880
+// section 6.8.7
+func (s *Session) txInterval() time.Duration {
+	interval := s.desiredMinTx
+	if s.remoteMinRx > interval {
+		interval = s.remoteMinRx
+	}
+	jitter := 0.75 + rand.Float64()*0.25
+	if s.cfg.DetectMult == 1 {
+		jitter = 0.75 + rand.Float64()*0.15
+	}
+	return time.Duration(float64(interval) * jitter)
+}
+
+func (s *Session) detectionTime() time.Duration {
+	interval := s.cfg.RequiredMinRx
+	if s.remoteDesiredMinTx > interval {
+		interval = s.remoteDesiredMinTx
+	}
+	return time.Duration(s.remoteDetectMult) * interval
+}
+
+func (s *Session) setState(state State, diag Diag) {
+	s.mutex.Lock()
+	oldState := s.state
+	s.state = state
+	s.mutex.Unlock()
+
+	if oldState == state {
+		return
+	}
+	s.localDiag = diag
+
+	if state == StateUp {
+		// Switch to the configured timers using a poll sequence
+		s.desiredMinTx = s.cfg.DesiredMinTx
+		s.pollActive = true
+	} else {
+		s.desiredMinTx = slowInterval(s.cfg.DesiredMinTx)
+	}
+	s.txNow = true
+
+	select {
+	case s.events <- Event{Peer: s.Peer(), State: state, Diag: diag,
+		RemoteState: s.remoteState}:
+	case <-s.stopChan:
+	}
+}
+
+func (s *Session) send(final bool) {
+	packet := ControlPacket{
+		Diag:                  s.localDiag,
+		State:                 s.State(),
+		Poll:                  s.pollActive && !final,
+		Final:                 final,
+		DetectMult:            s.cfg.DetectMult,
+		MyDiscriminator:       s.localDiscr,
+		YourDiscriminator:     s.remoteDiscr,
+		DesiredMinTxInterval:  s.desiredMinTx,
+		RequiredMinRxInterval: s.cfg.RequiredMinRx,
+	}
+	// Errors are not fatal; the peer will detect the missing packets
+	s.conn.WriteToUDP(packet.Marshal(), s.peer)
+}
+
+// Processes a received packet (RFC 5880 section 6.8.6)
+func (s *Session) receive(packet *ControlPacket) {
+	s.remoteDiscr = packet.MyDiscriminator
+	s.remoteState = packet.State
+	s.remoteMinRx = packet.RequiredMinRxInterval
+	s.remoteDesiredMinTx = packet.DesiredMinTxInterval
+	s.remoteDetectMult = packet.DetectMult
+
+	if packet.Final {
+		s.pollActive = false
+	}
+
+	state := s.State()
+	if state == StateAdminDown {
+		return
+	}
+
+	if packet.State == StateAdminDown {
+		if state != StateDown {
+			s.setState(StateDown, DiagNeighborDown)
+		}
+	} else {
+		switch state {
+		case StateDown:
+			if packet.State == StateDown {
+				s.setState(StateInit, DiagNone)
+			} else if packet.State == StateInit {
+				s.setState(StateUp, DiagNone)
+			}
+		case StateInit:
+			if packet.State == StateInit || packet.State == StateUp {
+				s.setState(StateUp, DiagNone)
+			}
+		case StateUp:
+			if packet.State == StateDown {
+				s.setState(StateDown, DiagNeighborDown)
+			}
+		}
+	}
+
+	if packet.Poll {
+		s.send(true)
+	}
+}
+
+func (s *Session) run() {
+	txTimer := time.NewTimer(0)
+	detectTimer := time.NewTimer(time.Hour)
+	detectTimer.Stop()
+	defer txTimer.Stop()
+	defer detectTimer.Stop()
+
+	for {
+		select {
+		case <-s.stopChan:
+			// Let the peer know we are going away
+			s.setState(StateAdminDown, DiagAdminDown)
+			s.send(false)
+			s.conn.Close()
+			return
+		case packet := <-s.rxChan:
+			s.receive(packet)
+			if !detectTimer.Stop() {
+				select {
+				case <-detectTimer.C:
+				default:
+				}
+			}
+			detectTimer.Reset(s.detectionTime())
+		case <-detectTimer.C:
+			state := s.State()
+			if state == StateInit || state == StateUp {
+				s.setState(StateDown, DiagControlDetectExpired)
+				s.remoteDiscr = 0
+			}
+		case <-txTimer.C:
+			if s.remoteDiscr != 0 || s.State() == StateDown {
+				s.send(false)
+			}
+			txTimer.Reset(s.txInterval())
+		}
+
+		if s.txNow {
+			s.txNow = false
+			if !txTimer.Stop() {
+				select {
+				case <-txTimer.C:
+				default:
+				}
+			}
+			txTimer.Reset(0)
+		}
+	}
+}
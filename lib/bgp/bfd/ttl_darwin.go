@@ -0,0 +1,8 @@
+package bfd
+
+// The syscall package only has the RFC 2292 options on darwin, these are
+// the RFC 3542 ones from netinet6/in6.h
+const (
+	ipv6RecvHopLimit = 0x25
+	ipv6HopLimit     = 0x2f
+)
@@ -0,0 +1,12 @@
+//go:build !darwin
+
+package bfd
+
+import (
+	"syscall"
+)
+
+const (
+	ipv6RecvHopLimit = syscall.IPV6_RECVHOPLIMIT
+	ipv6HopLimit     = syscall.IPV6_HOPLIMIT
+)
@@ -1,11 +1,16 @@
 package bgp
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/r3boot/anycast-agent/lib"
+	"github.com/r3boot/anycast-agent/lib/bgp/bfd"
 	"github.com/r3boot/anycast-agent/lib/bgp/bgp2go"
 )
 
@@ -13,7 +18,20 @@ type BGP struct {
 	context     bgp2go.BGPContext
 	cmdToPeer   chan bgp2go.BGPProcessMsg
 	cmdFromPeer chan bgp2go.BGPProcessMsg
+	events      chan bgp2go.BGPEvent
+	queryLock   sync.Mutex
 	peers       []string
+	neighbors   map[string]bgp2go.BGPNeighbourCfg
+	bfdPeers    map[string]bfd.Config
+	bfdServers  map[bool]*bfd.Server
+	flowLock    sync.Mutex
+	flowRules   map[string]*FlowRule
+	bmp         *BMPClient
+	mrt         *bgp2go.MRTDumper
+
+	// Guards the peers, neighbors and BFD sessions, which change when
+	// the agent is reconfigured
+	neighborLock sync.Mutex
 }
 
 type BGPConfig struct {
@@ -23,6 +41,20 @@ type BGPConfig struct {
 	NextHopIP6 string
 	LocalPref  int
 	BgpPeers   []string
+	// Keep the routes received from the peers, at most AdjRIBInLimit
+	// prefixes per peer (0 is unlimited)
+	AdjRIBIn      bool
+	AdjRIBInLimit int
+	// Per-peer settings (max-prefix, policies), indexed by the address of
+	// the peer. Address is filled in by AddNeighbor. AFIs is the complete
+	// list of families; when it is empty AddNeighbor uses the family of the
+	// session (plus inet with ExtendedNextHop).
+	Neighbors map[string]bgp2go.BGPNeighbourCfg
+	// BFD sessions, indexed by the address of the peer. The BGP session
+	// to a peer is torn down as soon as its BFD session goes down.
+	BFD map[string]bfd.Config
+	// Stream the state of the sessions to a BMP collector
+	BMP *BMPConfig
 }
 
 var Logger lib.Logger
@@ -38,6 +70,11 @@ func NewBGP(logger lib.Logger) (*BGP, error) {
 		context:     bgp2go.BGPContext{},
 		cmdToPeer:   make(chan bgp2go.BGPProcessMsg),
 		cmdFromPeer: make(chan bgp2go.BGPProcessMsg),
+		events:      make(chan bgp2go.BGPEvent, 64),
+		neighbors:   make(map[string]bgp2go.BGPNeighbourCfg),
+		bfdPeers:    make(map[string]bfd.Config),
+		bfdServers:  make(map[bool]*bfd.Server),
+		mrt:         bgp2go.NewMRTDumper(),
 	}
 
 	return bgp, nil
@@ -49,6 +86,12 @@ func (bgp *BGP) Initialize(cfg *BGPConfig) (err error) {
 	bgp.context.ASN = uint32(cfg.Asnum)
 	bgp.context.ListenLocal = true
 	bgp.peers = cfg.BgpPeers
+	if cfg.Neighbors != nil {
+		bgp.neighbors = cfg.Neighbors
+	}
+	if cfg.BFD != nil {
+		bgp.bfdPeers = cfg.BFD
+	}
 
 	bgp.context.RouterID, err = bgp2go.IPv4ToUint32(cfg.RouterId)
 	if err != nil {
@@ -69,6 +112,19 @@ func (bgp *BGP) Initialize(cfg *BGPConfig) (err error) {
 	}
 
 	bgp.context.LocalPref = uint32(cfg.LocalPref)
+	bgp.context.Events = bgp.events
+	bgp.context.MRT = bgp.mrt
+	bgp.context.DisableAdjRIBIn = !cfg.AdjRIBIn
+	bgp.context.AdjRIBInLimit = cfg.AdjRIBInLimit
+
+	if cfg.BMP != nil {
+		monitor := make(chan bgp2go.BGPMonitorMsg, 1024)
+		bgp.context.Monitor = monitor
+		bgp.bmp = NewBMPClient(*cfg.BMP, monitor)
+		if cfg.AdjRIBIn {
+			bgp.bmp.adjRIBIn = bgp.adjRIBInCounts
+		}
+	}
 
 	return
 }
@@ -82,35 +138,176 @@ func (bgp *BGP) ServerRoutine() {
 	bgp.cmdFromPeer = make(chan bgp2go.BGPProcessMsg)
 
 	Logger.Debug("bgp: Starting ServerRoutine")
+	go bgp.eventRoutine()
 	go bgp2go.StartBGPProcess(bgp.cmdToPeer, bgp.cmdFromPeer, bgp.context)
+	if bgp.bmp != nil {
+		go bgp.bmp.Run()
+	}
 
 	time.Sleep(1 * time.Second)
-	for _, bgpPeer = range bgp.peers {
+	bgp.neighborLock.Lock()
+	peers := append([]string{}, bgp.peers...)
+	bgp.neighborLock.Unlock()
+	for _, bgpPeer = range peers {
 		bgp.AddNeighbor(bgpPeer)
 	}
+
+	bgp.startBFD()
 }
 
-func (bgp *BGP) addv4Neighbor(ipaddr string) {
-	Logger.Debug("bgp: Adding IPv4 neighbor " + ipaddr)
-	bgp.cmdToPeer <- bgp2go.BGPProcessMsg{
-		Cmnd: "AddNeighbour",
-		Data: ipaddr + " inet",
+// Starts the BFD sessions for all peers which have BFD enabled. Single-hop
+// and multihop sessions use a different port, so each gets its own server
+func (bgp *BGP) startBFD() {
+	bgp.neighborLock.Lock()
+	defer bgp.neighborLock.Unlock()
+
+	for peer, cfg := range bgp.bfdPeers {
+		bgp.addBFDSession(peer, cfg)
 	}
 }
 
-func (bgp *BGP) addv6Neighbor(ipaddr string) {
-	Logger.Debug("bgp: Adding IPv6 neighbor " + ipaddr)
+// Must be called with the neighborLock held
+func (bgp *BGP) addBFDSession(peer string, cfg bfd.Config) {
+	server, ok := bgp.bfdServers[cfg.Multihop]
+	if !ok {
+		port := bfd.PortSingleHop
+		if cfg.Multihop {
+			port = bfd.PortMultiHop
+		}
+
+		var err error
+		server, err = bfd.NewServer("", port)
+		if err != nil {
+			Logger.Warn("bgp: Failed to start BFD: " + err.Error())
+			return
+		}
+		bgp.bfdServers[cfg.Multihop] = server
+
+		go server.Serve()
+		go bgp.bfdRoutine(server.Events)
+	}
+
+	Logger.Debug("bgp: Starting BFD session to " + peer)
+	if _, err := server.AddSession(peer, cfg); err != nil {
+		Logger.Warn("bgp: Failed to start BFD session to " + peer + ": " + err.Error())
+	}
+}
+
+// Must be called with the neighborLock held
+func (bgp *BGP) removeBFDSession(peer string) {
+	cfg, ok := bgp.bfdPeers[peer]
+	if !ok {
+		return
+	}
+
+	if server, ok := bgp.bfdServers[cfg.Multihop]; ok {
+		Logger.Debug("bgp: Stopping BFD session to " + peer)
+		server.RemoveSession(peer)
+	}
+}
+
+// Tears down the BGP session to a peer when its BFD session goes down
+func (bgp *BGP) bfdRoutine(events chan bfd.Event) {
+	wasUp := make(map[string]bool)
+
+	for event := range events {
+		Logger.Info("bgp: BFD session to " + event.Peer + " is " +
+			event.State.String() + " (" + event.Diag.String() + ")")
+
+		if event.State == bfd.StateUp {
+			wasUp[event.Peer] = true
+			continue
+		}
+
+		if !wasUp[event.Peer] {
+			continue
+		}
+		wasUp[event.Peer] = false
+
+		if event.State == bfd.StateAdminDown || event.RemoteState == bfd.StateAdminDown {
+			// BFD was disabled, here while the neighbor is reconfigured or
+			// by the peer; it does not mean the path is down
+			continue
+		}
+
+		Logger.Warn("bgp: BFD session to " + event.Peer + " went down, resetting BGP session")
+		bgp.cmdToPeer <- bgp2go.BGPProcessMsg{
+			Cmnd: "BFDDown",
+			Data: neighborAddress(event.Peer),
+		}
+	}
+}
+
+// Returns the neighbor's address, followed by its description if it has one
+func (bgp *BGP) neighborName(neighbor string) string {
+	bgp.neighborLock.Lock()
+	cfg, ok := bgp.neighbors[strings.Trim(neighbor, "[]")]
+	bgp.neighborLock.Unlock()
+	if !ok || cfg.Description == "" {
+		return neighbor
+	}
+	return neighbor + " (" + cfg.Description + ")"
+}
+
+// Logs the events reported by the bgp neighbours
+func (bgp *BGP) eventRoutine() {
+	for event := range bgp.events {
+		event.Neighbour = bgp.neighborName(event.Neighbour)
+		switch event.Event {
+		case "NotificationRcvd":
+			Logger.Warn("bgp: Received NOTIFICATION from " + event.Neighbour + ": " + event.Data)
+		case "NotificationSent":
+			Logger.Info("bgp: Sent NOTIFICATION to " + event.Neighbour + ": " + event.Data)
+		case "AdjRIBInLimit":
+			Logger.Warn("bgp: Adj-RIB-In of " + event.Neighbour + " is full: " + event.Data)
+		case "MaxPrefixWarning", "MaxPrefixExceeded", "BFDDown":
+			Logger.Warn("bgp: " + event.Event + " for " + event.Neighbour + ": " + event.Data)
+		default:
+			Logger.Debug("bgp: " + event.Event + " " + event.Neighbour + ": " + event.Data)
+		}
+	}
+}
+
+// Returns the address of a neighbor in the format used by bgp2go
+func neighborAddress(ipaddr string) string {
+	if strings.Contains(ipaddr, ":") {
+		return "[" + ipaddr + "]"
+	}
+	return ipaddr
+}
+
+func (bgp *BGP) addNeighbor(ipaddr, afi string) {
+	bgp.neighborLock.Lock()
+	cfg := bgp.neighbors[ipaddr]
+	bgp.neighborLock.Unlock()
+	cfg.Address = neighborAddress(ipaddr)
+	// Neighbors without configured address families only get the one of
+	// the session
+	if len(cfg.AFIs) == 0 {
+		cfg.AFIs = []string{afi}
+		if cfg.ExtendedNextHop {
+			// IPv4 routes are announced with an IPv6 next hop (RFC 8950)
+			cfg.AFIs = append(cfg.AFIs, "inet")
+		}
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		Logger.Warn("bgp: Failed to encode config for neighbor " + ipaddr + ": " + err.Error())
+		return
+	}
 	bgp.cmdToPeer <- bgp2go.BGPProcessMsg{
 		Cmnd: "AddNeighbour",
-		Data: "[" + ipaddr + "] inet6",
+		Data: string(data),
 	}
 }
 
 func (bgp *BGP) AddNeighbor(ipaddr string) {
 	if strings.Contains(ipaddr, ":") {
-		bgp.addv6Neighbor(ipaddr)
+		Logger.Debug("bgp: Adding IPv6 neighbor " + ipaddr)
+		bgp.addNeighbor(ipaddr, "inet6")
 	} else {
-		bgp.addv4Neighbor(ipaddr)
+		Logger.Debug("bgp: Adding IPv4 neighbor " + ipaddr)
+		bgp.addNeighbor(ipaddr, "inet")
 	}
 }
 
@@ -138,6 +335,57 @@ func (bgp *BGP) RemoveBGPNeighbor(ipaddr string) {
 	}
 }
 
+// Adds a neighbor while the bgp service runs, or replaces the settings of
+// an existing one, in which case its session is restarted. bfdCfg is nil
+// for neighbors without BFD
+func (bgp *BGP) SetNeighbor(ipaddr string, cfg bgp2go.BGPNeighbourCfg, bfdCfg *bfd.Config) {
+	bgp.neighborLock.Lock()
+	exists := false
+	for _, peer := range bgp.peers {
+		if peer == ipaddr {
+			exists = true
+		}
+	}
+	if !exists {
+		bgp.peers = append(bgp.peers, ipaddr)
+	}
+	bgp.neighbors[ipaddr] = cfg
+
+	oldBfdCfg, hadBfd := bgp.bfdPeers[ipaddr]
+	if bfdCfg == nil || !hadBfd || oldBfdCfg != *bfdCfg {
+		bgp.removeBFDSession(ipaddr)
+		delete(bgp.bfdPeers, ipaddr)
+		if bfdCfg != nil {
+			bgp.bfdPeers[ipaddr] = *bfdCfg
+			bgp.addBFDSession(ipaddr, *bfdCfg)
+		}
+	}
+	bgp.neighborLock.Unlock()
+
+	if exists {
+		bgp.RemoveBGPNeighbor(ipaddr)
+	}
+	bgp.AddNeighbor(ipaddr)
+}
+
+// Removes a neighbor and its BFD session while the bgp service runs
+func (bgp *BGP) DeleteNeighbor(ipaddr string) {
+	bgp.neighborLock.Lock()
+	peers := []string{}
+	for _, peer := range bgp.peers {
+		if peer != ipaddr {
+			peers = append(peers, peer)
+		}
+	}
+	bgp.peers = peers
+	delete(bgp.neighbors, ipaddr)
+	bgp.removeBFDSession(ipaddr)
+	delete(bgp.bfdPeers, ipaddr)
+	bgp.neighborLock.Unlock()
+
+	bgp.RemoveBGPNeighbor(ipaddr)
+}
+
 func (bgp *BGP) addv4Route(prefix string) {
 	Logger.Debug("bgp: Adding IPv4 prefix " + prefix)
 	bgp.cmdToPeer <- bgp2go.BGPProcessMsg{
@@ -154,13 +402,39 @@ func (bgp *BGP) addv6Route(prefix string) {
 	}
 }
 
-func (bgp *BGP) AddRoute(prefix string) {
+// Announces prefix on behalf of service; the service name can be matched
+// by the export policies of the peers
+func (bgp *BGP) AddRoute(prefix, service string) {
+	bgp.AddRoutePath(prefix, service, 0, "")
+}
+
+// Announces a path of prefix, for the peers with ADD-PATH enabled for its
+// family. Paths with another pathID are announced next to it; pathID 0 is
+// the path announced by AddRoute. An empty nextHop uses the next hop of
+// the peer
+func (bgp *BGP) AddRoutePath(prefix, service string, pathID uint32, nextHop string) {
 	prefix = add_cidr_mask(prefix)
+	route := prefix + routePathMeta(pathID, nextHop)
+	if service != "" {
+		route = route + " service=" + service
+	}
 	if strings.Contains(prefix, ":") {
-		bgp.addv6Route(prefix)
+		bgp.addv6Route(route)
 	} else {
-		bgp.addv4Route(prefix)
+		bgp.addv4Route(route)
+	}
+}
+
+// Returns the route meta which selects a path of a prefix
+func routePathMeta(pathID uint32, nextHop string) string {
+	meta := ""
+	if pathID != 0 {
+		meta = meta + " path_id=" + strconv.FormatUint(uint64(pathID), 10)
 	}
+	if nextHop != "" {
+		meta = meta + " next_hop=" + nextHop
+	}
+	return meta
 }
 
 func (bgp *BGP) removev4Route(prefix string) {
@@ -180,10 +454,103 @@ func (bgp *BGP) removev6Route(prefix string) {
 }
 
 func (bgp *BGP) RemoveRoute(prefix string) {
+	bgp.RemoveRoutePath(prefix, 0)
+}
+
+// Withdraws the path of prefix announced by AddRoutePath
+func (bgp *BGP) RemoveRoutePath(prefix string, pathID uint32) {
 	prefix = add_cidr_mask(prefix)
+	route := prefix + routePathMeta(pathID, "")
 	if strings.Contains(prefix, ":") {
-		bgp.removev6Route(prefix)
+		bgp.removev6Route(route)
 	} else {
-		bgp.removev4Route(prefix)
+		bgp.removev4Route(route)
+	}
+}
+
+// Shuts down the session to a neighbor, sending it message as the RFC 8203
+// shutdown communication. The session stays down until UndrainNeighbor.
+func (bgp *BGP) DrainNeighbor(ipaddr, message string) error {
+	if _, err := bgp2go.EncodeShutdownCommunication(message); err != nil {
+		return fmt.Errorf("BGP.DrainNeighbor: %v", strings.TrimSpace(err.Error()))
+	}
+	Logger.Info("bgp: Draining neighbor " + ipaddr + ": " + message)
+	bgp.cmdToPeer <- bgp2go.BGPProcessMsg{
+		Cmnd: "ShutdownNeighbour",
+		Data: strings.TrimSpace(neighborAddress(ipaddr) + " " + message),
+	}
+	return nil
+}
+
+func (bgp *BGP) UndrainNeighbor(ipaddr string) {
+	Logger.Info("bgp: Undraining neighbor " + ipaddr)
+	bgp.cmdToPeer <- bgp2go.BGPProcessMsg{
+		Cmnd: "EnableNeighbour",
+		Data: neighborAddress(ipaddr),
+	}
+}
+
+// Returns the routes received from a neighbor, or from all neighbors if
+// ipaddr is empty
+func (bgp *BGP) AdjRIBIn(ipaddr string) ([]bgp2go.AdjRIBInEntry, error) {
+	var (
+		routes []bgp2go.AdjRIBInEntry
+	)
+
+	neighbor := ""
+	if ipaddr != "" {
+		neighbor = neighborAddress(ipaddr)
 	}
+
+	// responses are not tagged, so only one query can be in flight
+	bgp.queryLock.Lock()
+	defer bgp.queryLock.Unlock()
+
+	bgp.cmdToPeer <- bgp2go.BGPProcessMsg{
+		Cmnd: "GetAdjRIBIn",
+		Data: neighbor,
+	}
+	response := <-bgp.cmdFromPeer
+	if response.Cmnd != "AdjRIBIn" {
+		return nil, errors.New("BGP.AdjRIBIn: " + response.Data)
+	}
+
+	if err := json.Unmarshal([]byte(response.Data), &routes); err != nil {
+		return nil, fmt.Errorf("BGP.AdjRIBIn: %v", err)
+	}
+
+	for i := range routes {
+		routes[i].Neighbour = strings.Trim(routes[i].Neighbour, "[]")
+	}
+
+	return routes, nil
+}
+
+// Returns the number of routes received from each neighbor
+func (bgp *BGP) adjRIBInCounts() (map[string]int, error) {
+	var (
+		counts map[string]int
+	)
+
+	bgp.queryLock.Lock()
+	defer bgp.queryLock.Unlock()
+
+	bgp.cmdToPeer <- bgp2go.BGPProcessMsg{
+		Cmnd: "GetAdjRIBInCounts",
+	}
+	response := <-bgp.cmdFromPeer
+	if response.Cmnd != "AdjRIBInCounts" {
+		return nil, errors.New("BGP.adjRIBInCounts: " + response.Data)
+	}
+
+	if err := json.Unmarshal([]byte(response.Data), &counts); err != nil {
+		return nil, fmt.Errorf("BGP.adjRIBInCounts: %v", err)
+	}
+
+	result := make(map[string]int)
+	for neighbor, count := range counts {
+		result[strings.Trim(neighbor, "[]")] = count
+	}
+
+	return result, nil
 }
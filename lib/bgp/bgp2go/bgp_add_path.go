@@ -0,0 +1,159 @@
+package bgp2go
+
+/*
+	add path (rfc 7911) send support: same prefix could be added several
+	times w/ different path ids (e.g. blue/green instances of the service
+	w/ different next hops). neighbours, which have negotiated add path for
+	the afi/safi, rcv all the paths; others rcv only the best one (first
+	path of the prefix in rib). we never ask neighbours to send us
+	multiple paths
+*/
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	//route meta's keys; path id of the route and its next hop
+	ROUTE_META_PATH_ID  = "path_id"
+	ROUTE_META_NEXT_HOP = "next_hop"
+)
+
+func checkAddPath(neighbourCfg *BGPNeighbourCfg) error {
+	for _, afi := range neighbourCfg.AddPath {
+		if _, exists := name2AFI[afi]; !exists {
+			return fmt.Errorf("unknown add path afi: %v\n", afi)
+		}
+	}
+	return nil
+}
+
+func addPathCaps(names []string) []MPCapability {
+	mpCaps := make([]MPCapability, 0)
+	for _, afi := range names {
+		if val, exists := name2AFI[afi]; exists {
+			mpCaps = append(mpCaps, val)
+		}
+	}
+	return mpCaps
+}
+
+/*
+	path id and next hop of the route, passed in route's meta
+	(e.g. "192.168.0.1/32 path_id=2 next_hop=10.0.0.2")
+*/
+func parseRoutePath(meta map[string]string) (uint32, error) {
+	var pathID uint32
+	if val, exists := meta[ROUTE_META_PATH_ID]; exists {
+		id, err := strconv.ParseUint(val, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("cant parse path id: %v\n", err)
+		}
+		pathID = uint32(id)
+	}
+	if nh, exists := meta[ROUTE_META_NEXT_HOP]; exists && net.ParseIP(nh) == nil {
+		return 0, fmt.Errorf("cant parse next hop: %v\n", nh)
+	}
+	return pathID, nil
+}
+
+/*
+	routes' meta is stored per path; path w/ zero id uses prefix as the key,
+	so routes w/o path id are handled as before
+*/
+func v4PathToString(nlri IPV4_NLRI) string {
+	if nlri.PathID == 0 {
+		return v4PrefixToString(nlri)
+	}
+	return fmt.Sprintf("%s#%d", v4PrefixToString(nlri), nlri.PathID)
+}
+
+func v6PathToString(nlri IPV6_NLRI) string {
+	if nlri.PathID == 0 {
+		return v6PrefixToString(nlri)
+	}
+	return fmt.Sprintf("%s#%d", v6PrefixToString(nlri), nlri.PathID)
+}
+
+/*
+	best path is the first path of the prefix in rib; if exclude is true,
+	path w/ ipv4's path id is skipped (used to find path, which is going to
+	replace the best one after withdraw)
+*/
+func (context *BGPContext) bestV4Path(ipv4 IPV4_NLRI, exclude bool) (IPV4_NLRI, bool) {
+	for _, nlri := range context.RIBv4 {
+		if nlri.Prefix != ipv4.Prefix || nlri.Length != ipv4.Length {
+			continue
+		}
+		if exclude && nlri.PathID == ipv4.PathID {
+			continue
+		}
+		return nlri, true
+	}
+	return IPV4_NLRI{}, false
+}
+
+func (context *BGPContext) bestV6Path(ipv6 IPV6_NLRI, exclude bool) (IPV6_NLRI, bool) {
+	for _, nlri := range context.RIBv6 {
+		if !nlri.Prefix.isEqual(ipv6.Prefix) || nlri.Length != ipv6.Length {
+			continue
+		}
+		if exclude && nlri.PathID == ipv6.PathID {
+			continue
+		}
+		return nlri, true
+	}
+	return IPV6_NLRI{}, false
+}
+
+func (context *BGPContext) shouldAdvertiseV4(neighbour *BGPNeighbour, ipv4 IPV4_NLRI) bool {
+	if neighbour.addPathInet {
+		return true
+	}
+	best, _ := context.bestV4Path(ipv4, false)
+	return best == ipv4
+}
+
+func (context *BGPContext) shouldAdvertiseV6(neighbour *BGPNeighbour, ipv6 IPV6_NLRI) bool {
+	if neighbour.addPathInet6 {
+		return true
+	}
+	best, _ := context.bestV6Path(ipv6, false)
+	return best == ipv6
+}
+
+func (context *BGPNeighbourContext) generateAddPathCaps() []AddPathCapability {
+	addPaths := make([]AddPathCapability, 0)
+	for _, mpCap := range context.AddPath {
+		addPaths = append(addPaths, AddPathCapability{AFI: mpCap.AFI,
+			SAFI: mpCap.SAFI, Flags: ADD_PATH_SEND})
+	}
+	return addPaths
+}
+
+/*
+	we could send multiple paths for afi/safi only if neighbour is able
+	to rcv em
+*/
+func (context *BGPNeighbourContext) negotiateAddPath(addPaths []AddPathCapability) {
+	for _, addPath := range addPaths {
+		if addPath.Flags&ADD_PATH_RECEIVE == 0 {
+			continue
+		}
+		mpCap := MPCapability{AFI: addPath.AFI, SAFI: addPath.SAFI}
+		if !capInList(mpCap, context.AddPath) {
+			continue
+		}
+		if isMPCapabilityEqual(mpCap, mpCapInet) {
+			context.addPathInet = true
+			context.ToMainContext <- BGPCommand{From: context.NeighbourAddr,
+				Cmnd: "addPathInet"}
+		} else if isMPCapabilityEqual(mpCap, mpCapInet6) {
+			context.addPathInet6 = true
+			context.ToMainContext <- BGPCommand{From: context.NeighbourAddr,
+				Cmnd: "addPathInet6"}
+		}
+	}
+}
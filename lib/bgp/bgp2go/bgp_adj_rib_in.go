@@ -0,0 +1,197 @@
+package bgp2go
+
+/*
+	Adj-RIB-In: routes, which we have rcved from the neighbours (rfc 4271 3.2).
+	it's shared between neighbour contexts (which are adding routes into it)
+	and main context (which clears it when session goes down and answers
+	queries from external apps), so access is guarded by mutex
+*/
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type AdjRIBInEntry struct {
+	Neighbour   string    `json:"neighbour" yaml:"neighbour"`
+	Prefix      string    `json:"prefix" yaml:"prefix"`
+	NextHop     string    `json:"nextHop" yaml:"nextHop"`
+	Origin      uint8     `json:"origin" yaml:"origin"`
+	ASPath      []uint32  `json:"asPath,omitempty" yaml:"asPath,omitempty"`
+	MED         uint32    `json:"med,omitempty" yaml:"med,omitempty"`
+	LocalPref   uint32    `json:"localPref,omitempty" yaml:"localPref,omitempty"`
+	Communities []string  `json:"communities,omitempty" yaml:"communities,omitempty"`
+	Received    time.Time `json:"received" yaml:"received"`
+}
+
+type AdjRIBIn struct {
+	sync.Mutex
+	//max amount of prefixes per neighbour; 0 - unlimited
+	Limit  int
+	routes map[string]map[string]AdjRIBInEntry
+	//neighbours, for which we have already reported that limit was reached
+	overLimit map[string]bool
+}
+
+func NewAdjRIBIn(limit int) *AdjRIBIn {
+	return &AdjRIBIn{
+		Limit:     limit,
+		routes:    make(map[string]map[string]AdjRIBInEntry),
+		overLimit: make(map[string]bool),
+	}
+}
+
+func v4PrefixToString(nlri IPV4_NLRI) string {
+	return fmt.Sprintf("%s/%d", Uint32IPv4ToString(nlri.Prefix), nlri.Length)
+}
+
+func v6PrefixToString(nlri IPV6_NLRI) string {
+	return fmt.Sprintf("%s/%d", IPv6AddrToIP(nlri.Prefix).String(), nlri.Length)
+}
+
+func routeToAdjRIBInEntry(neighbour string, bgpRoute *BGPRoute) AdjRIBInEntry {
+	entry := AdjRIBInEntry{
+		Neighbour: neighbour,
+		Origin:    bgpRoute.ORIGIN,
+		MED:       bgpRoute.MULTI_EXIT_DISC,
+		LocalPref: bgpRoute.LOCAL_PREF,
+		Received:  time.Now(),
+	}
+	for _, segment := range bgpRoute.AS_PATH {
+		entry.ASPath = append(entry.ASPath, segment.PSValue...)
+	}
+	for _, community := range bgpRoute.Community {
+		asn, cpart := CommunityPrettyPrint(community)
+		entry.Communities = append(entry.Communities, fmt.Sprintf("%d:%d", asn, cpart))
+	}
+	return entry
+}
+
+/*
+	adds rcved routes and removes withdrawn ones. returns true if we have
+	just reached the limit and some of the routes wasnt stored
+*/
+func (rib *AdjRIBIn) Update(neighbour string, bgpRoute *BGPRoute) bool {
+	rib.Lock()
+	defer rib.Unlock()
+	routes, exists := rib.routes[neighbour]
+	if !exists {
+		routes = make(map[string]AdjRIBInEntry)
+		rib.routes[neighbour] = routes
+	}
+	for _, nlri := range bgpRoute.WithdrawRoutes {
+		delete(routes, v4PrefixToString(nlri))
+	}
+	for _, nlri := range bgpRoute.WithdrawRoutesV6 {
+		delete(routes, v6PrefixToString(nlri))
+	}
+	if len(bgpRoute.Routes) == 0 && len(bgpRoute.RoutesV6) == 0 {
+		return false
+	}
+	entry := routeToAdjRIBInEntry(neighbour, bgpRoute)
+	v4Entry := entry
+	if bgpRoute.Flags.ExtendedNextHop {
+		v4Entry.NextHop = IPv6AddrToIP(bgpRoute.NEXT_HOPv6).String()
+	} else if len(bgpRoute.NEXT_HOP) == FOUR_OCTETS {
+		nh, _ := DecodeV4NextHop(bgpRoute)
+		v4Entry.NextHop = Uint32IPv4ToString(nh)
+	} else {
+		v4Entry.NextHop = Uint32IPv4ToString(bgpRoute.NEXT_HOPv4)
+	}
+	v6Entry := entry
+	v6Entry.NextHop = IPv6AddrToIP(bgpRoute.NEXT_HOPv6).String()
+	limitReached := false
+	for _, nlri := range bgpRoute.Routes {
+		prefix := v4PrefixToString(nlri)
+		if !rib.store(routes, prefix, v4Entry) {
+			limitReached = true
+		}
+	}
+	for _, nlri := range bgpRoute.RoutesV6 {
+		prefix := v6PrefixToString(nlri)
+		if !rib.store(routes, prefix, v6Entry) {
+			limitReached = true
+		}
+	}
+	if limitReached && !rib.overLimit[neighbour] {
+		rib.overLimit[neighbour] = true
+		return true
+	}
+	return false
+}
+
+func (rib *AdjRIBIn) store(routes map[string]AdjRIBInEntry, prefix string,
+	entry AdjRIBInEntry) bool {
+	if _, exists := routes[prefix]; !exists && rib.Limit > 0 && len(routes) >= rib.Limit {
+		return false
+	}
+	entry.Prefix = prefix
+	routes[prefix] = entry
+	return true
+}
+
+//session w/ neighbour went down; all of its routes are not valid anymore
+func (rib *AdjRIBIn) Clear(neighbour string) {
+	rib.Lock()
+	defer rib.Unlock()
+	delete(rib.routes, neighbour)
+	delete(rib.overLimit, neighbour)
+}
+
+func (rib *AdjRIBIn) Count(neighbour string) int {
+	rib.Lock()
+	defer rib.Unlock()
+	return len(rib.routes[neighbour])
+}
+
+func (rib *AdjRIBIn) Counts() map[string]int {
+	rib.Lock()
+	defer rib.Unlock()
+	counts := make(map[string]int)
+	for neighbour, routes := range rib.routes {
+		counts[neighbour] = len(routes)
+	}
+	return counts
+}
+
+/*
+	routes rcved from the neighbour (or from all of them if neighbour is "");
+	sorted by neighbour and prefix
+*/
+func (rib *AdjRIBIn) Routes(neighbour string) []AdjRIBInEntry {
+	rib.Lock()
+	defer rib.Unlock()
+	entries := make([]AdjRIBInEntry, 0)
+	for ribNeighbour, routes := range rib.routes {
+		if neighbour != "" && neighbour != ribNeighbour {
+			continue
+		}
+		for _, entry := range routes {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Neighbour != entries[j].Neighbour {
+			return entries[i].Neighbour < entries[j].Neighbour
+		}
+		return entries[i].Prefix < entries[j].Prefix
+	})
+	return entries
+}
+
+func (context *BGPNeighbourContext) storeRcvedRoute(bgpRoute *BGPRoute) {
+	limitReached := false
+	routes := context.InboundPolicy.Filter(bgpRoute, context.ASN)
+	for n := range routes {
+		if context.AdjRIBIn.Update(context.NeighbourAddr, &routes[n]) {
+			limitReached = true
+		}
+	}
+	if limitReached {
+		context.emitEvent("AdjRIBInLimit",
+			fmt.Sprintf("limit of %d prefixes reached; new prefixes are ignored",
+				context.AdjRIBIn.Limit))
+	}
+}
@@ -11,12 +11,23 @@ import (
 */
 
 const (
-	CAPABILITIES_OPTIONAL_PARAM = 2
-	CAPABILITY_MP_EXTENSION     = 1
-	CAPABILITY_GRACEFUL_RESTART = 64
-	CAPABILITY_AS4_NUMBER       = 65
-	CAPABILITY_ADD_PATH         = 69
-	MAX_UINT8                   = 255
+	CAPABILITIES_OPTIONAL_PARAM       = 2
+	CAPABILITY_MP_EXTENSION           = 1
+	CAPABILITY_ROUTE_REFRESH          = 2
+	CAPABILITY_EXTENDED_NEXT_HOP      = 5
+	CAPABILITY_GRACEFUL_RESTART       = 64
+	CAPABILITY_AS4_NUMBER             = 65
+	CAPABILITY_ADD_PATH               = 69
+	CAPABILITY_ENHANCED_ROUTE_REFRESH = 70
+	CAPABILITY_ROUTE_REFRESH_PRESTD   = 128
+	MAX_UINT8                         = 255
+)
+
+//send/receive field of add path capability (rfc 7911)
+const (
+	ADD_PATH_RECEIVE      = 1
+	ADD_PATH_SEND         = 2
+	ADD_PATH_SEND_RECEIVE = 3
 )
 
 const (
@@ -36,10 +47,15 @@ type Capability struct {
 	myasn field of open msg, or AS_TRANS(23456) if our asn > 65535
 */
 type BGPCapabilities struct {
-	SupportASN4 bool
-	ASN4        uint32
-	AddPath     uint8
-	SupportGR   bool
+	SupportASN4                 bool
+	ASN4                        uint32
+	SupportGR                   bool
+	SupportRouteRefresh         bool
+	SupportEnhancedRouteRefresh bool
+	//afi/safi, which could be advertised w/ next hop of other afi
+	ExtendedNextHop []ExtendedNHCapability
+	//afi/safi, for which multiple paths could be sent/rcved (rfc 7911)
+	AddPath []AddPathCapability
 }
 
 //Multiprotocol Extension
@@ -52,11 +68,18 @@ type MPCapability struct {
 //ADDPath
 type AddPathCapability struct {
 	AFI  uint16
-	SAFI uint16
+	SAFI uint8
 	/* Send/Recv/both */
 	Flags uint8
 }
 
+//Extended Next Hop Encoding (rfc 8950)
+type ExtendedNHCapability struct {
+	AFI   uint16
+	SAFI  uint16
+	NHAFI uint16
+}
+
 //Graceful Restart
 type GRCapability struct {
 	FlagsAndTime uint16
@@ -138,7 +161,7 @@ func EncodeCapability(capability Capability, data []byte) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	err := binary.Write(buf, binary.BigEndian, &capability)
 	if err != nil {
-		return nil, fmt.Errorf("error during capability encoding: %v\n")
+		return nil, fmt.Errorf("error during capability encoding: %v\n", err)
 	}
 	encodedCap := append(buf.Bytes(), data...)
 	return encodedCap, nil
@@ -188,23 +211,19 @@ func DecodeASN4Capabiltiy(encAsn4 []byte) (uint32, error) {
 	return asn4, nil
 }
 
-/*
-	TODO: right now i've implemented only capability anounce;
-	no actual encoding for nlri w/ add path has been implemented yet
-*/
 func EncodeAddPathCapability(addPaths []AddPathCapability) ([]byte, error) {
 	buf := new(bytes.Buffer)
-	encodedAddPaths := make([]byte, 0)
 	for _, addPath := range addPaths {
 		err := binary.Write(buf, binary.BigEndian, &addPath)
 		if err != nil {
 			return nil, fmt.Errorf("cant encode AddPath: %v\n", err)
 		}
-		encodedAddPaths = append(encodedAddPaths, buf.Bytes()...)
 	}
-	//TODO: check that len of encodedAddPaths is less than 255
+	if buf.Len() > MAX_UINT8 {
+		return nil, fmt.Errorf("too many afi/safi in AddPath capability\n")
+	}
 	capability, err := EncodeCapability(Capability{Code: CAPABILITY_ADD_PATH},
-		encodedAddPaths)
+		buf.Bytes())
 	if err != nil {
 		return nil, fmt.Errorf("cant encode AddPath capabiltiy: %v\n", err)
 	}
@@ -215,8 +234,9 @@ func EncodeAddPathCapability(addPaths []AddPathCapability) ([]byte, error) {
 func DecodeAddPathCapability(capability []byte) ([]AddPathCapability, error) {
 	addPathList := make([]AddPathCapability, 0)
 	addPath := AddPathCapability{}
-	if len(capability) < FIVE_OCTETS {
-		return nil, fmt.Errorf("incorrect add path capability lenght (<5)\n")
+	if len(capability) == 0 || len(capability)%FOUR_OCTETS != 0 {
+		return nil, fmt.Errorf("incorrect add path capability length: %v\n",
+			len(capability))
 	}
 	for len(capability) > 0 {
 		err := binary.Read(bytes.NewReader(capability), binary.BigEndian, &addPath)
@@ -224,12 +244,45 @@ func DecodeAddPathCapability(capability []byte) ([]AddPathCapability, error) {
 			return nil, fmt.Errorf("cant decode add path capability: %v\n", err)
 		}
 		addPathList = append(addPathList, addPath)
-		capability = capability[FIVE_OCTETS:]
+		capability = capability[FOUR_OCTETS:]
 	}
 
 	return addPathList, nil
 }
 
+func EncodeExtendedNHCapability(extNHs []ExtendedNHCapability) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, extNH := range extNHs {
+		err := binary.Write(buf, binary.BigEndian, &extNH)
+		if err != nil {
+			return nil, fmt.Errorf("cant encode extended next hop: %v\n", err)
+		}
+	}
+	capability, err := EncodeCapability(Capability{Code: CAPABILITY_EXTENDED_NEXT_HOP},
+		buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("cant encode extended next hop capability: %v\n", err)
+	}
+	return capability, nil
+}
+
+func DecodeExtendedNHCapability(capability []byte) ([]ExtendedNHCapability, error) {
+	extNHs := make([]ExtendedNHCapability, 0)
+	if len(capability) == 0 || len(capability)%SIX_OCTETS != 0 {
+		return nil, fmt.Errorf("incorrect extended next hop capability length\n")
+	}
+	for len(capability) > 0 {
+		extNH := ExtendedNHCapability{}
+		err := binary.Read(bytes.NewReader(capability), binary.BigEndian, &extNH)
+		if err != nil {
+			return nil, fmt.Errorf("cant decode extended next hop capability: %v\n", err)
+		}
+		extNHs = append(extNHs, extNH)
+		capability = capability[SIX_OCTETS:]
+	}
+	return extNHs, nil
+}
+
 /* Error to handle EOR Marker */
 type EndOfRib struct {
 	eor bool
@@ -268,3 +321,25 @@ func EncodeGRCapability(cap GRCapability) ([]byte, error) {
 	}
 	return capability, nil
 }
+
+/*
+	Route Refresh (rfc 2918) and Enhanced Route Refresh (rfc 7313)
+	capabilities dont carry any data; it's enough to advertise the code
+*/
+func EncodeRouteRefreshCapability() ([]byte, error) {
+	capability, err := EncodeCapability(Capability{Code: CAPABILITY_ROUTE_REFRESH},
+		[]byte{})
+	if err != nil {
+		return nil, fmt.Errorf("cant encode route refresh capability: %v\n", err)
+	}
+	return capability, nil
+}
+
+func EncodeEnhancedRouteRefreshCapability() ([]byte, error) {
+	capability, err := EncodeCapability(Capability{Code: CAPABILITY_ENHANCED_ROUTE_REFRESH},
+		[]byte{})
+	if err != nil {
+		return nil, fmt.Errorf("cant encode enhanced route refresh capability: %v\n", err)
+	}
+	return capability, nil
+}
@@ -0,0 +1,575 @@
+package bgp2go
+
+/*
+	flow specification (rfc 8955 for ipv4, rfc 8956 for ipv6). only
+	components, which we need to describe the traffic to our own prefixes,
+	are supported: prefixes, protocol, ports and packet length. actions are
+	sent as extended communities (traffic-rate w/ zero rate means discard)
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	//component types
+	FLOWSPEC_DST_PREFIX       = 1
+	FLOWSPEC_SRC_PREFIX       = 2
+	FLOWSPEC_IP_PROTO         = 3
+	FLOWSPEC_PORT             = 4
+	FLOWSPEC_DST_PORT         = 5
+	FLOWSPEC_SRC_PORT         = 6
+	FLOWSPEC_ICMP_TYPE        = 7
+	FLOWSPEC_ICMP_CODE        = 8
+	FLOWSPEC_TCP_FLAGS        = 9
+	FLOWSPEC_PACKET_LENGTH    = 10
+	FLOWSPEC_DSCP             = 11
+	FLOWSPEC_FRAGMENT         = 12
+	FLOWSPEC_FLOW_LABEL       = 13
+	FLOWSPEC_MAX_NLRI_LEN     = 4095
+	FLOWSPEC_EXT_NLRI_LEN     = 240
+	FLOWSPEC_EXT_NLRI_LEN_BIT = 0xf000
+
+	//numeric operator: <end of list><and><len (2 bits)><0><lt><gt><eq>
+	FLOWSPEC_OP_END = 0x80
+	FLOWSPEC_OP_AND = 0x40
+	FLOWSPEC_OP_LEN = 0x30
+	FLOWSPEC_OP_LT  = 0x04
+	FLOWSPEC_OP_GT  = 0x02
+	FLOWSPEC_OP_EQ  = 0x01
+
+	//traffic-rate-bytes (rfc 8955 7.3); rate is ieee float, bytes per second
+	EXT_COMMUNITY_TRAFFIC_RATE = 0x8006
+)
+
+/*
+	value matches if it's lt/gt/eq (or combination of em) Value. list of
+	matches is ORed, unless And is set (then match is ANDed w/ previous one)
+*/
+type FlowSpecNumeric struct {
+	Op    uint8
+	And   bool
+	Value uint64
+}
+
+type FlowSpecRule struct {
+	AFI              uint16
+	Destination      *net.IPNet
+	Source           *net.IPNet
+	Protocols        []FlowSpecNumeric
+	Ports            []FlowSpecNumeric
+	DestinationPorts []FlowSpecNumeric
+	SourcePorts      []FlowSpecNumeric
+	PacketLengths    []FlowSpecNumeric
+	//bytes per second; zero rate discards all matching traffic
+	RateLimit float32
+}
+
+var flowSpecOps = []struct {
+	name string
+	op   uint8
+}{
+	{">=", FLOWSPEC_OP_GT | FLOWSPEC_OP_EQ},
+	{"<=", FLOWSPEC_OP_LT | FLOWSPEC_OP_EQ},
+	{"!=", FLOWSPEC_OP_LT | FLOWSPEC_OP_GT},
+	{">", FLOWSPEC_OP_GT},
+	{"<", FLOWSPEC_OP_LT},
+	{"=", FLOWSPEC_OP_EQ},
+}
+
+/*
+	parses numeric match in the form of "53", ">=1024", "!=80" or
+	range "1024-65535"
+*/
+func ParseFlowSpecNumeric(expr string) ([]FlowSpecNumeric, error) {
+	expr = strings.TrimSpace(expr)
+	if bounds := strings.SplitN(expr, "-", 2); len(bounds) == 2 {
+		low, err := strconv.ParseUint(bounds[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cant parse range: %v\n", expr)
+		}
+		high, err := strconv.ParseUint(bounds[1], 10, 64)
+		if err != nil || high < low {
+			return nil, fmt.Errorf("cant parse range: %v\n", expr)
+		}
+		return []FlowSpecNumeric{
+			FlowSpecNumeric{Op: FLOWSPEC_OP_GT | FLOWSPEC_OP_EQ, Value: low},
+			FlowSpecNumeric{Op: FLOWSPEC_OP_LT | FLOWSPEC_OP_EQ, Value: high, And: true},
+		}, nil
+	}
+	op := uint8(FLOWSPEC_OP_EQ)
+	for _, flowSpecOp := range flowSpecOps {
+		if strings.HasPrefix(expr, flowSpecOp.name) {
+			op = flowSpecOp.op
+			expr = expr[len(flowSpecOp.name):]
+			break
+		}
+	}
+	value, err := strconv.ParseUint(expr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("cant parse numeric match: %v\n", expr)
+	}
+	return []FlowSpecNumeric{FlowSpecNumeric{Op: op, Value: value}}, nil
+}
+
+func encodeFlowSpecPrefix(afi uint16, compType uint8, prefix *net.IPNet) ([]byte, error) {
+	ip := prefix.IP.To4()
+	if afi == MP_AFI_IPV6 {
+		ip = prefix.IP.To16()
+		if prefix.IP.To4() != nil {
+			ip = nil
+		}
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("prefix %v is not of rule's afi\n", prefix)
+	}
+	length, _ := prefix.Mask.Size()
+	encoded := []byte{compType, uint8(length)}
+	if afi == MP_AFI_IPV6 {
+		//rfc 8956: offset of the pattern; we always match from the first bit
+		encoded = append(encoded, 0)
+	}
+	return append(encoded, ip.Mask(prefix.Mask)[:(length+7)/8]...), nil
+}
+
+func encodeFlowSpecNumeric(compType uint8, matches []FlowSpecNumeric) ([]byte, error) {
+	encoded := []byte{compType}
+	for n, match := range matches {
+		op := match.Op & (FLOWSPEC_OP_LT | FLOWSPEC_OP_GT | FLOWSPEC_OP_EQ)
+		if match.And && n != 0 {
+			op |= FLOWSPEC_OP_AND
+		}
+		if n == len(matches)-1 {
+			op |= FLOWSPEC_OP_END
+		}
+		buf := new(bytes.Buffer)
+		var err error
+		switch {
+		case match.Value <= math.MaxUint8:
+			err = binary.Write(buf, binary.BigEndian, uint8(match.Value))
+		case match.Value <= math.MaxUint16:
+			op |= 1 << 4
+			err = binary.Write(buf, binary.BigEndian, uint16(match.Value))
+		case match.Value <= math.MaxUint32:
+			op |= 2 << 4
+			err = binary.Write(buf, binary.BigEndian, uint32(match.Value))
+		default:
+			op |= 3 << 4
+			err = binary.Write(buf, binary.BigEndian, match.Value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cant encode flowspec numeric value: %v\n", err)
+		}
+		encoded = append(encoded, op)
+		encoded = append(encoded, buf.Bytes()...)
+	}
+	return encoded, nil
+}
+
+/*
+	components must be sent in the order of their types (rfc 8955 4.2)
+*/
+func EncodeFlowSpecNLRI(rule FlowSpecRule) ([]byte, error) {
+	encodedRule := make([]byte, 0)
+	for _, prefix := range []struct {
+		compType uint8
+		prefix   *net.IPNet
+	}{
+		{FLOWSPEC_DST_PREFIX, rule.Destination},
+		{FLOWSPEC_SRC_PREFIX, rule.Source},
+	} {
+		if prefix.prefix == nil {
+			continue
+		}
+		encoded, err := encodeFlowSpecPrefix(rule.AFI, prefix.compType, prefix.prefix)
+		if err != nil {
+			return nil, err
+		}
+		encodedRule = append(encodedRule, encoded...)
+	}
+	for _, numeric := range []struct {
+		compType uint8
+		matches  []FlowSpecNumeric
+	}{
+		{FLOWSPEC_IP_PROTO, rule.Protocols},
+		{FLOWSPEC_PORT, rule.Ports},
+		{FLOWSPEC_DST_PORT, rule.DestinationPorts},
+		{FLOWSPEC_SRC_PORT, rule.SourcePorts},
+		{FLOWSPEC_PACKET_LENGTH, rule.PacketLengths},
+	} {
+		if len(numeric.matches) == 0 {
+			continue
+		}
+		encoded, err := encodeFlowSpecNumeric(numeric.compType, numeric.matches)
+		if err != nil {
+			return nil, err
+		}
+		encodedRule = append(encodedRule, encoded...)
+	}
+	if len(encodedRule) == 0 {
+		return nil, fmt.Errorf("flowspec rule w/o components\n")
+	}
+	if len(encodedRule) > FLOWSPEC_MAX_NLRI_LEN {
+		return nil, fmt.Errorf("flowspec rule is too long: %v\n", len(encodedRule))
+	}
+	buf := new(bytes.Buffer)
+	var err error
+	if len(encodedRule) < FLOWSPEC_EXT_NLRI_LEN {
+		err = binary.Write(buf, binary.BigEndian, uint8(len(encodedRule)))
+	} else {
+		err = binary.Write(buf, binary.BigEndian,
+			uint16(FLOWSPEC_EXT_NLRI_LEN_BIT|len(encodedRule)))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cant encode flowspec nlri length: %v\n", err)
+	}
+	return append(buf.Bytes(), encodedRule...), nil
+}
+
+func decodeFlowSpecPrefix(afi uint16, data []byte) (*net.IPNet, int, error) {
+	addrLen := IPV4_ADDRESS_LEN
+	hdrLen := ONE_OCTET
+	if afi == MP_AFI_IPV6 {
+		addrLen = IPV6_ADDRESS_LEN
+		hdrLen = TWO_OCTETS
+	}
+	if len(data) < hdrLen {
+		return nil, 0, fmt.Errorf("flowspec prefix is too short\n")
+	}
+	length := int(data[0])
+	if afi == MP_AFI_IPV6 && data[1] != 0 {
+		return nil, 0, fmt.Errorf("flowspec prefix w/ non zero offset is not supported\n")
+	}
+	prefixBytes := (length + 7) / 8
+	if length > addrLen*8 || len(data) < hdrLen+prefixBytes {
+		return nil, 0, fmt.Errorf("wrong flowspec prefix length: %v\n", length)
+	}
+	ip := make(net.IP, addrLen)
+	copy(ip, data[hdrLen:hdrLen+prefixBytes])
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(length, addrLen*8)},
+		hdrLen + prefixBytes, nil
+}
+
+func decodeFlowSpecNumeric(data []byte) ([]FlowSpecNumeric, int, error) {
+	matches := make([]FlowSpecNumeric, 0)
+	offset := 0
+	for {
+		if len(data) < offset+ONE_OCTET {
+			return nil, 0, fmt.Errorf("flowspec numeric match is too short\n")
+		}
+		op := data[offset]
+		valueLen := 1 << ((op & FLOWSPEC_OP_LEN) >> 4)
+		offset += ONE_OCTET
+		if len(data) < offset+valueLen {
+			return nil, 0, fmt.Errorf("flowspec numeric match is too short\n")
+		}
+		var value uint64
+		for _, octet := range data[offset : offset+valueLen] {
+			value = value<<8 | uint64(octet)
+		}
+		offset += valueLen
+		matches = append(matches, FlowSpecNumeric{
+			Op:    op & (FLOWSPEC_OP_LT | FLOWSPEC_OP_GT | FLOWSPEC_OP_EQ),
+			And:   op&FLOWSPEC_OP_AND != 0,
+			Value: value})
+		if op&FLOWSPEC_OP_END != 0 {
+			return matches, offset, nil
+		}
+	}
+}
+
+func decodeFlowSpecRule(afi uint16, data []byte) (FlowSpecRule, error) {
+	rule := FlowSpecRule{AFI: afi}
+	for len(data) > 0 {
+		compType := data[0]
+		data = data[ONE_OCTET:]
+		var (
+			matches  []FlowSpecNumeric
+			prefix   *net.IPNet
+			consumed int
+			err      error
+		)
+		if compType == FLOWSPEC_DST_PREFIX || compType == FLOWSPEC_SRC_PREFIX {
+			prefix, consumed, err = decodeFlowSpecPrefix(afi, data)
+		} else {
+			//all other components use the same <op><value> format
+			matches, consumed, err = decodeFlowSpecNumeric(data)
+		}
+		if err != nil {
+			return rule, err
+		}
+		data = data[consumed:]
+		switch compType {
+		case FLOWSPEC_DST_PREFIX:
+			rule.Destination = prefix
+		case FLOWSPEC_SRC_PREFIX:
+			rule.Source = prefix
+		case FLOWSPEC_IP_PROTO:
+			rule.Protocols = matches
+		case FLOWSPEC_PORT:
+			rule.Ports = matches
+		case FLOWSPEC_DST_PORT:
+			rule.DestinationPorts = matches
+		case FLOWSPEC_SRC_PORT:
+			rule.SourcePorts = matches
+		case FLOWSPEC_PACKET_LENGTH:
+			rule.PacketLengths = matches
+		}
+	}
+	return rule, nil
+}
+
+func DecodeFlowSpecNLRI(afi uint16, data []byte) ([]FlowSpecRule, error) {
+	rules := make([]FlowSpecRule, 0)
+	if len(data) < ONE_OCTET {
+		return rules, EndOfRib{}
+	}
+	for len(data) > 0 {
+		ruleLen := int(data[0])
+		hdrLen := ONE_OCTET
+		if ruleLen >= FLOWSPEC_EXT_NLRI_LEN {
+			if len(data) < TWO_OCTETS {
+				return rules, fmt.Errorf("flowspec nlri is too short\n")
+			}
+			ruleLen = int(binary.BigEndian.Uint16(data)) &^ FLOWSPEC_EXT_NLRI_LEN_BIT
+			hdrLen = TWO_OCTETS
+		}
+		if len(data) < hdrLen+ruleLen {
+			return rules, fmt.Errorf("flowspec nlri is too short\n")
+		}
+		rule, err := decodeFlowSpecRule(afi, data[hdrLen:hdrLen+ruleLen])
+		if err != nil {
+			return rules, fmt.Errorf("cant decode flowspec nlri: %v", err)
+		}
+		rules = append(rules, rule)
+		data = data[hdrLen+ruleLen:]
+	}
+	return rules, nil
+}
+
+/*
+	flowspec nlri doesnt have next hop; nh length is always zero
+*/
+func EncodeFlowSpec_MP_REACH_NLRI(afi uint16, rules []FlowSpecRule) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	mpReachHdr := MP_REACH_NLRI_HDR{AFI: afi, SAFI: MP_SAFI_FLOWSPEC}
+	err := binary.Write(buf, binary.BigEndian, &mpReachHdr)
+	if err != nil {
+		return nil, err
+	}
+	reserved := uint8(0)
+	err = binary.Write(buf, binary.BigEndian, &reserved)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		encRule, err := EncodeFlowSpecNLRI(rule)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(encRule)
+	}
+	return buf.Bytes(), nil
+}
+
+func EncodeFlowSpec_MP_UNREACH_NLRI(afi uint16, rules []FlowSpecRule) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	mpUnreachHdr := MP_UNREACH_NLRI_HDR{AFI: afi, SAFI: MP_SAFI_FLOWSPEC}
+	err := binary.Write(buf, binary.BigEndian, &mpUnreachHdr)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		encRule, err := EncodeFlowSpecNLRI(rule)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(encRule)
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+	<type 2 octets><asn 2 octets><rate 4 octets>; asn is informational only
+*/
+func FlowSpecTrafficRate(asn uint32, rate float32) uint64 {
+	if asn > math.MaxUint16 {
+		asn = 0
+	}
+	return uint64(EXT_COMMUNITY_TRAFFIC_RATE)<<48 | uint64(asn)<<32 |
+		uint64(math.Float32bits(rate))
+}
+
+/*
+	rules are identified by their nlri; it's used as the key in flowspec rib
+*/
+func flowSpecKey(rule FlowSpecRule) (string, error) {
+	encRule, err := EncodeFlowSpecNLRI(rule)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d %x", rule.AFI, encRule), nil
+}
+
+func (rule FlowSpecRule) String() string {
+	fields := make([]string, 0)
+	if rule.Destination != nil {
+		fields = append(fields, "dst "+rule.Destination.String())
+	}
+	if rule.Source != nil {
+		fields = append(fields, "src "+rule.Source.String())
+	}
+	for _, numeric := range []struct {
+		name    string
+		matches []FlowSpecNumeric
+	}{
+		{"proto", rule.Protocols},
+		{"port", rule.Ports},
+		{"dport", rule.DestinationPorts},
+		{"sport", rule.SourcePorts},
+		{"len", rule.PacketLengths},
+	} {
+		if len(numeric.matches) == 0 {
+			continue
+		}
+		matches := make([]string, 0)
+		for _, match := range numeric.matches {
+			opName := "="
+			for _, flowSpecOp := range flowSpecOps {
+				if flowSpecOp.op == match.Op {
+					opName = flowSpecOp.name
+				}
+			}
+			if match.And {
+				opName = "&" + opName
+			}
+			matches = append(matches, opName+strconv.FormatUint(match.Value, 10))
+		}
+		fields = append(fields, numeric.name+" "+strings.Join(matches, ","))
+	}
+	return strings.Join(fields, " ")
+}
+
+/*
+	Data: json encoded FlowSpecRule. rule w/ the same nlri replaces
+	the old one (e.g. to change the rate)
+*/
+func parseFlowSpecRule(data string) (FlowSpecRule, string, error) {
+	var rule FlowSpecRule
+	err := json.Unmarshal([]byte(data), &rule)
+	if err != nil {
+		return rule, "", fmt.Errorf("cant decode flowspec rule: %v\n", err)
+	}
+	if rule.AFI != MP_AFI_IPV4 && rule.AFI != MP_AFI_IPV6 {
+		return rule, "", fmt.Errorf("unsupported flowspec afi: %v\n", rule.AFI)
+	}
+	key, err := flowSpecKey(rule)
+	if err != nil {
+		return rule, "", err
+	}
+	return rule, key, nil
+}
+
+func (context *BGPContext) findFlowSpec(key string) int {
+	for n, rule := range context.RIBFlowSpec {
+		if ruleKey, _ := flowSpecKey(rule); ruleKey == key {
+			return n
+		}
+	}
+	return -1
+}
+
+func (context *BGPContext) AddFlowSpec(data string) {
+	rule, key, err := parseFlowSpecRule(data)
+	if err != nil {
+		return
+	}
+	if n := context.findFlowSpec(key); n != -1 {
+		if context.RIBFlowSpec[n].RateLimit == rule.RateLimit {
+			return
+		}
+		context.RIBFlowSpec[n] = rule
+	} else {
+		context.RIBFlowSpec = append(context.RIBFlowSpec, rule)
+	}
+	context.AdvertiseFlowSpec(rule)
+}
+
+func (context *BGPContext) WithdrawFlowSpec(data string) {
+	_, key, err := parseFlowSpecRule(data)
+	if err != nil {
+		return
+	}
+	n := context.findFlowSpec(key)
+	if n == -1 {
+		return
+	}
+	rule := context.RIBFlowSpec[n]
+	context.RIBFlowSpec = append(context.RIBFlowSpec[:n], context.RIBFlowSpec[n+1:]...)
+	for i := range context.Neighbours {
+		neighbour := &context.Neighbours[i]
+		if neighbour.State == "Established" && neighbour.speaksFlowSpec(rule.AFI) {
+			neighbour.CmndChan <- BGPCommand{
+				Cmnd:  "WithdrawFlowSpec",
+				Route: BGPRoute{WithdrawFlowSpec: []FlowSpecRule{rule}}}
+		}
+	}
+}
+
+func (neighbour *BGPNeighbour) speaksFlowSpec(afi uint16) bool {
+	if afi == MP_AFI_IPV6 {
+		return neighbour.speaksFlow6
+	}
+	return neighbour.speaksFlow
+}
+
+/*
+	each rule is sent in its own update, coz action (ext community) is
+	per rule
+*/
+func (context *BGPContext) GenerateUpdateFlowSpec(rule FlowSpecRule) BGPRoute {
+	return BGPRoute{
+		ORIGIN:       ORIGIN_IGP,
+		LOCAL_PREF:   context.LocalPref,
+		Community:    context.Community,
+		FlowSpec:     []FlowSpecRule{rule},
+		ExtCommunity: []uint64{FlowSpecTrafficRate(context.ASN, rule.RateLimit)},
+	}
+}
+
+func (context *BGPContext) AdvertiseFlowSpec(rule FlowSpecRule) {
+	for i := range context.Neighbours {
+		neighbour := &context.Neighbours[i]
+		if neighbour.State == "Established" && neighbour.speaksFlowSpec(rule.AFI) {
+			neighbour.CmndChan <- BGPCommand{
+				Cmnd:  "AdvertiseFlowSpec",
+				Route: context.GenerateUpdateFlowSpec(rule)}
+		}
+	}
+}
+
+func (context *BGPContext) AdvertiseAllFlowSpec(neighbour *BGPNeighbour) {
+	context.advertiseAllFlowSpecAFI(neighbour, MP_AFI_IPV4)
+	context.advertiseAllFlowSpecAFI(neighbour, MP_AFI_IPV6)
+}
+
+func (context *BGPContext) advertiseAllFlowSpecAFI(neighbour *BGPNeighbour, afi uint16) {
+	if !neighbour.speaksFlowSpec(afi) {
+		return
+	}
+	for _, rule := range context.RIBFlowSpec {
+		if rule.AFI != afi {
+			continue
+		}
+		neighbour.CmndChan <- BGPCommand{
+			Cmnd:  "AdvertiseFlowSpec",
+			Route: context.GenerateUpdateFlowSpec(rule)}
+	}
+}
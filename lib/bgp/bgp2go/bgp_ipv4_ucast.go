@@ -16,6 +16,15 @@ func EncodeIPv4NLRI(flags RouteFlags, nlris []IPV4_NLRI) ([]byte, error) {
 	encodedNlris := make([]byte, 0)
 	for _, nlri := range nlris {
 		encodingLen := (nlri.Length + 7) / 8
+		var additionalData uint8
+		if flags.WithPathId {
+			//rfc 7911: each nlri is prepended by its own path id
+			err := binary.Write(buf, binary.BigEndian, &nlri.PathID)
+			if err != nil {
+				return nil, fmt.Errorf("cant encode ipv4 nlri's path id: %v\n", err)
+			}
+			additionalData += FOUR_OCTETS
+		}
 		if flags.Labeled {
 			//Size of the label in octets
 			nlri.Length += LABEL_SIZE_BITS
@@ -24,7 +33,6 @@ func EncodeIPv4NLRI(flags RouteFlags, nlris []IPV4_NLRI) ([]byte, error) {
 		if err != nil {
 			return nil, fmt.Errorf("cant encode ipv4 nlri's length: %v\n", err)
 		}
-		var additionalData uint8
 		if flags.Labeled {
 			//mpls label: <20 bits label><3 bits TC(aka exp)><1 bit bos>
 			label := uint32(((nlri.Label << 4) | LABEL_BOS))
@@ -53,20 +61,21 @@ func EncodeIPv4NLRI(flags RouteFlags, nlris []IPV4_NLRI) ([]byte, error) {
 //this is routine for decoding of ipv4 route as mp_reach/unreach nlri
 func DecodeIPv4NLRI(flags RouteFlags, data []byte) ([]IPV4_NLRI, error) {
 	nlris := make([]IPV4_NLRI, 0)
-	var pathID uint32
 	if len(data) < ONE_OCTET {
 		return nlris, EndOfRib{}
 	}
-	if flags.WithPathId {
-		err := binary.Read(bytes.NewReader(data), binary.BigEndian, &pathID)
-		if err != nil {
-			return nlris, fmt.Errorf("cant decode nlri's pathId: %v\n", err)
-		}
-		data = data[FOUR_OCTETS:]
-	}
 	for len(data) > 0 {
 		nlri := IPV4_NLRI{}
-		nlri.PathID = pathID
+		if flags.WithPathId {
+			if len(data) < FOUR_OCTETS+ONE_OCTET {
+				return nlris, fmt.Errorf("ipv4 nlri w/ path id is too short\n")
+			}
+			err := binary.Read(bytes.NewReader(data), binary.BigEndian, &nlri.PathID)
+			if err != nil {
+				return nlris, fmt.Errorf("cant decode nlri's pathId: %v\n", err)
+			}
+			data = data[FOUR_OCTETS:]
+		}
 		err := binary.Read(bytes.NewReader(data), binary.BigEndian, &nlri.Length)
 		if err != nil {
 			return nlris, fmt.Errorf("cant decode ipv4 nlri length: %v\n", err)
@@ -106,36 +115,52 @@ func DecodeIPv4NLRI(flags RouteFlags, data []byte) ([]IPV4_NLRI, error) {
 
 //TODO(tehnerd): accept mp_reach_nlri_hdr as input val for func
 func EncodeIPV4_MP_REACH_NLRI(nh uint32, flags RouteFlags, nlris []IPV4_NLRI) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.BigEndian, &nh)
+	if err != nil {
+		return nil, err
+	}
+	return encodeIPV4_MP_REACH_NLRI(buf.Bytes(), flags, nlris)
+}
+
+/*
+	rfc 8950: v4 nlri w/ v6 next hop; llnh is optional (zero address if
+	we dont share the segment w/ the neighbour)
+*/
+func EncodeExtNHIPV4_MP_REACH_NLRI(nh, llnh IPv6Addr, flags RouteFlags,
+	nlris []IPV4_NLRI) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.BigEndian, &nh)
+	if err != nil {
+		return nil, err
+	}
+	if !llnh.isEqual(IPv6Addr{}) {
+		err = binary.Write(buf, binary.BigEndian, &llnh)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return encodeIPV4_MP_REACH_NLRI(buf.Bytes(), flags, nlris)
+}
+
+func encodeIPV4_MP_REACH_NLRI(nh []byte, flags RouteFlags,
+	nlris []IPV4_NLRI) ([]byte, error) {
 	if len(nlris) < 1 {
 		return nil, fmt.Errorf("zero length NLRIs slice\n")
 	}
 	buf := new(bytes.Buffer)
 	mpReachHdr := MP_REACH_NLRI_HDR{AFI: MP_AFI_IPV4, SAFI: MP_SAFI_UCAST,
-		NHLength: IPV4_ADDRESS_LEN}
+		NHLength: uint8(len(nh))}
 	err := binary.Write(buf, binary.BigEndian, &mpReachHdr)
 	if err != nil {
 		return nil, err
 	}
-	err = binary.Write(buf, binary.BigEndian, &nh)
-	if err != nil {
-		return nil, err
-	}
+	buf.Write(nh)
 	reserved := uint8(0)
 	err = binary.Write(buf, binary.BigEndian, &reserved)
 	if err != nil {
 		return nil, err
 	}
-	if flags.WithPathId {
-		/*
-			we can group nlris into the same slice only if all of em has the same
-			bgp's path attrs and same pathID, so it's safe to only look at first nlri for
-			path's id value
-		*/
-		err = binary.Write(buf, binary.BigEndian, &nlris[0].PathID)
-		if err != nil {
-			return nil, err
-		}
-	}
 	encNLRI, err := EncodeIPv4NLRI(flags, nlris)
 	if err != nil {
 		return nil, err
@@ -165,13 +190,6 @@ func EncodeLabeledIPV4_MP_REACH_NLRI(nh uint32,
 	if err != nil {
 		return nil, err
 	}
-	if flags.WithPathId {
-		/* same logic as above for ipv4 nlri */
-		err = binary.Write(buf, binary.BigEndian, &nlris[0].PathID)
-		if err != nil {
-			return nil, err
-		}
-	}
 	encNLRI, err := EncodeIPv4NLRI(flags, nlris)
 	if err != nil {
 		return nil, err
@@ -180,12 +198,21 @@ func EncodeLabeledIPV4_MP_REACH_NLRI(nh uint32,
 	return mp_reach, nil
 }
 
+/*
+	if nh is v6 (rfc 8950) returned v4 nh is zero; v6 nh could be
+	decoded w/ DecodeIPV6NH
+*/
 func DecodeIPV4_MP_REACH_NLRI(flags RouteFlags,
 	data []byte, mpHdr MP_REACH_NLRI_HDR) (uint32, []IPV4_NLRI, error) {
 	var nh uint32
-	err := binary.Read(bytes.NewReader(data), binary.BigEndian, &nh)
-	if err != nil {
-		return nh, nil, err
+	if len(data) < int(mpHdr.NHLength)+ONE_OCTET {
+		return nh, nil, fmt.Errorf("ipv4 mp_reach_nlri is too short\n")
+	}
+	if mpHdr.NHLength == IPV4_ADDRESS_LEN {
+		err := binary.Read(bytes.NewReader(data), binary.BigEndian, &nh)
+		if err != nil {
+			return nh, nil, err
+		}
 	}
 	/*
 		one_octet -> reserved field
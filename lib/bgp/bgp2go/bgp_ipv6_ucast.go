@@ -8,6 +8,8 @@ import (
 
 const (
 	IPV6_ADDRESS_LEN = 16
+	//global + link local next hops
+	IPV6_LINK_LOCAL_NH_LEN = 32
 )
 
 type IPv6Addr [4]uint32
@@ -22,15 +24,23 @@ func (ipv6 IPv6Addr) isEqual(oIpv6 IPv6Addr) bool {
 type IPV6_NLRI struct {
 	Length uint8
 	Prefix IPv6Addr
+	PathID uint32
 }
 
-//TODO(tehnerd): labeled ipv6 and add path for ipv6
+//TODO(tehnerd): labeled ipv6
 
-//NH_LEN of 16 is hardcoded rightnow; TODO: support for linklocal
-func EncodeIPv6NLRI(nlris []IPV6_NLRI) ([]byte, error) {
+func EncodeIPv6NLRI(flags RouteFlags, nlris []IPV6_NLRI) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	encodedNlris := make([]byte, 0)
 	for _, nlri := range nlris {
+		var additionalData uint8
+		if flags.WithPathId {
+			err := binary.Write(buf, binary.BigEndian, &nlri.PathID)
+			if err != nil {
+				return nil, fmt.Errorf("cant encode ipv6 nlri's path id: %v\n", err)
+			}
+			additionalData += FOUR_OCTETS
+		}
 		err := binary.Write(buf, binary.BigEndian, &nlri.Length)
 		if err != nil {
 			return nil, fmt.Errorf("cant encode ipv6 nlri length: %v\n", err)
@@ -41,20 +51,30 @@ func EncodeIPv6NLRI(nlris []IPV6_NLRI) ([]byte, error) {
 		}
 		encodingLen := (nlri.Length + 7) / 8
 		encodedNlris = append(encodedNlris,
-			buf.Bytes()[:ONE_OCTET+encodingLen]...)
+			buf.Bytes()[:ONE_OCTET+encodingLen+additionalData]...)
 		buf.Reset()
 	}
 	return encodedNlris, nil
 
 }
 
-func DecodeIPv6NLRI(data []byte) ([]IPV6_NLRI, error) {
+func DecodeIPv6NLRI(flags RouteFlags, data []byte) ([]IPV6_NLRI, error) {
 	nlris := make([]IPV6_NLRI, 0)
 	if len(data) < ONE_OCTET {
 		return nlris, EndOfRib{}
 	}
 	for len(data) > 0 {
 		ipv6nlri := IPV6_NLRI{}
+		if flags.WithPathId {
+			if len(data) < FOUR_OCTETS+ONE_OCTET {
+				return nlris, fmt.Errorf("ipv6 nlri w/ path id is too short\n")
+			}
+			err := binary.Read(bytes.NewReader(data), binary.BigEndian, &ipv6nlri.PathID)
+			if err != nil {
+				return nlris, fmt.Errorf("cant decode nlri's pathId: %v\n", err)
+			}
+			data = data[FOUR_OCTETS:]
+		}
 		err := binary.Read(bytes.NewReader(data), binary.BigEndian, &ipv6nlri.Length)
 		if err != nil {
 			return nlris, fmt.Errorf("cant decode ipv6 nlri length: %v\n", err)
@@ -77,9 +97,22 @@ func DecodeIPv6NLRI(data []byte) ([]IPV6_NLRI, error) {
 }
 
 func EncodeIPV6_MP_REACH_NLRI(nh IPv6Addr, nlris []IPV6_NLRI) ([]byte, error) {
+	return EncodeLinkLocalIPV6_MP_REACH_NLRI(nh, IPv6Addr{}, RouteFlags{}, nlris)
+}
+
+/*
+	rfc2545: if we share the segment w/ the neighbour, nh contains both
+	global and link local addresses (nh len is 32). zero llnh means that
+	we dont have link local nh, and only global one is encoded
+*/
+func EncodeLinkLocalIPV6_MP_REACH_NLRI(nh, llnh IPv6Addr, flags RouteFlags,
+	nlris []IPV6_NLRI) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	mpReachHdr := MP_REACH_NLRI_HDR{AFI: MP_AFI_IPV6, SAFI: MP_SAFI_UCAST,
 		NHLength: IPV6_ADDRESS_LEN}
+	if !llnh.isEqual(IPv6Addr{}) {
+		mpReachHdr.NHLength = IPV6_LINK_LOCAL_NH_LEN
+	}
 	err := binary.Write(buf, binary.BigEndian, &mpReachHdr)
 	if err != nil {
 		return nil, err
@@ -88,12 +121,18 @@ func EncodeIPV6_MP_REACH_NLRI(nh IPv6Addr, nlris []IPV6_NLRI) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if mpReachHdr.NHLength == IPV6_LINK_LOCAL_NH_LEN {
+		err = binary.Write(buf, binary.BigEndian, &llnh)
+		if err != nil {
+			return nil, err
+		}
+	}
 	reserved := uint8(0)
 	err = binary.Write(buf, binary.BigEndian, &reserved)
 	if err != nil {
 		return nil, err
 	}
-	encNLRI, err := EncodeIPv6NLRI(nlris)
+	encNLRI, err := EncodeIPv6NLRI(flags, nlris)
 	if err != nil {
 		return nil, err
 	}
@@ -101,34 +140,64 @@ func EncodeIPV6_MP_REACH_NLRI(nh IPv6Addr, nlris []IPV6_NLRI) ([]byte, error) {
 	return mp_reach, nil
 }
 
-func DecodeIPV6_MP_REACH_NLRI(data []byte, mpHdr MP_REACH_NLRI_HDR) (IPv6Addr,
-	[]IPV6_NLRI, error) {
+func DecodeIPV6_MP_REACH_NLRI(flags RouteFlags, data []byte,
+	mpHdr MP_REACH_NLRI_HDR) (IPv6Addr, []IPV6_NLRI, error) {
 	var nh IPv6Addr
+	if mpHdr.NHLength != IPV6_ADDRESS_LEN &&
+		mpHdr.NHLength != IPV6_LINK_LOCAL_NH_LEN {
+		return nh, nil, fmt.Errorf("wrong ipv6 next hop length: %v\n", mpHdr.NHLength)
+	}
+	if len(data) < int(mpHdr.NHLength)+ONE_OCTET {
+		return nh, nil, fmt.Errorf("ipv6 mp_reach_nlri is too short\n")
+	}
 	err := binary.Read(bytes.NewReader(data), binary.BigEndian, &nh)
 	if err != nil {
 		return nh, nil, err
 	}
-	/*
-		TODO: check if len != IPV_ADDRESS_LEN (means that we have encoded link local
-		as well
-		one_octet -> reserved field
-	*/
+	//one_octet -> reserved field
 	data = data[mpHdr.NHLength+ONE_OCTET:]
-	nlris, err := DecodeIPv6NLRI(data)
+	nlris, err := DecodeIPv6NLRI(flags, data)
 	if err != nil {
 		return nh, nil, fmt.Errorf("cant decode ipv6 nlri: %v\n", err)
 	}
 	return nh, nlris, nil
 }
 
-func EncodeIPV6_MP_UNREACH_NLRI(nlris []IPV6_NLRI) ([]byte, error) {
+/*
+	decodes v6 next hop of mp_reach_nlri (could be used for v4 nlri as well,
+	rfc 8950). link local part is zero if nh contains only global address
+*/
+func DecodeIPV6NH(data []byte, mpHdr MP_REACH_NLRI_HDR) (IPv6Addr, IPv6Addr, error) {
+	var nh, llnh IPv6Addr
+	if mpHdr.NHLength != IPV6_ADDRESS_LEN &&
+		mpHdr.NHLength != IPV6_LINK_LOCAL_NH_LEN {
+		return nh, llnh, fmt.Errorf("wrong ipv6 next hop length: %v\n", mpHdr.NHLength)
+	}
+	if len(data) < int(mpHdr.NHLength) {
+		return nh, llnh, fmt.Errorf("ipv6 next hop is too short\n")
+	}
+	err := binary.Read(bytes.NewReader(data), binary.BigEndian, &nh)
+	if err != nil {
+		return nh, llnh, fmt.Errorf("cant decode ipv6 next hop: %v\n", err)
+	}
+	if mpHdr.NHLength == IPV6_LINK_LOCAL_NH_LEN {
+		err = binary.Read(bytes.NewReader(data[IPV6_ADDRESS_LEN:]), binary.BigEndian,
+			&llnh)
+		if err != nil {
+			return nh, llnh, fmt.Errorf("cant decode ipv6 link local next hop: %v\n", err)
+		}
+	}
+	return nh, llnh, nil
+}
+
+func EncodeIPV6_MP_UNREACH_NLRI(flags RouteFlags, nlris []IPV6_NLRI) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	mpUnreachHdr := MP_UNREACH_NLRI_HDR{AFI: MP_AFI_IPV6, SAFI: MP_SAFI_UCAST}
 	err := binary.Write(buf, binary.BigEndian, &mpUnreachHdr)
 	if err != nil {
 		return nil, err
 	}
-	encNLRI, err := EncodeIPv6NLRI(nlris)
+	encNLRI, err := EncodeIPv6NLRI(flags, nlris)
 	if err != nil {
 		return nil, err
 	}
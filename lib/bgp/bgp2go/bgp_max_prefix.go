@@ -0,0 +1,114 @@
+package bgp2go
+
+/*
+	max amount of prefixes, which we are accepting from the neighbour
+	(rfc 4271 6.7 and rfc 4486). we are counting unique prefixes in current
+	session, so it works even if adj-rib-in is disabled
+*/
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	MAX_PREFIX_ACTION_LOG      = "log"
+	MAX_PREFIX_ACTION_TEARDOWN = "teardown"
+	MAX_PREFIX_ACTION_RESTART  = "restart"
+)
+
+type MaxPrefixCfg struct {
+	//0 - unlimited
+	Limit int
+	//in percents of limit; 0 - dont warn
+	WarningThreshold int
+	/*
+		log - just report that limit was reached;
+		teardown - send cease and keep session down until EnableNeighbour;
+		restart - same as teardown, but reenable after RestartInterval
+	*/
+	Action          string
+	RestartInterval time.Duration
+}
+
+/*
+	returns true if session must be teardowned
+*/
+func (context *BGPNeighbourContext) checkMaxPrefix(bgpRoute *BGPRoute) bool {
+	if context.MaxPrefix.Limit <= 0 {
+		return false
+	}
+	if context.rcvedPrefixes == nil {
+		context.rcvedPrefixes = make(map[string]bool)
+	}
+	for _, nlri := range bgpRoute.WithdrawRoutes {
+		delete(context.rcvedPrefixes, v4PrefixToString(nlri))
+	}
+	for _, nlri := range bgpRoute.WithdrawRoutesV6 {
+		delete(context.rcvedPrefixes, v6PrefixToString(nlri))
+	}
+	for _, nlri := range bgpRoute.Routes {
+		context.rcvedPrefixes[v4PrefixToString(nlri)] = true
+	}
+	for _, nlri := range bgpRoute.RoutesV6 {
+		context.rcvedPrefixes[v6PrefixToString(nlri)] = true
+	}
+	rcved := len(context.rcvedPrefixes)
+	limit := context.MaxPrefix.Limit
+	threshold := limit * context.MaxPrefix.WarningThreshold / 100
+	if context.MaxPrefix.WarningThreshold > 0 && rcved >= threshold &&
+		rcved <= limit && !context.maxPrefixWarned {
+		context.maxPrefixWarned = true
+		context.emitEvent("MaxPrefixWarning",
+			fmt.Sprintf("rcved %d prefixes; limit is %d", rcved, limit))
+	}
+	if rcved <= limit || context.maxPrefixExceeded {
+		return false
+	}
+	context.maxPrefixExceeded = true
+	action := context.MaxPrefix.Action
+	if action == "" {
+		action = MAX_PREFIX_ACTION_TEARDOWN
+	}
+	context.emitEvent("MaxPrefixExceeded",
+		fmt.Sprintf("rcved %d prefixes; limit is %d; action: %s", rcved, limit, action))
+	return action != MAX_PREFIX_ACTION_LOG
+}
+
+func (context *BGPNeighbourContext) resetMaxPrefix() {
+	context.rcvedPrefixes = nil
+	context.maxPrefixWarned = false
+	context.maxPrefixExceeded = false
+}
+
+/*
+	neighbour has sent us more prefixes than allowed; dont try to reestablish
+	session until operator (or timer, if action is restart) reenables it
+*/
+func (context *BGPContext) MaxPrefixExceeded(neighbourAddr string) {
+	neighbour, err, _ := context.FindNeighbour(neighbourAddr)
+	if err != nil {
+		return
+	}
+	neighbour.adminDown = true
+	neighbour.maxPrefixDown = true
+	if neighbour.maxPrefix.Action != MAX_PREFIX_ACTION_RESTART {
+		return
+	}
+	go func(toMainContext chan BGPCommand, interval time.Duration) {
+		time.Sleep(interval)
+		toMainContext <- BGPCommand{From: neighbourAddr, Cmnd: "MaxPrefixRestart"}
+	}(context.ToMainContext, neighbour.maxPrefix.RestartInterval)
+}
+
+func (context *BGPContext) MaxPrefixRestart(neighbourAddr string) {
+	neighbour, err, _ := context.FindNeighbour(neighbourAddr)
+	if err != nil {
+		return
+	}
+	//operator could have reenabled or drained the neighbour in the meantime
+	if !neighbour.maxPrefixDown {
+		return
+	}
+	context.EnableNeighbour(neighbourAddr)
+}
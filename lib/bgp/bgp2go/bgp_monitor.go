@@ -0,0 +1,195 @@
+package bgp2go
+
+/*
+	session state and adj-rib-out of the neighbours for external monitoring
+	(e.g. bmp, rfc 7854). msgs are passed in the same form as they were
+	sent/rcved on the wire. unlike events, monitor msgs are never dropped,
+	so reader of the chan must keep up w/ the neighbours
+*/
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+type BGPMonitorMsg struct {
+	Neighbour string
+	//PeerUp, PeerDown or RouteMonitoring
+	Type         string
+	Time         time.Time
+	PeerASN      uint32
+	PeerRouterID uint32
+	ASN4         bool
+	//PeerUp: local side of the session and both open msgs (w/ headers)
+	LocalAddr  string
+	LocalPort  uint16
+	RemotePort uint16
+	SentOpen   []byte
+	RcvdOpen   []byte
+	/*
+		RouteMonitoring: update, which was sent to the neighbour; keys of
+		announced/withdrawn nlris (same nlri always has the same key)
+	*/
+	Update    []byte
+	Announced []string
+	Withdrawn []string
+	/*
+		PeerDown: notification (if any); LocalNotification is true if we have
+		sent it. LocalClose is true if we've closed session w/o notification
+	*/
+	Notification      []byte
+	LocalNotification bool
+	LocalClose        bool
+}
+
+type monitorState struct {
+	up                bool
+	sentOpen          []byte
+	rcvdOpen          []byte
+	peerASN           uint32
+	peerRouterID      uint32
+	localAddr         string
+	localPort         uint16
+	remotePort        uint16
+	notification      []byte
+	localNotification bool
+	localClose        bool
+}
+
+func parsePort(port string) uint16 {
+	val, _ := strconv.ParseUint(port, 10, 16)
+	return uint16(val)
+}
+
+func (context *BGPNeighbourContext) setMonitorAddr(laddr, lport, rport string) {
+	context.monitor.localAddr = laddr
+	context.monitor.localPort = parsePort(lport)
+	context.monitor.remotePort = parsePort(rport)
+}
+
+func (context *BGPNeighbourContext) setMonitorOpen(openMsg OpenMsg, rcvdOpen []byte) {
+	context.monitor.rcvdOpen = append([]byte{}, rcvdOpen...)
+	context.monitor.peerRouterID = openMsg.Hdr.BGPID
+	context.monitor.peerASN = uint32(openMsg.Hdr.MyASN)
+	if openMsg.Caps.SupportASN4 {
+		context.monitor.peerASN = openMsg.Caps.ASN4
+	}
+}
+
+func (context *BGPNeighbourContext) setMonitorNotification(notification []byte, local bool) {
+	context.monitor.notification = append([]byte{}, notification...)
+	context.monitor.localNotification = local
+}
+
+func (context *BGPNeighbourContext) newMonitorMsg(msgType string) BGPMonitorMsg {
+	return BGPMonitorMsg{
+		Neighbour:    context.NeighbourAddr,
+		Type:         msgType,
+		Time:         time.Now(),
+		PeerASN:      context.monitor.peerASN,
+		PeerRouterID: context.monitor.peerRouterID,
+		ASN4:         context.asn4,
+	}
+}
+
+func (context *BGPNeighbourContext) monitorPeerUp() {
+	context.monitor.up = true
+	context.monitor.notification = nil
+	context.monitor.localClose = false
+	if context.Monitor == nil {
+		return
+	}
+	msg := context.newMonitorMsg("PeerUp")
+	msg.LocalAddr = context.monitor.localAddr
+	msg.LocalPort = context.monitor.localPort
+	msg.RemotePort = context.monitor.remotePort
+	msg.SentOpen = context.monitor.sentOpen
+	msg.RcvdOpen = context.monitor.rcvdOpen
+	context.Monitor <- msg
+}
+
+/*
+	could be called several times on the way out of the session; only
+	the first call after peer up is reported
+*/
+func (context *BGPNeighbourContext) monitorPeerDown() {
+	if !context.monitor.up {
+		return
+	}
+	context.monitor.up = false
+	if context.Monitor == nil {
+		return
+	}
+	msg := context.newMonitorMsg("PeerDown")
+	msg.Notification = context.monitor.notification
+	msg.LocalNotification = context.monitor.localNotification
+	msg.LocalClose = context.monitor.localClose
+	context.Monitor <- msg
+}
+
+func (context *BGPNeighbourContext) monitorUpdate(route *BGPRoute, update []byte) {
+	if context.Monitor == nil || !context.monitor.up {
+		return
+	}
+	msg := context.newMonitorMsg("RouteMonitoring")
+	msg.Update = update
+	msg.Announced, msg.Withdrawn = routeKeys(route)
+	context.Monitor <- msg
+}
+
+/*
+	w/o add path, path id is not sent, so all the paths of the prefix
+	have the same key
+*/
+func routeKeys(route *BGPRoute) ([]string, []string) {
+	announced := make([]string, 0)
+	withdrawn := make([]string, 0)
+	for _, nlri := range route.Routes {
+		if !route.Flags.WithPathId {
+			nlri.PathID = 0
+		}
+		announced = append(announced, v4PathToString(nlri))
+	}
+	for _, nlri := range route.WithdrawRoutes {
+		if !route.Flags.WithPathId {
+			nlri.PathID = 0
+		}
+		withdrawn = append(withdrawn, v4PathToString(nlri))
+	}
+	for _, nlri := range route.RoutesV6 {
+		if !route.Flags.WithPathId {
+			nlri.PathID = 0
+		}
+		announced = append(announced, v6PathToString(nlri))
+	}
+	for _, nlri := range route.WithdrawRoutesV6 {
+		if !route.Flags.WithPathId {
+			nlri.PathID = 0
+		}
+		withdrawn = append(withdrawn, v6PathToString(nlri))
+	}
+	for _, rule := range route.FlowSpec {
+		if key, err := flowSpecKey(rule); err == nil {
+			announced = append(announced, key)
+		}
+	}
+	for _, rule := range route.WithdrawFlowSpec {
+		if key, err := flowSpecKey(rule); err == nil {
+			withdrawn = append(withdrawn, key)
+		}
+	}
+	return announced, withdrawn
+}
+
+/*
+	local side of the active session; remote port is always bgp's one
+*/
+func (context *BGPNeighbourContext) parseLocalAddr(laddrPort string) string {
+	laddr, lport, err := net.SplitHostPort(laddrPort)
+	if err != nil {
+		return laddrPort
+	}
+	context.setMonitorAddr(laddr, lport, BGP_PORT)
+	return laddr
+}
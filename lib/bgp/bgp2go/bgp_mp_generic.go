@@ -13,6 +13,8 @@ const (
 	MP_SAFI_UCAST   = 1
 	MP_SAFI_MCAST   = 2
 	MP_SAFI_LABELED = 4
+	//rfc 8955
+	MP_SAFI_FLOWSPEC = 133
 
 	LABEL_SIZE_BITS = 24
 	LABEL_BOS       = 1
@@ -70,6 +72,15 @@ func DecodeMP_REACH_NLRI(data []byte, bgpRoute *BGPRoute) error {
 			if err != nil {
 				return err
 			}
+			if hdr.NHLength != IPV4_ADDRESS_LEN {
+				v6nh, llnh, err := DecodeIPV6NH(data, hdr)
+				if err != nil {
+					return err
+				}
+				bgpRoute.Flags.ExtendedNextHop = true
+				bgpRoute.NEXT_HOPv6 = v6nh
+				bgpRoute.NEXT_HOPv6LinkLocal = llnh
+			}
 			bgpRoute.NEXT_HOPv4 = nh
 			bgpRoute.Routes = append(bgpRoute.Routes, nlris...)
 		case MP_SAFI_LABELED:
@@ -84,14 +95,30 @@ func DecodeMP_REACH_NLRI(data []byte, bgpRoute *BGPRoute) error {
 	case MP_AFI_IPV6:
 		switch hdr.SAFI {
 		case MP_SAFI_UCAST:
-			nh, nlris, err := DecodeIPV6_MP_REACH_NLRI(data, hdr)
+			nh, nlris, err := DecodeIPV6_MP_REACH_NLRI(bgpRoute.Flags, data, hdr)
+			if err != nil {
+				return err
+			}
+			_, llnh, err := DecodeIPV6NH(data, hdr)
 			if err != nil {
 				return err
 			}
 			bgpRoute.NEXT_HOPv6 = nh
+			bgpRoute.NEXT_HOPv6LinkLocal = llnh
 			bgpRoute.RoutesV6 = append(bgpRoute.RoutesV6, nlris...)
 		}
 	}
+	if hdr.SAFI == MP_SAFI_FLOWSPEC &&
+		(hdr.AFI == MP_AFI_IPV4 || hdr.AFI == MP_AFI_IPV6) {
+		if len(data) < int(hdr.NHLength)+ONE_OCTET {
+			return fmt.Errorf("flowspec mp_reach_nlri is too short\n")
+		}
+		rules, err := DecodeFlowSpecNLRI(hdr.AFI, data[hdr.NHLength+ONE_OCTET:])
+		if err != nil {
+			return err
+		}
+		bgpRoute.FlowSpec = append(bgpRoute.FlowSpec, rules...)
+	}
 	return nil
 }
 
@@ -124,14 +151,14 @@ func DecodeMP_UNREACH_NLRI(data []byte, bgpRoute *BGPRoute) error {
 	case MP_AFI_IPV6:
 		switch hdr.SAFI {
 		case MP_SAFI_UCAST:
-			nlris, err := DecodeIPv6NLRI(data)
+			nlris, err := DecodeIPv6NLRI(bgpRoute.Flags, data)
 			if err != nil {
 				return err
 			}
 			bgpRoute.WithdrawRoutesV6 = append(bgpRoute.WithdrawRoutesV6,
 				nlris...)
 		case MP_SAFI_LABELED:
-			nlris, err := DecodeIPv6NLRI(data)
+			nlris, err := DecodeIPv6NLRI(bgpRoute.Flags, data)
 			if err != nil {
 				return err
 			}
@@ -140,6 +167,14 @@ func DecodeMP_UNREACH_NLRI(data []byte, bgpRoute *BGPRoute) error {
 
 		}
 	}
+	if hdr.SAFI == MP_SAFI_FLOWSPEC &&
+		(hdr.AFI == MP_AFI_IPV4 || hdr.AFI == MP_AFI_IPV6) {
+		rules, err := DecodeFlowSpecNLRI(hdr.AFI, data)
+		if err != nil {
+			return err
+		}
+		bgpRoute.WithdrawFlowSpec = append(bgpRoute.WithdrawFlowSpec, rules...)
+	}
 	return nil
 }
 
@@ -0,0 +1,316 @@
+package bgp2go
+
+/*
+	mrt (rfc 6396) dump of the bgp msgs, which we have sent to/rcved from
+	the neighbours. every msg is written as BGP4MP_MESSAGE_AS4 record, so
+	dump could be read by bgpdump etc. the msgs we have sent are written w/
+	peer and local fields swapped (so "from" is always the sender of msg)
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	MRT_TYPE_BGP4MP            = 16
+	MRT_SUBTYPE_BGP4MP_MSG_AS4 = 4
+	MRT_HDR_SIZE               = 12
+	MRT_AFI_IPV4               = 1
+	MRT_AFI_IPV6               = 2
+	MRT_DEFAULT_MAX_SIZE       = 64 * 1024 * 1024
+	MRT_DEFAULT_KEEP           = 5
+)
+
+type MRTHeader struct {
+	Timestamp uint32
+	Type      uint16
+	Subtype   uint16
+	Length    uint32
+}
+
+type MRTStatus struct {
+	Enabled bool
+	Path    string
+	Size    int64
+	MaxSize int64
+	Keep    int
+	//last write error; dump is stopped after it
+	Error string
+}
+
+/*
+	writes mrt records into file; file is rotated (file.1, file.2 etc) when
+	it grows beyond MaxSize. safe to use from multiple goroutines
+*/
+type MRTDumper struct {
+	lock    sync.Mutex
+	file    *os.File
+	path    string
+	size    int64
+	maxSize int64
+	keep    int
+	err     error
+}
+
+func NewMRTDumper() *MRTDumper {
+	return &MRTDumper{}
+}
+
+func (dumper *MRTDumper) Start(path string, maxSize int64, keep int) error {
+	if maxSize <= 0 {
+		maxSize = MRT_DEFAULT_MAX_SIZE
+	}
+	if keep < 0 {
+		keep = MRT_DEFAULT_KEEP
+	}
+	dumper.lock.Lock()
+	defer dumper.lock.Unlock()
+	if dumper.file != nil {
+		dumper.file.Close()
+		dumper.file = nil
+	}
+	dumper.path = path
+	dumper.maxSize = maxSize
+	dumper.keep = keep
+	dumper.err = nil
+	return dumper.open()
+}
+
+func (dumper *MRTDumper) Stop() error {
+	dumper.lock.Lock()
+	defer dumper.lock.Unlock()
+	if dumper.file == nil {
+		return nil
+	}
+	err := dumper.file.Close()
+	dumper.file = nil
+	if err != nil {
+		return fmt.Errorf("cant close mrt dump: %v\n", err)
+	}
+	return nil
+}
+
+func (dumper *MRTDumper) Status() MRTStatus {
+	dumper.lock.Lock()
+	defer dumper.lock.Unlock()
+	status := MRTStatus{
+		Enabled: dumper.file != nil,
+		Path:    dumper.path,
+		Size:    dumper.size,
+		MaxSize: dumper.maxSize,
+		Keep:    dumper.keep,
+	}
+	if dumper.err != nil {
+		status.Error = dumper.err.Error()
+	}
+	return status
+}
+
+func (dumper *MRTDumper) enabled() bool {
+	if dumper == nil {
+		return false
+	}
+	dumper.lock.Lock()
+	defer dumper.lock.Unlock()
+	return dumper.file != nil
+}
+
+func (dumper *MRTDumper) open() error {
+	file, err := os.OpenFile(dumper.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("cant open mrt dump: %v\n", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cant stat mrt dump: %v\n", err)
+	}
+	dumper.file = file
+	dumper.size = info.Size()
+	return nil
+}
+
+/*
+	path -> path.1 -> path.2 ... ; w/ keep == 0 current file is just
+	truncated
+*/
+func (dumper *MRTDumper) rotate() error {
+	dumper.file.Close()
+	dumper.file = nil
+	if dumper.keep == 0 {
+		if err := os.Remove(dumper.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cant remove mrt dump: %v\n", err)
+		}
+		return dumper.open()
+	}
+	os.Remove(dumper.path + "." + strconv.Itoa(dumper.keep))
+	for i := dumper.keep - 1; i > 0; i-- {
+		os.Rename(dumper.path+"."+strconv.Itoa(i),
+			dumper.path+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(dumper.path, dumper.path+".1"); err != nil {
+		return fmt.Errorf("cant rotate mrt dump: %v\n", err)
+	}
+	return dumper.open()
+}
+
+func (dumper *MRTDumper) write(record []byte) {
+	dumper.lock.Lock()
+	defer dumper.lock.Unlock()
+	if dumper.file == nil {
+		return
+	}
+	if dumper.size > 0 && dumper.size+int64(len(record)) > dumper.maxSize {
+		if err := dumper.rotate(); err != nil {
+			dumper.err = err
+			return
+		}
+	}
+	written, err := dumper.file.Write(record)
+	dumper.size += int64(written)
+	if err != nil {
+		dumper.err = fmt.Errorf("cant write mrt dump: %v", err)
+		dumper.file.Close()
+		dumper.file = nil
+	}
+}
+
+/*
+	ipv4 addresses are written as such only if both of them are ipv4 ones
+	(e.g. v4 session on dual stack socket)
+*/
+func EncodeMRTBGP4MPMsg(timestamp time.Time, peerASN, localASN uint32,
+	peerAddr, localAddr net.IP, msg []byte) ([]byte, error) {
+	afi := uint16(MRT_AFI_IPV6)
+	peerIP, localIP := peerAddr.To16(), localAddr.To16()
+	if peerAddr.To4() != nil && localAddr.To4() != nil {
+		afi = MRT_AFI_IPV4
+		peerIP, localIP = peerAddr.To4(), localAddr.To4()
+	}
+	if peerIP == nil || localIP == nil {
+		return nil, fmt.Errorf("cant encode mrt record: invalid address\n")
+	}
+	body := new(bytes.Buffer)
+	//interface index is unknown
+	for _, field := range []interface{}{peerASN, localASN, uint16(0), afi} {
+		if err := binary.Write(body, binary.BigEndian, field); err != nil {
+			return nil, fmt.Errorf("cant encode mrt record: %v\n", err)
+		}
+	}
+	body.Write(peerIP)
+	body.Write(localIP)
+	body.Write(msg)
+	hdr := MRTHeader{
+		Timestamp: uint32(timestamp.Unix()),
+		Type:      MRT_TYPE_BGP4MP,
+		Subtype:   MRT_SUBTYPE_BGP4MP_MSG_AS4,
+		Length:    uint32(body.Len()),
+	}
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, hdr); err != nil {
+		return nil, fmt.Errorf("cant encode mrt header: %v\n", err)
+	}
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+/*
+	per connection state. socket's reads/writes are not aligned w/ bgp msgs,
+	so they are buffered till we have whole msg. asns are learned from the
+	open msgs, which are sent/rcved at the start of the session
+*/
+type mrtRecorder struct {
+	dumper     *MRTDumper
+	lock       sync.Mutex
+	remoteAddr net.IP
+	localAddr  net.IP
+	remoteASN  uint32
+	localASN   uint32
+	rcvdBuf    []byte
+	sentBuf    []byte
+}
+
+func newMRTRecorder(dumper *MRTDumper, sock *net.TCPConn) *mrtRecorder {
+	if dumper == nil {
+		return nil
+	}
+	recorder := &mrtRecorder{dumper: dumper}
+	if raddr, ok := sock.RemoteAddr().(*net.TCPAddr); ok {
+		recorder.remoteAddr = raddr.IP
+	}
+	if laddr, ok := sock.LocalAddr().(*net.TCPAddr); ok {
+		recorder.localAddr = laddr.IP
+	}
+	return recorder
+}
+
+func openMsgASN(msg []byte) (uint32, bool) {
+	openMsg, err := DecodeOpenMsg(msg[MSG_HDR_SIZE:])
+	if err != nil {
+		return 0, false
+	}
+	if openMsg.Caps.SupportASN4 {
+		return openMsg.Caps.ASN4, true
+	}
+	return uint32(openMsg.Hdr.MyASN), true
+}
+
+func (recorder *mrtRecorder) record(data []byte, rcvd bool) {
+	if recorder == nil {
+		return
+	}
+	buf := &recorder.sentBuf
+	if rcvd {
+		buf = &recorder.rcvdBuf
+	}
+	*buf = append(*buf, data...)
+	for len(*buf) >= MSG_HDR_SIZE {
+		msgLen := int(binary.BigEndian.Uint16((*buf)[16:18]))
+		if msgLen < MSG_HDR_SIZE {
+			//garbage; session is going to be closed anyway
+			*buf = nil
+			return
+		}
+		if len(*buf) < msgLen {
+			return
+		}
+		recorder.recordMsg((*buf)[:msgLen], rcvd)
+		*buf = (*buf)[msgLen:]
+	}
+}
+
+func (recorder *mrtRecorder) recordMsg(msg []byte, rcvd bool) {
+	recorder.lock.Lock()
+	if msg[18] == BGP_OPEN_MSG {
+		if asn, ok := openMsgASN(msg); ok {
+			if rcvd {
+				recorder.remoteASN = asn
+			} else {
+				recorder.localASN = asn
+			}
+		}
+	}
+	fromASN, toASN := recorder.remoteASN, recorder.localASN
+	recorder.lock.Unlock()
+	if !recorder.dumper.enabled() {
+		return
+	}
+	fromAddr, toAddr := recorder.remoteAddr, recorder.localAddr
+	if !rcvd {
+		fromASN, toASN = toASN, fromASN
+		fromAddr, toAddr = toAddr, fromAddr
+	}
+	record, err := EncodeMRTBGP4MPMsg(time.Now(), fromASN, toASN,
+		fromAddr, toAddr, msg)
+	if err != nil {
+		return
+	}
+	recorder.dumper.write(record)
+}
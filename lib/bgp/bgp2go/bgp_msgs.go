@@ -23,6 +23,7 @@ const (
 	THREE_OCTETS      = 3
 	FOUR_OCTETS       = 4
 	FIVE_OCTETS       = 5
+	SIX_OCTETS        = 6
 
 	// BGP's msg's types
 	BGP_OPEN_MSG         = 1
@@ -38,6 +39,7 @@ const (
 	BGP_HOLD_TIMER_EXPIRED = 4
 	BGP_FSM_ERROR          = 5
 	BGP_CASE_ERROR         = 6
+	BGP_ROUTEREFRESH_ERROR = 7
 
 	/*MSG Header subcodes */
 	BGP_MH_ERROR_NOTSYNC   = 1
@@ -65,12 +67,31 @@ const (
 	BGP_UPD_ERROR_INVALID_NETWORK    = 10
 	BGP_UPD_ERROR_MAILFORMED_AS_PATH = 11
 
-	/* Case errors subcodes */
-	BGP_CASE_ERROR_GENERIC   = 0
-	BGP_CASE_ERROR_COLLISION = 7
+	/* Route refresh msg subcodes (rfc 7313) */
+	BGP_RR_ERROR_INVALID_LENGTH = 1
+
+	/* Case errors subcodes (rfc 4486) */
+	BGP_CASE_ERROR_GENERIC             = 0
+	BGP_CASE_ERROR_MAX_PREFIX          = 1
+	BGP_CASE_ERROR_ADMIN_SHUTDOWN      = 2
+	BGP_CASE_ERROR_PEER_DECONFIGURED   = 3
+	BGP_CASE_ERROR_ADMIN_RESET         = 4
+	BGP_CASE_ERROR_CONNECTION_REJECTED = 5
+	BGP_CASE_ERROR_CONFIG_CHANGE       = 6
+	BGP_CASE_ERROR_COLLISION           = 7
+	BGP_CASE_ERROR_OUT_OF_RESOURCES    = 8
 
 	/* BGP Generic Error */
 	BGP_GENERIC_ERROR = 0
+
+	/*
+		Route refresh msg subtypes; for plain rfc 2918 it's always 0,
+		rfc 7313 adds begin/end markers of the refreshed routes
+	*/
+	ROUTE_REFRESH_NORMAL = 0
+	ROUTE_REFRESH_BORR   = 1
+	ROUTE_REFRESH_EORR   = 2
+	ROUTE_REFRESH_SIZE   = 23
 )
 
 /*
@@ -117,13 +138,20 @@ type NotificationMsg struct {
 	ErrorCode    uint8
 	ErrorSubcode uint8
 	/*
-	   according to 4271 there also could be data field of variable length,
-	   but so far havent seen that anyone actually uses it;
-	   removing it greatly simplifies notification encoding and shouldnt
-	   break anything, coz during notification rcving we must tear down the session anyway
-	   and for that purpose ErrorCode & Subcodes fields should be enought;
-	   data field could be added in future, if there are going to be any demands
+		variable length; for cease/admin shutdown and cease/admin reset
+		it contains shutdown communication (rfc 8203/9003)
 	*/
+	Data []byte
+}
+
+/*
+	rfc 2918; AFI/SAFI of the routes, which peer wants us to resend.
+	rfc 7313 reused reserved field as subtype (BoRR/EoRR demarcation)
+*/
+type RouteRefreshMsg struct {
+	AFI     uint16
+	Subtype uint8
+	SAFI    uint8
 }
 
 type PathSegment struct {
@@ -152,6 +180,13 @@ type RouteFlags struct {
 		we will remove local_pref and add ourself's asn according to this flag
 	*/
 	EBGP bool
+	//next hop was set by policy; neighbour's context must not override it
+	FixedNextHop bool
+	/*
+		v4 route w/ v6 next hop (rfc 8950); nh is taken from NEXT_HOPv6
+		and route must be encoded as mp_reach_nlri
+	*/
+	ExtendedNextHop bool
 }
 
 type BGPRoute struct {
@@ -159,11 +194,13 @@ type BGPRoute struct {
 	AS_PATH  []PathSegment
 	NEXT_HOP []byte
 	//TODO: mb it's better to use generic nh([]byte; above)
-	NEXT_HOPv6      IPv6Addr
-	NEXT_HOPv4      uint32
-	MULTI_EXIT_DISC uint32
-	LOCAL_PREF      uint32
-	ATOMIC_AGGR     bool
+	NEXT_HOPv6 IPv6Addr
+	//rfc2545; zero if we dont share the segment w/ the neighbour
+	NEXT_HOPv6LinkLocal IPv6Addr
+	NEXT_HOPv4          uint32
+	MULTI_EXIT_DISC     uint32
+	LOCAL_PREF          uint32
+	ATOMIC_AGGR         bool
 	//TODO(tehnerd): move ASN4 to RouteFlags
 	ASN4             bool
 	Flags            RouteFlags
@@ -173,7 +210,10 @@ type BGPRoute struct {
 	RoutesV6         []IPV6_NLRI
 	WithdrawRoutes   []IPV4_NLRI
 	WithdrawRoutesV6 []IPV6_NLRI
+	FlowSpec         []FlowSpecRule
+	WithdrawFlowSpec []FlowSpecRule
 	Community        []uint32
+	ExtCommunity     []uint64
 }
 
 func DecodeMsgHeader(msg []byte) (MsgHeader, error) {
@@ -243,6 +283,23 @@ func DecodeOpenMsg(msg []byte) (OpenMsg, error) {
 							return openMsg, fmt.Errorf("%v\n", err)
 						}
 						openMsg.Caps.SupportGR = true
+					case CAPABILITY_ROUTE_REFRESH, CAPABILITY_ROUTE_REFRESH_PRESTD:
+						openMsg.Caps.SupportRouteRefresh = true
+					case CAPABILITY_ENHANCED_ROUTE_REFRESH:
+						openMsg.Caps.SupportEnhancedRouteRefresh = true
+					case CAPABILITY_EXTENDED_NEXT_HOP:
+						extNHs, err := DecodeExtendedNHCapability(capability)
+						if err != nil {
+							return openMsg, fmt.Errorf("%v\n", err)
+						}
+						openMsg.Caps.ExtendedNextHop = append(openMsg.Caps.ExtendedNextHop,
+							extNHs...)
+					case CAPABILITY_ADD_PATH:
+						addPaths, err := DecodeAddPathCapability(capability)
+						if err != nil {
+							return openMsg, fmt.Errorf("%v\n", err)
+						}
+						openMsg.Caps.AddPath = append(openMsg.Caps.AddPath, addPaths...)
 					}
 				}
 			}
@@ -296,6 +353,54 @@ func EncodeOpenMsg(openMsg *OpenMsg) ([]byte, error) {
 		encodedOptParams = append(encodedOptParams, encParamHdr...)
 		encodedOptParams = append(encodedOptParams, encCap...)
 	}
+	if openMsg.Caps.SupportRouteRefresh {
+		encCap, err := EncodeRouteRefreshCapability()
+		if err != nil {
+			return nil, fmt.Errorf("cant encode route refresh cap: %v\n", err)
+		}
+		encParamHdr, err := EncodeOptionalParamHeader(OptionalParamHeader{
+			ParamType:   CAPABILITIES_OPTIONAL_PARAM,
+			ParamLength: uint8(len(encCap)),
+		})
+		encodedOptParams = append(encodedOptParams, encParamHdr...)
+		encodedOptParams = append(encodedOptParams, encCap...)
+	}
+	if openMsg.Caps.SupportEnhancedRouteRefresh {
+		encCap, err := EncodeEnhancedRouteRefreshCapability()
+		if err != nil {
+			return nil, fmt.Errorf("cant encode enhanced route refresh cap: %v\n", err)
+		}
+		encParamHdr, err := EncodeOptionalParamHeader(OptionalParamHeader{
+			ParamType:   CAPABILITIES_OPTIONAL_PARAM,
+			ParamLength: uint8(len(encCap)),
+		})
+		encodedOptParams = append(encodedOptParams, encParamHdr...)
+		encodedOptParams = append(encodedOptParams, encCap...)
+	}
+	if len(openMsg.Caps.ExtendedNextHop) > 0 {
+		encCap, err := EncodeExtendedNHCapability(openMsg.Caps.ExtendedNextHop)
+		if err != nil {
+			return nil, fmt.Errorf("cant encode extended next hop cap: %v\n", err)
+		}
+		encParamHdr, err := EncodeOptionalParamHeader(OptionalParamHeader{
+			ParamType:   CAPABILITIES_OPTIONAL_PARAM,
+			ParamLength: uint8(len(encCap)),
+		})
+		encodedOptParams = append(encodedOptParams, encParamHdr...)
+		encodedOptParams = append(encodedOptParams, encCap...)
+	}
+	if len(openMsg.Caps.AddPath) > 0 {
+		encCap, err := EncodeAddPathCapability(openMsg.Caps.AddPath)
+		if err != nil {
+			return nil, fmt.Errorf("cant encode add path cap: %v\n", err)
+		}
+		encParamHdr, err := EncodeOptionalParamHeader(OptionalParamHeader{
+			ParamType:   CAPABILITIES_OPTIONAL_PARAM,
+			ParamLength: uint8(len(encCap)),
+		})
+		encodedOptParams = append(encodedOptParams, encParamHdr...)
+		encodedOptParams = append(encodedOptParams, encCap...)
+	}
 
 	openMsg.Hdr.OptParamLength = uint8(len(encodedOptParams))
 	err := binary.Write(buf, binary.BigEndian, openMsg.Hdr)
@@ -372,6 +477,15 @@ func AddAttrToRoute(bgpRoute *BGPRoute, pathAttr *PathAttr) error {
 			}
 			bgpRoute.Community = append(bgpRoute.Community, community)
 		}
+	case BA_EXT_COMMUNITY:
+		var extCommunity uint64
+		for reader.Len() >= 8 {
+			err = binary.Read(reader, binary.BigEndian, &extCommunity)
+			if err != nil {
+				return fmt.Errorf("cant decode EXT_COMMUNITY Attr: %v\n", err)
+			}
+			bgpRoute.ExtCommunity = append(bgpRoute.ExtCommunity, extCommunity)
+		}
 	case BA_AS_PATH:
 		//TODO: as_path can has more than one path segment
 		if pathAttr.AttrLength != 0 {
@@ -545,7 +659,7 @@ func EncodeUpdateMsg(bgpRoute *BGPRoute) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cant encode path attributes: %v\n", err)
 	}
-	encodedRoutes, err := EncodeIPv4Route(bgpRoute.Routes)
+	encodedRoutes, err := encodeUpdateIPv4Routes(bgpRoute.Flags, bgpRoute.Routes)
 	if err != nil {
 		return nil, fmt.Errorf("cant encoded bgp routes: %v\n", err)
 	}
@@ -577,7 +691,8 @@ func EncodeUpdateMsg(bgpRoute *BGPRoute) ([]byte, error) {
 func EncodeWithdrawUpdateMsg(bgpRoute *BGPRoute) ([]byte, error) {
 	encodedUpdate := make([]byte, 0)
 	buf := new(bytes.Buffer)
-	encodedWithdrawRoutes, err := EncodeIPv4Route(bgpRoute.WithdrawRoutes)
+	encodedWithdrawRoutes, err := encodeUpdateIPv4Routes(bgpRoute.Flags,
+		bgpRoute.WithdrawRoutes)
 	if err != nil {
 		return nil, fmt.Errorf("cant encode withdraw routes")
 	}
@@ -602,6 +717,17 @@ func EncodeWithdrawUpdateMsg(bgpRoute *BGPRoute) ([]byte, error) {
 	return encodedUpdate, nil
 }
 
+/*
+	nlri/withdrawn routes fields of update msg; w/ add path (rfc 7911) each
+	route is prepended by path id, same as inside of mp_reach/unreach_nlri
+*/
+func encodeUpdateIPv4Routes(flags RouteFlags, routes []IPV4_NLRI) ([]byte, error) {
+	if flags.WithPathId {
+		return EncodeIPv4NLRI(RouteFlags{WithPathId: true}, routes)
+	}
+	return EncodeIPv4Route(routes)
+}
+
 func EncodeIPv4Route(routesSlice []IPV4_NLRI) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	routes := make([]byte, 0)
@@ -625,24 +751,25 @@ func EncodeIPv4Route(routesSlice []IPV4_NLRI) ([]byte, error) {
 }
 
 func DecodeNotificationMsg(msg []byte) (NotificationMsg, error) {
-	offset := MSG_HDR_SIZE
 	notification := NotificationMsg{}
-	reader := bytes.NewReader(msg[offset:])
-	err := binary.Read(reader, binary.BigEndian, &notification)
-	if err != nil {
+	if len(msg) < MSG_HDR_SIZE+TWO_OCTETS {
 		return notification, errors.New("cant decode notification")
 	}
+	notification.ErrorCode = msg[MSG_HDR_SIZE]
+	notification.ErrorSubcode = msg[MSG_HDR_SIZE+ONE_OCTET]
+	if len(msg) > MSG_HDR_SIZE+TWO_OCTETS {
+		notification.Data = append(notification.Data, msg[MSG_HDR_SIZE+TWO_OCTETS:]...)
+	}
 	return notification, nil
 }
 
 func EncodeNotificationMsg(notification *NotificationMsg) ([]byte, error) {
-	encodedNotification := make([]byte, 0)
-	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.BigEndian, notification)
-	if err != nil {
-		return nil, fmt.Errorf("can encode notification msg: %v\n", err)
+	encodedNotification := []byte{notification.ErrorCode, notification.ErrorSubcode}
+	encodedNotification = append(encodedNotification, notification.Data...)
+	if MSG_HDR_SIZE+len(encodedNotification) > MAX_MSG_SIZE {
+		return nil, fmt.Errorf("notification msg's data is too long: %v\n",
+			len(notification.Data))
 	}
-	encodedNotification = append(encodedNotification, buf.Bytes()...)
 	msgHdr := MsgHeader{
 		Type:   BGP_NOTIFICATION_MSG,
 		Length: MSG_HDR_SIZE + uint16(len(encodedNotification))}
@@ -654,6 +781,35 @@ func EncodeNotificationMsg(notification *NotificationMsg) ([]byte, error) {
 	return encodedNotification, nil
 }
 
+func DecodeRouteRefreshMsg(msg []byte) (RouteRefreshMsg, error) {
+	routeRefresh := RouteRefreshMsg{}
+	if len(msg) != ROUTE_REFRESH_SIZE {
+		return routeRefresh, fmt.Errorf("wrong route refresh msg length: %v\n", len(msg))
+	}
+	reader := bytes.NewReader(msg[MSG_HDR_SIZE:])
+	err := binary.Read(reader, binary.BigEndian, &routeRefresh)
+	if err != nil {
+		return routeRefresh, fmt.Errorf("cant decode route refresh msg: %v\n", err)
+	}
+	return routeRefresh, nil
+}
+
+func EncodeRouteRefreshMsg(routeRefresh *RouteRefreshMsg) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.BigEndian, routeRefresh)
+	if err != nil {
+		return nil, fmt.Errorf("cant encode route refresh msg: %v\n", err)
+	}
+	msgHdr := MsgHeader{
+		Type:   BGP_ROUTEREFRESH_MSG,
+		Length: MSG_HDR_SIZE + uint16(buf.Len())}
+	encMsgHdr, err := EncodeMsgHeader(&msgHdr)
+	if err != nil {
+		return nil, fmt.Errorf("cant encode route refresh msg hdr: %v\n", err)
+	}
+	return append(encMsgHdr, buf.Bytes()...), nil
+}
+
 func GenerateKeepalive() []byte {
 	keepAlive := MsgHeader{}
 	keepAlive.Length = MSG_HDR_SIZE
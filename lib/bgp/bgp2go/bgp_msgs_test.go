@@ -1,9 +1,16 @@
 package bgp2go
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 const (
@@ -20,6 +27,9 @@ const (
 	hexLabeledIPv4_MP_REACH_NLRI = "ffffffffffffffffffffffffffffffff007702000000604001010040020602010000ff7880040400000001c0080cff780001ff780002ff780064900e0039000104040a004e070038494701c0a8010638494401c0a8010338494501c0a8010438494601c0a8010538494301c0a8010238494201c0a80101"
 	hexJuniperOpen               = "ffffffffffffffffffffffffffffffff003b0104ff79005ac0a801081e02060104000100040202800002020200020440020078020641040000ff79"
 	hexEndOfRibv4                = "ffffffffffffffffffffffffffffffff001e0200000007900f0003000104"
+	hexAdminShutdown             = "ffffffffffffffffffffffffffffffff002a030602146d61696e74656e616e6365204348472d31323334"
+	hexRouteRefresh              = "ffffffffffffffffffffffffffffffff00170500010001"
+	hexRouteRefreshBoRRv6        = "ffffffffffffffffffffffffffffffff00170500020101"
 )
 
 func TestDecodeMsgHeader(t *testing.T) {
@@ -251,6 +261,203 @@ func TestEncodeNotificationMsg(t *testing.T) {
 
 }
 
+func TestNotificationWithData(t *testing.T) {
+	encodedNotification, _ := hex.DecodeString(hexAdminShutdown)
+	notification, err := DecodeNotificationMsg(encodedNotification)
+	if err != nil {
+		t.Errorf("error during notification w/ data decoding: %v\n", err)
+		return
+	}
+	if notification.ErrorCode != BGP_CASE_ERROR ||
+		notification.ErrorSubcode != BGP_CASE_ERROR_ADMIN_SHUTDOWN {
+		t.Errorf("wrong code/subcode of decoded notification: %v\n", notification)
+		return
+	}
+	communication, err := DecodeShutdownCommunication(notification.Data)
+	if err != nil {
+		t.Errorf("error during shutdown communication decoding: %v\n", err)
+		return
+	}
+	if communication != "maintenance CHG-1234" {
+		t.Errorf("wrong shutdown communication: %v\n", communication)
+		return
+	}
+	if notification.String() != `Cease/Administrative Shutdown: "maintenance CHG-1234"` {
+		t.Errorf("wrong notification description: %v\n", notification.String())
+		return
+	}
+	encCease, err := GenerateCeaseMsg(BGP_CASE_ERROR_ADMIN_SHUTDOWN, communication)
+	if err != nil {
+		t.Errorf("error during cease msg encoding: %v\n", err)
+		return
+	}
+	if hex.EncodeToString(encCease) != hexAdminShutdown {
+		t.Errorf("encoded cease is not equal to etalon's msg: %x\n", encCease)
+		return
+	}
+}
+
+func TestShutdownCommunicationLimits(t *testing.T) {
+	longCommunication := make([]byte, MAX_SHUTDOWN_COMMUNICATION_LEN+1)
+	for cntr := range longCommunication {
+		longCommunication[cntr] = 'a'
+	}
+	_, err := EncodeShutdownCommunication(string(longCommunication))
+	if err == nil {
+		t.Errorf("communication longer than 255 bytes must not be encoded\n")
+		return
+	}
+	_, err = EncodeShutdownCommunication(string(longCommunication[1:]))
+	if err != nil {
+		t.Errorf("255 bytes long communication must be encoded (rfc 9003): %v\n", err)
+		return
+	}
+	_, err = EncodeShutdownCommunication("\xff\xfe")
+	if err == nil {
+		t.Errorf("communication w/ invalid utf-8 must not be encoded\n")
+		return
+	}
+	_, err = DecodeShutdownCommunication([]byte{10, 'a', 'b'})
+	if err == nil {
+		t.Errorf("communication w/ wrong length must not be decoded\n")
+		return
+	}
+	notification := NotificationMsg{ErrorCode: BGP_CASE_ERROR,
+		ErrorSubcode: BGP_CASE_ERROR_PEER_DECONFIGURED}
+	if notification.String() != "Cease/Peer De-configured" {
+		t.Errorf("wrong notification description: %v\n", notification.String())
+		return
+	}
+}
+
+func TestDecodeOpenMsgRouteRefresh(t *testing.T) {
+	encodedOpen, _ := hex.DecodeString(hexOpenMsg)
+	openMsg, err := DecodeOpenMsg(encodedOpen[MSG_HDR_SIZE:])
+	if err != nil {
+		t.Errorf("error during open msg decoding: %v\n", err)
+		return
+	}
+	if !openMsg.Caps.SupportRouteRefresh {
+		t.Errorf("this open msg suppose to have route refresh enabled\n")
+		return
+	}
+	if openMsg.Caps.SupportEnhancedRouteRefresh {
+		t.Errorf("this open msg shouldnt have enhanced route refresh enabled\n")
+		return
+	}
+}
+
+func TestEncodeDecodeOpenEnhancedRouteRefresh(t *testing.T) {
+	openMsg := OpenMsg{Hdr: OpenMsgHdr{Version: 4, MyASN: 65000, HoldTime: 90, BGPID: 167772162}}
+	openMsg.Caps.SupportRouteRefresh = true
+	openMsg.Caps.SupportEnhancedRouteRefresh = true
+	encOpenMsg, err := EncodeOpenMsg(&openMsg)
+	if err != nil {
+		t.Errorf("error during open msg w/ERR encoding: %v\n", err)
+		return
+	}
+	newOpenMsg, err := DecodeOpenMsg(encOpenMsg[MSG_HDR_SIZE:])
+	if err != nil {
+		t.Errorf("error during open msg w/ERR decoding: %v\n", err)
+		return
+	}
+	if !newOpenMsg.Caps.SupportRouteRefresh ||
+		!newOpenMsg.Caps.SupportEnhancedRouteRefresh {
+		t.Errorf("error during route refresh caps encoding/decoding\n")
+		return
+	}
+}
+
+func TestEncodeDecodeOpenExtendedNextHop(t *testing.T) {
+	openMsg := OpenMsg{Hdr: OpenMsgHdr{Version: 4, MyASN: 65000, HoldTime: 90, BGPID: 167772162}}
+	extNH := ExtendedNHCapability{AFI: MP_AFI_IPV4, SAFI: MP_SAFI_UCAST,
+		NHAFI: MP_AFI_IPV6}
+	openMsg.Caps.ExtendedNextHop = []ExtendedNHCapability{extNH}
+	encOpenMsg, err := EncodeOpenMsg(&openMsg)
+	if err != nil {
+		t.Errorf("error during open msg w/extended nh encoding: %v\n", err)
+		return
+	}
+	newOpenMsg, err := DecodeOpenMsg(encOpenMsg[MSG_HDR_SIZE:])
+	if err != nil {
+		t.Errorf("error during open msg w/extended nh decoding: %v\n", err)
+		return
+	}
+	if len(newOpenMsg.Caps.ExtendedNextHop) != 1 ||
+		newOpenMsg.Caps.ExtendedNextHop[0] != extNH {
+		t.Errorf("error during extended nh cap encoding/decoding: %v\n",
+			newOpenMsg.Caps.ExtendedNextHop)
+		return
+	}
+	if _, err := DecodeExtendedNHCapability([]byte{0, 1, 0}); err == nil {
+		t.Errorf("extended nh cap w/ wrong length was accepted\n")
+	}
+}
+
+func TestEncodeDecodeOpenAddPath(t *testing.T) {
+	openMsg := OpenMsg{Hdr: OpenMsgHdr{Version: 4, MyASN: 65000, HoldTime: 90, BGPID: 167772162}}
+	addPaths := []AddPathCapability{
+		AddPathCapability{AFI: MP_AFI_IPV4, SAFI: MP_SAFI_UCAST, Flags: ADD_PATH_SEND},
+		AddPathCapability{AFI: MP_AFI_IPV6, SAFI: MP_SAFI_UCAST,
+			Flags: ADD_PATH_SEND_RECEIVE}}
+	openMsg.Caps.AddPath = addPaths
+	encOpenMsg, err := EncodeOpenMsg(&openMsg)
+	if err != nil {
+		t.Errorf("error during open msg w/ add path encoding: %v\n", err)
+		return
+	}
+	newOpenMsg, err := DecodeOpenMsg(encOpenMsg[MSG_HDR_SIZE:])
+	if err != nil {
+		t.Errorf("error during open msg w/ add path decoding: %v\n", err)
+		return
+	}
+	if len(newOpenMsg.Caps.AddPath) != 2 ||
+		newOpenMsg.Caps.AddPath[0] != addPaths[0] ||
+		newOpenMsg.Caps.AddPath[1] != addPaths[1] {
+		t.Errorf("error during add path cap encoding/decoding: %v\n",
+			newOpenMsg.Caps.AddPath)
+		return
+	}
+	//rfc 7911: <afi 2 octets, safi 1 octet, send/receive 1 octet>
+	if _, err := DecodeAddPathCapability([]byte{0, 1, 1, 3, 0}); err == nil {
+		t.Errorf("add path cap w/ wrong length was accepted\n")
+	}
+}
+
+func TestDecodeRouteRefreshMsg(t *testing.T) {
+	encodedRR, _ := hex.DecodeString(hexRouteRefresh)
+	routeRefresh, err := DecodeRouteRefreshMsg(encodedRR)
+	if err != nil {
+		t.Errorf("error during route refresh decoding: %v\n", err)
+		return
+	}
+	if routeRefresh.AFI != MP_AFI_IPV4 || routeRefresh.SAFI != MP_SAFI_UCAST ||
+		routeRefresh.Subtype != ROUTE_REFRESH_NORMAL {
+		t.Errorf("decoded route refresh is not equal to etalon: %v\n", routeRefresh)
+		return
+	}
+	_, err = DecodeRouteRefreshMsg(encodedRR[:len(encodedRR)-1])
+	if err == nil {
+		t.Errorf("route refresh w/ wrong length must not be decoded\n")
+		return
+	}
+}
+
+func TestEncodeRouteRefreshMsg(t *testing.T) {
+	encodedBoRR, _ := hex.DecodeString(hexRouteRefreshBoRRv6)
+	routeRefresh := RouteRefreshMsg{AFI: MP_AFI_IPV6, SAFI: MP_SAFI_UCAST,
+		Subtype: ROUTE_REFRESH_BORR}
+	encBoRR, err := EncodeRouteRefreshMsg(&routeRefresh)
+	if err != nil {
+		t.Errorf("error during route refresh encoding: %v\n", err)
+		return
+	}
+	if hex.EncodeToString(encBoRR) != hexRouteRefreshBoRRv6 || len(encBoRR) != len(encodedBoRR) {
+		t.Errorf("encoded route refresh is not equal to etalon's msg: %x\n", encBoRR)
+		return
+	}
+}
+
 func TestEncodeUpdateMsg1(t *testing.T) {
 	bgpRoute := BGPRoute{
 		ORIGIN:          ORIGIN_IGP,
@@ -395,7 +602,7 @@ func TestIPv6NLRIEncodingDecoding(t *testing.T) {
 		return
 	}
 	nlri.Prefix = v6addr
-	encIPv6NLRI, err := EncodeIPv6NLRI([]IPV6_NLRI{nlri})
+	encIPv6NLRI, err := EncodeIPv6NLRI(RouteFlags{}, []IPV6_NLRI{nlri})
 	if err != nil {
 		t.Errorf("cant encode ipv6 nlri: %v\n", err)
 		return
@@ -412,7 +619,7 @@ func TestIPv6NLRIEncodingDecoding(t *testing.T) {
 			return
 		}
 	}
-	decIpv6nlri, err := DecodeIPv6NLRI(encIPv6NLRI)
+	decIpv6nlri, err := DecodeIPv6NLRI(RouteFlags{}, encIPv6NLRI)
 	if err != nil {
 		t.Errorf("cant decode encoded nlri: %v\n", err)
 		return
@@ -451,7 +658,7 @@ func TestIPv6MP_REACH_EncodingDecoding(t *testing.T) {
 		t.Errorf("cant decode mp_reach_nlri hdr: %v\n", err)
 		return
 	}
-	decIPv6MPREACHnh, decIPv6MPREACHnlri, err := DecodeIPV6_MP_REACH_NLRI(encIPv6MPREACH[FOUR_OCTETS:],
+	decIPv6MPREACHnh, decIPv6MPREACHnlri, err := DecodeIPV6_MP_REACH_NLRI(RouteFlags{}, encIPv6MPREACH[FOUR_OCTETS:],
 		mpReachHdr)
 	if err != nil {
 		t.Errorf("cant decode encoded mp_reach_nlri for ipv6: %v\n", err)
@@ -468,11 +675,41 @@ func TestIPv6MP_REACH_EncodingDecoding(t *testing.T) {
 	}
 }
 
+func TestIPv6MP_REACH_LinkLocalNH(t *testing.T) {
+	nlri := IPV6_NLRI{Length: 48}
+	nlri.Prefix, _ = IPv6StringToAddr("2a00:bdc0:e003::")
+	v6nh, _ := IPv6StringToAddr("2001:db8::1")
+	v6llnh, _ := IPv6StringToAddr("fe80::1")
+	bgpRoute := BGPRoute{ORIGIN: ORIGIN_IGP, NEXT_HOPv6: v6nh,
+		NEXT_HOPv6LinkLocal: v6llnh, RoutesV6: []IPV6_NLRI{nlri}}
+	encodedUpdate, err := EncodeUpdateMsg(&bgpRoute)
+	if err != nil {
+		t.Errorf("cant encode route w/ link local nh: %v\n", err)
+		return
+	}
+	decodedRoute, err := DecodeUpdateMsg(encodedUpdate, &BGPCapabilities{})
+	if err != nil {
+		t.Errorf("cant decode route w/ link local nh: %v\n", err)
+		return
+	}
+	if decodedRoute.NEXT_HOPv6 != v6nh || decodedRoute.NEXT_HOPv6LinkLocal != v6llnh ||
+		len(decodedRoute.RoutesV6) != 1 || decodedRoute.RoutesV6[0] != nlri {
+		t.Errorf("decoded route not equal to original: %#v\n", decodedRoute)
+		return
+	}
+	mpReach, _ := EncodeIPV6_MP_REACH_NLRI(v6nh, []IPV6_NLRI{nlri})
+	mpReachHdr, _ := DecodeMP_REACH_NLRI_HDR(mpReach)
+	mpReachHdr.NHLength = 24
+	if _, _, err := DecodeIPV6_MP_REACH_NLRI(RouteFlags{}, mpReach[FOUR_OCTETS:], mpReachHdr); err == nil {
+		t.Errorf("wrong nh length wasnt detected\n")
+	}
+}
+
 func TestIPv6MP_UNREACH_Encoding(t *testing.T) {
 	nlri := IPV6_NLRI{Length: 48}
 	v6addr, _ := IPv6StringToAddr("2a00:bdc0:e003::")
 	nlri.Prefix = v6addr
-	encIPv6MPUNREACH, err := EncodeIPV6_MP_UNREACH_NLRI([]IPV6_NLRI{nlri})
+	encIPv6MPUNREACH, err := EncodeIPV6_MP_UNREACH_NLRI(RouteFlags{}, []IPV6_NLRI{nlri})
 	if err != nil {
 		t.Errorf("cant encode ipv6 mp reach nlri: %v\n", err)
 		return
@@ -511,7 +748,7 @@ func TestIPv6MP_UNREACH_PathAttrEncoding(t *testing.T) {
 	v6addr, _ := IPv6StringToAddr("2a00:bdc0:e003::")
 	nlri.Prefix = v6addr
 	pa := PathAttr{}
-	encIPv6MPUNREACHPA, err := EncodeV6MPUNRNLRI([]IPV6_NLRI{nlri}, &pa)
+	encIPv6MPUNREACHPA, err := EncodeV6MPUNRNLRI(RouteFlags{}, []IPV6_NLRI{nlri}, &pa)
 	if err != nil {
 		t.Errorf("cant encode ipv6 mp unreach nlri: %v\n", err)
 		return
@@ -650,6 +887,49 @@ func TestIPv4MP_REACH_EncodingDecoding(t *testing.T) {
 	}
 }
 
+func TestIPv4ExtNHMP_REACH_EncodingDecoding(t *testing.T) {
+	nlri := IPV4_NLRI{Length: 22}
+	nlri.Prefix, _ = IPv4ToUint32("10.10.252.0")
+	v6nh, _ := IPv6StringToAddr("2001:db8::1")
+	v6llnh, _ := IPv6StringToAddr("fe80::1")
+	for _, llnh := range []IPv6Addr{IPv6Addr{}, v6llnh} {
+		encIPv4MPREACH, err := EncodeExtNHIPV4_MP_REACH_NLRI(v6nh, llnh,
+			RouteFlags{}, []IPV4_NLRI{nlri})
+		if err != nil {
+			t.Errorf("cant encode ipv4 mp reach nlri w/ v6 nh: %v\n", err)
+			return
+		}
+		bgpRoute := BGPRoute{}
+		err = DecodeMP_REACH_NLRI(encIPv4MPREACH, &bgpRoute)
+		if err != nil {
+			t.Errorf("cant decode ipv4 mp reach nlri w/ v6 nh: %v\n", err)
+			return
+		}
+		if !bgpRoute.Flags.ExtendedNextHop || bgpRoute.NEXT_HOPv6 != v6nh ||
+			bgpRoute.NEXT_HOPv6LinkLocal != llnh || bgpRoute.NEXT_HOPv4 != 0 ||
+			len(bgpRoute.Routes) != 1 || bgpRoute.Routes[0] != nlri {
+			t.Errorf("decoded route not equal to original: %#v\n", bgpRoute)
+			return
+		}
+	}
+	bgpRoute := BGPRoute{ORIGIN: ORIGIN_IGP, MPINET: true, NEXT_HOPv6: v6nh,
+		Routes: []IPV4_NLRI{nlri}, Flags: RouteFlags{ExtendedNextHop: true}}
+	encodedUpdate, err := EncodeUpdateMsg(&bgpRoute)
+	if err != nil {
+		t.Errorf("cant encode update w/ extended nh: %v\n", err)
+		return
+	}
+	decodedRoute, err := DecodeUpdateMsg(encodedUpdate, &BGPCapabilities{})
+	if err != nil {
+		t.Errorf("cant decode update w/ extended nh: %v\n", err)
+		return
+	}
+	if decodedRoute.NEXT_HOPv6 != v6nh || len(decodedRoute.Routes) != 1 ||
+		decodedRoute.NEXT_HOP != nil {
+		t.Errorf("decoded update not equal to original: %#v\n", decodedRoute)
+	}
+}
+
 func TestIPv4MP_UNREACH_Encoding(t *testing.T) {
 	nlri := IPV4_NLRI{Length: 22}
 	v4addr, _ := IPv4ToUint32("10.10.252.0")
@@ -737,6 +1017,64 @@ func TestIPv4AddPathMP_REACH_EncodingDecoding(t *testing.T) {
 	fmt.Printf("%#v\n", decIPv4MPREACHnlri)
 }
 
+func TestAddPathMultipleNLRI(t *testing.T) {
+	v4addr, _ := IPv4ToUint32("10.10.252.0")
+	v4nlris := []IPV4_NLRI{IPV4_NLRI{Length: 24, Prefix: v4addr, PathID: 1},
+		IPV4_NLRI{Length: 24, Prefix: v4addr, PathID: 2}}
+	encV4NLRI, err := EncodeIPv4NLRI(RouteFlags{WithPathId: true}, v4nlris)
+	if err != nil {
+		t.Errorf("cant encode ipv4 nlri w/ path id: %v\n", err)
+		return
+	}
+	//each nlri: path id, length and 3 octets of prefix
+	if len(encV4NLRI) != 2*(FOUR_OCTETS+ONE_OCTET+THREE_OCTETS) {
+		t.Errorf("wrong length of encoded ipv4 nlri w/ path id: %v\n", len(encV4NLRI))
+		return
+	}
+	decV4NLRI, err := DecodeIPv4NLRI(RouteFlags{WithPathId: true}, encV4NLRI)
+	if err != nil || len(decV4NLRI) != 2 || decV4NLRI[0] != v4nlris[0] ||
+		decV4NLRI[1] != v4nlris[1] {
+		t.Errorf("decoded ipv4 nlri w/ path id not equal to original: %v %v\n",
+			decV4NLRI, err)
+		return
+	}
+	v6addr, _ := IPv6StringToAddr("2001:db8::")
+	v6nh, _ := IPv6StringToAddr("2001:db8:1::1")
+	v6nlris := []IPV6_NLRI{IPV6_NLRI{Length: 48, Prefix: v6addr, PathID: 1},
+		IPV6_NLRI{Length: 48, Prefix: v6addr, PathID: 2}}
+	encV6MPREACH, err := EncodeLinkLocalIPV6_MP_REACH_NLRI(v6nh, IPv6Addr{},
+		RouteFlags{WithPathId: true}, v6nlris)
+	if err != nil {
+		t.Errorf("cant encode ipv6 mp reach nlri w/ path id: %v\n", err)
+		return
+	}
+	mpReachHdr, err := DecodeMP_REACH_NLRI_HDR(encV6MPREACH)
+	if err != nil {
+		t.Errorf("cant decode mp_reach_nlri hdr: %v\n", err)
+		return
+	}
+	decV6nh, decV6NLRI, err := DecodeIPV6_MP_REACH_NLRI(RouteFlags{WithPathId: true},
+		encV6MPREACH[FOUR_OCTETS:], mpReachHdr)
+	if err != nil || !decV6nh.isEqual(v6nh) || len(decV6NLRI) != 2 ||
+		decV6NLRI[0] != v6nlris[0] || decV6NLRI[1] != v6nlris[1] {
+		t.Errorf("decoded ipv6 nlri w/ path id not equal to original: %v %v\n",
+			decV6NLRI, err)
+		return
+	}
+	encV6MPUNREACH, err := EncodeIPV6_MP_UNREACH_NLRI(RouteFlags{WithPathId: true},
+		v6nlris[1:])
+	if err != nil {
+		t.Errorf("cant encode ipv6 mp unreach nlri w/ path id: %v\n", err)
+		return
+	}
+	decV6NLRI, err = DecodeIPv6NLRI(RouteFlags{WithPathId: true},
+		encV6MPUNREACH[THREE_OCTETS:])
+	if err != nil || len(decV6NLRI) != 1 || decV6NLRI[0] != v6nlris[1] {
+		t.Errorf("withdrawn ipv6 nlri w/ path id not equal to original: %v %v\n",
+			decV6NLRI, err)
+	}
+}
+
 func TestIPv4AddPathMP_UNREACH_Encoding(t *testing.T) {
 	nlri := IPV4_NLRI{Length: 22, PathID: 10}
 	v4addr, _ := IPv4ToUint32("10.10.252.0")
@@ -918,3 +1256,202 @@ func BenchmarkDecodeOpen(b *testing.B) {
 		DecodeOpenMsg(data[MSG_HDR_SIZE:])
 	}
 }
+
+func TestFlowSpecNLRIEncodingDecoding(t *testing.T) {
+	//rfc 8955 example: dst 10.0.1.0/24, proto tcp, port 25
+	_, dst, _ := net.ParseCIDR("10.0.1.0/24")
+	rule := FlowSpecRule{AFI: MP_AFI_IPV4, Destination: dst,
+		Protocols: []FlowSpecNumeric{FlowSpecNumeric{Op: FLOWSPEC_OP_EQ, Value: 6}},
+		Ports:     []FlowSpecNumeric{FlowSpecNumeric{Op: FLOWSPEC_OP_EQ, Value: 25}}}
+	encRule, err := EncodeFlowSpecNLRI(rule)
+	if err != nil {
+		t.Errorf("cant encode flowspec nlri: %v\n", err)
+		return
+	}
+	if hex.EncodeToString(encRule) != "0b01180a0001038106048119" {
+		t.Errorf("wrong encoding of flowspec nlri: %x\n", encRule)
+		return
+	}
+	decRules, err := DecodeFlowSpecNLRI(MP_AFI_IPV4, encRule)
+	if err != nil || len(decRules) != 1 || !reflect.DeepEqual(decRules[0], rule) {
+		t.Errorf("decoded flowspec nlri not equal to original: %v %v\n", decRules, err)
+		return
+	}
+	_, dst6, _ := net.ParseCIDR("2001:db8::/48")
+	_, src6, _ := net.ParseCIDR("2001:db8:ffff::/64")
+	ports, _ := ParseFlowSpecNumeric("1024-65535")
+	lengths, _ := ParseFlowSpecNumeric(">=1400")
+	rule6 := FlowSpecRule{AFI: MP_AFI_IPV6, Destination: dst6, Source: src6,
+		DestinationPorts: ports, PacketLengths: lengths}
+	encRule, err = EncodeFlowSpecNLRI(rule6)
+	if err != nil {
+		t.Errorf("cant encode ipv6 flowspec nlri: %v\n", err)
+		return
+	}
+	decRules, err = DecodeFlowSpecNLRI(MP_AFI_IPV6, encRule)
+	if err != nil || len(decRules) != 1 || !reflect.DeepEqual(decRules[0], rule6) {
+		t.Errorf("decoded ipv6 flowspec nlri not equal to original: %v %v\n",
+			decRules, err)
+		return
+	}
+	rule6.Destination = dst
+	if _, err = EncodeFlowSpecNLRI(rule6); err == nil {
+		t.Errorf("ipv4 prefix was accepted in ipv6 flowspec rule\n")
+	}
+}
+
+func TestFlowSpecUpdateEncodingDecoding(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("192.168.0.1/32")
+	rule := FlowSpecRule{AFI: MP_AFI_IPV4, Destination: dst,
+		Protocols: []FlowSpecNumeric{FlowSpecNumeric{Op: FLOWSPEC_OP_EQ, Value: 17}}}
+	rate := FlowSpecTrafficRate(65000, 125000)
+	route := BGPRoute{ORIGIN: ORIGIN_IGP, FlowSpec: []FlowSpecRule{rule},
+		ExtCommunity: []uint64{rate}}
+	encUpdate, err := EncodeUpdateMsg(&route)
+	if err != nil {
+		t.Errorf("cant encode flowspec update: %v\n", err)
+		return
+	}
+	decRoute, err := DecodeUpdateMsg(encUpdate, &BGPCapabilities{})
+	if err != nil {
+		t.Errorf("cant decode flowspec update: %v\n", err)
+		return
+	}
+	if len(decRoute.FlowSpec) != 1 || !reflect.DeepEqual(decRoute.FlowSpec[0], rule) {
+		t.Errorf("decoded flowspec rule not equal to original: %v\n", decRoute.FlowSpec)
+		return
+	}
+	if len(decRoute.ExtCommunity) != 1 || decRoute.ExtCommunity[0] != rate {
+		t.Errorf("decoded ext communities not equal to original: %v\n",
+			decRoute.ExtCommunity)
+		return
+	}
+	route = BGPRoute{WithdrawFlowSpec: []FlowSpecRule{rule}}
+	encUpdate, err = EncodeUpdateMsg(&route)
+	if err != nil {
+		t.Errorf("cant encode flowspec withdraw: %v\n", err)
+		return
+	}
+	decRoute, err = DecodeUpdateMsg(encUpdate, &BGPCapabilities{})
+	if err != nil || len(decRoute.WithdrawFlowSpec) != 1 ||
+		!reflect.DeepEqual(decRoute.WithdrawFlowSpec[0], rule) {
+		t.Errorf("decoded flowspec withdraw not equal to original: %v %v\n",
+			decRoute.WithdrawFlowSpec, err)
+	}
+}
+
+func TestMRTBGP4MPMsgEncoding(t *testing.T) {
+	ka, _ := hex.DecodeString(hexKA)
+	timestamp := time.Unix(1500000000, 0)
+	record, err := EncodeMRTBGP4MPMsg(timestamp, 65000, 65001,
+		net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.1"), ka)
+	if err != nil {
+		t.Errorf("cant encode mrt record: %v\n", err)
+		return
+	}
+	expected := "59682f00" + "0010" + "0004" + "00000027" +
+		"0000fde8" + "0000fde9" + "0000" + "0001" + "0a000002" + "0a000001" + hexKA
+	if hex.EncodeToString(record) != expected {
+		t.Errorf("mrt record is not equal to expected one: %x\n", record)
+	}
+	record, err = EncodeMRTBGP4MPMsg(timestamp, 65000, 65001,
+		net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::1"), ka)
+	if err != nil {
+		t.Errorf("cant encode mrt v6 record: %v\n", err)
+		return
+	}
+	expected = "59682f00" + "0010" + "0004" + "0000003f" +
+		"0000fde8" + "0000fde9" + "0000" + "0002" +
+		"20010db8000000000000000000000002" +
+		"20010db8000000000000000000000001" + hexKA
+	if hex.EncodeToString(record) != expected {
+		t.Errorf("mrt v6 record is not equal to expected one: %x\n", record)
+	}
+}
+
+func TestMRTRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mrt")
+	if err != nil {
+		t.Errorf("cant create tmp dir: %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	dumper := NewMRTDumper()
+	path := filepath.Join(dir, "dump.mrt")
+	if err := dumper.Start(path, 0, 1); err != nil {
+		t.Errorf("cant start mrt dump: %v\n", err)
+		return
+	}
+	recorder := &mrtRecorder{dumper: dumper,
+		remoteAddr: net.ParseIP("10.0.0.2"),
+		localAddr:  net.ParseIP("10.0.0.1")}
+	openMsg, _ := hex.DecodeString(hexOpenMsg)
+	ka, _ := hex.DecodeString(hexKA)
+	//socket reads are not aligned w/ msgs
+	rcvd := append(append([]byte{}, openMsg...), ka...)
+	recorder.record(rcvd[:7], true)
+	recorder.record(rcvd[7:50], true)
+	recorder.record(rcvd[50:], true)
+	recorder.record(ka, false)
+	dumper.Stop()
+	//msgs after stop are not recorded
+	recorder.record(ka, true)
+
+	dump, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Errorf("cant read mrt dump: %v\n", err)
+		return
+	}
+	records := make([]string, 0)
+	for len(dump) >= MRT_HDR_SIZE {
+		length := MRT_HDR_SIZE + int(binary.BigEndian.Uint32(dump[8:12]))
+		//timestamp is not checked
+		records = append(records, hex.EncodeToString(dump[4:length]))
+		dump = dump[length:]
+	}
+	expected := []string{
+		"0010" + "0004" + "0000004f" + "0000fde8" + "00000000" + "0000" + "0001" +
+			"0a000002" + "0a000001" + hexOpenMsg,
+		"0010" + "0004" + "00000027" + "0000fde8" + "00000000" + "0000" + "0001" +
+			"0a000002" + "0a000001" + hexKA,
+		//sent msg: local side is the sender
+		"0010" + "0004" + "00000027" + "00000000" + "0000fde8" + "0000" + "0001" +
+			"0a000001" + "0a000002" + hexKA,
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("mrt records are not equal to expected ones:\n%v\n%v\n",
+			records, expected)
+	}
+}
+
+func TestMRTDumperRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mrt")
+	if err != nil {
+		t.Errorf("cant create tmp dir: %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	dumper := NewMRTDumper()
+	path := filepath.Join(dir, "dump.mrt")
+	if err := dumper.Start(path, 100, 2); err != nil {
+		t.Errorf("cant start mrt dump: %v\n", err)
+		return
+	}
+	record := make([]byte, 60)
+	for i := 0; i < 4; i++ {
+		dumper.write(record)
+	}
+	dumper.Stop()
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil || info.Size() != 60 {
+			t.Errorf("unexpected rotated mrt dump %s: %v\n", name, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("more mrt dumps than configured are kept\n")
+	}
+	if status := dumper.Status(); status.Enabled || status.Error != "" {
+		t.Errorf("unexpected mrt dump status: %v\n", status)
+	}
+}
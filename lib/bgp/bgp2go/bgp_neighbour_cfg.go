@@ -0,0 +1,166 @@
+package bgp2go
+
+/*
+	per neighbour settings: remote/local asn, timers, passive mode etc.
+	everything is optional; w/o them neighbour behaves as before (any peer's
+	asn is accepted, context's asn is used as local one)
+*/
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DEFAULT_HOLD_TIME = 90
+	MIN_HOLD_TIME     = 3
+	AS_TRANS          = 23456
+)
+
+func checkNeighbourAFIs(neighbourCfg *BGPNeighbourCfg) error {
+	for _, afi := range neighbourCfg.AFIs {
+		if _, exists := name2AFI[afi]; !exists {
+			return fmt.Errorf("unknown afi: %s\n", afi)
+		}
+	}
+	return nil
+}
+
+/*
+	hold time 0 in cfg means default one; keepalive 0 - one third of the
+	negotiated hold time
+*/
+func checkNeighbourTimers(neighbourCfg *BGPNeighbourCfg) error {
+	if neighbourCfg.HoldTime == 0 {
+		neighbourCfg.HoldTime = DEFAULT_HOLD_TIME
+	}
+	if neighbourCfg.HoldTime < MIN_HOLD_TIME || neighbourCfg.HoldTime > 65535 {
+		return fmt.Errorf("hold time must be between %d and 65535 seconds\n",
+			MIN_HOLD_TIME)
+	}
+	if neighbourCfg.KeepaliveTime >= neighbourCfg.HoldTime {
+		return fmt.Errorf("keepalive time must be less than hold time\n")
+	}
+	return nil
+}
+
+func checkNeighbourASNs(neighbourCfg *BGPNeighbourCfg) error {
+	for _, asn := range []uint32{neighbourCfg.RemoteASN, neighbourCfg.LocalASN} {
+		if asn == AS_TRANS {
+			return fmt.Errorf("AS_TRANS cant be used as neighbour's asn\n")
+		}
+	}
+	return nil
+}
+
+//local asn, which is used for the session w/ neighbour
+func (neighbour *BGPNeighbour) asn(defaultASN uint32) uint32 {
+	if neighbour.localASN != 0 {
+		return neighbour.localASN
+	}
+	return defaultASN
+}
+
+func (context *BGPNeighbourContext) holdTime() uint32 {
+	if context.HoldTime == 0 {
+		return DEFAULT_HOLD_TIME
+	}
+	return context.HoldTime
+}
+
+func (context *BGPNeighbourContext) ebgp() bool {
+	return context.RemoteASN != 0 && context.RemoteASN != context.ASN
+}
+
+/*
+	returns open msg error's subcode if we must reject the neighbour's open
+*/
+func (context *BGPNeighbourContext) checkOpen(openMsg OpenMsg) (uint8, bool) {
+	peerASN := uint32(openMsg.Hdr.MyASN)
+	if openMsg.Caps.SupportASN4 {
+		peerASN = openMsg.Caps.ASN4
+	}
+	if context.RemoteASN != 0 && peerASN != context.RemoteASN {
+		return BGP_OM_ERROR_BAD_PEER_AS, false
+	}
+	//rfc 4271 6.2: hold time must be either zero or at least three seconds
+	if openMsg.Hdr.HoldTime != 0 && openMsg.Hdr.HoldTime < MIN_HOLD_TIME {
+		return BGP_OM_ERROR_UACCEPT_HOLD, false
+	}
+	return 0, true
+}
+
+/*
+	hold time is the smaller one of ours and neighbour's; if it's zero,
+	neither keepalives nor hold timer are used
+*/
+func (context *BGPNeighbourContext) negotiateTimers(peerHoldTime uint16) {
+	holdTime := context.holdTime()
+	if uint32(peerHoldTime) < holdTime {
+		holdTime = uint32(peerHoldTime)
+	}
+	context.fsm.HoldTime = holdTime
+	context.fsm.KeepaliveTime = holdTime / 3
+	if context.KeepaliveTime != 0 && context.KeepaliveTime < context.fsm.KeepaliveTime {
+		context.fsm.KeepaliveTime = context.KeepaliveTime
+	}
+}
+
+/*
+	(re)started each time we rcv something from the neighbour
+*/
+func (context *BGPNeighbourContext) resetHoldTimer() {
+	if context.fsm.HoldTime == 0 {
+		return
+	}
+	holdTime := time.Duration(context.fsm.HoldTime) * time.Second
+	if context.holdTimer == nil {
+		context.holdTimer = time.NewTimer(holdTime)
+		return
+	}
+	if !context.holdTimer.Stop() {
+		select {
+		case <-context.holdTimer.C:
+		default:
+		}
+	}
+	context.holdTimer.Reset(holdTime)
+}
+
+func (context *BGPNeighbourContext) stopHoldTimer() {
+	if context.holdTimer != nil {
+		context.holdTimer.Stop()
+		context.holdTimer = nil
+	}
+	context.fsm.HoldTime = 0
+}
+
+//nil chan (never ready) if hold timer is not running
+func (context *BGPNeighbourContext) holdTimerExpired() <-chan time.Time {
+	if context.holdTimer == nil {
+		return nil
+	}
+	return context.holdTimer.C
+}
+
+/*
+	rfc 4271 5.1.2/5.1.5: ebgp neighbour must get our asn in as_path and
+	must not get local_pref
+*/
+func (context *BGPNeighbourContext) setEBGPAttrs(route *BGPRoute) {
+	if !context.ebgp() {
+		return
+	}
+	route.Flags.EBGP = true
+	route.LOCAL_PREF = 0
+	if len(route.AS_PATH) > 0 && route.AS_PATH[0].PSType == AS_SEQ &&
+		len(route.AS_PATH[0].PSValue) < 255 {
+		segment := PathSegment{PSType: AS_SEQ,
+			PSValue: append([]uint32{context.ASN}, route.AS_PATH[0].PSValue...)}
+		segment.PSLength = uint8(len(segment.PSValue))
+		route.AS_PATH = append([]PathSegment{segment}, route.AS_PATH[1:]...)
+		return
+	}
+	route.AS_PATH = append([]PathSegment{PathSegment{PSType: AS_SEQ, PSLength: 1,
+		PSValue: []uint32{context.ASN}}}, route.AS_PATH...)
+}
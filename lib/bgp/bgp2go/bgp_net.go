@@ -29,6 +29,8 @@ type SockControlChans struct {
 	writeChan         chan []byte
 	controlChan       chan string
 	localAddr         string
+	localPort         string
+	remotePort        string
 	keepaliveFeedback chan uint8
 }
 
@@ -46,7 +48,7 @@ func (sockChans *SockControlChans) Init() {
 func ConnectToNeighbour(neighbour string,
 	fromWriteError, toWriteError, readError, toReadError chan uint8,
 	readChan, writeChan chan []byte,
-	controlChan chan string) error {
+	controlChan chan string, mrtDumper *MRTDumper) error {
 	remoteAddr := strings.Join([]string{neighbour, BGP_PORT}, ":")
 	tcpAddr, err := net.ResolveTCPAddr("tcp", remoteAddr)
 	if err != nil {
@@ -61,17 +63,17 @@ func ConnectToNeighbour(neighbour string,
 	syscall.SetsockoptInt(int(fd.Fd()), syscall.IPPROTO_IP, syscall.IP_TOS, DSCP_CS6)
 	fd.Close()
 	/*
-		sending our localaddress; so it can be used as NEXT_HOP
+		sending our localaddress (w/ port); so it can be used as NEXT_HOP
 	*/
-	host, _, _ := net.SplitHostPort(tcpConn.LocalAddr().String())
-	controlChan <- host
-	go ReadFromNeighbour(tcpConn, readChan, readError, toReadError)
-	go WriteToNeighbour(tcpConn, writeChan, fromWriteError, toWriteError)
+	controlChan <- tcpConn.LocalAddr().String()
+	recorder := newMRTRecorder(mrtDumper, tcpConn)
+	go ReadFromNeighbour(tcpConn, readChan, readError, toReadError, recorder)
+	go WriteToNeighbour(tcpConn, writeChan, fromWriteError, toWriteError, recorder)
 	return nil
 }
 
 func ReadFromNeighbour(sock *net.TCPConn, readChan chan []byte,
-	readError, toReadError chan uint8) {
+	readError, toReadError chan uint8, recorder *mrtRecorder) {
 	loop := 1
 	for loop == 1 {
 		buf := make([]byte, 1024)
@@ -86,6 +88,7 @@ func ReadFromNeighbour(sock *net.TCPConn, readChan chan []byte,
 				continue
 			}
 		}
+		recorder.record(buf[:bytes], true)
 		select {
 		case readChan <- buf[:bytes]:
 		case <-toReadError:
@@ -96,11 +99,12 @@ func ReadFromNeighbour(sock *net.TCPConn, readChan chan []byte,
 }
 
 func WriteToNeighbour(sock *net.TCPConn, writeChan chan []byte,
-	fromWriteError, toWriteError chan uint8) {
+	fromWriteError, toWriteError chan uint8, recorder *mrtRecorder) {
 	loop := 1
 	for loop == 1 {
 		select {
 		case msg := <-writeChan:
+			recorder.record(msg, false)
 		WRITE:
 			bytes, err := sock.Write(msg)
 			if err != nil {
@@ -134,7 +138,7 @@ func WriteToNeighbour(sock *net.TCPConn, writeChan chan []byte,
 
 */
 
-func BGPListenForConnection(toMainContext chan BGPCommand) error {
+func BGPListenForConnection(toMainContext chan BGPCommand, mrtDumper *MRTDumper) error {
 	addr := strings.Join([]string{"", BGP_PORT}, ":")
 	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
 	//TODO: log instead of return
@@ -154,12 +158,17 @@ func BGPListenForConnection(toMainContext chan BGPCommand) error {
 		fd, _ := sock.File()
 		syscall.SetsockoptInt(int(fd.Fd()), syscall.IPPROTO_IP, syscall.IP_TOS, DSCP_CS6)
 		fd.Close()
-		go ProcessPeerConection(sock, toMainContext)
+		go ProcessPeerConection(sock, toMainContext, mrtDumper)
 	}
 }
 
-func ProcessPeerConection(sock *net.TCPConn, toMainContext chan BGPCommand) {
-	radr := strings.Split(sock.RemoteAddr().String(), ":")[0]
+func ProcessPeerConection(sock *net.TCPConn, toMainContext chan BGPCommand,
+	mrtDumper *MRTDumper) {
+	radr, rport, _ := net.SplitHostPort(sock.RemoteAddr().String())
+	if strings.Contains(radr, ":") {
+		//v6 neighbours are configured as [<v6_addr>]
+		radr = "[" + radr + "]"
+	}
 	sockChans := SockControlChans{}
 	sockChans.Init()
 	toMainContext <- BGPCommand{Cmnd: "NewConnection", CmndData: radr,
@@ -169,15 +178,18 @@ func ProcessPeerConection(sock *net.TCPConn, toMainContext chan BGPCommand) {
 		sock.Close()
 		return
 	}
-	ladr, _, _ := net.SplitHostPort(sock.LocalAddr().String())
+	ladr, lport, _ := net.SplitHostPort(sock.LocalAddr().String())
 	if v4, _ := regexp.MatchString(`^(\d{1,3}\.){3}\d{1,3}$`, ladr); v4 {
 		toMainContext <- BGPCommand{Cmnd: "NewRouterID", CmndData: ladr}
 	}
 	sockChans.localAddr = ladr
+	sockChans.localPort = lport
+	sockChans.remotePort = rport
+	recorder := newMRTRecorder(mrtDumper, sock)
 	go ReadFromNeighbour(sock, sockChans.readChan, sockChans.readError,
-		sockChans.toReadError)
+		sockChans.toReadError, recorder)
 	go WriteToNeighbour(sock, sockChans.writeChan, sockChans.fromWriteError,
-		sockChans.toWriteError)
+		sockChans.toWriteError, recorder)
 	toMainContext <- BGPCommand{Cmnd: "AddPassiveNeighbour", CmndData: radr,
 		sockChans: sockChans}
 
@@ -0,0 +1,148 @@
+package bgp2go
+
+/*
+	next hops are chosen per session: next hops from neighbour's cfg first,
+	then session's local address. if we share the segment w/ v6 neighbour,
+	link local address of the interface is sent as well (rfc 2545 3)
+*/
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+func IPToIPv6Addr(ip net.IP) IPv6Addr {
+	var ipv6addr IPv6Addr
+	ip = ip.To16()
+	if ip == nil {
+		return ipv6addr
+	}
+	for i := 0; i < 4; i++ {
+		ipv6addr[i] = uint32(ip[i*FOUR_OCTETS])<<24 |
+			uint32(ip[i*FOUR_OCTETS+1])<<16 |
+			uint32(ip[i*FOUR_OCTETS+2])<<8 |
+			uint32(ip[i*FOUR_OCTETS+3])
+	}
+	return ipv6addr
+}
+
+/*
+	parses address in the form which is used for neighbours ([v6_addr] or
+	v4_addr); zone of link local address (fe80::1%eth0) is ignored
+*/
+func parseNeighbourIP(addr string) net.IP {
+	addr = strings.Trim(addr, "[]")
+	if idx := strings.Index(addr, "%"); idx != -1 {
+		addr = addr[:idx]
+	}
+	return net.ParseIP(addr)
+}
+
+func checkNextHops(neighbourCfg *BGPNeighbourCfg) error {
+	if neighbourCfg.NextHop != "" {
+		ip := net.ParseIP(neighbourCfg.NextHop)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("next hop is not v4 address: %v\n", neighbourCfg.NextHop)
+		}
+	}
+	if neighbourCfg.NextHopV6 != "" {
+		ip := net.ParseIP(neighbourCfg.NextHopV6)
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("next hop is not v6 address: %v\n", neighbourCfg.NextHopV6)
+		}
+	}
+	return nil
+}
+
+/*
+	returns link local address of the interface, which has localIP
+	configured and neighbourIP inside of it's subnet; nil if neighbour
+	is not on the same segment
+*/
+func sharedSegmentLinkLocal(localIP, neighbourIP net.IP) net.IP {
+	if localIP == nil || neighbourIP == nil {
+		return nil
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		onLink := false
+		var linkLocal net.IP
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.To4() != nil {
+				continue
+			}
+			if ipnet.IP.IsLinkLocalUnicast() {
+				linkLocal = ipnet.IP
+			}
+			if ipnet.IP.Equal(localIP) && ipnet.Contains(neighbourIP) {
+				onLink = true
+			}
+		}
+		if onLink && linkLocal != nil {
+			return linkLocal
+		}
+	}
+	return nil
+}
+
+/*
+	ladr is local address of the session's socket
+*/
+func (context *BGPNeighbourContext) selectNextHops(ladr string) {
+	context.NextHop = context.defaultNextHop
+	context.NextHopV6 = context.defaultNextHopV6
+	context.NextHopV6LinkLocal = IPv6Addr{}
+	localIP := parseNeighbourIP(ladr)
+	switch {
+	case localIP == nil:
+	case localIP.To4() != nil:
+		context.NextHop = localIP.String()
+	case localIP.IsLinkLocalUnicast():
+		//session over link local addresses
+		context.NextHopV6LinkLocal = IPToIPv6Addr(localIP)
+	default:
+		context.NextHopV6 = IPToIPv6Addr(localIP)
+		linkLocal := sharedSegmentLinkLocal(localIP,
+			parseNeighbourIP(context.NeighbourAddr))
+		if linkLocal != nil {
+			context.NextHopV6LinkLocal = IPToIPv6Addr(linkLocal)
+		}
+	}
+	if context.ConfiguredNextHop != "" {
+		context.NextHop = context.ConfiguredNextHop
+	}
+	if context.ConfiguredNextHopV6 != "" {
+		context.NextHopV6 = IPToIPv6Addr(net.ParseIP(context.ConfiguredNextHopV6))
+	}
+	/*
+		there is no global address to use; link local is the only nh we
+		could send
+	*/
+	if context.NextHopV6.isEqual(IPv6Addr{}) {
+		context.NextHopV6 = context.NextHopV6LinkLocal
+		context.NextHopV6LinkLocal = IPv6Addr{}
+	}
+}
+
+/*
+	next hop, which was set by policy or route's meta; neighbour's context
+	wont replace it w/ session's one
+*/
+func (bgpRoute *BGPRoute) setFixedNextHop(nextHop string) {
+	bgpRoute.Flags.FixedNextHop = true
+	if nh, err := IPv4ToUint32(nextHop); err == nil {
+		bgpRoute.NEXT_HOPv4 = nh
+		bgpRoute.AddV4NextHop(nextHop)
+	} else if nh, err := IPv6StringToAddr(nextHop); err == nil {
+		bgpRoute.NEXT_HOPv6 = nh
+	}
+}
@@ -0,0 +1,109 @@
+package bgp2go
+
+/*
+	Human readable notifications and shutdown communication (rfc 8203 and
+	rfc 9003, which extended max length of the msg to 255 bytes)
+*/
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+const (
+	MAX_SHUTDOWN_COMMUNICATION_LEN = 255
+)
+
+var (
+	errorCode2Name = map[uint8]string{
+		BGP_MSG_HEADER_ERROR:   "Message Header Error",
+		BGP_OPEN_MSG_ERROR:     "OPEN Message Error",
+		BGP_UPDATE_MSG_ERROR:   "UPDATE Message Error",
+		BGP_HOLD_TIMER_EXPIRED: "Hold Timer Expired",
+		BGP_FSM_ERROR:          "Finite State Machine Error",
+		BGP_CASE_ERROR:         "Cease",
+		BGP_ROUTEREFRESH_ERROR: "ROUTE-REFRESH Message Error",
+	}
+
+	ceaseSubcode2Name = map[uint8]string{
+		BGP_CASE_ERROR_MAX_PREFIX:          "Maximum Number of Prefixes Reached",
+		BGP_CASE_ERROR_ADMIN_SHUTDOWN:      "Administrative Shutdown",
+		BGP_CASE_ERROR_PEER_DECONFIGURED:   "Peer De-configured",
+		BGP_CASE_ERROR_ADMIN_RESET:         "Administrative Reset",
+		BGP_CASE_ERROR_CONNECTION_REJECTED: "Connection Rejected",
+		BGP_CASE_ERROR_CONFIG_CHANGE:       "Other Configuration Change",
+		BGP_CASE_ERROR_COLLISION:           "Connection Collision Resolution",
+		BGP_CASE_ERROR_OUT_OF_RESOURCES:    "Out of Resources",
+	}
+)
+
+func EncodeShutdownCommunication(communication string) ([]byte, error) {
+	if len(communication) > MAX_SHUTDOWN_COMMUNICATION_LEN {
+		return nil, fmt.Errorf("shutdown communication is too long: %v\n",
+			len(communication))
+	}
+	if !utf8.ValidString(communication) {
+		return nil, fmt.Errorf("shutdown communication must be valid utf-8\n")
+	}
+	encodedCommunication := []byte{uint8(len(communication))}
+	return append(encodedCommunication, communication...), nil
+}
+
+func DecodeShutdownCommunication(data []byte) (string, error) {
+	if len(data) == 0 {
+		return "", nil
+	}
+	length := int(data[0])
+	if length > len(data)-ONE_OCTET {
+		return "", fmt.Errorf("shutdown communication length is bigger than data: %v\n",
+			length)
+	}
+	communication := data[ONE_OCTET : ONE_OCTET+length]
+	if !utf8.Valid(communication) {
+		return "", fmt.Errorf("shutdown communication is not valid utf-8\n")
+	}
+	return string(communication), nil
+}
+
+/*
+	Cease w/ admin shutdown or admin reset subcodes are the only ones
+	which could carry shutdown communication
+*/
+func (notification *NotificationMsg) HasShutdownCommunication() bool {
+	return notification.ErrorCode == BGP_CASE_ERROR &&
+		(notification.ErrorSubcode == BGP_CASE_ERROR_ADMIN_SHUTDOWN ||
+			notification.ErrorSubcode == BGP_CASE_ERROR_ADMIN_RESET)
+}
+
+func (notification *NotificationMsg) String() string {
+	code, exists := errorCode2Name[notification.ErrorCode]
+	if !exists {
+		code = fmt.Sprintf("code %d", notification.ErrorCode)
+	}
+	subcode := fmt.Sprintf("subcode %d", notification.ErrorSubcode)
+	if notification.ErrorCode == BGP_CASE_ERROR {
+		if name, exists := ceaseSubcode2Name[notification.ErrorSubcode]; exists {
+			subcode = name
+		}
+	}
+	if !notification.HasShutdownCommunication() || len(notification.Data) == 0 {
+		return fmt.Sprintf("%s/%s", code, subcode)
+	}
+	communication, err := DecodeShutdownCommunication(notification.Data)
+	if err != nil {
+		return fmt.Sprintf("%s/%s (malformed shutdown communication)", code, subcode)
+	}
+	return fmt.Sprintf("%s/%s: %q", code, subcode, communication)
+}
+
+func GenerateCeaseMsg(subcode uint8, communication string) ([]byte, error) {
+	notification := NotificationMsg{ErrorCode: BGP_CASE_ERROR, ErrorSubcode: subcode}
+	if communication != "" && notification.HasShutdownCommunication() {
+		data, err := EncodeShutdownCommunication(communication)
+		if err != nil {
+			return nil, err
+		}
+		notification.Data = data
+	}
+	return EncodeNotificationMsg(&notification)
+}
@@ -108,7 +108,7 @@ func EncodeBGPRouteAttrs(bgpRoute *BGPRoute) ([]byte, error) {
 		encodedAttrs = append(encodedAttrs, data...)
 	}
 	//TODO: implement "withdraw" flag; so we wont check this len for each of supported mp-afi
-	if len(bgpRoute.WithdrawRoutesV6) == 0 {
+	if len(bgpRoute.WithdrawRoutesV6) == 0 && len(bgpRoute.WithdrawFlowSpec) == 0 {
 		data, err = EncodeASPathAttr(bgpRoute.AS_PATH, &pathAttr, bgpRoute.ASN4)
 		if err != nil {
 			return nil, err
@@ -116,7 +116,7 @@ func EncodeBGPRouteAttrs(bgpRoute *BGPRoute) ([]byte, error) {
 		encodedAttrs = append(encodedAttrs, data...)
 	}
 
-	if len(bgpRoute.WithdrawRoutesV6) == 0 {
+	if len(bgpRoute.WithdrawRoutesV6) == 0 && len(bgpRoute.WithdrawFlowSpec) == 0 {
 		if bgpRoute.MULTI_EXIT_DISC != 0 {
 			data, err = EncodeMEDAttr(&bgpRoute.MULTI_EXIT_DISC, &pathAttr)
 			if err != nil {
@@ -142,15 +142,16 @@ func EncodeBGPRouteAttrs(bgpRoute *BGPRoute) ([]byte, error) {
 
 	}
 	if len(bgpRoute.RoutesV6) != 0 {
-		data, err = EncodeV6MPRNLRI(bgpRoute.NEXT_HOPv6,
-			bgpRoute.RoutesV6, &pathAttr)
+		data, err = EncodeLinkLocalV6MPRNLRI(bgpRoute.NEXT_HOPv6,
+			bgpRoute.NEXT_HOPv6LinkLocal, bgpRoute.Flags, bgpRoute.RoutesV6,
+			&pathAttr)
 		if err != nil {
 			return nil, err
 		}
 		encodedAttrs = append(encodedAttrs, data...)
 	}
 	if len(bgpRoute.WithdrawRoutesV6) != 0 {
-		data, err = EncodeV6MPUNRNLRI(bgpRoute.WithdrawRoutesV6,
+		data, err = EncodeV6MPUNRNLRI(bgpRoute.Flags, bgpRoute.WithdrawRoutesV6,
 			&pathAttr)
 		if err != nil {
 			return nil, err
@@ -158,7 +159,15 @@ func EncodeBGPRouteAttrs(bgpRoute *BGPRoute) ([]byte, error) {
 		encodedAttrs = append(encodedAttrs, data...)
 	}
 	if bgpRoute.MPINET {
-		if len(bgpRoute.Routes) != 0 {
+		if len(bgpRoute.Routes) != 0 && bgpRoute.Flags.ExtendedNextHop {
+			data, err = EncodeExtNHV4MPRNLRI(bgpRoute.NEXT_HOPv6,
+				bgpRoute.NEXT_HOPv6LinkLocal, bgpRoute.Flags, bgpRoute.Routes,
+				&pathAttr)
+			if err != nil {
+				return nil, err
+			}
+			encodedAttrs = append(encodedAttrs, data...)
+		} else if len(bgpRoute.Routes) != 0 {
 			data, err = EncodeV4MPRNLRI(bgpRoute.NEXT_HOPv4,
 				bgpRoute.Flags, bgpRoute.Routes, &pathAttr)
 			if err != nil {
@@ -176,14 +185,34 @@ func EncodeBGPRouteAttrs(bgpRoute *BGPRoute) ([]byte, error) {
 		}
 	}
 
+	if len(bgpRoute.FlowSpec) != 0 {
+		data, err = EncodeFlowSpecMPRNLRI(bgpRoute.FlowSpec, &pathAttr)
+		if err != nil {
+			return nil, err
+		}
+		encodedAttrs = append(encodedAttrs, data...)
+	}
+	if len(bgpRoute.WithdrawFlowSpec) != 0 {
+		data, err = EncodeFlowSpecMPUNRNLRI(bgpRoute.WithdrawFlowSpec, &pathAttr)
+		if err != nil {
+			return nil, err
+		}
+		encodedAttrs = append(encodedAttrs, data...)
+	}
+
 	if len(bgpRoute.Community) != 0 {
-		for _, community := range bgpRoute.Community {
-			data, err := EncodeBGPCommunity(community, &pathAttr)
-			if err != nil {
-				return nil, err
-			}
-			encodedAttrs = append(encodedAttrs, data...)
+		data, err := EncodeBGPCommunities(bgpRoute.Community, &pathAttr)
+		if err != nil {
+			return nil, err
 		}
+		encodedAttrs = append(encodedAttrs, data...)
+	}
+	if len(bgpRoute.ExtCommunity) != 0 {
+		data, err := EncodeBGPExtCommunities(bgpRoute.ExtCommunity, &pathAttr)
+		if err != nil {
+			return nil, err
+		}
+		encodedAttrs = append(encodedAttrs, data...)
 	}
 
 	return encodedAttrs, nil
@@ -289,9 +318,14 @@ func EncodeNextHopAttr(nh []byte, pathAttr *PathAttr) ([]byte, error) {
 }
 
 func EncodeV6MPRNLRI(nh IPv6Addr, nlris []IPV6_NLRI, pathAttr *PathAttr) ([]byte, error) {
+	return EncodeLinkLocalV6MPRNLRI(nh, IPv6Addr{}, RouteFlags{}, nlris, pathAttr)
+}
+
+func EncodeLinkLocalV6MPRNLRI(nh, llnh IPv6Addr, flags RouteFlags,
+	nlris []IPV6_NLRI, pathAttr *PathAttr) ([]byte, error) {
 	pathAttr.AttrFlags = BAF_OPTIONAL
 	pathAttr.AttrTypeCode = BA_MP_REACH_NLRI
-	encData, err := EncodeIPV6_MP_REACH_NLRI(nh, nlris)
+	encData, err := EncodeLinkLocalIPV6_MP_REACH_NLRI(nh, llnh, flags, nlris)
 	if err != nil {
 		return nil, fmt.Errorf("cant encode ipv6 mp reach nlri: %v\n", err)
 	}
@@ -321,10 +355,28 @@ func EncodeV4MPRNLRI(nh uint32, flags RouteFlags, nlris []IPV4_NLRI,
 	return encodedAttr, nil
 }
 
-func EncodeV6MPUNRNLRI(nlris []IPV6_NLRI, pathAttr *PathAttr) ([]byte, error) {
+func EncodeExtNHV4MPRNLRI(nh, llnh IPv6Addr, flags RouteFlags,
+	nlris []IPV4_NLRI, pathAttr *PathAttr) ([]byte, error) {
+	pathAttr.AttrFlags = BAF_OPTIONAL
+	pathAttr.AttrTypeCode = BA_MP_REACH_NLRI
+	encData, err := EncodeExtNHIPV4_MP_REACH_NLRI(nh, llnh, flags, nlris)
+	if err != nil {
+		return nil, fmt.Errorf("cant encode ipv4 mp reach nlri: %v\n", err)
+	}
+	pathAttr.ExtendedLength = true
+	pathAttr.AttrFlags |= BAF_EXT_LEN
+	encodedAttr, err := EncodePathAttr(pathAttr, encData)
+	if err != nil {
+		return nil, fmt.Errorf("error during MP_REACH_NLRI attr encoding: %v\n", err)
+	}
+	return encodedAttr, nil
+}
+
+func EncodeV6MPUNRNLRI(flags RouteFlags, nlris []IPV6_NLRI,
+	pathAttr *PathAttr) ([]byte, error) {
 	pathAttr.AttrFlags = BAF_OPTIONAL
 	pathAttr.AttrTypeCode = BA_MP_UNREACH_NLRI
-	encData, err := EncodeIPV6_MP_UNREACH_NLRI(nlris)
+	encData, err := EncodeIPV6_MP_UNREACH_NLRI(flags, nlris)
 	if err != nil {
 		return nil, fmt.Errorf("cant encode ipv6 mp unreach nlri: %v\n", err)
 	}
@@ -337,6 +389,60 @@ func EncodeV6MPUNRNLRI(nlris []IPV6_NLRI, pathAttr *PathAttr) ([]byte, error) {
 	return encodedAttr, nil
 }
 
+/*
+	mp_reach/unreach could carry only single afi; all the rules must
+	be of the same one
+*/
+func flowSpecRulesAFI(rules []FlowSpecRule) (uint16, error) {
+	afi := rules[0].AFI
+	for _, rule := range rules {
+		if rule.AFI != afi {
+			return 0, fmt.Errorf("flowspec rules w/ different afis in the same update\n")
+		}
+	}
+	return afi, nil
+}
+
+func EncodeFlowSpecMPRNLRI(rules []FlowSpecRule, pathAttr *PathAttr) ([]byte, error) {
+	pathAttr.AttrFlags = BAF_OPTIONAL
+	pathAttr.AttrTypeCode = BA_MP_REACH_NLRI
+	afi, err := flowSpecRulesAFI(rules)
+	if err != nil {
+		return nil, err
+	}
+	encData, err := EncodeFlowSpec_MP_REACH_NLRI(afi, rules)
+	if err != nil {
+		return nil, fmt.Errorf("cant encode flowspec mp reach nlri: %v\n", err)
+	}
+	pathAttr.ExtendedLength = true
+	pathAttr.AttrFlags |= BAF_EXT_LEN
+	encodedAttr, err := EncodePathAttr(pathAttr, encData)
+	if err != nil {
+		return nil, fmt.Errorf("error during MP_REACH_NLRI attr encoding: %v\n", err)
+	}
+	return encodedAttr, nil
+}
+
+func EncodeFlowSpecMPUNRNLRI(rules []FlowSpecRule, pathAttr *PathAttr) ([]byte, error) {
+	pathAttr.AttrFlags = BAF_OPTIONAL
+	pathAttr.AttrTypeCode = BA_MP_UNREACH_NLRI
+	afi, err := flowSpecRulesAFI(rules)
+	if err != nil {
+		return nil, err
+	}
+	encData, err := EncodeFlowSpec_MP_UNREACH_NLRI(afi, rules)
+	if err != nil {
+		return nil, fmt.Errorf("cant encode flowspec mp unreach nlri: %v\n", err)
+	}
+	pathAttr.ExtendedLength = true
+	pathAttr.AttrFlags |= BAF_EXT_LEN
+	encodedAttr, err := EncodePathAttr(pathAttr, encData)
+	if err != nil {
+		return nil, fmt.Errorf("error during MP_UNREACH_NLRI attr encoding: %v\n", err)
+	}
+	return encodedAttr, nil
+}
+
 func EncodeV4MPUNRNLRI(flags RouteFlags, nlris []IPV4_NLRI,
 	pathAttr *PathAttr) ([]byte, error) {
 	pathAttr.AttrFlags = BAF_OPTIONAL
@@ -370,6 +476,50 @@ func EncodeBGPCommunity(community uint32, pathAttr *PathAttr) ([]byte, error) {
 	return encodedAttr, nil
 }
 
+/*
+	all communities must be in the single attribute; path attribute
+	could not be repeated in update msg (rfc 4271 5)
+*/
+func EncodeBGPCommunities(communities []uint32, pathAttr *PathAttr) ([]byte, error) {
+	pathAttr.AttrFlags = BAF_TRANSITIVE | BAF_OPTIONAL
+	pathAttr.AttrTypeCode = BA_COMMUNITY
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.BigEndian, communities)
+	if err != nil {
+		return nil, fmt.Errorf("error during communities encoding: %v\n", err)
+	}
+	pathAttr.ExtendedLength = false
+	if buf.Len() > 255 {
+		pathAttr.ExtendedLength = true
+		pathAttr.AttrFlags |= BAF_EXT_LEN
+	}
+	encodedAttr, err := EncodePathAttr(pathAttr, buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("error during COMMUNITIES attr encoding: %v\n", err)
+	}
+	return encodedAttr, nil
+}
+
+func EncodeBGPExtCommunities(extCommunities []uint64, pathAttr *PathAttr) ([]byte, error) {
+	pathAttr.AttrFlags = BAF_TRANSITIVE | BAF_OPTIONAL
+	pathAttr.AttrTypeCode = BA_EXT_COMMUNITY
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.BigEndian, extCommunities)
+	if err != nil {
+		return nil, fmt.Errorf("error during ext communities encoding: %v\n", err)
+	}
+	pathAttr.ExtendedLength = false
+	if buf.Len() > 255 {
+		pathAttr.ExtendedLength = true
+		pathAttr.AttrFlags |= BAF_EXT_LEN
+	}
+	encodedAttr, err := EncodePathAttr(pathAttr, buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("error during EXT_COMMUNITIES attr encoding: %v\n", err)
+	}
+	return encodedAttr, nil
+}
+
 /*
 TODO: lots of things must be implemented.(for example as_path can has more than one
 path_segment. also not sure will it work with non zero as_path (gonna test/fix it later,
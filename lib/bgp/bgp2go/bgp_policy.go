@@ -0,0 +1,309 @@
+package bgp2go
+
+/*
+	simple routing policy. policy is a list of terms, which are evaluated in
+	order; first term w/ accept or reject action terminates evaluation. terms
+	w/o action only modifies route's attributes and evaluation continues.
+	if none of the terms has terminated evaluation - route is accepted
+*/
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	POLICY_ACCEPT = "accept"
+	POLICY_REJECT = "reject"
+
+	COMMUNITY_NO_EXPORT           = 0xFFFFFF01
+	COMMUNITY_NO_ADVERTISE        = 0xFFFFFF02
+	COMMUNITY_NO_EXPORT_SUBCONFED = 0xFFFFFF03
+
+	//route meta's key, which contains name of the service, which owns the route
+	ROUTE_META_SERVICE = "service"
+)
+
+var (
+	wellKnownCommunities = map[string]uint32{
+		"no-export":           COMMUNITY_NO_EXPORT,
+		"no-advertise":        COMMUNITY_NO_ADVERTISE,
+		"no-export-subconfed": COMMUNITY_NO_EXPORT_SUBCONFED,
+	}
+)
+
+type PolicyMatch struct {
+	//route must be inside of one of this prefixes (e.g. 10.0.0.0/8)
+	Prefixes []string
+	//0 - any length
+	MinLength int
+	MaxLength int
+	//inet or inet6
+	AFI         string
+	Services    []string
+	Communities []string
+}
+
+type PolicySet struct {
+	//replaces route's communities
+	Communities []string
+	//adds to route's communities
+	AddCommunities []string
+	//prepend our asn this many times
+	Prepend   int
+	MED       *uint32
+	LocalPref *uint32
+	NextHop   string
+}
+
+type PolicyTerm struct {
+	Name  string
+	Match PolicyMatch
+	Set   PolicySet
+	//accept, reject or "" (continue w/ next term)
+	Action string
+}
+
+type Policy struct {
+	Terms []PolicyTerm
+}
+
+/*
+	community could be either <asn>:<value> or one of well known names
+	(no-export etc)
+*/
+func ParseCommunity(community string) (uint32, error) {
+	if val, exists := wellKnownCommunities[community]; exists {
+		return val, nil
+	}
+	parts := strings.Split(community, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("cant parse community: %v\n", community)
+	}
+	asn, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("cant parse community's asn: %v\n", err)
+	}
+	val, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("cant parse community's value: %v\n", err)
+	}
+	return uint32(asn<<16 | val), nil
+}
+
+func parseCommunities(communities []string) ([]uint32, error) {
+	parsed := make([]uint32, 0, len(communities))
+	for _, community := range communities {
+		val, err := ParseCommunity(community)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, val)
+	}
+	return parsed, nil
+}
+
+/*
+	checks that policy could be evaluated; so we wont find out about typos
+	when we are going to advertise the routes
+*/
+func (policy *Policy) Validate() error {
+	for n, term := range policy.Terms {
+		for _, prefix := range term.Match.Prefixes {
+			if _, _, err := net.ParseCIDR(prefix); err != nil {
+				return fmt.Errorf("term %d: cant parse prefix: %v\n", n, err)
+			}
+		}
+		if term.Match.AFI != "" {
+			if _, exists := name2AFI[term.Match.AFI]; !exists {
+				return fmt.Errorf("term %d: unknown afi: %v\n", n, term.Match.AFI)
+			}
+		}
+		communities := append([]string{}, term.Match.Communities...)
+		communities = append(communities, term.Set.Communities...)
+		communities = append(communities, term.Set.AddCommunities...)
+		if _, err := parseCommunities(communities); err != nil {
+			return fmt.Errorf("term %d: %v", n, err)
+		}
+		if term.Set.NextHop != "" && net.ParseIP(term.Set.NextHop) == nil {
+			return fmt.Errorf("term %d: cant parse next hop: %v\n", n, term.Set.NextHop)
+		}
+		switch term.Action {
+		case "", POLICY_ACCEPT, POLICY_REJECT:
+		default:
+			return fmt.Errorf("term %d: unknown action: %v\n", n, term.Action)
+		}
+	}
+	return nil
+}
+
+/*
+	route must contain exactly one prefix. returns false if route was
+	rejected; otherwise route's attributes are modified according to policy
+*/
+func (policy *Policy) Apply(bgpRoute *BGPRoute, meta map[string]string,
+	asn uint32) bool {
+	if policy == nil {
+		return true
+	}
+	for _, term := range policy.Terms {
+		if !term.Match.matches(bgpRoute, meta) {
+			continue
+		}
+		term.Set.apply(bgpRoute, asn)
+		switch term.Action {
+		case POLICY_ACCEPT:
+			return true
+		case POLICY_REJECT:
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	rcved update could contain lots of prefixes, so policy is applied
+	to each of them separately. first route in result contains withdrawn
+	prefixes (including the ones, which were rejected by policy)
+*/
+func (policy *Policy) Filter(bgpRoute *BGPRoute, asn uint32) []BGPRoute {
+	if policy == nil {
+		return []BGPRoute{*bgpRoute}
+	}
+	withdraw := BGPRoute{}
+	withdraw.WithdrawRoutes = append(withdraw.WithdrawRoutes, bgpRoute.WithdrawRoutes...)
+	withdraw.WithdrawRoutesV6 = append(withdraw.WithdrawRoutesV6, bgpRoute.WithdrawRoutesV6...)
+	routes := []BGPRoute{withdraw}
+	template := *bgpRoute
+	template.Routes = nil
+	template.RoutesV6 = nil
+	template.WithdrawRoutes = nil
+	template.WithdrawRoutesV6 = nil
+	for _, nlri := range bgpRoute.Routes {
+		route := template
+		route.Routes = []IPV4_NLRI{nlri}
+		if policy.Apply(&route, nil, asn) {
+			routes = append(routes, route)
+		} else {
+			routes[0].WithdrawRoutes = append(routes[0].WithdrawRoutes, nlri)
+		}
+	}
+	for _, nlri := range bgpRoute.RoutesV6 {
+		route := template
+		route.RoutesV6 = []IPV6_NLRI{nlri}
+		if policy.Apply(&route, nil, asn) {
+			routes = append(routes, route)
+		} else {
+			routes[0].WithdrawRoutesV6 = append(routes[0].WithdrawRoutesV6, nlri)
+		}
+	}
+	return routes
+}
+
+func routePrefix(bgpRoute *BGPRoute) (net.IP, int, string) {
+	if len(bgpRoute.Routes) > 0 {
+		nlri := bgpRoute.Routes[0]
+		return net.ParseIP(Uint32IPv4ToString(nlri.Prefix)), int(nlri.Length), "inet"
+	}
+	if len(bgpRoute.RoutesV6) > 0 {
+		nlri := bgpRoute.RoutesV6[0]
+		return IPv6AddrToIP(nlri.Prefix), int(nlri.Length), "inet6"
+	}
+	return nil, 0, ""
+}
+
+func (match *PolicyMatch) matches(bgpRoute *BGPRoute, meta map[string]string) bool {
+	prefix, length, afi := routePrefix(bgpRoute)
+	if prefix == nil {
+		return false
+	}
+	if match.AFI != "" && match.AFI != afi {
+		return false
+	}
+	if match.MinLength > 0 && length < match.MinLength {
+		return false
+	}
+	if match.MaxLength > 0 && length > match.MaxLength {
+		return false
+	}
+	if len(match.Prefixes) > 0 {
+		found := false
+		for _, matchPrefix := range match.Prefixes {
+			_, network, err := net.ParseCIDR(matchPrefix)
+			if err != nil {
+				continue
+			}
+			matchLength, _ := network.Mask.Size()
+			if network.Contains(prefix) && length >= matchLength {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(match.Services) > 0 {
+		found := false
+		for _, service := range match.Services {
+			if meta[ROUTE_META_SERVICE] == service {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(match.Communities) > 0 {
+		communities, _ := parseCommunities(match.Communities)
+		found := false
+		for _, community := range communities {
+			for _, routeCommunity := range bgpRoute.Community {
+				if community == routeCommunity {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (set *PolicySet) apply(bgpRoute *BGPRoute, asn uint32) {
+	if set.Communities != nil {
+		bgpRoute.Community, _ = parseCommunities(set.Communities)
+	}
+	if len(set.AddCommunities) > 0 {
+		communities, _ := parseCommunities(set.AddCommunities)
+		//dont modify community slice, which could be shared w/ other routes
+		bgpRoute.Community = append(append([]uint32{}, bgpRoute.Community...),
+			communities...)
+	}
+	if set.Prepend > 0 {
+		prepended := PathSegment{PSType: AS_SEQ}
+		for cntr := 0; cntr < set.Prepend; cntr++ {
+			prepended.PSValue = append(prepended.PSValue, asn)
+		}
+		if len(bgpRoute.AS_PATH) > 0 && bgpRoute.AS_PATH[0].PSType == AS_SEQ {
+			prepended.PSValue = append(prepended.PSValue, bgpRoute.AS_PATH[0].PSValue...)
+			bgpRoute.AS_PATH = append([]PathSegment{prepended}, bgpRoute.AS_PATH[1:]...)
+		} else {
+			bgpRoute.AS_PATH = append([]PathSegment{prepended}, bgpRoute.AS_PATH...)
+		}
+		bgpRoute.AS_PATH[0].PSLength = uint8(len(bgpRoute.AS_PATH[0].PSValue))
+	}
+	if set.MED != nil {
+		bgpRoute.MULTI_EXIT_DISC = *set.MED
+	}
+	if set.LocalPref != nil {
+		bgpRoute.LOCAL_PREF = *set.LocalPref
+	}
+	if set.NextHop != "" {
+		bgpRoute.setFixedNextHop(set.NextHop)
+	}
+}
@@ -1,8 +1,10 @@
 package bgp2go
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 )
@@ -130,3 +132,11 @@ func IPv6AddrToString(ipv6addr IPv6Addr) string {
 	}
 	return ipv6
 }
+
+func IPv6AddrToIP(ipv6addr IPv6Addr) net.IP {
+	ipv6 := make(net.IP, IPV6_ADDRESS_LEN)
+	for i := 0; i < 4; i++ {
+		binary.BigEndian.PutUint32(ipv6[i*FOUR_OCTETS:], ipv6addr[i])
+	}
+	return ipv6
+}
@@ -8,6 +8,7 @@ package bgp2go
 //TODO: logging everywhere
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -19,10 +20,17 @@ var (
 	name2AFI = map[string]MPCapability{
 		"inet":  MPCapability{AFI: MP_AFI_IPV4, SAFI: MP_SAFI_UCAST},
 		"inet6": MPCapability{AFI: MP_AFI_IPV6, SAFI: MP_SAFI_UCAST},
+		"flow":  MPCapability{AFI: MP_AFI_IPV4, SAFI: MP_SAFI_FLOWSPEC},
+		"flow6": MPCapability{AFI: MP_AFI_IPV6, SAFI: MP_SAFI_FLOWSPEC},
 	}
 
 	mpCapInet  = MPCapability{AFI: MP_AFI_IPV4, SAFI: MP_SAFI_UCAST}
 	mpCapInet6 = MPCapability{AFI: MP_AFI_IPV6, SAFI: MP_SAFI_UCAST}
+	mpCapFlow  = MPCapability{AFI: MP_AFI_IPV4, SAFI: MP_SAFI_FLOWSPEC}
+	mpCapFlow6 = MPCapability{AFI: MP_AFI_IPV6, SAFI: MP_SAFI_FLOWSPEC}
+	//v4 routes w/ v6 next hop
+	extNHInet = ExtendedNHCapability{AFI: MP_AFI_IPV4, SAFI: MP_SAFI_UCAST,
+		NHAFI: MP_AFI_IPV6}
 )
 
 /*
@@ -34,6 +42,9 @@ type BGPContext struct {
 	//TODO: rib per afi/safi
 	RIBv4         []IPV4_NLRI
 	RIBv6         []IPV6_NLRI
+	RIBFlowSpec   []FlowSpecRule
+	//additional info about routes from RIBs (e.g. service), used by policies
+	routeMeta     map[string]map[string]string
 	ListenLocal   bool
 	Neighbours    []BGPNeighbour
 	ToMainContext chan BGPCommand
@@ -41,6 +52,24 @@ type BGPContext struct {
 	NextHopV6     IPv6Addr // use them lateron in route
 	Community     []uint32 // creation
 	LocalPref     uint32   // ..
+	/*
+		optional; if not nil, neighbours are going to report
+		what's going on w/ them (rcved notifications etc) into this chan.
+		events are dropped if nobody reads them
+	*/
+	Events chan BGPEvent
+	//optional; session state & sent updates of the neighbours (e.g. for bmp)
+	Monitor chan BGPMonitorMsg
+	//optional; mrt dump of the msgs sent to/rcved from the neighbours
+	MRT *MRTDumper
+	/*
+		Adj-RIB-In (routes rcved from neighbours) is enabled by default;
+		AdjRIBInLimit is the max amount of prefixes, which we store per
+		neighbour (0 - unlimited)
+	*/
+	DisableAdjRIBIn bool
+	AdjRIBInLimit   int
+	adjRIBIn        *AdjRIBIn
 }
 
 /*
@@ -63,7 +92,40 @@ type BGPNeighbour struct {
 	*/
 	speaksInet  bool
 	speaksInet6 bool
+	speaksFlow  bool
+	speaksFlow6 bool
 	as4         bool
+	/*
+		administratively shutdowned neighbour (w/ shutdown communication,
+		which would be sent to it). we dont try to connect to it and
+		rejects its connections till it's enabled again
+	*/
+	adminDown    bool
+	shutdownMsg  string
+	activeExists bool
+	maxPrefix    MaxPrefixCfg
+	//neighbour is down coz it has sent us too many prefixes
+	maxPrefixDown  bool
+	inboundPolicy  *Policy
+	outboundPolicy *Policy
+	//override next hops, which are taken from session's local address
+	nextHop   string
+	nextHopV6 string
+	//advertise v4 routes w/ v6 next hop (rfc 8950)
+	extendedNextHop bool
+	//afi/safi for which we would like to send all paths (rfc 7911)
+	addPath []MPCapability
+	//neighbour has agreed to rcv all paths
+	addPathInet  bool
+	addPathInet6 bool
+	//per neighbour settings (check BGPNeighbourCfg)
+	mpCaps        []MPCapability
+	remoteASN     uint32
+	localASN      uint32
+	holdTime      uint32
+	keepaliveTime uint32
+	passiveOnly   bool
+	description   string
 }
 
 /*
@@ -72,7 +134,44 @@ type BGPNeighbour struct {
 */
 type BGPNeighbourCfg struct {
 	Address string
-	MPCaps  []MPCapability
+	MPCaps  []MPCapability `json:"-"`
+	//names of afi/safi (inet, inet6, flow, flow6); used when cfg is json encoded
+	AFIs           []string
+	MaxPrefix      MaxPrefixCfg
+	InboundPolicy  *Policy
+	OutboundPolicy *Policy
+	NextHop        string
+	NextHopV6      string
+	/*
+		v4 routes over v6 session; inet afi must be enabled as well
+		(rfc 8950)
+	*/
+	ExtendedNextHop bool
+	//names of afi/safi, for which all paths of a prefix are sent (rfc 7911)
+	AddPath []string
+	//if set, neighbour's open w/ other asn is rejected
+	RemoteASN uint32
+	//overrides context's asn for this neighbour
+	LocalASN uint32
+	//in seconds; 0 - defaults (see checkNeighbourTimers)
+	HoldTime      uint32
+	KeepaliveTime uint32
+	//we never connect to passive neighbour; only accept its connections
+	Passive     bool
+	Description string
+	//neighbour is added in administratively down state (check AdminShutdown)
+	Shutdown bool
+}
+
+/*
+	something, which external app could be interested in (for logging etc)
+	Event: NotificationRcvd, NotificationSent, AdjRIBInLimit,
+	MaxPrefixWarning, MaxPrefixExceeded, BFDDown
+*/
+type BGPEvent struct {
+	Neighbour string
+	Event     string
+	Data      string
 }
 
 type BGPCommand struct {
@@ -98,9 +197,35 @@ type BGPNeighbourContext struct {
 	RouterID      uint32
 	NextHop       string
 	NextHopV6     IPv6Addr
-	asn4          bool
-	fsm           FSM
-	MPCaps        []MPCapability
+	//zero if we dont share the segment w/ the neighbour
+	NextHopV6LinkLocal IPv6Addr
+	//next hops from neighbour's cfg; override session's local address
+	ConfiguredNextHop   string
+	ConfiguredNextHopV6 string
+	/*
+		used when session's local address is of other family (e.g. v4 routes
+		over v6 session)
+	*/
+	defaultNextHop   string
+	defaultNextHopV6 IPv6Addr
+	//advertise extended next hop capability for inet afi
+	ExtendedNextHop bool
+	//both sides support v4 routes w/ v6 next hop
+	extendedNextHop bool
+	asn4            bool
+	fsm             FSM
+	MPCaps          []MPCapability
+	//advertise add path (send) capability for this afi/safi
+	AddPath []MPCapability
+	//0 if any asn is accepted
+	RemoteASN uint32
+	//configured timers; negotiated ones are in fsm
+	HoldTime      uint32
+	KeepaliveTime uint32
+	holdTimer     *time.Timer
+	//neighbour is able to rcv multiple paths; we are sending path ids
+	addPathInet  bool
+	addPathInet6 bool
 	/*
 		we are going to use this to decide should we adv routes
 		of such families to this neighbour or not.
@@ -108,10 +233,27 @@ type BGPNeighbourContext struct {
 	*/
 	speaksInet  bool
 	speaksInet6 bool
+	speaksFlow  bool
+	speaksFlow6 bool
 	as4         bool
-	//placeholders, not yet implemented
-	InboundPolicy  string
-	OutboundPolicy string
+	//route refresh (rfc 2918/7313) caps, advertised by the peer
+	routeRefresh         bool
+	enhancedRouteRefresh bool
+	//cmnds from main context, which we have rcved while sending msg to it
+	pendingCmnds []BGPCommand
+	Events       chan BGPEvent
+	Monitor      chan BGPMonitorMsg
+	monitor      monitorState
+	MRT          *MRTDumper
+	MaxPrefix    MaxPrefixCfg
+	//unique prefixes, rcved in current session; used for max prefix check
+	rcvedPrefixes     map[string]bool
+	maxPrefixWarned   bool
+	maxPrefixExceeded bool
+	//routes rcved from neighbour are stored here; nil if disabled
+	AdjRIBIn *AdjRIBIn
+	//applied to rcved routes before they are stored in adj-rib-in
+	InboundPolicy *Policy
 }
 
 /*
@@ -135,9 +277,12 @@ type BGPProcessMsg struct {
 func StartBGPProcess(toBGPProcess, fromBGPProcess chan BGPProcessMsg,
 	bgpContext BGPContext) {
 	bgpContext.ToMainContext = make(chan BGPCommand)
+	if !bgpContext.DisableAdjRIBIn {
+		bgpContext.adjRIBIn = NewAdjRIBIn(bgpContext.AdjRIBInLimit)
+	}
 	//we need root access to bind @ < 1024 port
 	if bgpContext.ListenLocal {
-		go BGPListenForConnection(bgpContext.ToMainContext)
+		go BGPListenForConnection(bgpContext.ToMainContext, bgpContext.MRT)
 	}
 	loop := 1
 	for loop == 1 {
@@ -166,6 +311,22 @@ func (context *BGPContext) ProcessExternalCommand(cmnd BGPProcessMsg,
 		context.AddV6Route(cmnd.Data)
 	case "WithdrawV6Route":
 		context.WithdrawV6Route(cmnd.Data)
+	case "ShutdownNeighbour":
+		context.ShutdownNeighbour(cmnd.Data)
+	case "ResetNeighbour":
+		context.ResetNeighbour(cmnd.Data)
+	case "EnableNeighbour":
+		context.EnableNeighbour(cmnd.Data)
+	case "GetAdjRIBIn":
+		responseChan <- context.GetAdjRIBIn(cmnd.Data)
+	case "GetAdjRIBInCounts":
+		responseChan <- context.GetAdjRIBInCounts()
+	case "BFDDown":
+		context.BFDDown(cmnd.Data)
+	case "AddFlowSpec":
+		context.AddFlowSpec(cmnd.Data)
+	case "WithdrawFlowSpec":
+		context.WithdrawFlowSpec(cmnd.Data)
 	}
 }
 
@@ -186,7 +347,7 @@ func (context *BGPContext) ProcessNeighbourCommand(cmnd BGPCommand) {
 			cmnd.ResponseChan <- "teardown"
 			return
 		}
-		if neighbour.State == "Established" {
+		if neighbour.State == "Established" || neighbour.adminDown {
 			cmnd.ResponseChan <- "teardown"
 			return
 		}
@@ -220,7 +381,8 @@ func (context *BGPContext) ProcessNeighbourCommand(cmnd BGPCommand) {
 
 	case "PassiveWonCollisionDetection", "PassiveClossed", "ActiveClossed",
 		"ActiveConnected", "Down", "Established", "PassiveEstablished",
-		"speaksInet", "speaksInet6":
+		"speaksInet", "speaksInet6", "speaksFlow", "speaksFlow6",
+		"addPathInet", "addPathInet6":
 		context.ChangeNeighbourInfo(cmnd.From, cmnd.Cmnd)
 
 	case "PassiveTeardown":
@@ -228,6 +390,15 @@ func (context *BGPContext) ProcessNeighbourCommand(cmnd BGPCommand) {
 
 	case "ActiveStartConnection":
 		context.CheckNeighbourInfo(&cmnd)
+
+	case "RouteRefresh":
+		context.RefreshRoutes(cmnd.From, cmnd.CmndData)
+
+	case "MaxPrefixExceeded":
+		context.MaxPrefixExceeded(cmnd.From)
+
+	case "MaxPrefixRestart":
+		context.MaxPrefixRestart(cmnd.From)
 	}
 }
 
@@ -254,6 +425,56 @@ func parseNeighbourData(data []string, neighbourCfg *BGPNeighbourCfg) {
 	}
 }
 
+/*
+	Data could be either "<address> <afi> <afi>" or json encoded
+	BGPNeighbourCfg (which allows to pass additional options, e.g max prefix)
+*/
+func parseNeighbourCfg(neighbourData string) (BGPNeighbourCfg, error) {
+	var neighbourCfg BGPNeighbourCfg
+	neighbourData = strings.TrimSpace(neighbourData)
+	if strings.HasPrefix(neighbourData, "{") {
+		err := json.Unmarshal([]byte(neighbourData), &neighbourCfg)
+		if err != nil {
+			return neighbourCfg, fmt.Errorf("cant decode neighbour's cfg: %v\n", err)
+		}
+		if err := checkNeighbourAFIs(&neighbourCfg); err != nil {
+			return neighbourCfg, err
+		}
+		parseNeighbourData(neighbourCfg.AFIs, &neighbourCfg)
+		if err := checkNeighbourASNs(&neighbourCfg); err != nil {
+			return neighbourCfg, err
+		}
+		if err := checkNeighbourTimers(&neighbourCfg); err != nil {
+			return neighbourCfg, err
+		}
+		if err := checkNextHops(&neighbourCfg); err != nil {
+			return neighbourCfg, err
+		}
+		if err := checkAddPath(&neighbourCfg); err != nil {
+			return neighbourCfg, err
+		}
+		for _, policy := range []*Policy{neighbourCfg.InboundPolicy,
+			neighbourCfg.OutboundPolicy} {
+			if policy == nil {
+				continue
+			}
+			if err := policy.Validate(); err != nil {
+				return neighbourCfg, fmt.Errorf("invalid policy: %v", err)
+			}
+		}
+		return neighbourCfg, nil
+	}
+	dataFields := strings.Fields(neighbourData)
+	if len(dataFields) == 0 {
+		return neighbourCfg, fmt.Errorf("neighbour's address is not specified\n")
+	}
+	neighbourCfg.Address = dataFields[0]
+	if len(dataFields) > 1 {
+		parseNeighbourData(dataFields, &neighbourCfg)
+	}
+	return neighbourCfg, nil
+}
+
 func (context *BGPContext) AddNeighbour(neighbourData string) {
 	/*
 		IMPORTANT: for v6 peering to work, neighbours address
@@ -263,28 +484,44 @@ func (context *BGPContext) AddNeighbour(neighbourData string) {
 		this lib; mb will change my mind in future)
 		for example check: go_keepalived/notifier/bgp_nitifier.go
 	*/
-	var neighbourCfg BGPNeighbourCfg
-	dataFields := strings.Fields(neighbourData)
-	neighbourCfg.Address = dataFields[0]
-	if len(dataFields) > 1 {
-		parseNeighbourData(dataFields, &neighbourCfg)
+	neighbourCfg, err := parseNeighbourCfg(neighbourData)
+	if err != nil {
+		return
 	}
-	_, err, _ := context.FindNeighbour(neighbourCfg.Address)
+	_, err, _ = context.FindNeighbour(neighbourCfg.Address)
 	if err == nil {
 		//neighbour already exists
 		return
 	}
 	cmndChan := make(chan BGPCommand, 1)
 	passiveCmndChan := make(chan BGPCommand, 1)
+	//passive or shutdowned neighbour doesnt have active context
+	activeExists := !neighbourCfg.Passive && !neighbourCfg.Shutdown
 	context.Neighbours = append(context.Neighbours, BGPNeighbour{
 		Address: neighbourCfg.Address,
 		State:   "Idle", CmndChan: cmndChan,
-		toPassiveNeighbourContext: passiveCmndChan})
-	bgpNeighbourContext := BGPNeighbourContext{RouterID: context.RouterID,
-		ASN: context.ASN, ToMainContext: context.ToMainContext,
-		ToNeighbourContext: cmndChan,
-		NeighbourAddr:      neighbourCfg.Address}
-	bgpNeighbourContext.MPCaps = append(bgpNeighbourContext.MPCaps, neighbourCfg.MPCaps...)
+		toPassiveNeighbourContext: passiveCmndChan,
+		activeExists:              activeExists,
+		mpCaps:                    neighbourCfg.MPCaps,
+		adminDown:                 neighbourCfg.Shutdown,
+		remoteASN:                 neighbourCfg.RemoteASN,
+		localASN:                  neighbourCfg.LocalASN,
+		holdTime:                  neighbourCfg.HoldTime,
+		keepaliveTime:             neighbourCfg.KeepaliveTime,
+		passiveOnly:               neighbourCfg.Passive,
+		description:               neighbourCfg.Description,
+		maxPrefix:                 neighbourCfg.MaxPrefix,
+		inboundPolicy:             neighbourCfg.InboundPolicy,
+		outboundPolicy:            neighbourCfg.OutboundPolicy,
+		nextHop:                   neighbourCfg.NextHop,
+		nextHopV6:                 neighbourCfg.NextHopV6,
+		extendedNextHop:           neighbourCfg.ExtendedNextHop,
+		addPath:                   addPathCaps(neighbourCfg.AddPath)})
+	if !activeExists {
+		return
+	}
+	bgpNeighbourContext := context.newNeighbourContext(
+		&context.Neighbours[len(context.Neighbours)-1], cmndChan)
 	go StartBGPNeighbourContext(&bgpNeighbourContext, false, SockControlChans{})
 }
 
@@ -300,7 +537,12 @@ func (context *BGPContext) RemoveNeighbour(neighbourData string) {
 		//neighbour doesnt exists
 		return
 	}
-	neighbour.CmndChan <- BGPCommand{Cmnd: "Shutdown"}
+	if neighbour.State == "Established" || neighbour.activeExists {
+		neighbour.CmndChan <- BGPCommand{Cmnd: "Shutdown"}
+	}
+	if context.adjRIBIn != nil {
+		context.adjRIBIn.Clear(neighbour.Address)
+	}
 	if i == (len(context.Neighbours) - 1) {
 		context.Neighbours = context.Neighbours[:i]
 	} else {
@@ -316,14 +558,16 @@ func (context *BGPContext) RestartActiveNeighbour(neighbour string) {
 		*/
 		return
 	}
+	if bgpNeighbour.adminDown || bgpNeighbour.passiveOnly {
+		bgpNeighbour.activeExists = false
+		return
+	}
 	if bgpNeighbour.CmndChan == bgpNeighbour.toPassiveNeighbourContext {
 		cmndChan := make(chan BGPCommand, 1)
 		bgpNeighbour.CmndChan = cmndChan
 	}
-	bgpNeighbourContext := BGPNeighbourContext{RouterID: context.RouterID,
-		ASN: context.ASN, ToMainContext: context.ToMainContext,
-		ToNeighbourContext: bgpNeighbour.CmndChan,
-		NeighbourAddr:      neighbour}
+	bgpNeighbour.activeExists = true
+	bgpNeighbourContext := context.newNeighbourContext(bgpNeighbour, bgpNeighbour.CmndChan)
 
 	go StartBGPNeighbourContext(&bgpNeighbourContext, false, SockControlChans{})
 
@@ -342,13 +586,152 @@ func (context *BGPContext) AddPassiveNeighbour(neighbourAddr string, sockChans S
 		return
 	}
 	neighbour.passiveExist = true
-	bgpNeighbourContext := BGPNeighbourContext{RouterID: context.RouterID,
-		ASN: context.ASN, ToMainContext: context.ToMainContext,
-		ToNeighbourContext: neighbour.toPassiveNeighbourContext,
-		NeighbourAddr:      neighbourAddr}
+	bgpNeighbourContext := context.newNeighbourContext(neighbour,
+		neighbour.toPassiveNeighbourContext)
 	go StartBGPNeighbourContext(&bgpNeighbourContext, true, sockChans)
 }
 
+func (context *BGPContext) newNeighbourContext(neighbour *BGPNeighbour,
+	cmndChan chan BGPCommand) BGPNeighbourContext {
+	neighbourContext := BGPNeighbourContext{RouterID: context.RouterID,
+		ASN: neighbour.asn(context.ASN), ToMainContext: context.ToMainContext,
+		ToNeighbourContext:  cmndChan,
+		NeighbourAddr:       neighbour.Address,
+		Events:              context.Events,
+		Monitor:             context.Monitor,
+		MRT:                 context.MRT,
+		AdjRIBIn:            context.adjRIBIn,
+		MaxPrefix:           neighbour.maxPrefix,
+		InboundPolicy:       neighbour.inboundPolicy,
+		ConfiguredNextHop:   neighbour.nextHop,
+		ConfiguredNextHopV6: neighbour.nextHopV6,
+		defaultNextHopV6:    context.NextHopV6,
+		ExtendedNextHop:     neighbour.extendedNextHop,
+		AddPath:             neighbour.addPath,
+		MPCaps:              neighbour.mpCaps,
+		RemoteASN:           neighbour.remoteASN,
+		HoldTime:            neighbour.holdTime,
+		KeepaliveTime:       neighbour.keepaliveTime}
+	if context.NextHop != 0 {
+		neighbourContext.defaultNextHop = Uint32IPv4ToString(context.NextHop)
+	}
+	return neighbourContext
+}
+
+/*
+	Data: neighbour's address or "" for all neighbours.
+	response's Data contains json encoded []AdjRIBInEntry
+*/
+func (context *BGPContext) GetAdjRIBIn(neighbour string) BGPProcessMsg {
+	if context.adjRIBIn == nil {
+		return BGPProcessMsg{Cmnd: "Error", Data: "adj-rib-in is disabled"}
+	}
+	encodedRoutes, err := json.Marshal(context.adjRIBIn.Routes(
+		strings.TrimSpace(neighbour)))
+	if err != nil {
+		return BGPProcessMsg{Cmnd: "Error",
+			Data: fmt.Sprintf("cant encode adj-rib-in: %v", err)}
+	}
+	return BGPProcessMsg{Cmnd: "AdjRIBIn", Data: string(encodedRoutes)}
+}
+
+/*
+	response's Data contains json encoded amount of stored prefixes
+	per neighbour
+*/
+func (context *BGPContext) GetAdjRIBInCounts() BGPProcessMsg {
+	if context.adjRIBIn == nil {
+		return BGPProcessMsg{Cmnd: "Error", Data: "adj-rib-in is disabled"}
+	}
+	encodedCounts, err := json.Marshal(context.adjRIBIn.Counts())
+	if err != nil {
+		return BGPProcessMsg{Cmnd: "Error",
+			Data: fmt.Sprintf("cant encode adj-rib-in counts: %v", err)}
+	}
+	return BGPProcessMsg{Cmnd: "AdjRIBInCounts", Data: string(encodedCounts)}
+}
+
+/*
+	Data: "<neighbour> <shutdown communication>"; communication is optional
+*/
+func parseNeighbourCommunication(data string) (string, string) {
+	dataFields := strings.SplitN(strings.TrimSpace(data), " ", 2)
+	if len(dataFields) == 1 {
+		return dataFields[0], ""
+	}
+	return dataFields[0], strings.TrimSpace(dataFields[1])
+}
+
+/*
+	sends cease/admin shutdown to the neighbour and keeps session w/ it down
+	till EnableNeighbour
+*/
+func (context *BGPContext) ShutdownNeighbour(neighbourData string) {
+	neighbourAddr, communication := parseNeighbourCommunication(neighbourData)
+	neighbour, err, _ := context.FindNeighbour(neighbourAddr)
+	if err != nil {
+		return
+	}
+	neighbour.adminDown = true
+	neighbour.maxPrefixDown = false
+	neighbour.shutdownMsg = communication
+	if neighbour.State == "Established" {
+		context.sendAdminShutdown(neighbour)
+	}
+}
+
+func (context *BGPContext) sendAdminShutdown(neighbour *BGPNeighbour) {
+	if neighbour.CmndChan != neighbour.toPassiveNeighbourContext {
+		//active context is going to be terminated
+		neighbour.activeExists = false
+	}
+	neighbour.CmndChan <- BGPCommand{Cmnd: "AdminShutdown",
+		CmndData: neighbour.shutdownMsg}
+}
+
+func (context *BGPContext) ResetNeighbour(neighbourData string) {
+	neighbourAddr, communication := parseNeighbourCommunication(neighbourData)
+	neighbour, err, _ := context.FindNeighbour(neighbourAddr)
+	if err != nil {
+		return
+	}
+	if neighbour.State == "Established" {
+		neighbour.CmndChan <- BGPCommand{Cmnd: "AdminReset",
+			CmndData: communication}
+	}
+}
+
+/*
+	bfd has detected that forwarding path to the neighbour is down; there is
+	no point in waiting for hold timer to expire (RFC 5882)
+*/
+func (context *BGPContext) BFDDown(neighbourAddr string) {
+	neighbour, err, _ := context.FindNeighbour(neighbourAddr)
+	if err != nil {
+		return
+	}
+	if neighbour.State == "Established" {
+		neighbour.CmndChan <- BGPCommand{Cmnd: "BFDDown"}
+	}
+}
+
+func (context *BGPContext) EnableNeighbour(neighbourData string) {
+	neighbourAddr, _ := parseNeighbourCommunication(neighbourData)
+	neighbour, err, _ := context.FindNeighbour(neighbourAddr)
+	if err != nil {
+		return
+	}
+	if !neighbour.adminDown {
+		return
+	}
+	neighbour.adminDown = false
+	neighbour.maxPrefixDown = false
+	neighbour.shutdownMsg = ""
+	if !neighbour.activeExists && neighbour.State != "Established" {
+		context.RestartActiveNeighbour(neighbourAddr)
+	}
+}
+
 func (context *BGPContext) ShouldCheckCollision(neighbourAddr string, passive bool) {
 	neighbour, err, _ := context.FindNeighbour(neighbourAddr)
 	if err != nil {
@@ -392,29 +775,54 @@ func (context *BGPContext) ChangeNeighbourInfo(neighbourAddr string, cmnd string
 		neighbour.activeConnected = true
 	case "Established":
 		neighbour.State = "Established"
+		if neighbour.adminDown {
+			context.sendAdminShutdown(neighbour)
+			return
+		}
 		if neighbour.speaksInet {
-			context.AdvertiseAllRoutesV4(neighbour.CmndChan)
+			context.AdvertiseAllRoutesV4(neighbour)
 		}
 		if neighbour.speaksInet6 {
-			context.AdvertiseAllRoutesV6(neighbour.CmndChan)
+			context.AdvertiseAllRoutesV6(neighbour)
 		}
+		context.AdvertiseAllFlowSpec(neighbour)
 	case "PassiveEstablished":
 		neighbour.State = "Established"
 		neighbour.CmndChan = neighbour.toPassiveNeighbourContext
+		if neighbour.adminDown {
+			context.sendAdminShutdown(neighbour)
+			return
+		}
 		if neighbour.speaksInet {
-			context.AdvertiseAllRoutesV4(neighbour.CmndChan)
+			context.AdvertiseAllRoutesV4(neighbour)
 		}
 		if neighbour.speaksInet6 {
-			context.AdvertiseAllRoutesV6(neighbour.CmndChan)
+			context.AdvertiseAllRoutesV6(neighbour)
 		}
+		context.AdvertiseAllFlowSpec(neighbour)
 	case "Down":
 		neighbour.State = "Down"
 		neighbour.speaksInet = false
 		neighbour.speaksInet6 = false
+		neighbour.speaksFlow = false
+		neighbour.speaksFlow6 = false
+		neighbour.addPathInet = false
+		neighbour.addPathInet6 = false
+		if context.adjRIBIn != nil {
+			context.adjRIBIn.Clear(neighbour.Address)
+		}
 	case "speaksInet":
 		neighbour.speaksInet = true
 	case "speaksInet6":
 		neighbour.speaksInet6 = true
+	case "speaksFlow":
+		neighbour.speaksFlow = true
+	case "speaksFlow6":
+		neighbour.speaksFlow6 = true
+	case "addPathInet":
+		neighbour.addPathInet = true
+	case "addPathInet6":
+		neighbour.addPathInet6 = true
 	}
 
 }
@@ -426,7 +834,8 @@ func (context *BGPContext) CheckNeighbourInfo(cmnd *BGPCommand) {
 	}
 	switch cmnd.Cmnd {
 	case "ActiveStartConnection":
-		if neighbour.State == "Established" {
+		if neighbour.State == "Established" || neighbour.adminDown {
+			neighbour.activeExists = false
 			cmnd.ResponseChan <- "teardown"
 		} else {
 			cmnd.ResponseChan <- "continue"
@@ -439,8 +848,41 @@ func (context *BGPContext) CheckNeighbourInfo(cmnd *BGPCommand) {
 	once per each afi/safi). or mb move it to sep files, like simple_injector_v4/v6 etc
 */
 
+/*
+	route could be followed by meta info in key=value format, e.g.
+	"192.168.0.1/32 service=dns". path_id allows to add multiple paths
+	for the same prefix (each could have its own next_hop), e.g.
+	"192.168.0.1/32 path_id=2 next_hop=10.0.0.2"
+*/
+func parseRouteMeta(route string) (string, map[string]string) {
+	fields := strings.Fields(route)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	meta := make(map[string]string)
+	for _, field := range fields[1:] {
+		keyValue := strings.SplitN(field, "=", 2)
+		if len(keyValue) == 2 {
+			meta[keyValue[0]] = keyValue[1]
+		}
+	}
+	return fields[0], meta
+}
+
+func (context *BGPContext) setRouteMeta(prefix string, meta map[string]string) {
+	if context.routeMeta == nil {
+		context.routeMeta = make(map[string]map[string]string)
+	}
+	if len(meta) == 0 {
+		delete(context.routeMeta, prefix)
+		return
+	}
+	context.routeMeta[prefix] = meta
+}
+
 func (context *BGPContext) AddV4Route(route string) {
 	//TODO:check/parse route
+	route, meta := parseRouteMeta(route)
 	splittedRoute := strings.Split(route, "/")
 	if len(splittedRoute) != 2 {
 		return
@@ -454,14 +896,19 @@ func (context *BGPContext) AddV4Route(route string) {
 	if err != nil {
 		return
 	}
+	pathID, err := parseRoutePath(meta)
+	if err != nil {
+		return
+	}
 
-	_, err = context.FindV4Route(ipv4, mask)
+	_, err = context.FindV4Route(ipv4, mask, pathID)
 	if err == nil {
 		//this means that route already exists
 		return
 	}
 
-	newRoute := IPV4_NLRI{Length: mask, Prefix: ipv4}
+	newRoute := IPV4_NLRI{Length: mask, Prefix: ipv4, PathID: pathID}
+	context.setRouteMeta(v4PathToString(newRoute), meta)
 	context.RIBv4 = append(context.RIBv4, newRoute)
 	context.AdvertiseRouteV4(newRoute)
 
@@ -469,6 +916,7 @@ func (context *BGPContext) AddV4Route(route string) {
 
 func (context *BGPContext) AddV6Route(route string) {
 	//TODO:check/parse route
+	route, meta := parseRouteMeta(route)
 	splittedRoute := strings.Split(route, "/")
 	if len(splittedRoute) != 2 {
 		return
@@ -482,20 +930,26 @@ func (context *BGPContext) AddV6Route(route string) {
 	if err != nil {
 		return
 	}
+	pathID, err := parseRoutePath(meta)
+	if err != nil {
+		return
+	}
 
-	_, err = context.FindV6Route(ipv6, mask)
+	_, err = context.FindV6Route(ipv6, mask, pathID)
 	if err == nil {
 		//this means that route already exists
 		return
 	}
 
-	newRoute := IPV6_NLRI{Length: mask, Prefix: ipv6}
+	newRoute := IPV6_NLRI{Length: mask, Prefix: ipv6, PathID: pathID}
+	context.setRouteMeta(v6PathToString(newRoute), meta)
 	context.RIBv6 = append(context.RIBv6, newRoute)
 	context.AdvertiseRouteV6(newRoute)
 }
 
 func (context *BGPContext) WithdrawV4Route(route string) {
 	//TODO:check/parse route
+	route, meta := parseRouteMeta(route)
 	splittedRoute := strings.Split(route, "/")
 	if len(splittedRoute) != 2 {
 		return
@@ -509,20 +963,27 @@ func (context *BGPContext) WithdrawV4Route(route string) {
 	if err != nil {
 		return
 	}
+	pathID, err := parseRoutePath(meta)
+	if err != nil {
+		return
+	}
 
-	err = context.DeleteV4Route(ipv4, mask)
+	wRoute, err := context.FindV4Route(ipv4, mask, pathID)
 	if err != nil {
 		//this means that route doesnt exists
 		return
 	}
 
-	wRoute := IPV4_NLRI{Length: mask, Prefix: ipv4}
+	//route must be still in rib, so we could find which path replaces it
 	context.WithdrawRouteV4(wRoute)
+	context.DeleteV4Route(ipv4, mask, pathID)
+	context.setRouteMeta(v4PathToString(wRoute), nil)
 
 }
 
 func (context *BGPContext) WithdrawV6Route(route string) {
 	//TODO:check/parse route
+	route, meta := parseRouteMeta(route)
 	splittedRoute := strings.Split(route, "/")
 	if len(splittedRoute) != 2 {
 		return
@@ -536,39 +997,47 @@ func (context *BGPContext) WithdrawV6Route(route string) {
 	if err != nil {
 		return
 	}
+	pathID, err := parseRoutePath(meta)
+	if err != nil {
+		return
+	}
 
-	err = context.DeleteV6Route(ipv6, mask)
+	wRoute, err := context.FindV6Route(ipv6, mask, pathID)
 	if err != nil {
 		//this means that route doesnt exists
 		return
 	}
 
-	wRoute := IPV6_NLRI{Length: mask, Prefix: ipv6}
+	//route must be still in rib, so we could find which path replaces it
 	context.WithdrawRouteV6(wRoute)
+	context.DeleteV6Route(ipv6, mask, pathID)
+	context.setRouteMeta(v6PathToString(wRoute), nil)
 
 }
 
-func (context *BGPContext) FindV4Route(ipv4 uint32, mask uint8) (IPV4_NLRI, error) {
+func (context *BGPContext) FindV4Route(ipv4 uint32, mask uint8,
+	pathID uint32) (IPV4_NLRI, error) {
 	for _, nlri := range context.RIBv4 {
-		if nlri.Prefix == ipv4 && nlri.Length == mask {
+		if nlri.Prefix == ipv4 && nlri.Length == mask && nlri.PathID == pathID {
 			return nlri, nil
 		}
 	}
 	return IPV4_NLRI{}, fmt.Errorf("route doesnt exists")
 }
 
-func (context *BGPContext) FindV6Route(ipv6 IPv6Addr, mask uint8) (IPV6_NLRI, error) {
+func (context *BGPContext) FindV6Route(ipv6 IPv6Addr, mask uint8,
+	pathID uint32) (IPV6_NLRI, error) {
 	for _, nlri := range context.RIBv6 {
-		if nlri.Prefix.isEqual(ipv6) && nlri.Length == mask {
+		if nlri.Prefix.isEqual(ipv6) && nlri.Length == mask && nlri.PathID == pathID {
 			return nlri, nil
 		}
 	}
 	return IPV6_NLRI{}, fmt.Errorf("route doesnt exists")
 }
 
-func (context *BGPContext) DeleteV4Route(ipv4 uint32, mask uint8) error {
+func (context *BGPContext) DeleteV4Route(ipv4 uint32, mask uint8, pathID uint32) error {
 	for n, nlri := range context.RIBv4 {
-		if nlri.Prefix == ipv4 && nlri.Length == mask {
+		if nlri.Prefix == ipv4 && nlri.Length == mask && nlri.PathID == pathID {
 			if n == (len(context.RIBv4) - 1) {
 				context.RIBv4 = context.RIBv4[:n]
 			} else {
@@ -580,9 +1049,9 @@ func (context *BGPContext) DeleteV4Route(ipv4 uint32, mask uint8) error {
 	return fmt.Errorf("route doesnt exist")
 }
 
-func (context *BGPContext) DeleteV6Route(ipv6 IPv6Addr, mask uint8) error {
+func (context *BGPContext) DeleteV6Route(ipv6 IPv6Addr, mask uint8, pathID uint32) error {
 	for n, nlri := range context.RIBv6 {
-		if nlri.Prefix.isEqual(ipv6) && nlri.Length == mask {
+		if nlri.Prefix.isEqual(ipv6) && nlri.Length == mask && nlri.PathID == pathID {
 			if n == (len(context.RIBv6) - 1) {
 				context.RIBv6 = context.RIBv6[:n]
 			} else {
@@ -597,8 +1066,10 @@ func (context *BGPContext) DeleteV6Route(ipv6 IPv6Addr, mask uint8) error {
 /*
 This is BGPContext's func because in future we could use info from context(for global lp,
 aspath etc
+returns false if route was rejected by neighbour's outbound policy
 */
-func (context *BGPContext) GenerateUpdateRouteV4(ipv4 IPV4_NLRI) BGPRoute {
+func (context *BGPContext) GenerateUpdateRouteV4(ipv4 IPV4_NLRI,
+	neighbour *BGPNeighbour) (BGPRoute, bool) {
 	bgpRoute := BGPRoute{
 		ORIGIN:     ORIGIN_IGP,
 		LOCAL_PREF: context.LocalPref, // lvanroon: Updated to carry more
@@ -607,10 +1078,17 @@ func (context *BGPContext) GenerateUpdateRouteV4(ipv4 IPV4_NLRI) BGPRoute {
 		Community:  context.Community, // bgp neighbors
 	}
 	bgpRoute.Routes = append(bgpRoute.Routes, ipv4)
-	return bgpRoute
+	meta := context.routeMeta[v4PathToString(ipv4)]
+	if nh, exists := meta[ROUTE_META_NEXT_HOP]; exists {
+		bgpRoute.setFixedNextHop(nh)
+	}
+	accepted := neighbour.outboundPolicy.Apply(&bgpRoute, meta,
+		neighbour.asn(context.ASN))
+	return bgpRoute, accepted
 }
 
-func (context *BGPContext) GenerateUpdateRouteV6(ipv6 IPV6_NLRI) BGPRoute {
+func (context *BGPContext) GenerateUpdateRouteV6(ipv6 IPV6_NLRI,
+	neighbour *BGPNeighbour) (BGPRoute, bool) {
 	bgpRoute := BGPRoute{
 		ORIGIN:     ORIGIN_IGP,
 		LOCAL_PREF: context.LocalPref, // lvanroon: Updated to carry more
@@ -619,7 +1097,13 @@ func (context *BGPContext) GenerateUpdateRouteV6(ipv6 IPV6_NLRI) BGPRoute {
 		Community:  context.Community, // bgp neighbors
 	}
 	bgpRoute.RoutesV6 = append(bgpRoute.RoutesV6, ipv6)
-	return bgpRoute
+	meta := context.routeMeta[v6PathToString(ipv6)]
+	if nh, exists := meta[ROUTE_META_NEXT_HOP]; exists {
+		bgpRoute.setFixedNextHop(nh)
+	}
+	accepted := neighbour.outboundPolicy.Apply(&bgpRoute, meta,
+		neighbour.asn(context.ASN))
+	return bgpRoute, accepted
 }
 
 func (context *BGPContext) GenerateWithdrawRouteV4(ipv4 IPV4_NLRI) BGPRoute {
@@ -635,66 +1119,162 @@ func (context *BGPContext) GenerateWithdrawRouteV6(ipv6 IPV6_NLRI) BGPRoute {
 }
 
 func (context *BGPContext) AdvertiseRouteV4(ipv4 IPV4_NLRI) {
-	for _, neighbour := range context.Neighbours {
-		if neighbour.State == "Established" && neighbour.speaksInet {
+	for i := range context.Neighbours {
+		neighbour := &context.Neighbours[i]
+		if neighbour.State == "Established" && neighbour.speaksInet &&
+			context.shouldAdvertiseV4(neighbour, ipv4) {
+			route, accepted := context.GenerateUpdateRouteV4(ipv4, neighbour)
+			if !accepted {
+				continue
+			}
 			neighbour.CmndChan <- BGPCommand{
 				Cmnd:  "AdvertiseRouteV4",
-				Route: context.GenerateUpdateRouteV4(ipv4)}
+				Route: route}
 		}
 	}
 }
 
 func (context *BGPContext) AdvertiseRouteV6(ipv6 IPV6_NLRI) {
-	for _, neighbour := range context.Neighbours {
-		if neighbour.State == "Established" && neighbour.speaksInet6 {
+	for i := range context.Neighbours {
+		neighbour := &context.Neighbours[i]
+		if neighbour.State == "Established" && neighbour.speaksInet6 &&
+			context.shouldAdvertiseV6(neighbour, ipv6) {
+			route, accepted := context.GenerateUpdateRouteV6(ipv6, neighbour)
+			if !accepted {
+				continue
+			}
 			neighbour.CmndChan <- BGPCommand{
 				Cmnd:  "AdvertiseRouteV6",
-				Route: context.GenerateUpdateRouteV6(ipv6)}
+				Route: route}
 		}
 	}
 }
 
+/*
+	ipv4 must be still in rib. neighbours w/o add path have rcved only the
+	best path; if it's withdrawn, next path of the prefix (if any) is sent
+	instead (implicit withdraw)
+*/
 func (context *BGPContext) WithdrawRouteV4(ipv4 IPV4_NLRI) {
-	for _, neighbour := range context.Neighbours {
-		if neighbour.State == "Established" && neighbour.speaksInet {
-			neighbour.CmndChan <- BGPCommand{
-				Cmnd:  "WithdrawRouteV4",
-				Route: context.GenerateWithdrawRouteV4(ipv4)}
+	replacement, replaced := context.bestV4Path(ipv4, true)
+	for i := range context.Neighbours {
+		neighbour := &context.Neighbours[i]
+		if neighbour.State != "Established" || !neighbour.speaksInet {
+			continue
+		}
+		if !context.shouldAdvertiseV4(neighbour, ipv4) {
+			continue
+		}
+		if !neighbour.addPathInet && replaced {
+			route, accepted := context.GenerateUpdateRouteV4(replacement, neighbour)
+			if accepted {
+				neighbour.CmndChan <- BGPCommand{
+					Cmnd:  "AdvertiseRouteV4",
+					Route: route}
+				continue
+			}
 		}
+		neighbour.CmndChan <- BGPCommand{
+			Cmnd:  "WithdrawRouteV4",
+			Route: context.GenerateWithdrawRouteV4(ipv4)}
 	}
 }
 
 func (context *BGPContext) WithdrawRouteV6(ipv6 IPV6_NLRI) {
-	for _, neighbour := range context.Neighbours {
-		if neighbour.State == "Established" && neighbour.speaksInet6 {
-			neighbour.CmndChan <- BGPCommand{
-				Cmnd:  "WithdrawRouteV6",
-				Route: context.GenerateWithdrawRouteV6(ipv6)}
+	replacement, replaced := context.bestV6Path(ipv6, true)
+	for i := range context.Neighbours {
+		neighbour := &context.Neighbours[i]
+		if neighbour.State != "Established" || !neighbour.speaksInet6 {
+			continue
+		}
+		if !context.shouldAdvertiseV6(neighbour, ipv6) {
+			continue
 		}
+		if !neighbour.addPathInet6 && replaced {
+			route, accepted := context.GenerateUpdateRouteV6(replacement, neighbour)
+			if accepted {
+				neighbour.CmndChan <- BGPCommand{
+					Cmnd:  "AdvertiseRouteV6",
+					Route: route}
+				continue
+			}
+		}
+		neighbour.CmndChan <- BGPCommand{
+			Cmnd:  "WithdrawRouteV6",
+			Route: context.GenerateWithdrawRouteV6(ipv6)}
 	}
 }
 
-func (context *BGPContext) AdvertiseAllRoutesV4(cmndChan chan BGPCommand) {
+func (context *BGPContext) AdvertiseAllRoutesV4(neighbour *BGPNeighbour) {
 	for _, route := range context.RIBv4 {
 		/*
 		   TODO: pack more that one route per update; implement check, that msg size is less then
 		   bpg_max_msg_len
 		*/
-		cmndChan <- BGPCommand{
+		if !context.shouldAdvertiseV4(neighbour, route) {
+			continue
+		}
+		bgpRoute, accepted := context.GenerateUpdateRouteV4(route, neighbour)
+		if !accepted {
+			continue
+		}
+		neighbour.CmndChan <- BGPCommand{
 			Cmnd:  "AdvertiseRouteV4",
-			Route: context.GenerateUpdateRouteV4(route)}
+			Route: bgpRoute}
 	}
 }
 
-func (context *BGPContext) AdvertiseAllRoutesV6(cmndChan chan BGPCommand) {
+func (context *BGPContext) AdvertiseAllRoutesV6(neighbour *BGPNeighbour) {
 	for _, route := range context.RIBv6 {
 		/*
 		   TODO: pack more that one route per update; implement check, that msg size is less then
 		   bpg_max_msg_len
 		*/
-		cmndChan <- BGPCommand{
+		if !context.shouldAdvertiseV6(neighbour, route) {
+			continue
+		}
+		bgpRoute, accepted := context.GenerateUpdateRouteV6(route, neighbour)
+		if !accepted {
+			continue
+		}
+		neighbour.CmndChan <- BGPCommand{
 			Cmnd:  "AdvertiseRouteV6",
-			Route: context.GenerateUpdateRouteV6(route)}
+			Route: bgpRoute}
+	}
+}
+
+/*
+	neighbour asked us to resend all the routes of afi/safi (rfc 2918).
+	Begin/End cmnds are translated by neighbour's context into BoRR/EoRR
+	msgs, if it has negotiated enhanced route refresh (rfc 7313)
+*/
+func (context *BGPContext) RefreshRoutes(neighbourAddr string, afiSafi string) {
+	neighbour, err, _ := context.FindNeighbour(neighbourAddr)
+	if err != nil {
+		return
+	}
+	if neighbour.State != "Established" {
+		return
+	}
+	var mpCap MPCapability
+	_, err = fmt.Sscanf(afiSafi, "%d %d", &mpCap.AFI, &mpCap.SAFI)
+	if err != nil {
+		return
+	}
+	switch {
+	case isMPCapabilityEqual(mpCap, mpCapInet) && neighbour.speaksInet:
+		neighbour.CmndChan <- BGPCommand{Cmnd: "BeginRouteRefresh", CmndData: afiSafi}
+		context.AdvertiseAllRoutesV4(neighbour)
+		neighbour.CmndChan <- BGPCommand{Cmnd: "EndRouteRefresh", CmndData: afiSafi}
+	case isMPCapabilityEqual(mpCap, mpCapInet6) && neighbour.speaksInet6:
+		neighbour.CmndChan <- BGPCommand{Cmnd: "BeginRouteRefresh", CmndData: afiSafi}
+		context.AdvertiseAllRoutesV6(neighbour)
+		neighbour.CmndChan <- BGPCommand{Cmnd: "EndRouteRefresh", CmndData: afiSafi}
+	case isMPCapabilityEqual(mpCap, mpCapFlow) && neighbour.speaksFlow,
+		isMPCapabilityEqual(mpCap, mpCapFlow6) && neighbour.speaksFlow6:
+		neighbour.CmndChan <- BGPCommand{Cmnd: "BeginRouteRefresh", CmndData: afiSafi}
+		context.advertiseAllFlowSpecAFI(neighbour, mpCap.AFI)
+		neighbour.CmndChan <- BGPCommand{Cmnd: "EndRouteRefresh", CmndData: afiSafi}
 	}
 }
 
@@ -704,11 +1284,10 @@ func (context *BGPNeighbourContext) GetRouterID(fromConnect chan string) {
 	if ladr == "exit" {
 		return
 	}
+	ladr = context.parseLocalAddr(ladr)
+	context.selectNextHops(ladr)
 	if v4, _ := regexp.MatchString(`^(\d{1,3}\.){3}\d{1,3}$`, ladr); v4 {
-		context.NextHop = ladr
 		context.ToMainContext <- BGPCommand{Cmnd: "NewRouterID", CmndData: ladr}
-	} else {
-		context.NextHopV6, _ = IPv6StringToAddr(ladr)
 	}
 }
 
@@ -719,12 +1298,25 @@ func (context *BGPNeighbourContext) AddCapabilityFlag(mpCap MPCapability) {
 	} else if isMPCapabilityEqual(mpCap, mpCapInet6) {
 		context.speaksInet6 = true
 		context.ToMainContext <- BGPCommand{From: context.NeighbourAddr, Cmnd: "speaksInet6"}
+	} else if isMPCapabilityEqual(mpCap, mpCapFlow) {
+		context.speaksFlow = true
+		context.ToMainContext <- BGPCommand{From: context.NeighbourAddr, Cmnd: "speaksFlow"}
+	} else if isMPCapabilityEqual(mpCap, mpCapFlow6) {
+		context.speaksFlow6 = true
+		context.ToMainContext <- BGPCommand{From: context.NeighbourAddr, Cmnd: "speaksFlow6"}
 	}
 }
 
 func (context *BGPNeighbourContext) removeAllCapabilityFlags() {
 	context.speaksInet = false
 	context.speaksInet6 = false
+	context.speaksFlow = false
+	context.speaksFlow6 = false
+	context.routeRefresh = false
+	context.enhancedRouteRefresh = false
+	context.extendedNextHop = false
+	context.addPathInet = false
+	context.addPathInet6 = false
 }
 
 func (context *BGPNeighbourContext) parseValidOpen(openMsg OpenMsg) {
@@ -733,6 +1325,16 @@ func (context *BGPNeighbourContext) parseValidOpen(openMsg OpenMsg) {
 	} else {
 		context.asn4 = false
 	}
+	context.routeRefresh = openMsg.Caps.SupportRouteRefresh
+	context.enhancedRouteRefresh = openMsg.Caps.SupportEnhancedRouteRefresh
+	if context.ExtendedNextHop {
+		for _, extNH := range openMsg.Caps.ExtendedNextHop {
+			if extNH == extNHInet {
+				context.extendedNextHop = true
+			}
+		}
+	}
+	context.negotiateAddPath(openMsg.Caps.AddPath)
 	if len(context.MPCaps) == 0 {
 		/*
 			if we dont support any mp caps we can talk at least inet4
@@ -774,21 +1376,20 @@ func StartBGPNeighbourContext(context *BGPNeighbourContext, passive bool,
 		localSockChans.readChan = sockChans.readChan
 		localSockChans.writeChan = sockChans.writeChan
 		localSockChans.controlChan = sockChans.controlChan
-		if v4, _ := regexp.MatchString(`^(\d{1,3}\.){3}\d{1,3}$`,
-			sockChans.localAddr); v4 {
-			context.NextHop = sockChans.localAddr
-		} else {
-			context.NextHopV6, _ = IPv6StringToAddr(sockChans.localAddr)
-		}
+		context.selectNextHops(sockChans.localAddr)
+		context.setMonitorAddr(sockChans.localAddr, sockChans.localPort,
+			sockChans.remotePort)
 	}
 	keepaliveFeedback := make(chan uint8)
 	localSockChans.keepaliveFeedback = keepaliveFeedback
 	msgBuf := make([]byte, 0)
 	context.fsm.Event("Start")
-	context.fsm.KeepaliveTime = 30
 	context.fsm.DelayOpenTime = 5
 RECONNECT:
+	context.stopHoldTimer()
+	context.monitorPeerDown()
 	context.removeAllCapabilityFlags()
+	context.resetMaxPrefix()
 	if !passive {
 		context.ToMainContext <- BGPCommand{From: context.NeighbourAddr,
 			Cmnd:         "ActiveStartConnection",
@@ -809,7 +1410,8 @@ RECONNECT:
 			localSockChans.toReadError,
 			localSockChans.readChan,
 			localSockChans.writeChan,
-			localSockChans.controlChan)
+			localSockChans.controlChan,
+			context.MRT)
 		if err != nil {
 			if err == CANT_CONNECT_ERROR {
 				localSockChans.controlChan <- "exit"
@@ -858,53 +1460,32 @@ RECONNECT:
 	}
 	loop = 1
 	for loop == 1 {
+		/*
+			cmnds, which main context has sent us while we were waiting
+			for it to receive our own msg (check sendToMainContext)
+		*/
+		for len(context.pendingCmnds) > 0 {
+			msgFromMainContext := context.pendingCmnds[0]
+			context.pendingCmnds = context.pendingCmnds[1:]
+			switch context.processMainContextCmnd(msgFromMainContext, localSockChans) {
+			case "Shutdown":
+				shutdown = true
+				goto CLOSE_CONNECTION
+			case "Reset":
+				goto CLOSE_CONNECTION
+			}
+		}
 		select {
 		case msgFromMainContext := <-context.ToNeighbourContext:
-			if msgFromMainContext.Cmnd == "Shutdown" {
+			switch context.processMainContextCmnd(msgFromMainContext, localSockChans) {
+			case "Shutdown":
 				shutdown = true
-				//FIXME: send notification if established
 				goto CLOSE_CONNECTION
-			}
-			if context.fsm.State == "Established" {
-				/*
-					 it's more practical from implementation point of view
-						not to mix advertise and withdraw routes
-						into the same update
-				*/
-				if msgFromMainContext.Cmnd == "AdvertiseRouteV4" {
-					route := msgFromMainContext.Route
-					err := route.AddV4NextHop(context.NextHop)
-					if err != nil {
-						continue
-					}
-					data, err := EncodeUpdateMsg(&route)
-					if err != nil {
-						continue
-					}
-
-					localSockChans.writeChan <- data
-				} else if msgFromMainContext.Cmnd == "AdvertiseRouteV6" {
-					route := msgFromMainContext.Route
-					route.NEXT_HOPv6 = context.NextHopV6
-					data, err := EncodeUpdateMsg(&route)
-					if err != nil {
-						continue
-					}
-
-					localSockChans.writeChan <- data
-				} else if msgFromMainContext.Cmnd == "WithdrawRouteV4" ||
-					msgFromMainContext.Cmnd == "WithdrawRouteV6" {
-					route := msgFromMainContext.Route
-					data, err := EncodeUpdateMsg(&route)
-					if err != nil {
-						continue
-					}
-
-					localSockChans.writeChan <- data
-				}
-
+			case "Reset":
+				goto CLOSE_CONNECTION
 			}
 		case bgpMsg := <-localSockChans.readChan:
+			context.resetHoldTimer()
 			msgBuf = append(msgBuf, bgpMsg...)
 			for {
 				if len(msgBuf) < MSG_HDR_SIZE {
@@ -949,6 +1530,20 @@ RECONNECT:
 							goto RECONNECT
 						}
 					}
+					if subcode, ok := context.checkOpen(openMsg); !ok {
+						SendNotification(context, "OpenError", localSockChans,
+							BGP_OPEN_MSG_ERROR, subcode)
+						msgBuf = msgBuf[:0]
+						if passive {
+							context.ToMainContext <- BGPCommand{From: context.NeighbourAddr,
+								Cmnd: "PassiveClossed"}
+							goto PASSIVE_TEARDOWN
+						} else {
+							context.ToMainContext <- BGPCommand{From: context.NeighbourAddr,
+								Cmnd: "ActiveClossed"}
+							goto RECONNECT
+						}
+					}
 					state := context.fsm.Event("OpenRcv")
 					chckResult := PerformCollisionCheck(context, passive, &openMsg)
 					if chckResult == "teardown" {
@@ -965,11 +1560,12 @@ RECONNECT:
 						return
 					}
 					context.parseValidOpen(openMsg)
+					context.setMonitorOpen(openMsg, msgBuf[:hdr.Length])
 					bgpCaps.SupportASN4 = context.asn4
+					context.negotiateTimers(openMsg.Hdr.HoldTime)
+					context.resetHoldTimer()
 					switch state {
 					case "OpenKA":
-						context.fsm.KeepaliveTime = uint32(openMsg.Hdr.HoldTime / 3)
-						context.fsm.HoldTime = uint32(openMsg.Hdr.HoldTime)
 						err := GenerateOpenMsg(context, localSockChans.writeChan, "")
 						if err != nil {
 							SendNotification(context, "OpenSendError", localSockChans,
@@ -1009,11 +1605,12 @@ RECONNECT:
 						}
 					}
 				case BGP_UPDATE_MSG:
-					/* right now we dont care about rcved msg */
-					_, err := DecodeUpdateMsg(msgBuf[:hdr.Length], &bgpCaps)
+					rcvedRoute, err := DecodeUpdateMsg(msgBuf[:hdr.Length], &bgpCaps)
+					endOfRib := false
 					if err != nil {
 						switch err.(type) {
 						case EndOfRib:
+							endOfRib = true
 						default:
 							SendNotification(context, "UpdateError",
 								localSockChans,
@@ -1047,11 +1644,52 @@ RECONNECT:
 							goto RECONNECT
 						}
 					}
+					if !endOfRib && context.checkMaxPrefix(&rcvedRoute) {
+						context.sendToMainContext(BGPCommand{From: context.NeighbourAddr,
+							Cmnd: "MaxPrefixExceeded"})
+						context.sendCease(BGP_CASE_ERROR_MAX_PREFIX, "", localSockChans)
+						goto CLOSE_CONNECTION
+					}
+					if context.AdjRIBIn != nil && !endOfRib {
+						context.storeRcvedRoute(&rcvedRoute)
+					}
 				case BGP_NOTIFICATION_MSG:
+					notification, err := DecodeNotificationMsg(msgBuf[:hdr.Length])
+					context.setMonitorNotification(msgBuf[:hdr.Length], false)
+					if err == nil {
+						context.emitEvent("NotificationRcvd", notification.String())
+					}
 					goto CLOSE_CONNECTION
+				case BGP_ROUTEREFRESH_MSG:
+					routeRefresh, err := DecodeRouteRefreshMsg(msgBuf[:hdr.Length])
+					if err != nil {
+						SendNotification(context, "RouteRefreshError", localSockChans,
+							BGP_ROUTEREFRESH_ERROR, BGP_RR_ERROR_INVALID_LENGTH)
+						msgBuf = msgBuf[:0]
+						if passive {
+							context.ToMainContext <- BGPCommand{From: context.NeighbourAddr,
+								Cmnd: "PassiveClossed"}
+							goto PASSIVE_TEARDOWN
+						} else {
+							context.ToMainContext <- BGPCommand{From: context.NeighbourAddr,
+								Cmnd: "ActiveClossed"}
+							goto RECONNECT
+						}
+					}
+					/*
+						BoRR/EoRR from the peer are only interesting if we would keep
+						its routes; right now we are only answering for the requests
+					*/
+					if context.fsm.State == "Established" &&
+						routeRefresh.Subtype == ROUTE_REFRESH_NORMAL {
+						context.sendToMainContext(BGPCommand{From: context.NeighbourAddr,
+							Cmnd:     "RouteRefresh",
+							CmndData: fmt.Sprintf("%d %d", routeRefresh.AFI, routeRefresh.SAFI)})
+					}
 				case BGP_KEEPALIVE_MSG:
 					state := context.fsm.Event("Keepalive")
 					if state == "Established" {
+						context.monitorPeerUp()
 						if passive {
 							context.ToMainContext <- BGPCommand{From: context.NeighbourAddr,
 								Cmnd: "PassiveEstablished"}
@@ -1066,6 +1704,20 @@ RECONNECT:
 				}
 				msgBuf = msgBuf[hdr.Length:]
 			}
+		case <-context.holdTimerExpired():
+			context.holdTimer = nil
+			SendNotification(context, "HoldTimerExpired", localSockChans,
+				BGP_HOLD_TIMER_EXPIRED, BGP_GENERIC_ERROR)
+			msgBuf = msgBuf[:0]
+			if passive {
+				context.ToMainContext <- BGPCommand{From: context.NeighbourAddr,
+					Cmnd: "PassiveClossed"}
+				goto PASSIVE_TEARDOWN
+			} else {
+				context.ToMainContext <- BGPCommand{From: context.NeighbourAddr,
+					Cmnd: "ActiveClossed"}
+				goto RECONNECT
+			}
 		case <-localSockChans.readError:
 			goto CLOSE_CONNECTION
 		case <-localSockChans.toWriteError:
@@ -1075,12 +1727,22 @@ RECONNECT:
 
 CLOSE_CONNECTION:
 	CloseSockets(context, localSockChans)
+	context.monitorPeerDown()
+	context.stopHoldTimer()
 	if context.fsm.State == "Established" {
 		keepaliveFeedback <- uint8(1)
 	}
 	msgBuf = msgBuf[:0]
+	context.pendingCmnds = context.pendingCmnds[:0]
 	context.fsm.Event("Start")
 	if shutdown {
+		if passive {
+			context.ToMainContext <- BGPCommand{From: context.NeighbourAddr,
+				Cmnd: "PassiveClossed"}
+		} else {
+			context.ToMainContext <- BGPCommand{From: context.NeighbourAddr,
+				Cmnd: "ActiveClossed"}
+		}
 		return
 	}
 	if passive {
@@ -1096,13 +1758,196 @@ CLOSE_CONNECTION:
 	}
 
 PASSIVE_TEARDOWN:
+	context.monitorPeerDown()
+	context.stopHoldTimer()
 	context.ToMainContext <- BGPCommand{From: context.NeighbourAddr,
 		Cmnd: "PassiveTeardown"}
 	return
 
 }
 
+/*
+	returns "Shutdown" if main context asked us to terminate the session and
+	"Reset" if session must be reestablished
+*/
+func (context *BGPNeighbourContext) processMainContextCmnd(msgFromMainContext BGPCommand,
+	localSockChans SockControlChans) string {
+	switch msgFromMainContext.Cmnd {
+	case "Shutdown":
+		context.sendCease(BGP_CASE_ERROR_PEER_DECONFIGURED, "", localSockChans)
+		return "Shutdown"
+	case "AdminShutdown":
+		context.sendCease(BGP_CASE_ERROR_ADMIN_SHUTDOWN, msgFromMainContext.CmndData,
+			localSockChans)
+		return "Shutdown"
+	case "AdminReset":
+		context.sendCease(BGP_CASE_ERROR_ADMIN_RESET, msgFromMainContext.CmndData,
+			localSockChans)
+		return "Reset"
+	case "BFDDown":
+		//path to the neighbour is down, so we dont even try to send notification
+		context.monitor.localClose = true
+		context.emitEvent("BFDDown", "")
+		return "Reset"
+	}
+	if context.fsm.State != "Established" {
+		return ""
+	}
+	/*
+		 it's more practical from implementation point of view
+			not to mix advertise and withdraw routes
+			into the same update
+	*/
+	switch msgFromMainContext.Cmnd {
+	case "AdvertiseRouteV4":
+		route := msgFromMainContext.Route
+		route.ASN4 = context.asn4
+		route.Flags.WithPathId = context.addPathInet
+		context.setEBGPAttrs(&route)
+		if !route.Flags.FixedNextHop && context.extendedNextHop {
+			//v4 nlri w/ v6 nh could be sent only inside mp_reach_nlri
+			route.MPINET = true
+			route.Flags.ExtendedNextHop = true
+			route.NEXT_HOPv6 = context.NextHopV6
+			route.NEXT_HOPv6LinkLocal = context.NextHopV6LinkLocal
+		} else if !route.Flags.FixedNextHop {
+			err := route.AddV4NextHop(context.NextHop)
+			if err != nil {
+				return ""
+			}
+		}
+		data, err := EncodeUpdateMsg(&route)
+		if err != nil {
+			return ""
+		}
+		localSockChans.writeChan <- data
+		context.monitorUpdate(&route, data)
+	case "AdvertiseRouteV6":
+		route := msgFromMainContext.Route
+		route.ASN4 = context.asn4
+		route.Flags.WithPathId = context.addPathInet6
+		context.setEBGPAttrs(&route)
+		if !route.Flags.FixedNextHop {
+			route.NEXT_HOPv6 = context.NextHopV6
+			route.NEXT_HOPv6LinkLocal = context.NextHopV6LinkLocal
+		}
+		data, err := EncodeUpdateMsg(&route)
+		if err != nil {
+			return ""
+		}
+		localSockChans.writeChan <- data
+		context.monitorUpdate(&route, data)
+	case "AdvertiseFlowSpec":
+		//flowspec nlri doesnt have next hop (rfc 8955 4)
+		route := msgFromMainContext.Route
+		route.ASN4 = context.asn4
+		context.setEBGPAttrs(&route)
+		data, err := EncodeUpdateMsg(&route)
+		if err != nil {
+			return ""
+		}
+		localSockChans.writeChan <- data
+		context.monitorUpdate(&route, data)
+	case "WithdrawFlowSpec":
+		route := msgFromMainContext.Route
+		data, err := EncodeUpdateMsg(&route)
+		if err != nil {
+			return ""
+		}
+		localSockChans.writeChan <- data
+		context.monitorUpdate(&route, data)
+	case "WithdrawRouteV4", "WithdrawRouteV6":
+		route := msgFromMainContext.Route
+		if msgFromMainContext.Cmnd == "WithdrawRouteV4" {
+			route.Flags.WithPathId = context.addPathInet
+		} else {
+			route.Flags.WithPathId = context.addPathInet6
+		}
+		data, err := EncodeUpdateMsg(&route)
+		if err != nil {
+			return ""
+		}
+		localSockChans.writeChan <- data
+		context.monitorUpdate(&route, data)
+	case "BeginRouteRefresh", "EndRouteRefresh":
+		/*
+			rfc 7313: if peer supports enhanced route refresh we must
+			wrap resended routes with BoRR/EoRR msgs, so it could purge
+			stale routes which wasnt readvertised
+		*/
+		if !context.enhancedRouteRefresh {
+			return ""
+		}
+		routeRefresh := RouteRefreshMsg{Subtype: ROUTE_REFRESH_BORR}
+		if msgFromMainContext.Cmnd == "EndRouteRefresh" {
+			routeRefresh.Subtype = ROUTE_REFRESH_EORR
+		}
+		_, err := fmt.Sscanf(msgFromMainContext.CmndData, "%d %d",
+			&routeRefresh.AFI, &routeRefresh.SAFI)
+		if err != nil {
+			return ""
+		}
+		data, err := EncodeRouteRefreshMsg(&routeRefresh)
+		if err != nil {
+			return ""
+		}
+		localSockChans.writeChan <- data
+	}
+	return ""
+}
+
+/*
+	sockets are going to be closed by the caller (check CLOSE_CONNECTION)
+*/
+func (context *BGPNeighbourContext) sendCease(subcode uint8, communication string,
+	localSockChans SockControlChans) {
+	encodedCease, err := GenerateCeaseMsg(subcode, communication)
+	if err != nil {
+		//communication is malformed; better to send cease w/o it
+		encodedCease, err = GenerateCeaseMsg(subcode, "")
+		if err != nil {
+			return
+		}
+	}
+	localSockChans.writeChan <- encodedCease
+	context.setMonitorNotification(encodedCease, true)
+	notification, _ := DecodeNotificationMsg(encodedCease)
+	context.emitEvent("NotificationSent", notification.String())
+}
+
+func (context *BGPNeighbourContext) emitEvent(event, data string) {
+	if context.Events == nil {
+		return
+	}
+	select {
+	case context.Events <- BGPEvent{Neighbour: context.NeighbourAddr,
+		Event: event, Data: data}:
+	default:
+	}
+}
+
+/*
+	main context could block while sending us cmnds (for example during
+	readvertisement of all the routes). so, when we are established, we
+	are queueing its cmnds while waiting for it to receive our msg
+*/
+func (context *BGPNeighbourContext) sendToMainContext(cmnd BGPCommand) {
+	for {
+		select {
+		case context.ToMainContext <- cmnd:
+			return
+		case pendingCmnd := <-context.ToNeighbourContext:
+			context.pendingCmnds = append(context.pendingCmnds, pendingCmnd)
+		}
+	}
+}
+
 func SendKeepalive(writeChan chan []byte, sleepTime uint32, feedbackChan chan uint8) {
+	if sleepTime == 0 {
+		//zero hold time was negotiated; keepalives must not be sent
+		<-feedbackChan
+		return
+	}
 	loop := 1
 	ka := GenerateKeepalive()
 	for loop == 1 {
@@ -1124,16 +1969,27 @@ func SendKeepalive(writeChan chan []byte, sleepTime uint32, feedbackChan chan ui
 
 func GenerateOpenMsg(context *BGPNeighbourContext, writeChan chan []byte,
 	event string) error {
-	//TODO: check if context.ASN > 2^16; then MyASN must be AS_TRANS
-	openMsg := OpenMsg{Hdr: OpenMsgHdr{Version: uint8(4), MyASN: uint16(context.ASN),
-		BGPID: context.RouterID, HoldTime: uint16(context.fsm.HoldTime)}}
+	//4 byte asn is sent in capability; rfc 6793
+	myASN := uint16(AS_TRANS)
+	if context.ASN <= 65535 {
+		myASN = uint16(context.ASN)
+	}
+	openMsg := OpenMsg{Hdr: OpenMsgHdr{Version: uint8(4), MyASN: myASN,
+		BGPID: context.RouterID, HoldTime: uint16(context.holdTime())}}
 	openMsg.MPCaps = append(openMsg.MPCaps, context.MPCaps...)
 	openMsg.Caps.SupportASN4 = true
 	openMsg.Caps.ASN4 = context.ASN
+	openMsg.Caps.SupportRouteRefresh = true
+	openMsg.Caps.SupportEnhancedRouteRefresh = true
+	if context.ExtendedNextHop {
+		openMsg.Caps.ExtendedNextHop = []ExtendedNHCapability{extNHInet}
+	}
+	openMsg.Caps.AddPath = context.generateAddPathCaps()
 	encodedOpen, err := EncodeOpenMsg(&openMsg)
 	if err != nil {
 		return err
 	}
+	context.monitor.sentOpen = encodedOpen
 	writeChan <- encodedOpen
 	if event != "" {
 		context.fsm.Event(event)
@@ -1151,6 +2007,8 @@ func SendNotification(context *BGPNeighbourContext, event string,
 		return
 	}
 	sockChans.writeChan <- encodedNotification
+	context.setMonitorNotification(encodedNotification, true)
+	context.emitEvent("NotificationSent", notificationMsg.String())
 	sockChans.toWriteError <- 0
 	sockChans.toReadError <- 1
 	if context.fsm.State == "Established" {
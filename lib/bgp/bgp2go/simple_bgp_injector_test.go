@@ -2,7 +2,9 @@ package bgp2go
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 )
 
 func prepareConnectionPassive(contextType string) (SockControlChans, chan BGPCommand, chan BGPCommand) {
@@ -142,3 +144,805 @@ func TestMPSessionInit(t *testing.T) {
 		t.Errorf("error in passive fsm. must be in PassiveEstablished state")
 	}
 }
+
+/*
+	brings passive session w/ default (v4 only) caps to established state;
+	configure (if not nil) could change neighbour context before it's started
+*/
+func establishPassiveSession(t *testing.T,
+	configure func(*BGPNeighbourContext)) (SockControlChans, chan BGPCommand, chan BGPCommand) {
+	testContext := generateTestNeighbourContext("v4")
+	scc := SockControlChans{}
+	scc.Init()
+	scc.localAddr = "192.168.0.2"
+	fromN := make(chan BGPCommand)
+	toN := make(chan BGPCommand)
+	rid, _ := IPv4ToUint32("172.16.0.1")
+	bgpNeighbourContext := BGPNeighbourContext{RouterID: rid,
+		ASN: 6500, ToMainContext: fromN,
+		ToNeighbourContext: toN,
+		NeighbourAddr:      "192.168.0.1"}
+	if configure != nil {
+		configure(&bgpNeighbourContext)
+	}
+	go StartBGPNeighbourContext(&bgpNeighbourContext, true, scc)
+	GenerateOpenMsg(&testContext, scc.readChan, "")
+	<-fromN
+	toN <- BGPCommand{Cmnd: "NoCollision"}
+	<-fromN
+	//open and keepalive
+	<-scc.writeChan
+	<-scc.writeChan
+	scc.readChan <- GenerateKeepalive()
+	msgFromN := <-fromN
+	if msgFromN.Cmnd != "PassiveEstablished" {
+		t.Errorf("error in passive fsm. must be in PassiveEstablished state")
+	}
+	return scc, fromN, toN
+}
+
+/*
+	reads msgs, which passive peer sends to us; skipping keepalives
+*/
+func readNonKeepalive(t *testing.T, scc SockControlChans) (MsgHeader, []byte) {
+	for {
+		msg := <-scc.writeChan
+		hdr, err := DecodeMsgHeader(msg)
+		if err != nil {
+			t.Errorf("%v\n", err)
+			return hdr, msg
+		}
+		if hdr.Type != BGP_KEEPALIVE_MSG {
+			return hdr, msg
+		}
+	}
+}
+
+func TestRouteRefresh(t *testing.T) {
+	scc, fromN, toN := establishPassiveSession(t, nil)
+	encodedRR, _ := EncodeRouteRefreshMsg(&RouteRefreshMsg{AFI: MP_AFI_IPV4,
+		SAFI: MP_SAFI_UCAST})
+	scc.readChan <- encodedRR
+	msgFromN := <-fromN
+	if msgFromN.Cmnd != "RouteRefresh" || msgFromN.CmndData != "1 1" {
+		t.Errorf("route refresh wasnt passed to main context: %v %v\n",
+			msgFromN.Cmnd, msgFromN.CmndData)
+		return
+	}
+	prefix, _ := IPv4ToUint32("10.0.0.0")
+	route := BGPRoute{ORIGIN: ORIGIN_IGP}
+	route.Routes = append(route.Routes, IPV4_NLRI{Length: 24, Prefix: prefix})
+	go func() {
+		toN <- BGPCommand{Cmnd: "BeginRouteRefresh", CmndData: msgFromN.CmndData}
+		toN <- BGPCommand{Cmnd: "AdvertiseRouteV4", Route: route}
+		toN <- BGPCommand{Cmnd: "EndRouteRefresh", CmndData: msgFromN.CmndData}
+	}()
+	expectedSubtypes := []uint8{ROUTE_REFRESH_BORR, 0, ROUTE_REFRESH_EORR}
+	for _, subtype := range expectedSubtypes {
+		hdr, msg := readNonKeepalive(t, scc)
+		if subtype == 0 {
+			if hdr.Type != BGP_UPDATE_MSG {
+				t.Errorf("readvertised route must be sent between BoRR and EoRR\n")
+				return
+			}
+			continue
+		}
+		if hdr.Type != BGP_ROUTEREFRESH_MSG {
+			t.Errorf("expected route refresh msg, got msg type: %v\n", hdr.Type)
+			return
+		}
+		routeRefresh, err := DecodeRouteRefreshMsg(msg)
+		if err != nil {
+			t.Errorf("cant decode route refresh msg: %v\n", err)
+			return
+		}
+		if routeRefresh.Subtype != subtype || routeRefresh.AFI != MP_AFI_IPV4 {
+			t.Errorf("wrong BoRR/EoRR msg: %v\n", routeRefresh)
+			return
+		}
+	}
+}
+
+func TestAdminShutdown(t *testing.T) {
+	events := make(chan BGPEvent, 10)
+	scc, fromN, toN := establishPassiveSession(t,
+		func(context *BGPNeighbourContext) { context.Events = events })
+	go func() {
+		toN <- BGPCommand{Cmnd: "AdminShutdown", CmndData: "maintenance CHG-1234"}
+	}()
+	hdr, msg := readNonKeepalive(t, scc)
+	if hdr.Type != BGP_NOTIFICATION_MSG {
+		t.Errorf("expected notification msg, got msg type: %v\n", hdr.Type)
+		return
+	}
+	notification, err := DecodeNotificationMsg(msg)
+	if err != nil {
+		t.Errorf("cant decode notification: %v\n", err)
+		return
+	}
+	communication, _ := DecodeShutdownCommunication(notification.Data)
+	if notification.ErrorSubcode != BGP_CASE_ERROR_ADMIN_SHUTDOWN ||
+		communication != "maintenance CHG-1234" {
+		t.Errorf("wrong admin shutdown notification: %v\n", notification.String())
+		return
+	}
+	event := <-events
+	if event.Event != "NotificationSent" || event.Neighbour != "192.168.0.1" {
+		t.Errorf("sent notification wasnt reported: %v\n", event)
+		return
+	}
+	<-scc.toWriteError
+	<-scc.toReadError
+	msgFromN := <-fromN
+	if msgFromN.Cmnd != "Down" {
+		t.Errorf("main context wasnt informed about session's shutdown: %v\n",
+			msgFromN.Cmnd)
+		return
+	}
+	msgFromN = <-fromN
+	if msgFromN.Cmnd != "PassiveClossed" {
+		t.Errorf("main context wasnt informed about closed passive session: %v\n",
+			msgFromN.Cmnd)
+		return
+	}
+}
+
+func TestBFDDown(t *testing.T) {
+	events := make(chan BGPEvent, 10)
+	scc, fromN, toN := establishPassiveSession(t,
+		func(context *BGPNeighbourContext) { context.Events = events })
+	go func() {
+		toN <- BGPCommand{Cmnd: "BFDDown"}
+	}()
+	event := <-events
+	if event.Event != "BFDDown" || event.Neighbour != "192.168.0.1" {
+		t.Errorf("bfd down wasnt reported: %v\n", event)
+		return
+	}
+	<-scc.toWriteError
+	<-scc.toReadError
+	msgFromN := <-fromN
+	if msgFromN.Cmnd != "Down" {
+		t.Errorf("main context wasnt informed about session's teardown: %v\n",
+			msgFromN.Cmnd)
+		return
+	}
+}
+
+func TestNotificationRcvdEvent(t *testing.T) {
+	events := make(chan BGPEvent, 10)
+	scc, _, _ := establishPassiveSession(t,
+		func(context *BGPNeighbourContext) { context.Events = events })
+	encodedCease, _ := GenerateCeaseMsg(BGP_CASE_ERROR_ADMIN_RESET, "upgrade")
+	scc.readChan <- encodedCease
+	event := <-events
+	if event.Event != "NotificationRcvd" ||
+		event.Data != `Cease/Administrative Reset: "upgrade"` {
+		t.Errorf("rcved notification wasnt reported: %v\n", event)
+		return
+	}
+}
+
+/*
+	rcved update is processed before route refresh, which is passed to main
+	context; so we are using it as a sync point
+*/
+func sendUpdateAndSync(t *testing.T, scc SockControlChans, fromN chan BGPCommand,
+	route *BGPRoute) {
+	encodedUpdate, err := EncodeUpdateMsg(route)
+	if err != nil {
+		t.Errorf("cant encode update: %v\n", err)
+		return
+	}
+	scc.readChan <- encodedUpdate
+	encodedRR, _ := EncodeRouteRefreshMsg(&RouteRefreshMsg{AFI: MP_AFI_IPV4,
+		SAFI: MP_SAFI_UCAST})
+	scc.readChan <- encodedRR
+	<-fromN
+}
+
+func TestAdjRIBIn(t *testing.T) {
+	events := make(chan BGPEvent, 10)
+	adjRIBIn := NewAdjRIBIn(2)
+	scc, fromN, _ := establishPassiveSession(t,
+		func(context *BGPNeighbourContext) {
+			context.Events = events
+			context.AdjRIBIn = adjRIBIn
+		})
+	route := BGPRoute{ORIGIN: ORIGIN_IGP, MULTI_EXIT_DISC: 10,
+		Community: []uint32{65000<<16 | 100}}
+	for _, prefix := range []string{"10.0.0.0", "10.0.1.0", "10.0.2.0"} {
+		p, _ := IPv4ToUint32(prefix)
+		route.Routes = append(route.Routes, IPV4_NLRI{Length: 24, Prefix: p})
+	}
+	route.AddV4NextHop("192.168.0.1")
+	sendUpdateAndSync(t, scc, fromN, &route)
+	routes := adjRIBIn.Routes("192.168.0.1")
+	if len(routes) != 2 {
+		t.Errorf("adj-rib-in limit wasnt enforced; stored routes: %v\n", routes)
+		return
+	}
+	if routes[0].Prefix != "10.0.0.0/24" || routes[0].NextHop != "192.168.0.1" ||
+		routes[0].MED != 10 ||
+		routes[0].Communities[0] != "65000:100" {
+		t.Errorf("wrong adj-rib-in entry: %v\n", routes[0])
+		return
+	}
+	event := <-events
+	if event.Event != "AdjRIBInLimit" {
+		t.Errorf("reached limit wasnt reported: %v\n", event)
+		return
+	}
+	withdraw := BGPRoute{WithdrawRoutes: route.Routes[:1]}
+	sendUpdateAndSync(t, scc, fromN, &withdraw)
+	routes = adjRIBIn.Routes("")
+	if len(routes) != 1 || routes[0].Prefix != "10.0.1.0/24" {
+		t.Errorf("withdrawn route wasnt removed from adj-rib-in: %v\n", routes)
+		return
+	}
+	adjRIBIn.Clear("192.168.0.1")
+	if adjRIBIn.Count("192.168.0.1") != 0 {
+		t.Errorf("adj-rib-in wasnt cleared\n")
+	}
+}
+
+func TestAdjRIBInV6(t *testing.T) {
+	adjRIBIn := NewAdjRIBIn(0)
+	route := BGPRoute{ORIGIN: ORIGIN_IGP}
+	route.AS_PATH = []PathSegment{PathSegment{PSType: AS_SEQ, PSLength: 2,
+		PSValue: []uint32{6501, 6502}}}
+	route.NEXT_HOPv6, _ = IPv6StringToAddr("2001:db8::1")
+	prefix, _ := IPv6StringToAddr("2001:db8:100::")
+	route.RoutesV6 = append(route.RoutesV6, IPV6_NLRI{Length: 48, Prefix: prefix})
+	adjRIBIn.Update("[2001:db8::1]", &route)
+	routes := adjRIBIn.Routes("[2001:db8::1]")
+	if len(routes) != 1 || routes[0].Prefix != "2001:db8:100::/48" ||
+		routes[0].NextHop != "2001:db8::1" || len(routes[0].ASPath) != 2 {
+		t.Errorf("wrong v6 adj-rib-in entry: %v\n", routes)
+	}
+}
+
+func TestParseNeighbourCfg(t *testing.T) {
+	neighbourCfg, err := parseNeighbourCfg("192.168.0.1 inet inet6")
+	if err != nil || neighbourCfg.Address != "192.168.0.1" ||
+		len(neighbourCfg.MPCaps) != 2 {
+		t.Errorf("cant parse legacy neighbour's cfg: %v %v\n", neighbourCfg, err)
+		return
+	}
+	neighbourCfg, err = parseNeighbourCfg(`{"Address": "[2001:db8::1]",
+		"AFIs": ["inet6"], "MaxPrefix": {"Limit": 100, "Action": "log"}}`)
+	if err != nil || neighbourCfg.Address != "[2001:db8::1]" ||
+		len(neighbourCfg.MPCaps) != 1 || neighbourCfg.MPCaps[0].AFI != MP_AFI_IPV6 ||
+		neighbourCfg.MaxPrefix.Limit != 100 ||
+		neighbourCfg.MaxPrefix.Action != MAX_PREFIX_ACTION_LOG {
+		t.Errorf("cant parse json neighbour's cfg: %v %v\n", neighbourCfg, err)
+	}
+	_, err = parseNeighbourCfg(`{"Address": "192.168.0.1", "NextHop": "2001:db8::1"}`)
+	if err == nil {
+		t.Errorf("v6 address was accepted as v4 next hop\n")
+	}
+	_, err = parseNeighbourCfg(`{"Address": "192.168.0.1", "AddPath": ["inet7"]}`)
+	if err == nil {
+		t.Errorf("unknown afi was accepted for add path\n")
+	}
+	_, err = parseNeighbourCfg(`{"Address": "192.168.0.1", "AFIs": ["inet7"]}`)
+	if err == nil {
+		t.Errorf("unknown afi was accepted\n")
+	}
+	_, err = parseNeighbourCfg(`{"Address": "192.168.0.1", "RemoteASN": 23456}`)
+	if err == nil {
+		t.Errorf("AS_TRANS was accepted as neighbour's asn\n")
+	}
+	_, err = parseNeighbourCfg(`{"Address": "192.168.0.1", "HoldTime": 2}`)
+	if err == nil {
+		t.Errorf("hold time less than 3 seconds was accepted\n")
+	}
+	_, err = parseNeighbourCfg(`{"Address": "192.168.0.1", "HoldTime": 30,
+		"KeepaliveTime": 30}`)
+	if err == nil {
+		t.Errorf("keepalive time which isnt less than hold time was accepted\n")
+	}
+	neighbourCfg, err = parseNeighbourCfg(`{"Address": "192.168.0.1",
+		"RemoteASN": 65001, "LocalASN": 4200000000, "Passive": true}`)
+	if err != nil || neighbourCfg.HoldTime != DEFAULT_HOLD_TIME ||
+		neighbourCfg.KeepaliveTime != 0 || neighbourCfg.RemoteASN != 65001 ||
+		neighbourCfg.LocalASN != 4200000000 || !neighbourCfg.Passive {
+		t.Errorf("cant parse per neighbour settings: %v %v\n", neighbourCfg, err)
+	}
+}
+
+func TestBadPeerAS(t *testing.T) {
+	testContext := generateTestNeighbourContext("v4")
+	scc := SockControlChans{}
+	scc.Init()
+	scc.localAddr = "192.168.0.2"
+	fromN := make(chan BGPCommand)
+	toN := make(chan BGPCommand)
+	rid, _ := IPv4ToUint32("172.16.0.1")
+	bgpNeighbourContext := BGPNeighbourContext{RouterID: rid,
+		ASN: 6500, ToMainContext: fromN,
+		ToNeighbourContext: toN,
+		NeighbourAddr:      "192.168.0.1",
+		RemoteASN:          65001}
+	go StartBGPNeighbourContext(&bgpNeighbourContext, true, scc)
+	GenerateOpenMsg(&testContext, scc.readChan, "")
+	hdr, msg := readNonKeepalive(t, scc)
+	if hdr.Type != BGP_NOTIFICATION_MSG {
+		t.Errorf("expected notification msg, got msg type: %v\n", hdr.Type)
+		return
+	}
+	notification, err := DecodeNotificationMsg(msg)
+	if err != nil || notification.ErrorCode != BGP_OPEN_MSG_ERROR ||
+		notification.ErrorSubcode != BGP_OM_ERROR_BAD_PEER_AS {
+		t.Errorf("wrong notification for unexpected peer's asn: %v %v\n",
+			notification, err)
+		return
+	}
+	<-scc.toWriteError
+	<-scc.toReadError
+	msgFromN := <-fromN
+	if msgFromN.Cmnd != "PassiveClossed" {
+		t.Errorf("main context wasnt informed about closed passive session: %v\n",
+			msgFromN.Cmnd)
+	}
+}
+
+func TestHoldTimerExpired(t *testing.T) {
+	scc, fromN, _ := establishPassiveSession(t,
+		func(context *BGPNeighbourContext) { context.HoldTime = 3 })
+	start := time.Now()
+	//we dont send anything, so neighbour must tear down the session
+	hdr, msg := readNonKeepalive(t, scc)
+	if hdr.Type != BGP_NOTIFICATION_MSG {
+		t.Errorf("expected notification msg, got msg type: %v\n", hdr.Type)
+		return
+	}
+	notification, err := DecodeNotificationMsg(msg)
+	if err != nil || notification.ErrorCode != BGP_HOLD_TIMER_EXPIRED {
+		t.Errorf("wrong notification on hold timer expiration: %v %v\n",
+			notification, err)
+		return
+	}
+	if time.Since(start) < 2*time.Second {
+		t.Errorf("hold timer expired too early: %v\n", time.Since(start))
+	}
+	<-scc.toWriteError
+	<-scc.toReadError
+	msgFromN := <-fromN
+	if msgFromN.Cmnd != "Down" {
+		t.Errorf("main context wasnt informed about session's teardown: %v\n",
+			msgFromN.Cmnd)
+	}
+}
+
+func TestNegotiateTimers(t *testing.T) {
+	context := BGPNeighbourContext{}
+	context.negotiateTimers(30)
+	if context.fsm.HoldTime != 30 || context.fsm.KeepaliveTime != 10 {
+		t.Errorf("wrong timers w/ neighbour's smaller hold time: %v %v\n",
+			context.fsm.HoldTime, context.fsm.KeepaliveTime)
+	}
+	context = BGPNeighbourContext{HoldTime: 60, KeepaliveTime: 5}
+	context.negotiateTimers(180)
+	if context.fsm.HoldTime != 60 || context.fsm.KeepaliveTime != 5 {
+		t.Errorf("wrong timers w/ configured keepalive time: %v %v\n",
+			context.fsm.HoldTime, context.fsm.KeepaliveTime)
+	}
+	context.negotiateTimers(0)
+	if context.fsm.HoldTime != 0 || context.fsm.KeepaliveTime != 0 {
+		t.Errorf("keepalives must be disabled w/ zero hold time: %v %v\n",
+			context.fsm.HoldTime, context.fsm.KeepaliveTime)
+	}
+}
+
+func TestEBGPAttrs(t *testing.T) {
+	context := BGPNeighbourContext{ASN: 65000, RemoteASN: 65001}
+	route := BGPRoute{LOCAL_PREF: 100, AS_PATH: []PathSegment{
+		PathSegment{PSType: AS_SEQ, PSLength: 1, PSValue: []uint32{65010}}}}
+	orig := route.AS_PATH[0].PSValue
+	context.setEBGPAttrs(&route)
+	if !route.Flags.EBGP || route.LOCAL_PREF != 0 || len(route.AS_PATH) != 1 ||
+		route.AS_PATH[0].PSLength != 2 || route.AS_PATH[0].PSValue[0] != 65000 ||
+		route.AS_PATH[0].PSValue[1] != 65010 {
+		t.Errorf("wrong ebgp attrs: %v\n", route)
+	}
+	if len(orig) != 1 || orig[0] != 65010 {
+		t.Errorf("route's as path from main context was changed: %v\n", orig)
+	}
+	route = BGPRoute{LOCAL_PREF: 100}
+	context.RemoteASN = 65000
+	context.setEBGPAttrs(&route)
+	if route.Flags.EBGP || route.LOCAL_PREF != 100 || len(route.AS_PATH) != 0 {
+		t.Errorf("ibgp route was changed: %v\n", route)
+	}
+}
+
+func TestSelectNextHops(t *testing.T) {
+	globalNH, _ := IPv6StringToAddr("2001:db8::100")
+	context := BGPNeighbourContext{NeighbourAddr: "[fe80::2%eth0]",
+		defaultNextHop: "10.0.0.1", defaultNextHopV6: globalNH}
+	context.selectNextHops("fe80::1%eth0")
+	linkLocalNH, _ := IPv6StringToAddr("fe80::1")
+	if context.NextHop != "10.0.0.1" || context.NextHopV6 != globalNH ||
+		context.NextHopV6LinkLocal != linkLocalNH {
+		t.Errorf("wrong next hops for link local session: %v %v %v\n", context.NextHop,
+			context.NextHopV6, context.NextHopV6LinkLocal)
+		return
+	}
+	context.defaultNextHopV6 = IPv6Addr{}
+	context.selectNextHops("fe80::1%eth0")
+	if context.NextHopV6 != linkLocalNH || context.NextHopV6LinkLocal != (IPv6Addr{}) {
+		t.Errorf("link local wasnt used as the only next hop: %v %v\n",
+			context.NextHopV6, context.NextHopV6LinkLocal)
+		return
+	}
+	context = BGPNeighbourContext{NeighbourAddr: "192.168.0.1",
+		defaultNextHopV6: globalNH, ConfiguredNextHopV6: "2001:db8::200"}
+	context.selectNextHops("192.168.0.2")
+	configuredNH, _ := IPv6StringToAddr("2001:db8::200")
+	if context.NextHop != "192.168.0.2" || context.NextHopV6 != configuredNH {
+		t.Errorf("wrong next hops for v4 session: %v %v\n", context.NextHop,
+			context.NextHopV6)
+		return
+	}
+	context.ConfiguredNextHop = "192.168.0.100"
+	context.selectNextHops("192.168.0.2")
+	if context.NextHop != "192.168.0.100" {
+		t.Errorf("configured next hop wasnt used: %v\n", context.NextHop)
+	}
+}
+
+func generateTestRoute(prefixes ...string) BGPRoute {
+	route := BGPRoute{ORIGIN: ORIGIN_IGP}
+	for _, prefix := range prefixes {
+		p, _ := IPv4ToUint32(prefix)
+		route.Routes = append(route.Routes, IPV4_NLRI{Length: 24, Prefix: p})
+	}
+	route.AddV4NextHop("192.168.0.1")
+	return route
+}
+
+func TestMaxPrefixTeardown(t *testing.T) {
+	events := make(chan BGPEvent, 10)
+	scc, fromN, _ := establishPassiveSession(t,
+		func(context *BGPNeighbourContext) {
+			context.Events = events
+			context.MaxPrefix = MaxPrefixCfg{Limit: 2, WarningThreshold: 50,
+				Action: MAX_PREFIX_ACTION_TEARDOWN}
+		})
+	route := generateTestRoute("10.0.0.0")
+	sendUpdateAndSync(t, scc, fromN, &route)
+	event := <-events
+	if event.Event != "MaxPrefixWarning" {
+		t.Errorf("crossed warning threshold wasnt reported: %v\n", event)
+		return
+	}
+	//readvertised prefix must not be counted twice
+	route = generateTestRoute("10.0.0.0", "10.0.1.0")
+	sendUpdateAndSync(t, scc, fromN, &route)
+	route = generateTestRoute("10.0.2.0")
+	encodedUpdate, _ := EncodeUpdateMsg(&route)
+	scc.readChan <- encodedUpdate
+	msgFromN := <-fromN
+	if msgFromN.Cmnd != "MaxPrefixExceeded" {
+		t.Errorf("main context wasnt informed about exceeded limit: %v\n",
+			msgFromN.Cmnd)
+		return
+	}
+	hdr, msg := readNonKeepalive(t, scc)
+	if hdr.Type != BGP_NOTIFICATION_MSG {
+		t.Errorf("expected notification msg, got msg type: %v\n", hdr.Type)
+		return
+	}
+	notification, _ := DecodeNotificationMsg(msg)
+	if notification.ErrorCode != BGP_CASE_ERROR ||
+		notification.ErrorSubcode != BGP_CASE_ERROR_MAX_PREFIX {
+		t.Errorf("wrong max prefix notification: %v\n", notification.String())
+		return
+	}
+	event = <-events
+	if event.Event != "MaxPrefixExceeded" {
+		t.Errorf("exceeded limit wasnt reported: %v\n", event)
+	}
+}
+
+func TestMaxPrefixLog(t *testing.T) {
+	events := make(chan BGPEvent, 10)
+	scc, fromN, _ := establishPassiveSession(t,
+		func(context *BGPNeighbourContext) {
+			context.Events = events
+			context.MaxPrefix = MaxPrefixCfg{Limit: 1,
+				Action: MAX_PREFIX_ACTION_LOG}
+		})
+	route := generateTestRoute("10.0.0.0", "10.0.1.0")
+	sendUpdateAndSync(t, scc, fromN, &route)
+	event := <-events
+	if event.Event != "MaxPrefixExceeded" {
+		t.Errorf("exceeded limit wasnt reported: %v\n", event)
+		return
+	}
+	//session must stay up: next route refresh is still processed
+	sendUpdateAndSync(t, scc, fromN, &route)
+}
+
+func TestMaxPrefixRestart(t *testing.T) {
+	context := BGPContext{ToMainContext: make(chan BGPCommand, 1)}
+	context.Neighbours = append(context.Neighbours, BGPNeighbour{
+		Address:      "192.168.0.1",
+		activeExists: true,
+		maxPrefix: MaxPrefixCfg{Limit: 1, Action: MAX_PREFIX_ACTION_RESTART,
+			RestartInterval: 10 * time.Millisecond}})
+	context.MaxPrefixExceeded("192.168.0.1")
+	if !context.Neighbours[0].adminDown {
+		t.Errorf("neighbour must stay down after exceeding max prefix\n")
+		return
+	}
+	cmnd := <-context.ToMainContext
+	if cmnd.Cmnd != "MaxPrefixRestart" || cmnd.From != "192.168.0.1" {
+		t.Errorf("neighbour wasnt scheduled for restart: %v\n", cmnd)
+		return
+	}
+	context.MaxPrefixRestart(cmnd.From)
+	if context.Neighbours[0].adminDown || context.Neighbours[0].maxPrefixDown {
+		t.Errorf("neighbour wasnt reenabled after restart interval\n")
+	}
+}
+
+func TestOutboundPolicy(t *testing.T) {
+	med := uint32(50)
+	transit := &Policy{Terms: []PolicyTerm{
+		PolicyTerm{Match: PolicyMatch{Prefixes: []string{"10.0.0.0/8"},
+			MaxLength: 24},
+			Action: POLICY_REJECT},
+		PolicyTerm{Match: PolicyMatch{Services: []string{"dns"}},
+			Set: PolicySet{AddCommunities: []string{"no-export", "65000:53"},
+				Prepend: 2, MED: &med, NextHop: "192.168.0.100"},
+			Action: POLICY_ACCEPT},
+	}}
+	if err := transit.Validate(); err != nil {
+		t.Errorf("valid policy wasnt accepted: %v\n", err)
+		return
+	}
+	context := BGPContext{ASN: 65000, Community: []uint32{65000<<16 | 1}}
+	context.AddV4Route("10.0.0.0/24")
+	context.AddV4Route("192.0.2.53/32 service=dns")
+	neighbour := &BGPNeighbour{Address: "192.168.0.1", outboundPolicy: transit}
+	if _, accepted := context.GenerateUpdateRouteV4(context.RIBv4[0],
+		neighbour); accepted {
+		t.Errorf("route must be rejected by outbound policy\n")
+		return
+	}
+	route, accepted := context.GenerateUpdateRouteV4(context.RIBv4[1], neighbour)
+	if !accepted {
+		t.Errorf("route must be accepted by outbound policy\n")
+		return
+	}
+	if len(route.Community) != 3 || route.Community[1] != COMMUNITY_NO_EXPORT ||
+		route.MULTI_EXIT_DISC != med || !route.Flags.FixedNextHop ||
+		len(route.AS_PATH) != 1 || route.AS_PATH[0].PSLength != 2 ||
+		route.AS_PATH[0].PSValue[0] != 65000 {
+		t.Errorf("policy's actions wasnt applied: %v\n", route)
+		return
+	}
+	if len(context.Community) != 1 {
+		t.Errorf("policy has modified context's communities: %v\n", context.Community)
+		return
+	}
+	//neighbour w/o policy gets route as is
+	route, accepted = context.GenerateUpdateRouteV4(context.RIBv4[0],
+		&BGPNeighbour{Address: "192.168.0.2"})
+	if !accepted || len(route.Community) != 1 || len(route.AS_PATH) != 0 {
+		t.Errorf("route was modified w/o policy: %v\n", route)
+	}
+	encodedUpdate, err := EncodeUpdateMsg(&route)
+	if err != nil {
+		t.Errorf("cant encode update w/ policy's attributes: %v\n", err)
+		return
+	}
+	decodedRoute, err := DecodeUpdateMsg(encodedUpdate, &BGPCapabilities{})
+	if err != nil || len(decodedRoute.Community) != 1 {
+		t.Errorf("cant decode update w/ policy's attributes: %v %v\n",
+			decodedRoute, err)
+	}
+}
+
+func TestInboundPolicy(t *testing.T) {
+	localPref := uint32(50)
+	policy := &Policy{Terms: []PolicyTerm{
+		PolicyTerm{Match: PolicyMatch{AFI: "inet", MinLength: 25},
+			Action: POLICY_REJECT},
+		PolicyTerm{Match: PolicyMatch{Communities: []string{"65000:666"}},
+			Set: PolicySet{LocalPref: &localPref}},
+	}}
+	route := generateTestRoute("10.0.0.0", "10.0.1.0")
+	route.Routes = append(route.Routes, IPV4_NLRI{Length: 32, Prefix: 1})
+	route.Community = []uint32{65000<<16 | 666}
+	routes := policy.Filter(&route, 65000)
+	if len(routes) != 3 || len(routes[0].WithdrawRoutes) != 1 ||
+		routes[1].LOCAL_PREF != localPref {
+		t.Errorf("inbound policy wasnt applied: %v\n", routes)
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	invalid := []Policy{
+		Policy{Terms: []PolicyTerm{PolicyTerm{Match: PolicyMatch{Prefixes: []string{"10.0.0.0"}}}}},
+		Policy{Terms: []PolicyTerm{PolicyTerm{Match: PolicyMatch{AFI: "inet7"}}}},
+		Policy{Terms: []PolicyTerm{PolicyTerm{Set: PolicySet{Communities: []string{"65000:70000"}}}}},
+		Policy{Terms: []PolicyTerm{PolicyTerm{Action: "drop"}}},
+	}
+	for _, policy := range invalid {
+		if err := policy.Validate(); err == nil {
+			t.Errorf("invalid policy was accepted: %v\n", policy)
+		}
+	}
+}
+
+func TestAddPathSend(t *testing.T) {
+	testContext := generateTestNeighbourContext("v4")
+	scc := SockControlChans{}
+	scc.Init()
+	scc.localAddr = "192.168.0.2"
+	fromN := make(chan BGPCommand)
+	toN := make(chan BGPCommand)
+	rid, _ := IPv4ToUint32("172.16.0.1")
+	bgpNeighbourContext := BGPNeighbourContext{RouterID: rid,
+		ASN: 6500, ToMainContext: fromN,
+		ToNeighbourContext: toN,
+		NeighbourAddr:      "192.168.0.1",
+		AddPath:            []MPCapability{mpCapInet}}
+	go StartBGPNeighbourContext(&bgpNeighbourContext, true, scc)
+	//we are able to rcv multiple paths from passive peer
+	openMsg := OpenMsg{Hdr: OpenMsgHdr{Version: 4, MyASN: uint16(testContext.ASN),
+		BGPID: testContext.RouterID, HoldTime: 90}}
+	openMsg.Caps.AddPath = []AddPathCapability{AddPathCapability{AFI: MP_AFI_IPV4,
+		SAFI: MP_SAFI_UCAST, Flags: ADD_PATH_RECEIVE}}
+	encodedOpen, _ := EncodeOpenMsg(&openMsg)
+	scc.readChan <- encodedOpen
+	<-fromN
+	toN <- BGPCommand{Cmnd: "NoCollision"}
+	expectedCmnds := []string{"addPathInet", "speaksInet"}
+	for _, cmnd := range expectedCmnds {
+		msgFromN := <-fromN
+		if msgFromN.Cmnd != cmnd {
+			t.Errorf("expected %v from neighbour, got: %v\n", cmnd, msgFromN.Cmnd)
+			return
+		}
+	}
+	msg := <-scc.writeChan
+	passiveOpen, err := DecodeOpenMsg(msg[MSG_HDR_SIZE:])
+	if err != nil || len(passiveOpen.Caps.AddPath) != 1 ||
+		passiveOpen.Caps.AddPath[0].Flags != ADD_PATH_SEND {
+		t.Errorf("passive peer must advertise add path (send): %v %v\n",
+			passiveOpen.Caps.AddPath, err)
+		return
+	}
+	<-scc.writeChan
+	scc.readChan <- GenerateKeepalive()
+	if msgFromN := <-fromN; msgFromN.Cmnd != "PassiveEstablished" {
+		t.Errorf("error in passive fsm. must be in PassiveEstablished state")
+		return
+	}
+	route := generateTestRoute("10.0.0.0")
+	route.Routes[0].PathID = 2
+	toN <- BGPCommand{Cmnd: "AdvertiseRouteV4", Route: route}
+	_, msg = readNonKeepalive(t, scc)
+	//nlri follows withdrawn routes and path attrs (both are prefixed by 2 octets length)
+	attrsLength := int(msg[MSG_HDR_SIZE+TWO_OCTETS])<<8 | int(msg[MSG_HDR_SIZE+THREE_OCTETS])
+	nlris, err := DecodeIPv4NLRI(RouteFlags{WithPathId: true},
+		msg[MSG_HDR_SIZE+FOUR_OCTETS+attrsLength:])
+	if err != nil || len(nlris) != 1 || nlris[0] != route.Routes[0] {
+		t.Errorf("route wasnt sent w/ path id: %v %v\n", nlris, err)
+	}
+}
+
+func TestAddPathBestPath(t *testing.T) {
+	context := BGPContext{ASN: 65000}
+	context.Neighbours = []BGPNeighbour{
+		BGPNeighbour{Address: "192.168.0.1", State: "Established",
+			CmndChan: make(chan BGPCommand, 10), speaksInet: true, addPathInet: true},
+		BGPNeighbour{Address: "192.168.0.2", State: "Established",
+			CmndChan: make(chan BGPCommand, 10), speaksInet: true},
+	}
+	addPathChan := context.Neighbours[0].CmndChan
+	bestPathChan := context.Neighbours[1].CmndChan
+	context.AddV4Route("192.0.2.53/32 path_id=1 next_hop=10.0.0.1")
+	context.AddV4Route("192.0.2.53/32 path_id=2 next_hop=10.0.0.2")
+	context.AddV4Route("192.0.2.53/32 path_id=2 next_hop=10.0.0.2")
+	context.AddV4Route("192.0.2.53/32 path_id=3 next_hop=10.0.0")
+	if len(context.RIBv4) != 2 {
+		t.Errorf("duplicate or invalid path was added into rib: %v\n", context.RIBv4)
+		return
+	}
+	if len(addPathChan) != 2 || len(bestPathChan) != 1 {
+		t.Errorf("wrong number of advertised paths: %v (add path), %v\n",
+			len(addPathChan), len(bestPathChan))
+		return
+	}
+	for i := 0; i < 2; i++ {
+		cmnd := <-addPathChan
+		nh, _ := DecodeV4NextHop(&cmnd.Route)
+		if cmnd.Route.Routes[0].PathID != uint32(i+1) ||
+			nh != uint32(10<<24|i+1) || !cmnd.Route.Flags.FixedNextHop {
+			t.Errorf("path was advertised w/o its path id or next hop: %v\n", cmnd.Route)
+			return
+		}
+	}
+	<-bestPathChan
+	//best path is replaced by the next one for neighbour w/o add path
+	context.WithdrawV4Route("192.0.2.53/32 path_id=1")
+	cmnd := <-addPathChan
+	if cmnd.Cmnd != "WithdrawRouteV4" || cmnd.Route.WithdrawRoutes[0].PathID != 1 {
+		t.Errorf("path wasnt withdrawn from add path neighbour: %v\n", cmnd)
+		return
+	}
+	cmnd = <-bestPathChan
+	if cmnd.Cmnd != "AdvertiseRouteV4" || cmnd.Route.Routes[0].PathID != 2 {
+		t.Errorf("best path wasnt replaced: %v\n", cmnd)
+		return
+	}
+	context.WithdrawV4Route("192.0.2.53/32 path_id=2")
+	for _, cmndChan := range []chan BGPCommand{addPathChan, bestPathChan} {
+		cmnd = <-cmndChan
+		if cmnd.Cmnd != "WithdrawRouteV4" {
+			t.Errorf("last path wasnt withdrawn: %v\n", cmnd)
+			return
+		}
+	}
+	if len(context.RIBv4) != 0 || len(context.routeMeta) != 0 {
+		t.Errorf("withdrawn paths are still in rib: %v %v\n", context.RIBv4,
+			context.routeMeta)
+	}
+}
+
+func TestFlowSpecAdvertise(t *testing.T) {
+	context := BGPContext{ASN: 65000}
+	context.Neighbours = []BGPNeighbour{
+		BGPNeighbour{Address: "192.168.0.1", State: "Established",
+			CmndChan: make(chan BGPCommand, 10), speaksInet: true, speaksFlow: true},
+		BGPNeighbour{Address: "192.168.0.2", State: "Established",
+			CmndChan: make(chan BGPCommand, 10), speaksInet: true},
+	}
+	flowChan := context.Neighbours[0].CmndChan
+	inetChan := context.Neighbours[1].CmndChan
+	rule := `{"AFI": 1, "Destination": {"IP": "192.0.2.53", "Mask": "/////w=="},
+		"Protocols": [{"Op": 1, "Value": 17}], "RateLimit": 1000}`
+	context.AddFlowSpec(rule)
+	context.AddFlowSpec(rule)
+	context.AddFlowSpec(`{"AFI": 1}`)
+	if len(context.RIBFlowSpec) != 1 {
+		t.Errorf("duplicate or invalid flowspec rule was added: %v\n", context.RIBFlowSpec)
+		return
+	}
+	if len(flowChan) != 1 || len(inetChan) != 0 {
+		t.Errorf("wrong number of advertised flowspec rules: %v, %v (w/o flowspec)\n",
+			len(flowChan), len(inetChan))
+		return
+	}
+	cmnd := <-flowChan
+	if cmnd.Cmnd != "AdvertiseFlowSpec" || len(cmnd.Route.ExtCommunity) != 1 ||
+		cmnd.Route.ExtCommunity[0] != FlowSpecTrafficRate(65000, 1000) {
+		t.Errorf("flowspec rule was advertised w/o its action: %v\n", cmnd)
+		return
+	}
+	//same match w/ other action replaces the rule
+	context.AddFlowSpec(strings.Replace(rule, "1000", "0", 1))
+	cmnd = <-flowChan
+	if len(context.RIBFlowSpec) != 1 || cmnd.Cmnd != "AdvertiseFlowSpec" ||
+		cmnd.Route.ExtCommunity[0] != FlowSpecTrafficRate(65000, 0) {
+		t.Errorf("flowspec rule wasnt replaced: %v\n", cmnd)
+		return
+	}
+	context.Neighbours[1].speaksFlow = true
+	context.AdvertiseAllFlowSpec(&context.Neighbours[1])
+	if len(inetChan) != 1 {
+		t.Errorf("flowspec rules wasnt advertised to established neighbour\n")
+		return
+	}
+	context.WithdrawFlowSpec(rule)
+	cmnd = <-flowChan
+	if cmnd.Cmnd != "WithdrawFlowSpec" || len(cmnd.Route.WithdrawFlowSpec) != 1 ||
+		len(context.RIBFlowSpec) != 0 {
+		t.Errorf("flowspec rule wasnt withdrawn: %v\n", cmnd)
+	}
+}
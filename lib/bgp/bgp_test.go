@@ -0,0 +1,88 @@
+package bgp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/r3boot/anycast-agent/lib"
+	"github.com/r3boot/anycast-agent/lib/bgp/bfd"
+	"github.com/r3boot/anycast-agent/lib/bgp/bgp2go"
+)
+
+func TestBFDRoutine(t *testing.T) {
+	if Logger.Info == nil {
+		Logger = lib.NewLogger(false)
+	}
+
+	tests := []struct {
+		name  string
+		down  bfd.Event
+		reset bool
+	}{
+		{"path down", bfd.Event{State: bfd.StateDown, Diag: bfd.DiagControlDetectExpired, RemoteState: bfd.StateUp}, true},
+		{"peer admin down", bfd.Event{State: bfd.StateDown, Diag: bfd.DiagNeighborDown, RemoteState: bfd.StateAdminDown}, false},
+		{"local admin down", bfd.Event{State: bfd.StateAdminDown, Diag: bfd.DiagAdminDown, RemoteState: bfd.StateUp}, false},
+	}
+
+	for _, test := range tests {
+		bgp := &BGP{cmdToPeer: make(chan bgp2go.BGPProcessMsg, 1)}
+		events := make(chan bfd.Event, 2)
+		test.down.Peer = "10.0.4.1"
+		events <- bfd.Event{Peer: "10.0.4.1", State: bfd.StateUp, RemoteState: bfd.StateUp}
+		events <- test.down
+		close(events)
+
+		done := make(chan struct{})
+		go func() {
+			bgp.bfdRoutine(events)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: bfdRoutine did not return", test.name)
+		}
+
+		select {
+		case msg := <-bgp.cmdToPeer:
+			if !test.reset {
+				t.Errorf("%s: unexpected %s %s", test.name, msg.Cmnd, msg.Data)
+			} else if msg.Cmnd != "BFDDown" || msg.Data != "10.0.4.1" {
+				t.Errorf("%s: got %s %s, want BFDDown 10.0.4.1", test.name, msg.Cmnd, msg.Data)
+			}
+		default:
+			if test.reset {
+				t.Errorf("%s: BGP session was not reset", test.name)
+			}
+		}
+	}
+}
+
+func TestRoutePath(t *testing.T) {
+	if Logger.Info == nil {
+		Logger = lib.NewLogger(false)
+	}
+
+	bgp := &BGP{cmdToPeer: make(chan bgp2go.BGPProcessMsg, 1)}
+	tests := []struct {
+		name  string
+		send  func()
+		cmnd  string
+		route string
+	}{
+		{"route", func() { bgp.AddRoute("192.0.2.1", "dns") }, "AddV4Route", "192.0.2.1/32 service=dns"},
+		{"path", func() { bgp.AddRoutePath("192.0.2.1", "dns", 2, "10.0.4.2") }, "AddV4Route", "192.0.2.1/32 path_id=2 next_hop=10.0.4.2 service=dns"},
+		{"v6 path", func() { bgp.AddRoutePath("2001:db8::1", "", 3, "2001:db8:4::2") }, "AddV6Route", "2001:db8::1/128 path_id=3 next_hop=2001:db8:4::2"},
+		{"path without next hop", func() { bgp.AddRoutePath("192.0.2.0/24", "", 4, "") }, "AddV4Route", "192.0.2.0/24 path_id=4"},
+		{"withdraw path", func() { bgp.RemoveRoutePath("192.0.2.1", 2) }, "WithdrawV4Route", "192.0.2.1/32 path_id=2"},
+		{"withdraw route", func() { bgp.RemoveRoute("2001:db8::1") }, "WithdrawV6Route", "2001:db8::1/128"},
+	}
+
+	for _, test := range tests {
+		test.send()
+		msg := <-bgp.cmdToPeer
+		if msg.Cmnd != test.cmnd || msg.Data != test.route {
+			t.Errorf("%s: got %s %q, want %s %q", test.name, msg.Cmnd, msg.Data, test.cmnd, test.route)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/r3boot/anycast-agent/lib/bgp/bgp2go"
+)
+
+// BGP Monitoring Protocol (RFC 7854) message types and flags
+const (
+	bmpVersion = 3
+
+	bmpMsgRouteMonitoring = 0
+	bmpMsgStatistics      = 1
+	bmpMsgPeerDown        = 2
+	bmpMsgPeerUp          = 3
+	bmpMsgInitiation      = 4
+
+	bmpPeerFlagV = 0x80 // IPv6 peer
+	bmpPeerFlagL = 0x40 // post-policy
+	bmpPeerFlagA = 0x20 // 2-byte AS_PATH
+	bmpPeerFlagO = 0x10 // Adj-RIB-Out (RFC 8671)
+
+	bmpInfoSysDescr = 1
+	bmpInfoSysName  = 2
+
+	bmpStatAdjRIBIn         = 7
+	bmpStatAdjRIBOutPostPol = 15
+
+	bmpDownLocalNotification    = 1
+	bmpDownLocalNoNotification  = 2
+	bmpDownRemoteNotification   = 3
+	bmpDownRemoteNoNotification = 4
+
+	bmpDialTimeout  = 5 * time.Second
+	bmpWriteTimeout = 10 * time.Second
+)
+
+const (
+	BMPDefaultStatsInterval     = 60 * time.Second
+	BMPDefaultReconnectInterval = 10 * time.Second
+	BMPDefaultBufferSize        = 10000
+)
+
+// Collector is the host:port of the BMP station. SysName defaults to the
+// hostname. BufferSize is the number of messages queued while the
+// collector is slow; on overflow the connection is reset and the state
+// of all peers is sent again.
+type BMPConfig struct {
+	Collector         string
+	SysName           string
+	SysDescr          string
+	StatsInterval     time.Duration
+	ReconnectInterval time.Duration
+	BufferSize        int
+}
+
+type bmpPeer struct {
+	up bgp2go.BGPMonitorMsg
+	// Last route monitoring message of every prefix announced to the peer
+	adjRIBOut map[string][]byte
+}
+
+// Streams the session state and Adj-RIB-Out of the bgp neighbours to a
+// BMP collector. Every (re)connect starts with an Initiation, followed by
+// a Peer Up and the full Adj-RIB-Out of every established peer
+type BMPClient struct {
+	cfg      BMPConfig
+	monitor  chan bgp2go.BGPMonitorMsg
+	adjRIBIn func() (map[string]int, error)
+	lock     sync.Mutex
+	peers    map[string]*bmpPeer
+	queue    chan []byte
+}
+
+func NewBMPClient(cfg BMPConfig, monitor chan bgp2go.BGPMonitorMsg) *BMPClient {
+	if cfg.SysName == "" {
+		cfg.SysName, _ = os.Hostname()
+	}
+	if cfg.SysDescr == "" {
+		cfg.SysDescr = "anycast-agent"
+	}
+	if cfg.StatsInterval <= 0 {
+		cfg.StatsInterval = BMPDefaultStatsInterval
+	}
+	if cfg.ReconnectInterval <= 0 {
+		cfg.ReconnectInterval = BMPDefaultReconnectInterval
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = BMPDefaultBufferSize
+	}
+
+	return &BMPClient{
+		cfg:     cfg,
+		monitor: monitor,
+		peers:   make(map[string]*bmpPeer),
+	}
+}
+
+func (c *BMPClient) Run() {
+	go c.monitorRoutine()
+
+	for {
+		conn, err := net.DialTimeout("tcp", c.cfg.Collector, bmpDialTimeout)
+		if err != nil {
+			Logger.Warn("bgp: Failed to connect to BMP collector: " + err.Error())
+			time.Sleep(c.cfg.ReconnectInterval)
+			continue
+		}
+
+		Logger.Info("bgp: Connected to BMP collector " + c.cfg.Collector)
+		if err = c.serve(conn); err != nil {
+			Logger.Warn("bgp: Lost connection to BMP collector: " + err.Error())
+		}
+		conn.Close()
+		time.Sleep(c.cfg.ReconnectInterval)
+	}
+}
+
+func (c *BMPClient) serve(conn net.Conn) error {
+	queue := make(chan []byte, c.cfg.BufferSize)
+
+	c.lock.Lock()
+	msgs := [][]byte{bmpInitiation(c.cfg)}
+	for _, peer := range c.peers {
+		msgs = append(msgs, bmpPeerUp(peer.up))
+		for _, msg := range peer.adjRIBOut {
+			msgs = append(msgs, msg)
+		}
+	}
+	c.queue = queue
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		if c.queue == queue {
+			c.queue = nil
+		}
+		c.lock.Unlock()
+	}()
+
+	// Collectors do not send anything; reading only detects the close
+	closed := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ioutil.Discard, conn)
+		if err == nil {
+			err = io.EOF
+		}
+		closed <- err
+	}()
+
+	for _, msg := range msgs {
+		if err := bmpWrite(conn, msg); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(c.cfg.StatsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-queue:
+			if !ok {
+				return errors.New("buffer overflow")
+			}
+			if err := bmpWrite(conn, msg); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			for _, msg := range c.statistics() {
+				if err := bmpWrite(conn, msg); err != nil {
+					return err
+				}
+			}
+		case err := <-closed:
+			return err
+		}
+	}
+}
+
+func bmpWrite(conn net.Conn, msg []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(bmpWriteTimeout))
+	_, err := conn.Write(msg)
+	return err
+}
+
+// Keeps the state of the peers up to date and queues the messages for the
+// collector. The neighbours block on the monitor channel, so this must
+// never wait for the collector
+func (c *BMPClient) monitorRoutine() {
+	for msg := range c.monitor {
+		c.lock.Lock()
+		encoded := c.update(msg)
+		if encoded != nil && c.queue != nil {
+			select {
+			case c.queue <- encoded:
+			default:
+				close(c.queue)
+				c.queue = nil
+			}
+		}
+		c.lock.Unlock()
+	}
+}
+
+func (c *BMPClient) update(msg bgp2go.BGPMonitorMsg) []byte {
+	name := strings.Trim(msg.Neighbour, "[]")
+
+	switch msg.Type {
+	case "PeerUp":
+		c.peers[name] = &bmpPeer{
+			up:        msg,
+			adjRIBOut: make(map[string][]byte),
+		}
+		return bmpPeerUp(msg)
+	case "PeerDown":
+		if _, ok := c.peers[name]; !ok {
+			return nil
+		}
+		delete(c.peers, name)
+		return bmpPeerDown(msg)
+	case "RouteMonitoring":
+		peer, ok := c.peers[name]
+		if !ok {
+			return nil
+		}
+		encoded := bmpRouteMonitoring(msg)
+		for _, key := range msg.Withdrawn {
+			delete(peer.adjRIBOut, key)
+		}
+		for _, key := range msg.Announced {
+			peer.adjRIBOut[key] = encoded
+		}
+		return encoded
+	}
+
+	return nil
+}
+
+func (c *BMPClient) statistics() [][]byte {
+	var received map[string]int
+	if c.adjRIBIn != nil {
+		received, _ = c.adjRIBIn()
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	msgs := [][]byte{}
+	now := time.Now()
+	for name, peer := range c.peers {
+		stats := map[uint16]uint64{
+			bmpStatAdjRIBOutPostPol: uint64(len(peer.adjRIBOut)),
+		}
+		if received != nil {
+			stats[bmpStatAdjRIBIn] = uint64(received[name])
+		}
+		msgs = append(msgs, bmpStatistics(peer.up, now, stats))
+	}
+
+	return msgs
+}
+
+func bmpMessage(msgType uint8, body []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(bmpVersion)
+	binary.Write(buf, binary.BigEndian, uint32(6+len(body)))
+	buf.WriteByte(msgType)
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func bmpTLV(tlvType uint16, value []byte) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, tlvType)
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.Write(value)
+	return buf.Bytes()
+}
+
+// Returns ipaddr as 16 bytes and whether it is an IPv6 address
+func bmpAddress(ipaddr string) ([]byte, bool) {
+	ip := net.ParseIP(strings.Trim(ipaddr, "[]"))
+	if ip == nil {
+		return make([]byte, net.IPv6len), false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return append(make([]byte, net.IPv6len-net.IPv4len), ip4...), false
+	}
+	return ip.To16(), true
+}
+
+func bmpPeerHeader(msg bgp2go.BGPMonitorMsg, flags uint8, t time.Time) []byte {
+	address, v6 := bmpAddress(msg.Neighbour)
+	if v6 {
+		flags |= bmpPeerFlagV
+	}
+	if !msg.ASN4 {
+		flags |= bmpPeerFlagA
+	}
+
+	buf := new(bytes.Buffer)
+	// Global instance peer, without peer distinguisher
+	buf.WriteByte(0)
+	buf.WriteByte(flags)
+	buf.Write(make([]byte, 8))
+	buf.Write(address)
+	binary.Write(buf, binary.BigEndian, msg.PeerASN)
+	binary.Write(buf, binary.BigEndian, msg.PeerRouterID)
+	binary.Write(buf, binary.BigEndian, uint32(t.Unix()))
+	binary.Write(buf, binary.BigEndian, uint32(t.Nanosecond()/1000))
+	return buf.Bytes()
+}
+
+func bmpInitiation(cfg BMPConfig) []byte {
+	body := bmpTLV(bmpInfoSysDescr, []byte(cfg.SysDescr))
+	body = append(body, bmpTLV(bmpInfoSysName, []byte(cfg.SysName))...)
+	return bmpMessage(bmpMsgInitiation, body)
+}
+
+func bmpPeerUp(msg bgp2go.BGPMonitorMsg) []byte {
+	buf := bytes.NewBuffer(bmpPeerHeader(msg, 0, msg.Time))
+	address, _ := bmpAddress(msg.LocalAddr)
+	buf.Write(address)
+	binary.Write(buf, binary.BigEndian, msg.LocalPort)
+	binary.Write(buf, binary.BigEndian, msg.RemotePort)
+	buf.Write(msg.SentOpen)
+	buf.Write(msg.RcvdOpen)
+	return bmpMessage(bmpMsgPeerUp, buf.Bytes())
+}
+
+func bmpPeerDown(msg bgp2go.BGPMonitorMsg) []byte {
+	buf := bytes.NewBuffer(bmpPeerHeader(msg, 0, msg.Time))
+	switch {
+	case msg.Notification != nil && msg.LocalNotification:
+		buf.WriteByte(bmpDownLocalNotification)
+		buf.Write(msg.Notification)
+	case msg.Notification != nil:
+		buf.WriteByte(bmpDownRemoteNotification)
+		buf.Write(msg.Notification)
+	case msg.LocalClose:
+		// No FSM event code to report
+		buf.WriteByte(bmpDownLocalNoNotification)
+		buf.Write([]byte{0, 0})
+	default:
+		buf.WriteByte(bmpDownRemoteNoNotification)
+	}
+	return bmpMessage(bmpMsgPeerDown, buf.Bytes())
+}
+
+// Updates sent to a peer have passed its export policy
+func bmpRouteMonitoring(msg bgp2go.BGPMonitorMsg) []byte {
+	buf := bytes.NewBuffer(bmpPeerHeader(msg, bmpPeerFlagL|bmpPeerFlagO, msg.Time))
+	buf.Write(msg.Update)
+	return bmpMessage(bmpMsgRouteMonitoring, buf.Bytes())
+}
+
+func bmpStatistics(up bgp2go.BGPMonitorMsg, t time.Time, stats map[uint16]uint64) []byte {
+	buf := bytes.NewBuffer(bmpPeerHeader(up, bmpPeerFlagO, t))
+	binary.Write(buf, binary.BigEndian, uint32(len(stats)))
+	for _, statType := range []uint16{bmpStatAdjRIBIn, bmpStatAdjRIBOutPostPol} {
+		value, ok := stats[statType]
+		if !ok {
+			continue
+		}
+		gauge := make([]byte, 8)
+		binary.BigEndian.PutUint64(gauge, value)
+		buf.Write(bmpTLV(statType, gauge))
+	}
+	return bmpMessage(bmpMsgStatistics, buf.Bytes())
+}
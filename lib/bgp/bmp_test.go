@@ -0,0 +1,168 @@
+package bgp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/r3boot/anycast-agent/lib"
+	"github.com/r3boot/anycast-agent/lib/bgp/bgp2go"
+)
+
+type bmpTestMsg struct {
+	msgType uint8
+	body    []byte
+}
+
+func readBMPMsg(t *testing.T, conn net.Conn) bmpTestMsg {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	hdr := make([]byte, 6)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		t.Fatalf("cant read bmp header: %v", err)
+	}
+	if hdr[0] != bmpVersion {
+		t.Fatalf("unexpected bmp version: %d", hdr[0])
+	}
+	body := make([]byte, binary.BigEndian.Uint32(hdr[1:5])-6)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		t.Fatalf("cant read bmp body: %v", err)
+	}
+	return bmpTestMsg{msgType: hdr[5], body: body}
+}
+
+func expectBMPMsg(t *testing.T, conn net.Conn, msgType uint8) bmpTestMsg {
+	msg := readBMPMsg(t, conn)
+	if msg.msgType != msgType {
+		t.Fatalf("expected bmp msg type %d, got %d", msgType, msg.msgType)
+	}
+	return msg
+}
+
+func acceptBMP(t *testing.T, listener net.Listener) net.Conn {
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("cant accept bmp connection: %v", err)
+	}
+	return conn
+}
+
+func TestBMPClient(t *testing.T) {
+	if Logger.Info == nil {
+		Logger = lib.NewLogger(false)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cant listen: %v", err)
+	}
+	defer listener.Close()
+
+	monitor := make(chan bgp2go.BGPMonitorMsg)
+	client := NewBMPClient(BMPConfig{
+		Collector:         listener.Addr().String(),
+		SysName:           "test",
+		StatsInterval:     time.Hour,
+		ReconnectInterval: 10 * time.Millisecond,
+	}, monitor)
+	go client.Run()
+
+	conn := acceptBMP(t, listener)
+	msg := expectBMPMsg(t, conn, bmpMsgInitiation)
+	if string(msg.body[4:4+binary.BigEndian.Uint16(msg.body[2:4])]) != "anycast-agent" {
+		t.Errorf("unexpected sysDescr in initiation: %v", msg.body)
+	}
+
+	up := bgp2go.BGPMonitorMsg{
+		Neighbour:    "[2001:db8::1]",
+		Type:         "PeerUp",
+		Time:         time.Now(),
+		PeerASN:      65001,
+		PeerRouterID: 1,
+		ASN4:         true,
+		LocalAddr:    "2001:db8::2",
+		LocalPort:    179,
+		RemotePort:   40000,
+		SentOpen:     []byte{1, 2, 3},
+		RcvdOpen:     []byte{4, 5, 6},
+	}
+	monitor <- up
+
+	msg = expectBMPMsg(t, conn, bmpMsgPeerUp)
+	if msg.body[1] != bmpPeerFlagV {
+		t.Errorf("unexpected peer flags: %x", msg.body[1])
+	}
+	if !net.IP(msg.body[10:26]).Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("unexpected peer address: %v", msg.body[10:26])
+	}
+	if binary.BigEndian.Uint32(msg.body[26:30]) != 65001 {
+		t.Errorf("unexpected peer as: %v", msg.body[26:30])
+	}
+	peerUp := msg.body[42:]
+	if !net.IP(peerUp[:16]).Equal(net.ParseIP("2001:db8::2")) ||
+		binary.BigEndian.Uint16(peerUp[16:18]) != 179 ||
+		binary.BigEndian.Uint16(peerUp[18:20]) != 40000 ||
+		string(peerUp[20:]) != string([]byte{1, 2, 3, 4, 5, 6}) {
+		t.Errorf("unexpected peer up: %v", peerUp)
+	}
+
+	update := up
+	update.Type = "RouteMonitoring"
+	update.Update = []byte{7, 8, 9}
+	update.Announced = []string{"2001:db8::/32", "2001:db8:1::/48"}
+	monitor <- update
+
+	msg = expectBMPMsg(t, conn, bmpMsgRouteMonitoring)
+	if msg.body[1] != bmpPeerFlagV|bmpPeerFlagL|bmpPeerFlagO {
+		t.Errorf("unexpected route monitoring flags: %x", msg.body[1])
+	}
+	if string(msg.body[42:]) != string([]byte{7, 8, 9}) {
+		t.Errorf("unexpected route monitoring update: %v", msg.body[42:])
+	}
+
+	withdraw := up
+	withdraw.Type = "RouteMonitoring"
+	withdraw.Update = []byte{10}
+	withdraw.Withdrawn = []string{"2001:db8:1::/48"}
+	monitor <- withdraw
+	expectBMPMsg(t, conn, bmpMsgRouteMonitoring)
+
+	// After a reconnect, the collector gets the current state of the peer
+	conn.Close()
+	conn = acceptBMP(t, listener)
+	defer conn.Close()
+	expectBMPMsg(t, conn, bmpMsgInitiation)
+	expectBMPMsg(t, conn, bmpMsgPeerUp)
+	msg = expectBMPMsg(t, conn, bmpMsgRouteMonitoring)
+	if string(msg.body[42:]) != string([]byte{7, 8, 9}) {
+		t.Errorf("unexpected resynced update: %v", msg.body[42:])
+	}
+
+	for _, msg := range client.statistics() {
+		body := msg[6:]
+		if binary.BigEndian.Uint32(body[42:46]) != 1 ||
+			binary.BigEndian.Uint16(body[46:48]) != bmpStatAdjRIBOutPostPol ||
+			binary.BigEndian.Uint64(body[50:58]) != 1 {
+			t.Errorf("unexpected statistics report: %v", body[42:])
+		}
+	}
+
+	down := up
+	down.Type = "PeerDown"
+	down.Notification = []byte{6, 2}
+	down.LocalNotification = true
+	monitor <- down
+
+	msg = expectBMPMsg(t, conn, bmpMsgPeerDown)
+	if msg.body[42] != bmpDownLocalNotification ||
+		string(msg.body[43:]) != string([]byte{6, 2}) {
+		t.Errorf("unexpected peer down: %v", msg.body[42:])
+	}
+
+	// Routes of a peer which is down are not monitored
+	monitor <- update
+	if len(client.statistics()) != 0 {
+		t.Errorf("peer is still known after peer down")
+	}
+}
@@ -0,0 +1,150 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/r3boot/anycast-agent/lib/bgp/bgp2go"
+)
+
+// A FlowSpec rule announced to the peers which have FlowSpec enabled. The
+// rule is withdrawn automatically once it expires
+type FlowRule struct {
+	Name    string
+	Rule    bgp2go.FlowSpecRule
+	Expires time.Time
+	timer   *time.Timer
+}
+
+func sameFlowMatch(a, b bgp2go.FlowSpecRule) bool {
+	encodedA, errA := bgp2go.EncodeFlowSpecNLRI(a)
+	encodedB, errB := bgp2go.EncodeFlowSpecNLRI(b)
+	return errA == nil && errB == nil && a.AFI == b.AFI &&
+		bytes.Equal(encodedA, encodedB)
+}
+
+func (bgp *BGP) sendFlowRule(cmnd string, rule bgp2go.FlowSpecRule) error {
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+	bgp.cmdToPeer <- bgp2go.BGPProcessMsg{
+		Cmnd: cmnd,
+		Data: string(data),
+	}
+	return nil
+}
+
+// Announces rule under name for ttl. Adding a rule with an existing name
+// replaces it and restarts its expiry timer
+func (bgp *BGP) AddFlowRule(name string, rule bgp2go.FlowSpecRule, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("BGP.AddFlowRule: Expiry must be positive")
+	}
+	if _, err := bgp2go.EncodeFlowSpecNLRI(rule); err != nil {
+		return fmt.Errorf("BGP.AddFlowRule: %v", strings.TrimSpace(err.Error()))
+	}
+
+	bgp.flowLock.Lock()
+	defer bgp.flowLock.Unlock()
+
+	if bgp.flowRules == nil {
+		bgp.flowRules = make(map[string]*FlowRule)
+	}
+
+	// Rules are identified by their match on the wire, so two names
+	// cannot share the same one
+	for _, other := range bgp.flowRules {
+		if other.Name != name && sameFlowMatch(other.Rule, rule) {
+			return errors.New("BGP.AddFlowRule: Flow rule " + other.Name + " has the same match")
+		}
+	}
+
+	if old, ok := bgp.flowRules[name]; ok {
+		old.timer.Stop()
+		// A rule with the same match is replaced by the new announcement
+		if !sameFlowMatch(old.Rule, rule) {
+			if err := bgp.sendFlowRule("WithdrawFlowSpec", old.Rule); err != nil {
+				return fmt.Errorf("BGP.AddFlowRule: %v", err)
+			}
+		}
+		delete(bgp.flowRules, name)
+	}
+
+	Logger.Info("bgp: Adding flow rule " + name + ": " + rule.String())
+	if err := bgp.sendFlowRule("AddFlowSpec", rule); err != nil {
+		return fmt.Errorf("BGP.AddFlowRule: %v", err)
+	}
+
+	flowRule := &FlowRule{
+		Name:    name,
+		Rule:    rule,
+		Expires: time.Now().Add(ttl),
+	}
+	flowRule.timer = time.AfterFunc(ttl, func() {
+		bgp.expireFlowRule(flowRule)
+	})
+	bgp.flowRules[name] = flowRule
+
+	return nil
+}
+
+func (bgp *BGP) expireFlowRule(flowRule *FlowRule) {
+	bgp.flowLock.Lock()
+	defer bgp.flowLock.Unlock()
+
+	// The rule could have been replaced or removed in the meantime
+	if bgp.flowRules[flowRule.Name] != flowRule {
+		return
+	}
+
+	Logger.Info("bgp: Flow rule " + flowRule.Name + " expired")
+	if err := bgp.sendFlowRule("WithdrawFlowSpec", flowRule.Rule); err != nil {
+		Logger.Warn("bgp: Failed to withdraw flow rule " + flowRule.Name + ": " + err.Error())
+	}
+	delete(bgp.flowRules, flowRule.Name)
+}
+
+func (bgp *BGP) RemoveFlowRule(name string) error {
+	bgp.flowLock.Lock()
+	defer bgp.flowLock.Unlock()
+
+	flowRule, ok := bgp.flowRules[name]
+	if !ok {
+		return errors.New("BGP.RemoveFlowRule: No such flow rule: " + name)
+	}
+	flowRule.timer.Stop()
+
+	Logger.Info("bgp: Removing flow rule " + name)
+	if err := bgp.sendFlowRule("WithdrawFlowSpec", flowRule.Rule); err != nil {
+		return fmt.Errorf("BGP.RemoveFlowRule: %v", err)
+	}
+	delete(bgp.flowRules, name)
+
+	return nil
+}
+
+// Returns the active flow rules, sorted by name
+func (bgp *BGP) FlowRules() []FlowRule {
+	bgp.flowLock.Lock()
+	defer bgp.flowLock.Unlock()
+
+	rules := []FlowRule{}
+	for _, flowRule := range bgp.flowRules {
+		rules = append(rules, FlowRule{
+			Name:    flowRule.Name,
+			Rule:    flowRule.Rule,
+			Expires: flowRule.Expires,
+		})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Name < rules[j].Name
+	})
+
+	return rules
+}
@@ -0,0 +1,31 @@
+package bgp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/r3boot/anycast-agent/lib/bgp/bgp2go"
+)
+
+// Starts writing all BGP messages sent to and received from the neighbors
+// to path in MRT format. The file is rotated once it exceeds maxSize bytes,
+// keeping at most keep old files
+func (bgp *BGP) StartMRTDump(path string, maxSize int64, keep int) error {
+	if err := bgp.mrt.Start(path, maxSize, keep); err != nil {
+		return fmt.Errorf("BGP.StartMRTDump: %v", strings.TrimSpace(err.Error()))
+	}
+	Logger.Info("bgp: Dumping BGP messages to " + path)
+	return nil
+}
+
+func (bgp *BGP) StopMRTDump() error {
+	if err := bgp.mrt.Stop(); err != nil {
+		return fmt.Errorf("BGP.StopMRTDump: %v", strings.TrimSpace(err.Error()))
+	}
+	Logger.Info("bgp: Stopped dumping BGP messages")
+	return nil
+}
+
+func (bgp *BGP) MRTDumpStatus() bgp2go.MRTStatus {
+	return bgp.mrt.Status()
+}
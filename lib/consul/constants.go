@@ -1,12 +1,18 @@
 package consul
 
 import (
+	"time"
+
 	"github.com/hashicorp/consul/api"
 )
 
+const (
+	connectTimeout     = 10 * time.Second
+	watchRetryInterval = 5 * time.Second
+)
+
 type Consul struct {
-	uri    string
-	Prefix string
+	config *api.Config
 	client *api.Client
 	kv     *api.KV
 }
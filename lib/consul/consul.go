@@ -2,19 +2,30 @@ package consul
 
 import (
 	"fmt"
+	"os"
 	"strings"
+
+	"github.com/hashicorp/consul/api"
 )
 
-func NewConsul(uri string) (*Consul, error) {
-	if strings.HasPrefix(uri, "http://") {
-		uri = uri[7:]
-	} else if strings.HasPrefix(uri, "https://") {
-		uri = uri[8:]
-	}
+// Settings which are not set are taken from the environment, the same way
+// as the consul cli does (CONSUL_HTTP_ADDR, CONSUL_HTTP_TOKEN,
+// CONSUL_CACERT, CONSUL_CLIENT_CERT, CONSUL_CLIENT_KEY, ...). Address is
+// either host:port or a http:// or https:// url
+type Config struct {
+	Address       string
+	Token         string
+	Datacenter    string
+	CAFile        string
+	CertFile      string
+	KeyFile       string
+	TLSServerName string
+	TLSSkipVerify bool
+}
 
+func NewConsul(cfg Config) (*Consul, error) {
 	c := &Consul{
-		Prefix: "anycast",
-		uri:    uri,
+		config: apiConfig(cfg),
 	}
 
 	err := c.Connect()
@@ -24,3 +35,64 @@ func NewConsul(uri string) (*Consul, error) {
 
 	return c, nil
 }
+
+func apiConfig(cfg Config) *api.Config {
+	config := api.DefaultConfig()
+
+	if cfg.Address != "" {
+		config.Address = cfg.Address
+	}
+
+	// The address can have a scheme, from cfg or from CONSUL_HTTP_ADDR;
+	// like CONSUL_HTTP_SSL it sets the scheme explicitly
+	schemeSet := os.Getenv(api.HTTPSSLEnvName) != ""
+	if strings.HasPrefix(config.Address, "http://") {
+		config.Scheme = "http"
+		config.Address = config.Address[7:]
+		schemeSet = true
+	} else if strings.HasPrefix(config.Address, "https://") {
+		config.Scheme = "https"
+		config.Address = config.Address[8:]
+		schemeSet = true
+	}
+
+	if cfg.Token != "" {
+		config.Token = cfg.Token
+	}
+
+	if cfg.Datacenter != "" {
+		config.Datacenter = cfg.Datacenter
+	}
+
+	if cfg.CAFile != "" {
+		config.TLSConfig.CAFile = cfg.CAFile
+	}
+
+	if cfg.CertFile != "" {
+		config.TLSConfig.CertFile = cfg.CertFile
+	}
+
+	if cfg.KeyFile != "" {
+		config.TLSConfig.KeyFile = cfg.KeyFile
+	}
+
+	if cfg.TLSServerName != "" {
+		config.TLSConfig.Address = cfg.TLSServerName
+	}
+
+	if cfg.TLSSkipVerify {
+		config.TLSConfig.InsecureSkipVerify = true
+	}
+
+	// A client certificate is only of use over https
+	if config.TLSConfig.CertFile != "" && !schemeSet {
+		config.Scheme = "https"
+	}
+
+	return config
+}
+
+// Returns the url of the consul server, for use in messages
+func (c *Consul) URL() string {
+	return c.config.Scheme + "://" + c.config.Address
+}
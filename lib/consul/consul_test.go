@@ -0,0 +1,37 @@
+package consul
+
+import (
+	"testing"
+)
+
+func TestAPIConfigScheme(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		cfg     Config
+		scheme  string
+		address string
+	}{
+		{"default", nil, Config{}, "http", "127.0.0.1:8500"},
+		{"flag", nil, Config{Address: "https://consul:8501"}, "https", "consul:8501"},
+		{"client cert", nil, Config{Address: "consul:8501", CertFile: "client.pem"}, "https", "consul:8501"},
+		{"client cert over http", nil, Config{Address: "http://consul:8500", CertFile: "client.pem"}, "http", "consul:8500"},
+		{"env address", map[string]string{"CONSUL_HTTP_ADDR": "https://consul:8501"}, Config{}, "https", "consul:8501"},
+		{"env http with client cert", map[string]string{"CONSUL_HTTP_ADDR": "http://consul:8500"}, Config{CertFile: "client.pem"}, "http", "consul:8500"},
+		{"env ssl disabled with client cert", map[string]string{"CONSUL_HTTP_SSL": "false"}, Config{CertFile: "client.pem"}, "http", "127.0.0.1:8500"},
+		{"flag over env", map[string]string{"CONSUL_HTTP_ADDR": "http://consul:8500"}, Config{Address: "consul:8501", CertFile: "client.pem"}, "https", "consul:8501"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"CONSUL_HTTP_ADDR", "CONSUL_HTTP_SSL", "CONSUL_CLIENT_CERT"} {
+				t.Setenv(name, test.env[name])
+			}
+
+			config := apiConfig(test.cfg)
+			if config.Scheme != test.scheme || config.Address != test.address {
+				t.Errorf("got %s://%s, want %s://%s", config.Scheme, config.Address, test.scheme, test.address)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package consul
+
+import (
+	"flag"
+)
+
+// Registers the consul flags, which are shared by anycast-agent and
+// aactl. Flags which are not given fall back to the environment
+func RegisterFlags(cfg *Config) {
+	flag.StringVar(&cfg.Address, "consul", "",
+		"Connect to consul on this url (default $CONSUL_HTTP_ADDR or http://127.0.0.1:8500)")
+
+	flag.StringVar(&cfg.Token, "consul-token", "",
+		"ACL token to use (default $CONSUL_HTTP_TOKEN)")
+
+	flag.StringVar(&cfg.Datacenter, "consul-datacenter", "",
+		"Consul datacenter to use (default the one of the agent)")
+
+	flag.StringVar(&cfg.CAFile, "consul-ca-cert", "",
+		"CA bundle to verify consul with (default $CONSUL_CACERT)")
+
+	flag.StringVar(&cfg.CertFile, "consul-client-cert", "",
+		"Client certificate for consul (default $CONSUL_CLIENT_CERT)")
+
+	flag.StringVar(&cfg.KeyFile, "consul-client-key", "",
+		"Key of the client certificate (default $CONSUL_CLIENT_KEY)")
+
+	flag.StringVar(&cfg.TLSServerName, "consul-tls-server-name", "",
+		"Server name to verify the consul certificate against (default $CONSUL_TLS_SERVER_NAME)")
+
+	flag.BoolVar(&cfg.TLSSkipVerify, "consul-tls-skip-verify", false,
+		"Do not verify the consul certificate")
+}
@@ -1,27 +1,32 @@
 package consul
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"strconv"
-
-	"reflect"
 	"strings"
+	"time"
 
 	"path/filepath"
 
 	"github.com/hashicorp/consul/api"
-	"github.com/r3boot/anycast-agent/lib/structs"
 )
 
 func (c *Consul) Connect() error {
 	var err error
 
-	c.client, err = api.NewClient(api.DefaultConfig())
+	c.client, err = api.NewClient(c.config)
 	if err != nil {
 		return fmt.Errorf("Consul.Connect api.NewClient: %v", err)
 	}
 
+	// Fail now, instead of at the first lookup
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	query := (&api.QueryOptions{}).WithContext(ctx)
+	if _, err = c.client.Status().LeaderWithQueryOptions(query); err != nil {
+		return fmt.Errorf("Consul.Connect: consul at %s is unreachable: %v", c.URL(), err)
+	}
+
 	c.kv = c.client.KV()
 
 	return nil
@@ -32,8 +37,6 @@ func (c *Consul) Set(key, value string) error {
 		key = key[1:]
 	}
 
-	fmt.Printf("Consul.Set: key=%s; value: %s\n", key, value)
-
 	data := &api.KVPair{Key: key, Value: []byte(value)}
 	_, err := c.kv.Put(data, nil)
 	if err != nil {
@@ -43,13 +46,44 @@ func (c *Consul) Set(key, value string) error {
 	return nil
 }
 
-func (c *Consul) Get(key string) (string, error) {
+// Returns the value of key with its ModifyIndex, which is 0 for a key
+// which does not exist
+func (c *Consul) Get(key string) (string, uint64, error) {
+	key = strings.TrimPrefix(key, "/")
+
 	data, _, err := c.kv.Get(key, nil)
 	if err != nil {
-		return "", fmt.Errorf("Consul.Get: kv.Get: %v", err)
+		return "", 0, fmt.Errorf("Consul.Get: kv.Get: %v", err)
+	}
+	if data == nil {
+		return "", 0, nil
+	}
+
+	return string(data.Value), data.ModifyIndex, nil
+}
+
+// Only writes value if the ModifyIndex of key is still version. Version 0
+// only creates the key
+func (c *Consul) CompareAndSet(key, value string, version uint64) (bool, error) {
+	key = strings.TrimPrefix(key, "/")
+
+	data := &api.KVPair{Key: key, Value: []byte(value), ModifyIndex: version}
+	ok, _, err := c.kv.CAS(data, nil)
+	if err != nil {
+		return false, fmt.Errorf("Consul.CompareAndSet: kv.CAS: %v", err)
 	}
 
-	return string(data.Value), nil
+	return ok, nil
+}
+
+func (c *Consul) Delete(key string) error {
+	key = strings.TrimPrefix(key, "/")
+
+	if _, err := c.kv.Delete(key, nil); err != nil {
+		return fmt.Errorf("Consul.Delete: kv.Delete: %v", err)
+	}
+
+	return nil
 }
 
 func (c *Consul) Ls(path string) ([]string, error) {
@@ -85,170 +119,87 @@ func (c *Consul) Ls(path string) ([]string, error) {
 	return allEntries, nil
 }
 
-func (c *Consul) ApplyObject(object interface{}) error {
-	var (
-		err error
-	)
-
-	switch reflect.TypeOf(object).Name() {
-	case "BgpPeerObject":
-		{
-			bgpPeer := object.(structs.BgpPeerObject)
-			path := c.Prefix + "/peers/" + bgpPeer.Meta.Name
-
-			if err = c.Set(path+"/asnum", strconv.Itoa(bgpPeer.Spec.AsNumber)); err != nil {
-				return err
-			}
-
-			if bgpPeer.Spec.IP != "" {
-				if err = c.Set(path+"/ip", bgpPeer.Spec.IP); err != nil {
-					return err
-				}
-			}
+// Returns all keys below prefix with their values
+func (c *Consul) List(prefix string) (map[string]string, error) {
+	data, _, err := c.kv.List(prefix, &api.QueryOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Consul.List: kv.List: %v", err)
+	}
 
-			if bgpPeer.Spec.IP6 != "" {
-				if err = c.Set(path+"/ip6", bgpPeer.Spec.IP6); err != nil {
-					return err
-				}
-			}
+	values := make(map[string]string)
+	for _, entry := range data {
+		if entry == nil {
+			continue
 		}
-	case "AnycastObject":
-		{
-			anycast := object.(structs.AnycastObject)
-			path := c.Prefix + "/services/" + anycast.Meta.Name
-
-			if err = c.Set(path+"/asnum", strconv.Itoa(anycast.Spec.AsNumber)); err != nil {
-				return err
-			}
-
-			if err = c.Set(path+"/ip", anycast.Spec.IP); err != nil {
-				return err
-			}
+		values[entry.Key] = string(entry.Value)
+	}
 
-			if err = c.Set(path+"/ip6", anycast.Spec.IP6); err != nil {
-				return err
-			}
+	return values, nil
+}
 
-			if err = c.Set(path+"/healthcheck", anycast.Spec.HealthCheck); err != nil {
-				return err
-			}
+func (c *Consul) DeleteTree(prefix string) error {
+	if strings.HasPrefix(prefix, "/") {
+		prefix = prefix[1:]
+	}
 
-			peers := strings.Join(anycast.Spec.Peers, ",")
-			if err = c.Set(path+"/peers", peers); err != nil {
-				return err
-			}
-		}
+	if _, err := c.kv.DeleteTree(prefix, nil); err != nil {
+		return fmt.Errorf("Consul.DeleteTree: kv.DeleteTree: %v", err)
 	}
 
 	return nil
 }
 
-func (c *Consul) GetObject(objType, name string) (interface{}, error) {
-	var (
-		err error
-	)
-
-	switch objType {
-	case structs.TypeBgpPeer:
-		{
-			path := c.Prefix + "/peers/" + name
-
-			object := structs.BgpPeerObject{
-				ApiVersion: 1,
-				Type:       structs.TypeBgpPeer,
-				Meta: structs.BgpPeerMetaObject{
-					Name: name,
-				},
-				Spec: structs.BgpPeerSpecObject{},
-			}
-
-			response, err := c.Get(path + "/asnum")
-			if err != nil {
-				err = errors.New("GetObject: asnum not found")
-				return nil, err
-			}
-			asnum, err := strconv.Atoi(response)
-			if err != nil {
-				err = errors.New("GetObject: Failed to convert asnum to int")
-				return nil, err
-			}
-			object.Spec.AsNumber = asnum
+// Signals on the returned channel whenever a key below prefix changes,
+// using blocking queries. Signals are coalesced, and the channel is
+// closed once stop is closed
+func (c *Consul) Watch(prefix string, stop <-chan struct{}) (<-chan struct{}, error) {
+	_, meta, err := c.kv.List(prefix, &api.QueryOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Consul.Watch: kv.List: %v", err)
+	}
 
-			if response, err = c.Get(path + "/ip"); err == nil {
-				object.Spec.IP = response
-			}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
 
-			if response, err = c.Get(path + "/ip6"); err == nil {
-				object.Spec.IP6 = response
-			}
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
 
-			return object, nil
-		}
-	case structs.TypeAnycast:
-		{
-			path := c.Prefix + "/services/" + name
-
-			object := structs.AnycastObject{
-				ApiVersion: 1,
-				Type:       structs.TypeAnycast,
-				Meta: structs.AnycastMetaObject{
-					Name: name,
-				},
-				Spec: structs.AnycastSpecObject{},
+		index := meta.LastIndex
+		for {
+			query := (&api.QueryOptions{WaitIndex: index}).WithContext(ctx)
+			_, meta, err := c.kv.List(prefix, query)
+			if ctx.Err() != nil {
+				return
 			}
-
-			if response, err := c.Get(path + "/asnum"); err == nil {
-				if object.Spec.AsNumber, err = strconv.Atoi(response); err != nil {
-					return nil, err
+			if err != nil {
+				select {
+				case <-time.After(watchRetryInterval):
+					continue
+				case <-ctx.Done():
+					return
 				}
 			}
 
-			if response, err := c.Get(path + "/ip"); err == nil {
-				object.Spec.IP = response
+			// The index can go backwards after a snapshot restore
+			if meta.LastIndex < index {
+				index = 0
+				continue
 			}
-
-			if response, err := c.Get(path + "/ip6"); err == nil {
-				object.Spec.IP6 = response
+			if meta.LastIndex == index {
+				continue
 			}
+			index = meta.LastIndex
 
-			if response, err := c.Get(path + "/healthcheck"); err == nil {
-				object.Spec.HealthCheck = response
+			select {
+			case changes <- struct{}{}:
+			default:
 			}
-
-			if response, err := c.Get(path + "/peers"); err == nil {
-				object.Spec.Peers = strings.Split(response, ",")
-			}
-
-			return object, nil
 		}
-	}
-
-	err = errors.New("GetObject: Unknown error")
-	return nil, err
-}
-
-func (c *Consul) GetAllObjects(objType, path string) ([]interface{}, error) {
-	var (
-		items    []interface{}
-		name     string
-		diritems []string
-		err      error
-	)
-
-	if diritems, err = c.Ls(path); err != nil {
-		err = errors.New("GetAllObjects: c.Ls() failed: " + err.Error())
-		return nil, err
-	}
-
-	for _, name = range diritems {
-		object, err := c.GetObject(objType, name)
-		if err != nil {
-			err = errors.New("GetAllObjects: c.GetObject() failed: " + err.Error())
-			return nil, err
-		}
-
-		items = append(items, object)
-	}
+	}()
 
-	return items, err
+	return changes, nil
 }
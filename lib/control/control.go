@@ -0,0 +1,251 @@
+package control
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Path of the unix socket on which the agent accepts control requests
+const DefaultSocket = "/var/run/anycast-agent.sock"
+
+const (
+	EndpointDrain   = "/neighbours/drain"
+	EndpointUndrain = "/neighbours/undrain"
+	// GET; the optional neighbour query parameter limits the output to
+	// the routes received from that neighbour
+	EndpointAdjRIBIn = "/rib/in"
+	// GET lists the active flow rules
+	EndpointFlows        = "/flows"
+	EndpointFlowAdd      = "/flows/add"
+	EndpointFlowWithdraw = "/flows/withdraw"
+	// GET shows the state of the MRT dump of the bgp messages
+	EndpointMRT      = "/mrt"
+	EndpointMRTStart = "/mrt/start"
+	EndpointMRTStop  = "/mrt/stop"
+	// GET shows the services and neighbours of the agent
+	EndpointStatus = "/status"
+)
+
+const (
+	FlowActionDiscard   = "discard"
+	FlowActionRateLimit = "rate-limit"
+	// Expiry of flow rules which do not set one
+	DefaultFlowExpiry = time.Hour
+)
+
+const (
+	DefaultMRTFile    = "/var/tmp/anycast-agent.mrt"
+	DefaultMRTMaxSize = 64 * 1024 * 1024
+	DefaultMRTKeep    = 5
+)
+
+// Request used to (un)drain a bgp neighbour
+type DrainRequest struct {
+	Neighbour string `json:"neighbour"`
+	Message   string `json:"message,omitempty"`
+}
+
+// FlowSpec rule to inject. Destination must be one of the prefixes
+// announced by the agent. The match lists hold numeric expressions like
+// "53", ">=1024" or "1024-65535"; protocols can also be given by name.
+// Rate is in bytes per second and Expires is a duration like "30m".
+type FlowRequest struct {
+	Name             string   `json:"name" yaml:"name"`
+	Destination      string   `json:"destination" yaml:"destination"`
+	Source           string   `json:"source,omitempty" yaml:"source,omitempty"`
+	Protocols        []string `json:"protocols,omitempty" yaml:"protocols,omitempty"`
+	Ports            []string `json:"ports,omitempty" yaml:"ports,omitempty"`
+	DestinationPorts []string `json:"destinationPorts,omitempty" yaml:"destinationPorts,omitempty"`
+	SourcePorts      []string `json:"sourcePorts,omitempty" yaml:"sourcePorts,omitempty"`
+	PacketLengths    []string `json:"packetLengths,omitempty" yaml:"packetLengths,omitempty"`
+	Action           string   `json:"action" yaml:"action"`
+	Rate             float32  `json:"rate,omitempty" yaml:"rate,omitempty"`
+	Expires          string   `json:"expires,omitempty" yaml:"expires,omitempty"`
+}
+
+// Request used to withdraw a flow rule before it expires
+type FlowWithdrawRequest struct {
+	Name string `json:"name"`
+}
+
+// Active flow rule as reported by the agent
+type FlowStatus struct {
+	Name    string  `json:"name" yaml:"name"`
+	Match   string  `json:"match" yaml:"match"`
+	Action  string  `json:"action" yaml:"action"`
+	Rate    float32 `json:"rate,omitempty" yaml:"rate,omitempty"`
+	Expires string  `json:"expires" yaml:"expires"`
+}
+
+// Request used to start the MRT dump. MaxSize is in bytes; once the file
+// exceeds it, it is rotated and at most Keep old files are kept
+type MRTRequest struct {
+	Path    string `json:"path"`
+	MaxSize int64  `json:"maxSize,omitempty"`
+	Keep    int    `json:"keep"`
+}
+
+// State of the MRT dump as reported by the agent
+type MRTStatus struct {
+	Enabled bool   `json:"enabled" yaml:"enabled"`
+	Path    string `json:"path,omitempty" yaml:"path,omitempty"`
+	Size    int64  `json:"size" yaml:"size"`
+	MaxSize int64  `json:"maxSize,omitempty" yaml:"maxSize,omitempty"`
+	Keep    int    `json:"keep" yaml:"keep"`
+	Error   string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// State of a service as reported by the agent. A service is announced
+// while its health check succeeds
+type ServiceStatus struct {
+	Name      string `json:"name" yaml:"name"`
+	IP        string `json:"ip,omitempty" yaml:"ip,omitempty"`
+	IP6       string `json:"ip6,omitempty" yaml:"ip6,omitempty"`
+	Announced bool   `json:"announced" yaml:"announced"`
+}
+
+// State of the agent as reported by the agent
+type AgentStatus struct {
+	Node       string          `json:"node" yaml:"node"`
+	AsNumber   int             `json:"asNumber" yaml:"asNumber"`
+	RouterId   string          `json:"routerId" yaml:"routerId"`
+	NextHop    string          `json:"nextHop,omitempty" yaml:"nextHop,omitempty"`
+	NextHop6   string          `json:"nextHop6,omitempty" yaml:"nextHop6,omitempty"`
+	Services   []ServiceStatus `json:"services" yaml:"services"`
+	Neighbours []string        `json:"neighbours" yaml:"neighbours"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type Server struct {
+	path     string
+	mux      *http.ServeMux
+	listener net.Listener
+}
+
+type Client struct {
+	path   string
+	client *http.Client
+}
+
+func NewServer(path string) (*Server, error) {
+	var (
+		listener net.Listener
+		err      error
+	)
+
+	// Remove a stale socket left behind by a previous instance
+	if _, err = os.Stat(path); err == nil {
+		if err = os.Remove(path); err != nil {
+			return nil, errors.New("NewServer: Failed to remove stale socket: " + err.Error())
+		}
+	}
+
+	if listener, err = net.Listen("unix", path); err != nil {
+		return nil, errors.New("NewServer: Failed to listen: " + err.Error())
+	}
+
+	if err = os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, errors.New("NewServer: Failed to set socket permissions: " + err.Error())
+	}
+
+	return &Server{
+		path:     path,
+		mux:      http.NewServeMux(),
+		listener: listener,
+	}, nil
+}
+
+func (s *Server) HandleFunc(endpoint string, handler func(w http.ResponseWriter, r *http.Request)) {
+	s.mux.HandleFunc(endpoint, handler)
+}
+
+func (s *Server) Serve() error {
+	return http.Serve(s.listener, s.mux)
+}
+
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// Decodes the json body of a request into value
+func ReadRequest(r *http.Request, value interface{}) error {
+	if r.Method != http.MethodPost {
+		return fmt.Errorf("method %s not allowed", r.Method)
+	}
+	return json.NewDecoder(r.Body).Decode(value)
+}
+
+func WriteResponse(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func WriteError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: err.Error()})
+}
+
+func NewClient(path string) *Client {
+	return &Client{
+		path: path,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("unix", path)
+				},
+			},
+		},
+	}
+}
+
+// Sends request (if not nil) to the agent and decodes its answer into response
+func (c *Client) Call(endpoint string, request interface{}, response interface{}) error {
+	var (
+		body []byte
+		resp *http.Response
+		err  error
+	)
+
+	if request != nil {
+		if body, err = json.Marshal(request); err != nil {
+			return fmt.Errorf("Client.Call: %v", err)
+		}
+		resp, err = c.client.Post("http://agent"+endpoint, "application/json", bytes.NewReader(body))
+	} else {
+		resp, err = c.client.Get("http://agent" + endpoint)
+	}
+	if err != nil {
+		return fmt.Errorf("Client.Call: Failed to contact agent on %s: %v", c.path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errResp := errorResponse{}
+		if err = json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == "" {
+			return fmt.Errorf("Client.Call: %s", resp.Status)
+		}
+		return errors.New(errResp.Error)
+	}
+
+	if response == nil {
+		return nil
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("Client.Call: Failed to decode response: %v", err)
+	}
+
+	return nil
+}
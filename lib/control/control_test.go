@@ -0,0 +1,25 @@
+package control
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCallNoAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := NewClient(filepath.Join(dir, "missing.sock"))
+	for _, request := range []interface{}{nil, DrainRequest{Neighbour: "10.0.4.1"}} {
+		err := client.Call(EndpointDrain, request, nil)
+		if err == nil || !strings.Contains(err.Error(), "Failed to contact agent") {
+			t.Errorf("Call(%v): got %v, want an error for the missing socket", request, err)
+		}
+	}
+}
@@ -18,11 +18,17 @@ type HealthCheckConfig struct {
 type HealthCheck struct {
 	Config HealthCheckConfig
 	Health bool
+	quit   chan struct{}
 }
 
 func NewHealthCheck(logger lib.Logger, cfg HealthCheckConfig) *HealthCheck {
 	Logger = logger
-	return &HealthCheck{Config: cfg}
+	return &HealthCheck{Config: cfg, quit: make(chan struct{})}
+}
+
+// Ends the CheckRoutine
+func (hc *HealthCheck) Stop() {
+	close(hc.quit)
 }
 
 func (hc *HealthCheck) CheckRoutine() {
@@ -33,8 +39,16 @@ func (hc *HealthCheck) CheckRoutine() {
 	Logger.Debug("HealthCheck: Starting polling routine")
 	for {
 		checkStatus = lib.RunsOK(hc.Config.Command)
-		hc.Config.ResultChan <- checkStatus
-
-		time.Sleep(hc.Config.Interval)
+		select {
+		case hc.Config.ResultChan <- checkStatus:
+		case <-hc.quit:
+			return
+		}
+
+		select {
+		case <-time.After(hc.Config.Interval):
+		case <-hc.quit:
+			return
+		}
 	}
 }
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Shown as the old value of a field which is added, and as the new value
+// of a field which is removed
+const Unset = "<unset>"
+
+// A field which differs between two versions of an object, by its path in
+// the yaml, e.g. spec.ip or spec.policy.export[0].action
+type FieldDiff struct {
+	Path string
+	Old  string
+	New  string
+}
+
+// Returns the fields which differ, sorted by path. old is nil for an
+// object which does not exist yet
+func DiffObjects(old, new interface{}) ([]FieldDiff, error) {
+	oldFields := make(map[string]string)
+	if old != nil {
+		if err := flattenObject(old, oldFields); err != nil {
+			return nil, fmt.Errorf("DiffObjects: %v", err)
+		}
+	}
+
+	newFields := make(map[string]string)
+	if err := flattenObject(new, newFields); err != nil {
+		return nil, fmt.Errorf("DiffObjects: %v", err)
+	}
+
+	paths := []string{}
+	for path := range oldFields {
+		if _, ok := newFields[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	for path := range newFields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	diffs := []FieldDiff{}
+	for _, path := range paths {
+		oldValue, ok := oldFields[path]
+		if !ok {
+			oldValue = Unset
+		}
+		newValue, ok := newFields[path]
+		if !ok {
+			newValue = Unset
+		}
+		if oldValue != newValue {
+			diffs = append(diffs, FieldDiff{Path: path, Old: oldValue, New: newValue})
+		}
+	}
+
+	return diffs, nil
+}
+
+// Goes through the yaml of the object, so the paths use the names of the
+// yaml files, and fields which are left out of the yaml are unset
+func flattenObject(object interface{}, fields map[string]string) error {
+	data, err := yaml.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	var value interface{}
+	if err = yaml.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	flatten("", value, fields)
+	return nil
+}
+
+// Lists of plain values are compared as a whole, lists of mappings by
+// their items
+func flatten(path string, value interface{}, fields map[string]string) {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		for key, item := range value {
+			child := fmt.Sprint(key)
+			if path != "" {
+				child = path + "." + child
+			}
+			flatten(child, item, fields)
+		}
+	case []interface{}:
+		items := []string{}
+		for i, item := range value {
+			switch item.(type) {
+			case map[interface{}]interface{}, []interface{}:
+				flatten(fmt.Sprintf("%s[%d]", path, i), item, fields)
+			default:
+				items = append(items, fmt.Sprint(item))
+			}
+		}
+		if len(items) > 0 {
+			fields[path] = "[" + strings.Join(items, ", ") + "]"
+		}
+	case nil:
+	default:
+		fields[path] = fmt.Sprint(value)
+	}
+}
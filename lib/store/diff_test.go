@@ -0,0 +1,47 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffObjects(t *testing.T) {
+	diffs, err := DiffObjects(testService("dns"), testService("dns"))
+	if err != nil || len(diffs) != 0 {
+		t.Errorf("DiffObjects: got %v, %v for equal objects", diffs, err)
+	}
+
+	changed := testService("dns")
+	changed.Spec.IP = "192.0.2.54"
+	changed.Spec.IP6 = ""
+	changed.Spec.Peers = []string{"laptop"}
+	changed.Spec.Placement.Sites = append(changed.Spec.Placement.Sites, "lon")
+
+	diffs, err = DiffObjects(testService("dns"), changed)
+	if err != nil {
+		t.Fatalf("DiffObjects: %v", err)
+	}
+	expected := []FieldDiff{
+		{"spec.bgpPeers", "[laptop, router]", "[laptop]"},
+		{"spec.ip", "192.0.2.53", "192.0.2.54"},
+		{"spec.ip6", "2001:db8:53::53", ""},
+		{"spec.placement.sites", "[ams, fra]", "[ams, fra, lon]"},
+	}
+	if !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("DiffObjects: got %v, want %v", diffs, expected)
+	}
+
+	// A new object has every field added
+	diffs, err = DiffObjects(nil, testPeer())
+	if err != nil {
+		t.Fatalf("DiffObjects: %v", err)
+	}
+	for _, diff := range diffs {
+		if diff.Old != Unset {
+			t.Errorf("DiffObjects: %s was %s for a new object", diff.Path, diff.Old)
+		}
+	}
+	if len(diffs) == 0 {
+		t.Errorf("DiffObjects: no fields for a new object")
+	}
+}
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"reflect"
+
+	"github.com/r3boot/anycast-agent/lib/structs"
+	"gopkg.in/yaml.v2"
+)
+
+var typeDirs = map[string]string{
+	structs.TypeBgpPeer: "peers",
+	structs.TypeAnycast: "services",
+	structs.TypeNode:    "nodes",
+}
+
+// Returns the type and name of an object
+func objectName(object interface{}) (string, string, bool) {
+	switch object := object.(type) {
+	case structs.BgpPeerObject:
+		return structs.TypeBgpPeer, object.Meta.Name, true
+	case structs.AnycastObject:
+		return structs.TypeAnycast, object.Meta.Name, true
+	case structs.NodeObject:
+		return structs.TypeNode, object.Meta.Name, true
+	}
+
+	return "", "", false
+}
+
+// A document is the object as json, with the fields of its Revision next
+// to apiVersion, type, meta and spec. The fields of the object are named
+// after their yaml tags, so the structs are the only place where they are
+// defined
+func encodeDocument(object interface{}, revision Revision) (string, error) {
+	if _, _, ok := objectName(object); !ok {
+		return "", errors.New("unknown object " + reflect.TypeOf(object).String())
+	}
+
+	data, err := yaml.Marshal(object)
+	if err != nil {
+		return "", err
+	}
+
+	fields := make(map[string]interface{})
+	if err = yaml.Unmarshal(data, &fields); err != nil {
+		return "", err
+	}
+	for key, value := range fields {
+		fields[key] = jsonValue(value)
+	}
+
+	fields["generation"] = revision.Generation
+	fields["modified"] = revision.Modified
+	fields["author"] = revision.Author
+
+	// Keeps healthchecks like "test -f x && exit 0" readable in the kv
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	if err = encoder.Encode(fields); err != nil {
+		return "", err
+	}
+
+	return string(bytes.TrimSpace(buffer.Bytes())), nil
+}
+
+// yaml decodes mappings into map[interface{}]interface{}, which json can
+// not encode
+func jsonValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		fields := make(map[string]interface{})
+		for key, item := range value {
+			fields[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return fields
+	case []interface{}:
+		for i, item := range value {
+			value[i] = jsonValue(item)
+		}
+	}
+
+	return value
+}
+
+// json is valid yaml, so the object is read with its yaml tags. Documents
+// written with deprecated keys are read as well
+func decodeDocument(objType, data string) (interface{}, Revision, error) {
+	header := struct {
+		Type string `json:"type"`
+		Revision
+	}{}
+	if err := json.Unmarshal([]byte(data), &header); err != nil {
+		return nil, Revision{}, err
+	}
+	if header.Type != objType {
+		return nil, Revision{}, errors.New("document of type " + header.Type + " where " + objType + " was expected")
+	}
+
+	object, err := structs.UnmarshalObject(objType, []byte(data))
+	if err != nil {
+		return nil, Revision{}, err
+	}
+
+	return object, header.Revision, nil
+}
+
+// user@host of whoever runs the process, recorded as the author of the
+// changes it makes
+func defaultAuthor() string {
+	name := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return name
+	}
+
+	return name + "@" + host
+}
@@ -0,0 +1,449 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	etcdRequestTimeout = 10 * time.Second
+	etcdRetryInterval  = 5 * time.Second
+)
+
+// A KV on etcd v3, which is spoken to over the json gateway of etcd so no
+// grpc client is needed. Requests go to the first endpoint which answers
+type Etcd struct {
+	endpoints []string
+	current   int
+	username  string
+	password  string
+	token     string
+	client    *http.Client
+	stream    *http.Client
+	mutex     sync.Mutex
+}
+
+// The gateway encodes 64 bit integers as strings
+type etcdKeyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value,omitempty"`
+	ModRevision int64  `json:"mod_revision,string,omitempty"`
+}
+
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []etcdKeyValue `json:"kvs"`
+}
+
+type etcdCompare struct {
+	Key         []byte `json:"key"`
+	Target      string `json:"target"`
+	Result      string `json:"result"`
+	ModRevision int64  `json:"mod_revision,string"`
+}
+
+type etcdRequestOp struct {
+	RequestPut *etcdKeyValue `json:"request_put,omitempty"`
+}
+
+type etcdTxnRequest struct {
+	Compare []etcdCompare   `json:"compare"`
+	Success []etcdRequestOp `json:"success"`
+}
+
+type etcdTxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+type etcdWatchRequest struct {
+	CreateRequest etcdRangeRequest `json:"create_request"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Created  bool              `json:"created"`
+		Canceled bool              `json:"canceled"`
+		Events   []json.RawMessage `json:"events"`
+	} `json:"result"`
+	Error *etcdError `json:"error"`
+}
+
+type etcdAuthRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type etcdAuthResponse struct {
+	Token string `json:"token"`
+}
+
+type etcdError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// location is etcd://host:port[,host:port] or etcds:// for https, with
+// optional user:password credentials
+func NewEtcd(location *url.URL, cfg Config) (*Etcd, error) {
+	scheme := "http"
+	transport := &http.Transport{}
+
+	if location.Scheme == "etcds" {
+		scheme = "https"
+		tlsConfig, err := etcdTLSConfig(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("NewEtcd: %v", err)
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	e := &Etcd{
+		client: &http.Client{Transport: transport, Timeout: etcdRequestTimeout},
+		stream: &http.Client{Transport: transport},
+	}
+
+	for _, host := range strings.Split(location.Host, ",") {
+		e.endpoints = append(e.endpoints, scheme+"://"+host)
+	}
+
+	if location.User != nil {
+		e.username = location.User.Username()
+		e.password, _ = location.User.Password()
+	}
+
+	// Fail now, instead of at the first lookup
+	if err := e.call("/v3/maintenance/status", struct{}{}, nil); err != nil {
+		return nil, fmt.Errorf("NewEtcd: etcd at %s is unreachable: %v", e.URL(), err)
+	}
+
+	return e, nil
+}
+
+func etcdTLSConfig(cfg Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if cfg.CAFile != "" {
+		data, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates found in " + cfg.CAFile)
+		}
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func (e *Etcd) URL() string {
+	return strings.Join(e.endpoints, ",")
+}
+
+func (e *Etcd) Set(key, value string) error {
+	key = strings.TrimPrefix(key, "/")
+
+	request := etcdKeyValue{Key: []byte(key), Value: []byte(value)}
+	if err := e.call("/v3/kv/put", request, nil); err != nil {
+		return fmt.Errorf("Etcd.Set: %v", err)
+	}
+
+	return nil
+}
+
+// The version of a key is its mod_revision
+func (e *Etcd) Get(key string) (string, uint64, error) {
+	request := etcdRangeRequest{Key: []byte(strings.TrimPrefix(key, "/"))}
+	response := etcdRangeResponse{}
+	if err := e.call("/v3/kv/range", request, &response); err != nil {
+		return "", 0, fmt.Errorf("Etcd.Get: %v", err)
+	}
+
+	if len(response.Kvs) == 0 {
+		return "", 0, nil
+	}
+
+	return string(response.Kvs[0].Value), uint64(response.Kvs[0].ModRevision), nil
+}
+
+// A key which does not exist compares as mod_revision 0
+func (e *Etcd) CompareAndSet(key, value string, version uint64) (bool, error) {
+	key = strings.TrimPrefix(key, "/")
+
+	request := etcdTxnRequest{
+		Compare: []etcdCompare{{
+			Key:         []byte(key),
+			Target:      "MOD",
+			Result:      "EQUAL",
+			ModRevision: int64(version),
+		}},
+		Success: []etcdRequestOp{{
+			RequestPut: &etcdKeyValue{Key: []byte(key), Value: []byte(value)},
+		}},
+	}
+	response := etcdTxnResponse{}
+	if err := e.call("/v3/kv/txn", request, &response); err != nil {
+		return false, fmt.Errorf("Etcd.CompareAndSet: %v", err)
+	}
+
+	return response.Succeeded, nil
+}
+
+func (e *Etcd) Delete(key string) error {
+	request := etcdRangeRequest{Key: []byte(strings.TrimPrefix(key, "/"))}
+	if err := e.call("/v3/kv/deleterange", request, nil); err != nil {
+		return fmt.Errorf("Etcd.Delete: %v", err)
+	}
+
+	return nil
+}
+
+func (e *Etcd) List(prefix string) (map[string]string, error) {
+	response := etcdRangeResponse{}
+	if err := e.call("/v3/kv/range", prefixRange(prefix), &response); err != nil {
+		return nil, fmt.Errorf("Etcd.List: %v", err)
+	}
+
+	values := make(map[string]string)
+	for _, kv := range response.Kvs {
+		values[string(kv.Key)] = string(kv.Value)
+	}
+
+	return values, nil
+}
+
+func (e *Etcd) DeleteTree(prefix string) error {
+	if err := e.call("/v3/kv/deleterange", prefixRange(prefix), nil); err != nil {
+		return fmt.Errorf("Etcd.DeleteTree: %v", err)
+	}
+
+	return nil
+}
+
+// Signals on the returned channel whenever a key below prefix changes.
+// Signals are coalesced, and the channel is closed once stop is closed.
+// After a lost watch a change is always signalled, since events can have
+// been missed
+func (e *Etcd) Watch(prefix string, stop <-chan struct{}) (<-chan struct{}, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	request := etcdWatchRequest{CreateRequest: prefixRange(prefix)}
+	response, err := e.post(ctx, e.stream, "/v3/watch", request)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("Etcd.Watch: %v", err)
+	}
+
+	changes := make(chan struct{}, 1)
+	signal := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+
+	go func() {
+		defer close(changes)
+
+		for {
+			decoder := json.NewDecoder(response.Body)
+			for {
+				event := etcdWatchResponse{}
+				if err := decoder.Decode(&event); err != nil {
+					break
+				}
+				if event.Error != nil || event.Result.Canceled {
+					break
+				}
+				if len(event.Result.Events) > 0 {
+					signal()
+				}
+			}
+			response.Body.Close()
+
+			for {
+				select {
+				case <-time.After(etcdRetryInterval):
+				case <-ctx.Done():
+					return
+				}
+				if response, err = e.post(ctx, e.stream, "/v3/watch", request); err == nil {
+					break
+				}
+			}
+			signal()
+		}
+	}()
+
+	return changes, nil
+}
+
+// Returns the range of all keys starting with prefix
+func prefixRange(prefix string) etcdRangeRequest {
+	key := []byte(strings.TrimPrefix(prefix, "/"))
+
+	end := make([]byte, len(key))
+	copy(end, key)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return etcdRangeRequest{Key: key, RangeEnd: end[:i+1]}
+		}
+	}
+
+	// Only 0xff bytes, so everything from key onwards
+	return etcdRangeRequest{Key: key, RangeEnd: []byte{0}}
+}
+
+// Posts request to the json gateway and decodes the answer into response,
+// which can be nil
+func (e *Etcd) call(path string, request, response interface{}) error {
+	result, err := e.post(context.Background(), e.client, path, request)
+	if err != nil {
+		return err
+	}
+	defer result.Body.Close()
+
+	if response == nil {
+		return nil
+	}
+
+	return json.NewDecoder(result.Body).Decode(response)
+}
+
+// Authenticates before the first request if credentials are given, and
+// again once etcd says the token expired
+func (e *Etcd) post(ctx context.Context, client *http.Client, path string, request interface{}) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mutex.Lock()
+	authenticated := e.token != ""
+	e.mutex.Unlock()
+	if e.username != "" && !authenticated {
+		if err = e.authenticate(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	response, err := e.do(ctx, client, path, body)
+	if err == nil && response.StatusCode == http.StatusUnauthorized && e.username != "" {
+		response.Body.Close()
+		if err = e.authenticate(ctx); err != nil {
+			return nil, err
+		}
+		response, err = e.do(ctx, client, path, body)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		etcdErr := etcdError{}
+		data, _ := ioutil.ReadAll(response.Body)
+		if json.Unmarshal(data, &etcdErr) == nil && etcdErr.Message != "" {
+			return nil, fmt.Errorf("%s: %s", path, etcdErr.Message)
+		}
+		return nil, fmt.Errorf("%s: %s", path, response.Status)
+	}
+
+	return response, nil
+}
+
+// Tries the endpoints in turn, starting with the one which answered last
+func (e *Etcd) do(ctx context.Context, client *http.Client, path string, body []byte) (*http.Response, error) {
+	e.mutex.Lock()
+	current := e.current
+	token := e.token
+	e.mutex.Unlock()
+
+	var lastErr error
+	for i := 0; i < len(e.endpoints); i++ {
+		endpoint := (current + i) % len(e.endpoints)
+
+		request, err := http.NewRequest(http.MethodPost, e.endpoints[endpoint]+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		request = request.WithContext(ctx)
+		request.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			request.Header.Set("Authorization", token)
+		}
+
+		response, err := client.Do(request)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+
+		e.mutex.Lock()
+		e.current = endpoint
+		e.mutex.Unlock()
+
+		return response, nil
+	}
+
+	return nil, fmt.Errorf("no endpoint of %s answered: %v", e.URL(), lastErr)
+}
+
+func (e *Etcd) authenticate(ctx context.Context) error {
+	body, err := json.Marshal(etcdAuthRequest{Name: e.username, Password: e.password})
+	if err != nil {
+		return err
+	}
+
+	response, err := e.do(ctx, e.client, "/v3/auth/authenticate", body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return errors.New("authentication as " + e.username + " failed: " + response.Status)
+	}
+
+	auth := etcdAuthResponse{}
+	if err = json.NewDecoder(response.Body).Decode(&auth); err != nil {
+		return err
+	}
+
+	e.mutex.Lock()
+	e.token = auth.Token
+	e.mutex.Unlock()
+
+	return nil
+}
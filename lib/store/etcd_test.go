@@ -0,0 +1,168 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Speaks just enough of the json gateway of etcd for the conformance
+// tests, on top of a Memory kv
+type fakeEtcd struct {
+	kv       *Memory
+	password string
+}
+
+// Without a range end only the key itself is in the range
+func (f *fakeEtcd) inRange(key []byte, request etcdRangeRequest) bool {
+	if len(request.RangeEnd) == 0 {
+		return bytes.Equal(key, request.Key)
+	}
+	return bytes.Compare(key, request.Key) >= 0 && bytes.Compare(key, request.RangeEnd) < 0
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v3/auth/authenticate" {
+		request := etcdAuthRequest{}
+		json.NewDecoder(r.Body).Decode(&request)
+		if request.Name != "anycast" || request.Password != f.password {
+			http.Error(w, `{"code":3,"message":"authentication failed"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(etcdAuthResponse{Token: "token"})
+		return
+	}
+
+	if f.password != "" && r.Header.Get("Authorization") != "token" {
+		http.Error(w, `{"code":16,"message":"invalid auth token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v3/maintenance/status":
+		w.Write([]byte(`{"version":"3.5.0"}`))
+
+	case "/v3/kv/put":
+		request := etcdKeyValue{}
+		json.NewDecoder(r.Body).Decode(&request)
+		f.kv.Set(string(request.Key), string(request.Value))
+		w.Write([]byte(`{}`))
+
+	case "/v3/kv/txn":
+		request := etcdTxnRequest{}
+		json.NewDecoder(r.Body).Decode(&request)
+		compare, put := request.Compare[0], request.Success[0].RequestPut
+		if compare.Target != "MOD" || compare.Result != "EQUAL" || !bytes.Equal(compare.Key, put.Key) {
+			http.Error(w, `{"code":12,"message":"unsupported txn"}`, http.StatusNotImplemented)
+			return
+		}
+		ok, _ := f.kv.CompareAndSet(string(put.Key), string(put.Value), uint64(compare.ModRevision))
+		json.NewEncoder(w).Encode(etcdTxnResponse{Succeeded: ok})
+
+	case "/v3/kv/range", "/v3/kv/deleterange":
+		request := etcdRangeRequest{}
+		json.NewDecoder(r.Body).Decode(&request)
+		values, _ := f.kv.List("")
+		response := etcdRangeResponse{}
+		for key, value := range values {
+			if !f.inRange([]byte(key), request) {
+				continue
+			}
+			if r.URL.Path == "/v3/kv/deleterange" {
+				f.kv.Delete(key)
+				continue
+			}
+			_, version, _ := f.kv.Get(key)
+			response.Kvs = append(response.Kvs, etcdKeyValue{Key: []byte(key), Value: []byte(value), ModRevision: int64(version)})
+		}
+		json.NewEncoder(w).Encode(response)
+
+	case "/v3/watch":
+		request := etcdWatchRequest{}
+		json.NewDecoder(r.Body).Decode(&request)
+		stop := make(chan struct{})
+		defer close(stop)
+		changes, _ := f.kv.Watch(string(request.CreateRequest.Key), stop)
+
+		w.Write([]byte(`{"result":{"created":true}}` + "\n"))
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-changes:
+				w.Write([]byte(`{"result":{"events":[{"type":"PUT"}]}}` + "\n"))
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newFakeEtcd(t *testing.T, password string) *url.URL {
+	server := httptest.NewServer(&fakeEtcd{kv: NewMemory(), password: password})
+	t.Cleanup(server.Close)
+
+	location, _ := url.Parse(server.URL)
+	location.Scheme = "etcd"
+	if password != "" {
+		location.User = url.UserPassword("anycast", password)
+	}
+
+	return location
+}
+
+func TestEtcdStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		kv, err := NewEtcd(newFakeEtcd(t, ""), Config{})
+		if err != nil {
+			t.Fatalf("NewEtcd: %v", err)
+		}
+		return NewKVStore(kv, DefaultPrefix)
+	})
+}
+
+func TestEtcdAuth(t *testing.T) {
+	location := newFakeEtcd(t, "secret")
+	if _, err := NewEtcd(location, Config{}); err != nil {
+		t.Fatalf("NewEtcd: %v", err)
+	}
+
+	location.User = url.UserPassword("anycast", "wrong")
+	if _, err := NewEtcd(location, Config{}); err == nil {
+		t.Errorf("NewEtcd: expected an error for a wrong password")
+	}
+}
+
+// The endpoints are tried in turn, so a dead first endpoint is skipped
+func TestEtcdEndpoints(t *testing.T) {
+	location := newFakeEtcd(t, "")
+	location.Host = "127.0.0.1:1," + location.Host
+
+	kv, err := NewEtcd(location, Config{})
+	if err != nil {
+		t.Fatalf("NewEtcd: %v", err)
+	}
+	if err = kv.Set("anycast/services/dns/ip", "192.0.2.53"); err != nil {
+		t.Errorf("Set: %v", err)
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+	for prefix, end := range map[string]string{
+		"anycast/peers/": "anycast/peers0",
+		"/a":             "b",
+		"a\xff":          "b",
+		"\xff":           "\x00",
+	} {
+		request := prefixRange(prefix)
+		if string(request.RangeEnd) != end {
+			t.Errorf("prefixRange(%q): got %q, want %q", prefix, request.RangeEnd, end)
+		}
+	}
+}
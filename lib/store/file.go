@@ -0,0 +1,334 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/r3boot/anycast-agent/lib/structs"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	filePollInterval = 5 * time.Second
+)
+
+// A Store on a directory of yaml files as read by structs.LoadAllFromYaml,
+// for sites without consul or etcd. The directory is read recursively, like
+// aactl apply does. A file can hold several --- separated objects, and
+// files which do not end in .yaml or .yml are skipped. Changes are picked
+// up with inotify, or by polling the directory where that is not
+// available
+type File struct {
+	dir string
+	// Watch polls at this interval instead of using inotify when set
+	pollInterval time.Duration
+
+	// Every warning about a file is given to warn once, not at every read
+	warn       func(...interface{})
+	warnedLock sync.Mutex
+	warned     map[string]bool
+}
+
+func NewFile(dir string) (*File, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("NewFile: %v", err)
+	}
+	if !info.IsDir() {
+		return nil, errors.New("NewFile: " + dir + " is not a directory")
+	}
+
+	return &File{dir: dir}, nil
+}
+
+func (f *File) URL() string {
+	return "file://" + f.dir
+}
+
+func isYamlFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+
+	return strings.HasSuffix(name, ".yaml") || strings.HasSuffix(name, ".yml")
+}
+
+// Returns the objects of objType by name, and the files they are read from
+func (f *File) load(objType string) (map[string]interface{}, map[string]string, error) {
+	if _, ok := typeDirs[objType]; !ok {
+		return nil, nil, errors.New("unknown object type " + objType)
+	}
+
+	objects := make(map[string]interface{})
+	files := make(map[string]string)
+	err := filepath.Walk(f.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isYamlFile(info.Name()) {
+			return nil
+		}
+
+		found, warnings, err := structs.LoadAllFromYaml(path)
+		f.warnOnce(warnings)
+		if err != nil {
+			return err
+		}
+
+		for _, object := range found {
+			fileType, name, ok := objectName(object)
+			if !ok || fileType != objType {
+				continue
+			}
+			if other, ok := files[name]; ok {
+				return fmt.Errorf("%s %s is defined in both %s and %s", objType, name, other, path)
+			}
+
+			objects[name] = object
+			files[name] = path
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return objects, files, nil
+}
+
+func (f *File) warnOnce(warnings []structs.YamlError) {
+	if f.warn == nil {
+		return
+	}
+
+	f.warnedLock.Lock()
+	defer f.warnedLock.Unlock()
+
+	if f.warned == nil {
+		f.warned = make(map[string]bool)
+	}
+	for _, warning := range warnings {
+		if !f.warned[warning.Error()] {
+			f.warned[warning.Error()] = true
+			f.warn(warning.Error())
+		}
+	}
+}
+
+func (f *File) Get(objType, name string) (interface{}, error) {
+	objects, _, err := f.load(objType)
+	if err != nil {
+		return nil, fmt.Errorf("Store.Get: %v", err)
+	}
+
+	object, ok := objects[name]
+	if !ok {
+		return nil, fmt.Errorf("Store.Get: %s %s %w", objType, name, ErrNotFound)
+	}
+
+	return object, nil
+}
+
+// Replaces the object in the file it is read from, or else writes it to
+// <type>-<name>.yaml
+func (f *File) Put(object interface{}) error {
+	objType, name, ok := objectName(object)
+	if !ok {
+		return errors.New("Store.Put: unknown object")
+	}
+	if name == "" {
+		return errors.New("Store.Put: object has no name")
+	}
+
+	_, files, err := f.load(objType)
+	if err != nil {
+		return fmt.Errorf("Store.Put: %v", err)
+	}
+
+	if path, ok := files[name]; ok {
+		err = rewriteFile(path, objType, name, object)
+	} else {
+		err = writeFile(filepath.Join(f.dir, objType+"-"+name+".yaml"), []interface{}{object})
+	}
+	if err != nil {
+		return fmt.Errorf("Store.Put: %v", err)
+	}
+
+	return nil
+}
+
+// Rewrites the file at path with object in place of the object of objType
+// and name, or without that object when object is nil. The other objects
+// in the file are kept
+func rewriteFile(path, objType, name string, object interface{}) error {
+	found, _, err := structs.LoadAllFromYaml(path)
+	if err != nil {
+		return err
+	}
+
+	objects := []interface{}{}
+	for _, existing := range found {
+		existingType, existingName, _ := objectName(existing)
+		if existingType != objType || existingName != name {
+			objects = append(objects, existing)
+		} else if object != nil {
+			objects = append(objects, object)
+		}
+	}
+
+	return writeFile(path, objects)
+}
+
+// Writes objects as --- separated documents, and removes the file when
+// there are none
+func writeFile(path string, objects []interface{}) error {
+	if len(objects) == 0 {
+		return os.Remove(path)
+	}
+
+	documents := []string{}
+	for _, object := range objects {
+		data, err := yaml.Marshal(object)
+		if err != nil {
+			return err
+		}
+		documents = append(documents, string(data))
+	}
+
+	// Written next to the file and renamed over it, so the agent never
+	// reads a half written file
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := ioutil.WriteFile(tmpPath, []byte(strings.Join(documents, "---\n")), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// Files do not count their changes, so only Modified is set
+func (f *File) Revision(objType, name string) (Revision, error) {
+	_, files, err := f.load(objType)
+	if err != nil {
+		return Revision{}, fmt.Errorf("Store.Revision: %v", err)
+	}
+
+	path, ok := files[name]
+	if !ok {
+		return Revision{}, fmt.Errorf("Store.Revision: %s %s %w", objType, name, ErrNotFound)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return Revision{}, fmt.Errorf("Store.Revision: %v", err)
+	}
+
+	return Revision{Modified: info.ModTime().UTC()}, nil
+}
+
+// Objects are returned sorted by name
+func (f *File) List(objType string) ([]interface{}, error) {
+	objects, _, err := f.load(objType)
+	if err != nil {
+		return nil, fmt.Errorf("Store.List: %v", err)
+	}
+
+	names := []string{}
+	for name := range objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	items := []interface{}{}
+	for _, name := range names {
+		items = append(items, objects[name])
+	}
+
+	return items, nil
+}
+
+func (f *File) Delete(objType, name string) error {
+	_, files, err := f.load(objType)
+	if err != nil {
+		return fmt.Errorf("Store.Delete: %v", err)
+	}
+
+	path, ok := files[name]
+	if !ok {
+		return fmt.Errorf("Store.Delete: %s %s %w", objType, name, ErrNotFound)
+	}
+
+	if err = rewriteFile(path, objType, name, nil); err != nil {
+		return fmt.Errorf("Store.Delete: %v", err)
+	}
+
+	return nil
+}
+
+// The directory is watched before it is read, so no change is missed
+func (f *File) Watch(objType string, stop <-chan struct{}) (<-chan Event, error) {
+	var (
+		changes <-chan struct{}
+		err     error
+	)
+
+	if f.pollInterval == 0 {
+		changes, err = watchDir(f.dir, stop)
+	}
+	if f.pollInterval != 0 || err != nil {
+		interval := f.pollInterval
+		if interval == 0 {
+			interval = filePollInterval
+		}
+		changes = pollDir(interval, stop)
+	}
+
+	current, _, err := f.load(objType)
+	if err != nil {
+		return nil, fmt.Errorf("Store.Watch: %v", err)
+	}
+
+	objects := func() (map[string]interface{}, error) {
+		objects, _, err := f.load(objType)
+		return objects, err
+	}
+
+	return watchObjects(objType, current, objects, changes, stop), nil
+}
+
+// Signals a possible change at every interval; the objects are compared
+// by watchObjects
+func pollDir(interval time.Duration, stop <-chan struct{}) <-chan struct{} {
+	changes := make(chan struct{})
+	go func() {
+		defer close(changes)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			select {
+			case changes <- struct{}{}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return changes
+}
@@ -0,0 +1,245 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/r3boot/anycast-agent/lib/structs"
+	"gopkg.in/yaml.v2"
+)
+
+func TestFileStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		s, err := NewFile(t.TempDir())
+		if err != nil {
+			t.Fatalf("NewFile: %v", err)
+		}
+		return s
+	})
+}
+
+func TestFileStorePolling(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return &File{dir: t.TempDir(), pollInterval: 50 * time.Millisecond}
+	})
+}
+
+const testServiceYaml = `apiVersion: 1
+type: anycast
+meta:
+  name: dns
+spec:
+  asnum: 65001
+  ip: 192.0.2.53
+  healthCheck: /bin/true
+  bgpPeers:
+    - laptop
+`
+
+var testServiceObject = structs.AnycastObject{
+	ApiVersion: 1,
+	Type:       structs.TypeAnycast,
+	Meta:       structs.AnycastMetaObject{Name: "dns"},
+	Spec: structs.AnycastSpecObject{
+		AsNumber:    65001,
+		IP:          "192.0.2.53",
+		HealthCheck: "/bin/true",
+		Peers:       []string{"laptop"},
+	},
+}
+
+// Files written by hand are picked up under their own name, and a broken
+// file is reported until it is fixed
+func TestFileStoreEdit(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFile(dir)
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	events, err := s.Watch(structs.TypeAnycast, stop)
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+
+	path := filepath.Join(dir, "dns.yaml")
+	if err = ioutil.WriteFile(path, []byte(testServiceYaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not an object"), 0644)
+
+	expectEvent(t, events, Event{
+		Type:    EventPut,
+		ObjType: structs.TypeAnycast,
+		Name:    "dns",
+		Object:  testServiceObject,
+	})
+
+	if err = ioutil.WriteFile(path, []byte("apiVersion: 1\ntype: anycast\nmeta: ["), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if event.Type != EventError || event.Err == nil {
+			t.Fatalf("expected an error, got %#v", event)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no event for the broken dns.yaml")
+	}
+
+	// Updates go to the file the object was read from
+	service := testService("dns")
+	if err = s.Put(service); err == nil {
+		t.Errorf("Put: expected an error while dns.yaml is broken")
+	}
+	if err = ioutil.WriteFile(path, []byte(testServiceYaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put(service); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	object, _, err := structs.LoadFromYaml(path)
+	if err != nil {
+		t.Fatalf("LoadFromYaml: %v", err)
+	}
+	if object.(structs.AnycastObject).Spec.IP6 != service.Spec.IP6 {
+		t.Errorf("Put did not replace dns.yaml: %#v", object)
+	}
+}
+
+// Files with several objects, as applied by aactl, hold every object;
+// updates and deletes leave the other objects of the file alone
+func TestFileStoreMultipleObjects(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFile(dir)
+	if err != nil {
+		t.Fatalf("NewFile: %v", err)
+	}
+
+	peer, _ := yaml.Marshal(testPeer())
+	service, _ := yaml.Marshal(testService("dns"))
+	path := filepath.Join(dir, "dns.yaml")
+	if err = ioutil.WriteFile(path, []byte(string(peer)+"---\n"+string(service)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []interface{}{testPeer(), testService("dns")} {
+		objType, name, _ := objectName(expected)
+		object, err := s.Get(objType, name)
+		if err != nil {
+			t.Fatalf("Get %s: %v", objType, err)
+		}
+		if !reflect.DeepEqual(object, expected) {
+			t.Errorf("Get %s:\n got %#v\nwant %#v", objType, object, expected)
+		}
+	}
+
+	updated := testService("dns")
+	updated.Spec.IP6 = ""
+	if err = s.Put(updated); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if err = s.Delete(structs.TypeBgpPeer, "laptop"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	objects, _, err := structs.LoadAllFromYaml(path)
+	if err != nil {
+		t.Fatalf("LoadAllFromYaml: %v", err)
+	}
+	if !reflect.DeepEqual(objects, []interface{}{updated}) {
+		t.Errorf("dns.yaml holds %#v, want only the updated service", objects)
+	}
+
+	if err = s.Delete(structs.TypeAnycast, "dns"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("dns.yaml was not removed with its last object")
+	}
+
+	// A name can only be used once, also within a file
+	if err = ioutil.WriteFile(path, []byte(string(service)+"---\n"+string(service)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.List(structs.TypeAnycast); err == nil || !strings.Contains(err.Error(), "defined in both") {
+		t.Errorf("List: expected a defined in both error, got %v", err)
+	}
+}
+
+// Subdirectories are read like aactl apply reads them, and watched as well
+func TestFileStoreSubdirectories(t *testing.T) {
+	for name, newStore := range map[string]func(dir string) *File{
+		"inotify": func(dir string) *File { return &File{dir: dir} },
+		"polling": func(dir string) *File { return &File{dir: dir, pollInterval: 50 * time.Millisecond} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := newStore(dir)
+
+			peer, _ := yaml.Marshal(testPeer())
+			if err := os.MkdirAll(filepath.Join(dir, "peers", "home"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "peers", "home", "laptop.yaml"), peer, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Get(structs.TypeBgpPeer, "laptop"); err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+
+			stop := make(chan struct{})
+			defer close(stop)
+			events, err := s.Watch(structs.TypeAnycast, stop)
+			if err != nil {
+				t.Fatalf("Watch: %v", err)
+			}
+
+			services := filepath.Join(dir, "services")
+			if err = os.Mkdir(services, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err = ioutil.WriteFile(filepath.Join(services, "dns.yaml"), []byte(testServiceYaml), 0644); err != nil {
+				t.Fatal(err)
+			}
+			expectEvent(t, events, Event{
+				Type:    EventPut,
+				ObjType: structs.TypeAnycast,
+				Name:    "dns",
+				Object:  testServiceObject,
+			})
+		})
+	}
+}
+
+// Deprecated keys are reported once, with the file they are used in
+func TestFileStoreWarnings(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dns.yaml")
+	if err := ioutil.WriteFile(path, []byte(testServiceYaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	warnings := []string{}
+	s := &File{dir: dir, warn: func(v ...interface{}) {
+		warnings = append(warnings, fmt.Sprint(v...))
+	}}
+	for i := 0; i < 2; i++ {
+		if _, err := s.List(structs.TypeAnycast); err != nil {
+			t.Fatalf("List: %v", err)
+		}
+	}
+
+	expected := []string{path + ":6:3: spec.asnum is deprecated, use spec.asNumber"}
+	if !reflect.DeepEqual(warnings, expected) {
+		t.Errorf("got warnings %q, want %q", warnings, expected)
+	}
+}
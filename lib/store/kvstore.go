@@ -0,0 +1,302 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/r3boot/anycast-agent/lib/structs"
+)
+
+// Keeps every object as a single json document under
+// <prefix>/<type dir>/<name>. Writes use check-and-set, so two writers
+// can not overwrite each other's change unseen
+type kvStore struct {
+	kv     KV
+	prefix string
+	author string
+}
+
+func NewKVStore(kv KV, prefix string) Store {
+	return &kvStore{
+		kv:     kv,
+		prefix: prefix,
+		author: defaultAuthor(),
+	}
+}
+
+func (s *kvStore) URL() string {
+	return s.kv.URL() + "/" + s.prefix
+}
+
+// Returns the path of the type with a trailing slash, so listing peers/
+// does not match peersfoo
+func (s *kvStore) dir(objType string) (string, error) {
+	typeDir, ok := typeDirs[objType]
+	if !ok {
+		return "", errors.New("unknown object type " + objType)
+	}
+
+	return s.prefix + "/" + typeDir + "/", nil
+}
+
+func (s *kvStore) key(objType, name string) (string, error) {
+	path, err := s.dir(objType)
+	if err != nil {
+		return "", err
+	}
+
+	return path + name, nil
+}
+
+// Returns the object with its revision and the version of its key, which
+// is 0 if the object does not exist
+func (s *kvStore) get(objType, name string) (interface{}, Revision, uint64, error) {
+	key, err := s.key(objType, name)
+	if err != nil {
+		return nil, Revision{}, 0, err
+	}
+
+	data, version, err := s.kv.Get(key)
+	if err != nil || version == 0 {
+		return nil, Revision{}, version, err
+	}
+
+	object, revision, err := decodeDocument(objType, data)
+	if err != nil {
+		return nil, Revision{}, 0, fmt.Errorf("%s %s: %v", objType, name, err)
+	}
+
+	return object, revision, version, nil
+}
+
+// Writing an object which did not change leaves it at its generation
+func (s *kvStore) Put(object interface{}) error {
+	objType, name, ok := objectName(object)
+	if !ok {
+		return errors.New("Store.Put: unknown object")
+	}
+	if name == "" {
+		return errors.New("Store.Put: object has no name")
+	}
+
+	current, revision, version, err := s.get(objType, name)
+	if err != nil {
+		return fmt.Errorf("Store.Put: %v", err)
+	}
+	if version != 0 && reflect.DeepEqual(current, object) {
+		return nil
+	}
+
+	revision = Revision{
+		Generation: revision.Generation + 1,
+		Modified:   time.Now().UTC(),
+		Author:     s.author,
+	}
+	if err = s.write(objType, name, object, revision, version); err != nil {
+		return fmt.Errorf("Store.Put: %w", err)
+	}
+
+	return nil
+}
+
+func (s *kvStore) write(objType, name string, object interface{}, revision Revision, version uint64) error {
+	key, err := s.key(objType, name)
+	if err != nil {
+		return err
+	}
+
+	data, err := encodeDocument(object, revision)
+	if err != nil {
+		return err
+	}
+
+	ok, err := s.kv.CompareAndSet(key, data, version)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s %s %w", objType, name, ErrConflict)
+	}
+
+	return nil
+}
+
+func (s *kvStore) Get(objType, name string) (interface{}, error) {
+	object, _, version, err := s.get(objType, name)
+	if err != nil {
+		return nil, fmt.Errorf("Store.Get: %v", err)
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("Store.Get: %s %s %w", objType, name, ErrNotFound)
+	}
+
+	return object, nil
+}
+
+func (s *kvStore) Revision(objType, name string) (Revision, error) {
+	_, revision, version, err := s.get(objType, name)
+	if err != nil {
+		return Revision{}, fmt.Errorf("Store.Revision: %v", err)
+	}
+	if version == 0 {
+		return Revision{}, fmt.Errorf("Store.Revision: %s %s %w", objType, name, ErrNotFound)
+	}
+
+	return revision, nil
+}
+
+// Objects are returned sorted by name
+func (s *kvStore) List(objType string) ([]interface{}, error) {
+	objects, err := s.objects(objType)
+	if err != nil {
+		return nil, fmt.Errorf("Store.List: %v", err)
+	}
+
+	names := []string{}
+	for name := range objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	items := []interface{}{}
+	for _, name := range names {
+		items = append(items, objects[name])
+	}
+
+	return items, nil
+}
+
+// Objects in the old layout are refused instead of skipped, since the
+// agent would otherwise run without them
+func (s *kvStore) objects(objType string) (map[string]interface{}, error) {
+	path, err := s.dir(objType)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := s.kv.List(path)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make(map[string]interface{})
+	for key, value := range values {
+		name := strings.TrimPrefix(key, path)
+		if strings.Contains(name, "/") {
+			return nil, errors.New("found objects in the old layout below " + path + ", run aactl migrate")
+		}
+
+		object, _, err := decodeDocument(objType, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %v", objType, name, err)
+		}
+		objects[name] = object
+	}
+
+	return objects, nil
+}
+
+func (s *kvStore) Delete(objType, name string) error {
+	if _, err := s.Get(objType, name); err != nil {
+		return fmt.Errorf("Store.Delete: %w", err)
+	}
+
+	key, err := s.key(objType, name)
+	if err != nil {
+		return fmt.Errorf("Store.Delete: %v", err)
+	}
+
+	if err = s.kv.Delete(key); err != nil {
+		return fmt.Errorf("Store.Delete: %v", err)
+	}
+
+	return nil
+}
+
+// The kv only signals that something changed below the type, so the
+// objects are listed again and compared with what was seen before
+func (s *kvStore) Watch(objType string, stop <-chan struct{}) (<-chan Event, error) {
+	path, err := s.dir(objType)
+	if err != nil {
+		return nil, fmt.Errorf("Store.Watch: %v", err)
+	}
+
+	changes, err := s.kv.Watch(path, stop)
+	if err != nil {
+		return nil, fmt.Errorf("Store.Watch: %v", err)
+	}
+
+	current, err := s.objects(objType)
+	if err != nil {
+		return nil, fmt.Errorf("Store.Watch: %v", err)
+	}
+
+	objects := func() (map[string]interface{}, error) {
+		return s.objects(objType)
+	}
+
+	return watchObjects(objType, current, objects, changes, stop), nil
+}
+
+// Rewrites the objects which still have a key per field as documents, and
+// returns them as type:name. An object which exists in both layouts is
+// left alone, since it is not known which one is current
+func (s *kvStore) migrate() ([]string, error) {
+	migrated := []string{}
+
+	for _, objType := range []string{structs.TypeBgpPeer, structs.TypeAnycast, structs.TypeNode} {
+		path, err := s.dir(objType)
+		if err != nil {
+			return migrated, err
+		}
+
+		values, err := s.kv.List(path)
+		if err != nil {
+			return migrated, err
+		}
+
+		allFields := make(map[string]map[string]string)
+		for key, value := range values {
+			tokens := strings.SplitN(strings.TrimPrefix(key, path), "/", 2)
+			if len(tokens) != 2 {
+				continue
+			}
+			if _, ok := allFields[tokens[0]]; !ok {
+				allFields[tokens[0]] = make(map[string]string)
+			}
+			allFields[tokens[0]][tokens[1]] = value
+		}
+
+		names := []string{}
+		for name := range allFields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			object, err := decodeLegacyObject(objType, name, allFields[name])
+			if err != nil {
+				return migrated, fmt.Errorf("%s %s: %v", objType, name, err)
+			}
+
+			revision := Revision{Generation: 1, Modified: time.Now().UTC(), Author: s.author}
+			if err = s.write(objType, name, object, revision, 0); err != nil {
+				if IsConflict(err) {
+					err = fmt.Errorf("%s %s exists in both layouts, remove %s%s/ by hand", objType, name, path, name)
+				}
+				return migrated, err
+			}
+
+			if err = s.kv.DeleteTree(path + name + "/"); err != nil {
+				return migrated, err
+			}
+			migrated = append(migrated, objType+":"+name)
+		}
+	}
+
+	return migrated, nil
+}
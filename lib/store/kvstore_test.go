@@ -0,0 +1,169 @@
+package store
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/r3boot/anycast-agent/lib/structs"
+)
+
+func TestDocument(t *testing.T) {
+	service := testService("dns")
+	service.Spec.HealthCheck = "test -f /run/dns.pid && dig @127.0.0.1 example.com >/dev/null"
+
+	data, err := encodeDocument(service, Revision{Generation: 3, Author: "root@dns1"})
+	if err != nil {
+		t.Fatalf("encodeDocument: %v", err)
+	}
+	if !strings.Contains(data, "&& dig") {
+		t.Errorf("encodeDocument: healthcheck is escaped: %s", data)
+	}
+
+	// The fields are named as in the yaml files
+	fields := make(map[string]interface{})
+	if err = json.Unmarshal([]byte(data), &fields); err != nil {
+		t.Fatalf("document is not json: %v", err)
+	}
+	for _, key := range []string{"apiVersion", "type", "meta", "spec", "generation", "modified", "author"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("document has no %s: %s", key, data)
+		}
+	}
+	if spec := fields["spec"].(map[string]interface{}); spec["asNumber"] != 65001.0 {
+		t.Errorf("document has no spec.asNumber: %s", data)
+	}
+
+	object, revision, err := decodeDocument(structs.TypeAnycast, data)
+	if err != nil {
+		t.Fatalf("decodeDocument: %v", err)
+	}
+	if !reflect.DeepEqual(object, service) {
+		t.Errorf("decodeDocument:\n got %#v\nwant %#v", object, service)
+	}
+	if revision.Generation != 3 || revision.Author != "root@dns1" {
+		t.Errorf("decodeDocument: got revision %#v", revision)
+	}
+
+	if _, _, err = decodeDocument(structs.TypeBgpPeer, data); err == nil {
+		t.Errorf("decodeDocument: expected an error for the wrong type")
+	}
+}
+
+func TestRevision(t *testing.T) {
+	s := NewKVStore(NewMemory(), DefaultPrefix)
+
+	service := testService("dns")
+	for _, generation := range []int64{1, 1, 2} {
+		if generation == 2 {
+			service.Spec.IP = "192.0.2.54"
+		}
+		if err := s.Put(service); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+
+		revision, err := s.Revision(structs.TypeAnycast, "dns")
+		if err != nil {
+			t.Fatalf("Revision: %v", err)
+		}
+		if revision.Generation != generation {
+			t.Errorf("Revision: got generation %d, want %d", revision.Generation, generation)
+		}
+		if revision.Author == "" || revision.Modified.IsZero() {
+			t.Errorf("Revision: no author or time: %#v", revision)
+		}
+	}
+
+	if _, err := s.Revision(structs.TypeAnycast, "ntp"); !IsNotFound(err) {
+		t.Errorf("Revision: expected not found, got %v", err)
+	}
+}
+
+// Writes the key between the read and the write of Put, like a second
+// aactl would
+type racingKV struct {
+	*Memory
+	raced bool
+}
+
+func (r *racingKV) CompareAndSet(key, value string, version uint64) (bool, error) {
+	if !r.raced {
+		r.raced = true
+		r.Memory.Set(key, value)
+	}
+	return r.Memory.CompareAndSet(key, value, version)
+}
+
+func TestConflict(t *testing.T) {
+	kv := &racingKV{Memory: NewMemory()}
+	s := NewKVStore(kv, DefaultPrefix)
+
+	if err := s.Put(testService("dns")); !IsConflict(err) {
+		t.Errorf("Put: expected a conflict, got %v", err)
+	}
+	if err := s.Put(testService("ntp")); err != nil {
+		t.Errorf("Put: %v", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	kv := NewMemory()
+	for key, value := range map[string]string{
+		"anycast/peers/laptop/asnum":       "65342",
+		"anycast/peers/laptop/ip":          "10.0.4.1",
+		"anycast/peers/laptop/labels":      "role=uplink,site=home",
+		"anycast/peers/laptop/bfd_enabled": "true",
+		"anycast/services/dns/asnum":       "65001",
+		"anycast/services/dns/ip":          "192.0.2.53",
+		"anycast/services/dns/healthcheck": "dig @127.0.0.1 example.com",
+		"anycast/services/dns/peers":       "laptop,router",
+		"anycast/services/ntp/asnum":       "65001",
+		"anycast/services/ntp/ip":          "192.0.2.123",
+		"anycast/services/ntp/peers":       "laptop",
+	} {
+		kv.Set(key, value)
+	}
+	s := NewKVStore(kv, DefaultPrefix)
+
+	// Objects in the old layout are not silently ignored
+	if _, err := s.List(structs.TypeAnycast); err == nil || !strings.Contains(err.Error(), "aactl migrate") {
+		t.Errorf("List: expected an error about the old layout, got %v", err)
+	}
+
+	migrated, err := Migrate(s)
+	if err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	expected := []string{"bgpPeer:laptop", "anycast:dns", "anycast:ntp"}
+	if !reflect.DeepEqual(migrated, expected) {
+		t.Errorf("Migrate: got %v, want %v", migrated, expected)
+	}
+
+	peer, err := s.Get(structs.TypeBgpPeer, "laptop")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	spec := peer.(structs.BgpPeerObject).Spec
+	if spec.AsNumber != 65342 || spec.IP != "10.0.4.1" || !spec.Bfd.Enabled {
+		t.Errorf("Get: got %#v", peer)
+	}
+
+	services, err := GetAnycastServices(s)
+	if err != nil {
+		t.Fatalf("GetAnycastServices: %v", err)
+	}
+	if len(services) != 2 || !reflect.DeepEqual(services[0].Spec.Peers, []string{"laptop", "router"}) {
+		t.Errorf("GetAnycastServices: got %#v", services)
+	}
+
+	values, _ := kv.List("anycast/services/dns/")
+	if len(values) != 0 {
+		t.Errorf("Migrate: old keys left: %v", values)
+	}
+
+	// Running it again finds nothing to do
+	if migrated, err = Migrate(s); err != nil || len(migrated) != 0 {
+		t.Errorf("Migrate: got %v, %v", migrated, err)
+	}
+}
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/r3boot/anycast-agent/lib/structs"
+	"gopkg.in/yaml.v2"
+)
+
+// Before objects were kept as documents, every field of an object had its
+// own key, as <prefix>/<type dir>/<name>/<field>. These are only read to
+// migrate them
+
+// Fields which are missing are left empty
+func decodeLegacyObject(objType, name string, fields map[string]string) (interface{}, error) {
+	switch objType {
+	case structs.TypeBgpPeer:
+		object := structs.BgpPeerObject{
+			ApiVersion: 1,
+			Type:       structs.TypeBgpPeer,
+			Meta: structs.BgpPeerMetaObject{
+				Name:   name,
+				Labels: decodeLabels(fields["labels"]),
+			},
+			Spec: structs.BgpPeerSpecObject{
+				IP:              fields["ip"],
+				IP6:             fields["ip6"],
+				Description:     fields["description"],
+				AddressFamilies: decodeList(fields["afis"]),
+				NextHop:         fields["nexthop"],
+				NextHop6:        fields["nexthop6"],
+			},
+		}
+		spec := &object.Spec
+		spec.MaxPrefix.Action = fields["maxprefix_action"]
+
+		err := decodeInts(fields, map[string]*int{
+			"asnum":             &spec.AsNumber,
+			"local_asnum":       &spec.LocalAsNumber,
+			"holdtime":          &spec.HoldTime,
+			"keepalive":         &spec.Keepalive,
+			"maxprefix_limit":   &spec.MaxPrefix.Limit,
+			"maxprefix_warning": &spec.MaxPrefix.WarningThreshold,
+			"maxprefix_restart": &spec.MaxPrefix.RestartInterval,
+			"bfd_min_tx":        &spec.Bfd.MinTx,
+			"bfd_min_rx":        &spec.Bfd.MinRx,
+			"bfd_multiplier":    &spec.Bfd.Multiplier,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		err = decodeBools(fields, map[string]*bool{
+			"passive":      &spec.Passive,
+			"shutdown":     &spec.Shutdown,
+			"bfd_enabled":  &spec.Bfd.Enabled,
+			"bfd_multihop": &spec.Bfd.Multihop,
+			"flowspec":     &spec.Flowspec,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if policy, ok := fields["policy"]; ok {
+			if err = yaml.Unmarshal([]byte(policy), &spec.Policy); err != nil {
+				return nil, errors.New("Failed to unmarshal policy: " + err.Error())
+			}
+		}
+
+		return object, nil
+
+	case structs.TypeAnycast:
+		object := structs.AnycastObject{
+			ApiVersion: 1,
+			Type:       structs.TypeAnycast,
+			Meta: structs.AnycastMetaObject{
+				Name: name,
+			},
+			Spec: structs.AnycastSpecObject{
+				IP:           fields["ip"],
+				IP6:          fields["ip6"],
+				HealthCheck:  fields["healthcheck"],
+				Peers:        decodeList(fields["peers"]),
+				PeerSelector: decodeLabels(fields["peer_selector"]),
+				Placement: structs.PlacementObject{
+					NodeSelector: decodeLabels(fields["node_selector"]),
+					Sites:        decodeList(fields["sites"]),
+				},
+			},
+		}
+		spec := &object.Spec
+
+		err := decodeInts(fields, map[string]*int{
+			"asnum":     &spec.AsNumber,
+			"min_nodes": &spec.Placement.MinNodes,
+			"max_nodes": &spec.Placement.MaxNodes,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return object, nil
+
+	case structs.TypeNode:
+		object := structs.NodeObject{
+			ApiVersion: 1,
+			Type:       structs.TypeNode,
+			Meta: structs.NodeMetaObject{
+				Name:   name,
+				Labels: decodeLabels(fields["labels"]),
+			},
+			Spec: structs.NodeSpecObject{
+				Hostname:     fields["hostname"],
+				Site:         fields["site"],
+				RouterId:     fields["router_id"],
+				NextHop:      fields["nexthop"],
+				NextHop6:     fields["nexthop6"],
+				Peers:        decodeList(fields["peers"]),
+				PeerSelector: decodeLabels(fields["peer_selector"]),
+			},
+		}
+
+		return object, nil
+	}
+
+	return nil, errors.New("unknown object type " + objType)
+}
+
+func decodeInts(fields map[string]string, targets map[string]*int) error {
+	var err error
+
+	for key, target := range targets {
+		value, ok := fields[key]
+		if !ok {
+			continue
+		}
+		if *target, err = strconv.Atoi(value); err != nil {
+			return errors.New("Failed to convert " + key + " to int")
+		}
+	}
+
+	return nil
+}
+
+func decodeBools(fields map[string]string, targets map[string]*bool) error {
+	var err error
+
+	for key, target := range targets {
+		value, ok := fields[key]
+		if !ok {
+			continue
+		}
+		if *target, err = strconv.ParseBool(value); err != nil {
+			return errors.New("Failed to convert " + key + " to bool")
+		}
+	}
+
+	return nil
+}
+
+// Lists are stored comma separated
+func decodeList(data string) []string {
+	if data == "" {
+		return nil
+	}
+
+	return strings.Split(data, ",")
+}
+
+// Labels are stored as a sorted, comma separated list of key=value pairs
+func decodeLabels(data string) map[string]string {
+	if data == "" {
+		return nil
+	}
+
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(data, ",") {
+		tokens := strings.SplitN(pair, "=", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+		labels[tokens[0]] = tokens[1]
+	}
+
+	return labels
+}
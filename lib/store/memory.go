@@ -0,0 +1,160 @@
+package store
+
+import (
+	"strings"
+	"sync"
+)
+
+// A KV which only lives in memory, for tests and for running the agent
+// without a configuration store
+type Memory struct {
+	mutex    sync.Mutex
+	data     map[string]memoryValue
+	revision uint64
+	watchers map[*memoryWatcher]bool
+}
+
+// version is the revision of the memory at the last write of the value
+type memoryValue struct {
+	value   string
+	version uint64
+}
+
+type memoryWatcher struct {
+	prefix  string
+	changes chan struct{}
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		data:     make(map[string]memoryValue),
+		watchers: make(map[*memoryWatcher]bool),
+	}
+}
+
+func (m *Memory) URL() string {
+	return "memory://"
+}
+
+func (m *Memory) Set(key, value string) error {
+	key = strings.TrimPrefix(key, "/")
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.set(key, value)
+
+	return nil
+}
+
+// Must be called with the mutex held
+func (m *Memory) set(key, value string) {
+	m.revision++
+	m.data[key] = memoryValue{value: value, version: m.revision}
+	m.notify(key)
+}
+
+func (m *Memory) Get(key string) (string, uint64, error) {
+	key = strings.TrimPrefix(key, "/")
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	data := m.data[key]
+	return data.value, data.version, nil
+}
+
+func (m *Memory) CompareAndSet(key, value string, version uint64) (bool, error) {
+	key = strings.TrimPrefix(key, "/")
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.data[key].version != version {
+		return false, nil
+	}
+	m.set(key, value)
+
+	return true, nil
+}
+
+func (m *Memory) Delete(key string) error {
+	key = strings.TrimPrefix(key, "/")
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.data[key]; ok {
+		delete(m.data, key)
+		m.notify(key)
+	}
+
+	return nil
+}
+
+func (m *Memory) List(prefix string) (map[string]string, error) {
+	prefix = strings.TrimPrefix(prefix, "/")
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	values := make(map[string]string)
+	for key, data := range m.data {
+		if strings.HasPrefix(key, prefix) {
+			values[key] = data.value
+		}
+	}
+
+	return values, nil
+}
+
+func (m *Memory) DeleteTree(prefix string) error {
+	prefix = strings.TrimPrefix(prefix, "/")
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for key := range m.data {
+		if strings.HasPrefix(key, prefix) {
+			delete(m.data, key)
+			m.notify(key)
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) Watch(prefix string, stop <-chan struct{}) (<-chan struct{}, error) {
+	watcher := &memoryWatcher{
+		prefix:  strings.TrimPrefix(prefix, "/"),
+		changes: make(chan struct{}, 1),
+	}
+
+	m.mutex.Lock()
+	m.watchers[watcher] = true
+	m.mutex.Unlock()
+
+	go func() {
+		<-stop
+		m.mutex.Lock()
+		delete(m.watchers, watcher)
+		close(watcher.changes)
+		m.mutex.Unlock()
+	}()
+
+	return watcher.changes, nil
+}
+
+// Signals are coalesced, so a slow watcher does not block writers. Must
+// be called with the mutex held
+func (m *Memory) notify(key string) {
+	for watcher := range m.watchers {
+		if !strings.HasPrefix(key, watcher.prefix) {
+			continue
+		}
+		select {
+		case watcher.changes <- struct{}{}:
+		default:
+		}
+	}
+}
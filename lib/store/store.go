@@ -0,0 +1,381 @@
+package store
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/r3boot/anycast-agent/lib/consul"
+	"github.com/r3boot/anycast-agent/lib/structs"
+)
+
+const (
+	DefaultPrefix = "anycast"
+
+	EventPut    = "put"
+	EventDelete = "delete"
+	EventError  = "error"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrConflict = errors.New("was changed by someone else, try again")
+)
+
+// A Store holds the bgpPeer, anycast and node objects, by type and name.
+// Objects are the values returned by structs.LoadFromYaml
+type Store interface {
+	Get(objType, name string) (interface{}, error)
+	Put(object interface{}) error
+	List(objType string) ([]interface{}, error)
+	Delete(objType, name string) error
+	// Returns when and by whom the object was last changed
+	Revision(objType, name string) (Revision, error)
+	// Sends an event for every object of objType which is added, changed
+	// or removed, until stop is closed
+	Watch(objType string, stop <-chan struct{}) (<-chan Event, error)
+	URL() string
+}
+
+// Object is nil for EventDelete. EventError is sent when the objects
+// could not be read after a change, with the reason in Err
+type Event struct {
+	Type    string
+	ObjType string
+	Name    string
+	Object  interface{}
+	Err     error
+}
+
+// Generation counts the changes made to an object, starting at 1. Stores
+// which do not keep it leave it at 0
+type Revision struct {
+	Generation int64     `json:"generation"`
+	Modified   time.Time `json:"modified"`
+	Author     string    `json:"author"`
+}
+
+// The key/value store underneath a Store. Keys are slash separated paths
+// without a leading slash. Every write of a key gives it a new version;
+// keys which do not exist have version 0
+type KV interface {
+	Get(key string) (string, uint64, error)
+	// Only writes value if the key is still at version, and returns
+	// whether it did
+	CompareAndSet(key, value string, version uint64) (bool, error)
+	Delete(key string) error
+	List(prefix string) (map[string]string, error)
+	DeleteTree(prefix string) error
+	Watch(prefix string, stop <-chan struct{}) (<-chan struct{}, error)
+	URL() string
+}
+
+// The backend is selected by the scheme of URL: consul://, etcd://,
+// etcds:// (etcd over https), file:// or memory://. The path of the url
+// is the prefix under which the objects are kept, or the directory for
+// file://. Without URL, consul is used as configured by Consul. Warn is
+// given the warnings about the objects read, such as the deprecated keys
+// in the files of a file:// store; they are dropped when it is nil
+type Config struct {
+	URL      string
+	Consul   consul.Config
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	Warn     func(...interface{})
+}
+
+func RegisterFlags(cfg *Config) {
+	flag.StringVar(&cfg.URL, "store", "",
+		"Configuration store to use (consul://host:port, etcd://host:port[,host:port], etcds://..., file:///path/to/dir)")
+
+	flag.StringVar(&cfg.CAFile, "etcd-ca-cert", "",
+		"CA bundle to verify etcd with")
+
+	flag.StringVar(&cfg.CertFile, "etcd-client-cert", "",
+		"Client certificate for etcd")
+
+	flag.StringVar(&cfg.KeyFile, "etcd-client-key", "",
+		"Key of the client certificate for etcd")
+
+	consul.RegisterFlags(&cfg.Consul)
+}
+
+func New(cfg Config) (Store, error) {
+	if cfg.URL == "" {
+		client, err := consul.NewConsul(cfg.Consul)
+		if err != nil {
+			return nil, fmt.Errorf("store.New: %v", err)
+		}
+		return NewKVStore(client, DefaultPrefix), nil
+	}
+
+	location, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("store.New: %v", err)
+	}
+
+	prefix := strings.Trim(location.Path, "/")
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+
+	var kv KV
+	switch location.Scheme {
+	case "consul", "http", "https":
+		consulCfg := cfg.Consul
+		if location.Scheme == "consul" {
+			consulCfg.Address = location.Host
+		} else {
+			consulCfg.Address = location.Scheme + "://" + location.Host
+		}
+		if kv, err = consul.NewConsul(consulCfg); err != nil {
+			return nil, fmt.Errorf("store.New: %v", err)
+		}
+	case "etcd", "etcds":
+		if kv, err = NewEtcd(location, cfg); err != nil {
+			return nil, fmt.Errorf("store.New: %v", err)
+		}
+	case "memory":
+		kv = NewMemory()
+	case "file":
+		// file:///etc/anycast-agent/conf.d, or file://conf.d for a
+		// relative path
+		file, err := NewFile(location.Host + location.Path)
+		if err != nil {
+			return nil, fmt.Errorf("store.New: %v", err)
+		}
+		file.warn = cfg.Warn
+		return file, nil
+	default:
+		return nil, errors.New("store.New: unknown store " + location.Scheme)
+	}
+
+	return NewKVStore(kv, prefix), nil
+}
+
+// Reads the objects of objType every time changes signals, and sends an
+// event for every object which was added, changed or removed since
+func watchObjects(objType string, current map[string]interface{},
+	objects func() (map[string]interface{}, error),
+	changes <-chan struct{}, stop <-chan struct{}) <-chan Event {
+	events := make(chan Event)
+
+	go func() {
+		defer close(events)
+
+		lastErr := ""
+		for range changes {
+			// Objects which fail to load are reported once, and the
+			// change which fixes them is picked up like any other
+			found, err := objects()
+			if err != nil {
+				if err.Error() == lastErr {
+					continue
+				}
+				lastErr = err.Error()
+				select {
+				case events <- Event{Type: EventError, ObjType: objType, Err: err}:
+				case <-stop:
+					return
+				}
+				continue
+			}
+			lastErr = ""
+
+			for _, event := range diffObjects(objType, current, found) {
+				select {
+				case events <- event:
+				case <-stop:
+					return
+				}
+			}
+			current = found
+		}
+	}()
+
+	return events
+}
+
+func diffObjects(objType string, old, new map[string]interface{}) []Event {
+	names := []string{}
+	for name := range old {
+		if _, ok := new[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	for name := range new {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	events := []Event{}
+	for _, name := range names {
+		object, ok := new[name]
+		switch {
+		case !ok:
+			events = append(events, Event{Type: EventDelete, ObjType: objType, Name: name})
+		case !reflect.DeepEqual(old[name], object):
+			events = append(events, Event{Type: EventPut, ObjType: objType, Name: name, Object: object})
+		}
+	}
+
+	return events
+}
+
+// Converts the objects which a store kept before it stored documents,
+// and returns them as type:name. Stores without an old layout have
+// nothing to migrate
+func Migrate(s Store) ([]string, error) {
+	kvs, ok := s.(*kvStore)
+	if !ok {
+		return nil, nil
+	}
+
+	migrated, err := kvs.migrate()
+	if err != nil {
+		return migrated, fmt.Errorf("store.Migrate: %v", err)
+	}
+
+	return migrated, nil
+}
+
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+func IsConflict(err error) bool {
+	return errors.Is(err, ErrConflict)
+}
+
+// Returns the type and name of an object as returned by
+// structs.LoadFromYaml
+func ObjectName(object interface{}) (string, string, error) {
+	objType, name, ok := objectName(object)
+	if !ok {
+		return "", "", errors.New("ObjectName: unknown object")
+	}
+
+	return objType, name, nil
+}
+
+// Returns the labels in the meta of an object
+func ObjectLabels(object interface{}) map[string]string {
+	switch object := object.(type) {
+	case structs.BgpPeerObject:
+		return object.Meta.Labels
+	case structs.AnycastObject:
+		return object.Meta.Labels
+	case structs.NodeObject:
+		return object.Meta.Labels
+	}
+
+	return nil
+}
+
+// Returns the services and nodes which list the bgp peer by name, as
+// type:name. Peers selected by labels are not counted, since another
+// peer can take their place
+func BgpPeerUsers(s Store, name string) ([]string, error) {
+	objects := []interface{}{}
+	for _, objType := range []string{structs.TypeAnycast, structs.TypeNode} {
+		items, err := s.List(objType)
+		if err != nil {
+			return nil, errors.New("BgpPeerUsers: " + err.Error())
+		}
+		objects = append(objects, items...)
+	}
+
+	return peerUsers(objects, name), nil
+}
+
+func peerUsers(objects []interface{}, name string) []string {
+	users := []string{}
+	for _, object := range objects {
+		var peers []string
+		switch object := object.(type) {
+		case structs.AnycastObject:
+			peers = object.Spec.Peers
+		case structs.NodeObject:
+			peers = object.Spec.Peers
+		}
+
+		for _, peer := range peers {
+			if peer == name {
+				objType, objName, _ := objectName(object)
+				users = append(users, objType+":"+objName)
+			}
+		}
+	}
+
+	return users
+}
+
+func GetBgpPeers(s Store) ([]structs.BgpPeerObject, error) {
+	objects, err := s.List(structs.TypeBgpPeer)
+	if err != nil {
+		return nil, errors.New("GetBgpPeers: " + err.Error())
+	}
+
+	peers := []structs.BgpPeerObject{}
+	for _, object := range objects {
+		peers = append(peers, object.(structs.BgpPeerObject))
+	}
+
+	return peers, nil
+}
+
+func GetAnycastServices(s Store) ([]structs.AnycastObject, error) {
+	objects, err := s.List(structs.TypeAnycast)
+	if err != nil {
+		return nil, errors.New("GetAnycastServices: " + err.Error())
+	}
+
+	services := []structs.AnycastObject{}
+	for _, object := range objects {
+		services = append(services, object.(structs.AnycastObject))
+	}
+
+	return services, nil
+}
+
+func GetNodes(s Store) ([]structs.NodeObject, error) {
+	objects, err := s.List(structs.TypeNode)
+	if err != nil {
+		return nil, errors.New("GetNodes: " + err.Error())
+	}
+
+	nodes := []structs.NodeObject{}
+	for _, object := range objects {
+		nodes = append(nodes, object.(structs.NodeObject))
+	}
+
+	return nodes, nil
+}
+
+// Nodes are found by name, or else by their hostname
+func FindNode(s Store, hostname string) (structs.NodeObject, error) {
+	if object, err := s.Get(structs.TypeNode, hostname); err == nil {
+		return object.(structs.NodeObject), nil
+	} else if !IsNotFound(err) {
+		return structs.NodeObject{}, errors.New("FindNode: " + err.Error())
+	}
+
+	nodes, err := GetNodes(s)
+	if err != nil {
+		return structs.NodeObject{}, errors.New("FindNode: " + err.Error())
+	}
+
+	for _, node := range nodes {
+		if structs.NodeHostname(node) == hostname {
+			return node, nil
+		}
+	}
+
+	return structs.NodeObject{}, errors.New("FindNode: no node for host " + hostname)
+}
@@ -0,0 +1,361 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/r3boot/anycast-agent/lib/structs"
+)
+
+func testPeer() structs.BgpPeerObject {
+	med := uint32(100)
+	return structs.BgpPeerObject{
+		ApiVersion: 1,
+		Type:       structs.TypeBgpPeer,
+		Meta: structs.BgpPeerMetaObject{
+			Name:   "laptop",
+			Labels: map[string]string{"site": "home", "role": "uplink"},
+		},
+		Spec: structs.BgpPeerSpecObject{
+			AsNumber:        65342,
+			IP:              "10.0.4.1",
+			IP6:             "2001:db8::1",
+			Description:     "laptop uplink",
+			HoldTime:        90,
+			Keepalive:       30,
+			AddressFamilies: []string{structs.AddressFamilyInet, structs.AddressFamilyFlow},
+			Passive:         true,
+			MaxPrefix:       structs.MaxPrefixObject{Limit: 1000, WarningThreshold: 80, Action: "restart", RestartInterval: 15},
+			Bfd:             structs.BfdObject{Enabled: true, MinTx: 300, MinRx: 300, Multiplier: 3},
+			Flowspec:        true,
+			Policy: structs.PolicyObject{
+				Export: []structs.PolicyTermObject{{
+					Name:   "transit",
+					Match:  structs.PolicyMatchObject{Services: []string{"dns"}},
+					Set:    structs.PolicySetObject{AddCommunities: []string{"no-export"}, MED: &med},
+					Action: "accept",
+				}},
+			},
+		},
+	}
+}
+
+func testService(name string) structs.AnycastObject {
+	return structs.AnycastObject{
+		ApiVersion: 1,
+		Type:       structs.TypeAnycast,
+		Meta:       structs.AnycastMetaObject{Name: name},
+		Spec: structs.AnycastSpecObject{
+			AsNumber:     65001,
+			IP:           "192.0.2.53",
+			IP6:          "2001:db8:53::53",
+			HealthCheck:  "dig @127.0.0.1 example.com",
+			Peers:        []string{"laptop", "router"},
+			PeerSelector: map[string]string{"site": "home"},
+			Placement: structs.PlacementObject{
+				NodeSelector: map[string]string{"role": "dns"},
+				Sites:        []string{"ams", "fra"},
+				MinNodes:     2,
+				MaxNodes:     4,
+			},
+		},
+	}
+}
+
+func testNode() structs.NodeObject {
+	return structs.NodeObject{
+		ApiVersion: 1,
+		Type:       structs.TypeNode,
+		Meta: structs.NodeMetaObject{
+			Name:   "dns1",
+			Labels: map[string]string{"role": "dns"},
+		},
+		Spec: structs.NodeSpecObject{
+			Hostname:     "dns1.example.net",
+			Site:         "ams",
+			RouterId:     "10.0.0.1",
+			NextHop:      "10.0.0.1",
+			NextHop6:     "2001:db8::a",
+			Peers:        []string{"laptop"},
+			PeerSelector: map[string]string{"site": "home"},
+		},
+	}
+}
+
+// Every change is a single event, so the next event has to be expected
+func expectEvent(t *testing.T, events <-chan Event, expected Event) {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		if !reflect.DeepEqual(event, expected) {
+			t.Fatalf("got event %#v, want %#v", event, expected)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no %s event for %s", expected.Type, expected.Name)
+	}
+}
+
+// The conformance tests every backend has to pass. newStore returns an
+// empty store
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("RoundTrip", func(t *testing.T) {
+		s := newStore(t)
+		for _, object := range []interface{}{testPeer(), testService("dns"), testNode()} {
+			if err := s.Put(object); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+		}
+
+		for objType, expected := range map[string]interface{}{
+			structs.TypeBgpPeer: testPeer(),
+			structs.TypeAnycast: testService("dns"),
+			structs.TypeNode:    testNode(),
+		} {
+			_, name, _ := objectName(expected)
+			object, err := s.Get(objType, name)
+			if err != nil {
+				t.Fatalf("Get %s: %v", objType, err)
+			}
+			if !reflect.DeepEqual(object, expected) {
+				t.Errorf("Get %s:\n got %#v\nwant %#v", objType, object, expected)
+			}
+		}
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.Put(testService("dns")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+
+		expected := structs.AnycastObject{
+			ApiVersion: 1,
+			Type:       structs.TypeAnycast,
+			Meta:       structs.AnycastMetaObject{Name: "dns"},
+			Spec:       structs.AnycastSpecObject{AsNumber: 65002, IP: "192.0.2.54", HealthCheck: "true", Peers: []string{"router"}},
+		}
+		if err := s.Put(expected); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+
+		object, err := s.Get(structs.TypeAnycast, "dns")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if !reflect.DeepEqual(object, expected) {
+			t.Errorf("Get:\n got %#v\nwant %#v", object, expected)
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.Put(testService("dns")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+
+		// dn is a prefix of dns, which must not match
+		if _, err := s.Get(structs.TypeAnycast, "dn"); !IsNotFound(err) {
+			t.Errorf("Get: expected not found, got %v", err)
+		}
+		if _, err := s.Get(structs.TypeBgpPeer, "dns"); !IsNotFound(err) {
+			t.Errorf("Get: expected not found, got %v", err)
+		}
+		if err := s.Delete(structs.TypeAnycast, "dn"); !IsNotFound(err) {
+			t.Errorf("Delete: expected not found, got %v", err)
+		}
+	})
+
+	t.Run("UnknownType", func(t *testing.T) {
+		s := newStore(t)
+		if _, err := s.Get("flow", "dns"); err == nil || IsNotFound(err) {
+			t.Errorf("Get: expected an error, got %v", err)
+		}
+		if _, err := s.List("flow"); err == nil {
+			t.Errorf("List: expected an error")
+		}
+		if err := s.Put(struct{}{}); err == nil {
+			t.Errorf("Put: expected an error")
+		}
+		if err := s.Put(structs.AnycastObject{}); err == nil {
+			t.Errorf("Put: expected an error for an object without a name")
+		}
+	})
+
+	t.Run("ListDelete", func(t *testing.T) {
+		s := newStore(t)
+
+		objects, err := s.List(structs.TypeAnycast)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		if len(objects) != 0 {
+			t.Fatalf("List: expected an empty store, got %d objects", len(objects))
+		}
+
+		for _, name := range []string{"ntp", "dns", "dns2"} {
+			if err = s.Put(testService(name)); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+		}
+		if err = s.Put(testPeer()); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+
+		if err = s.Delete(structs.TypeAnycast, "dns"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+
+		objects, err = s.List(structs.TypeAnycast)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		names := []string{}
+		for _, object := range objects {
+			names = append(names, object.(structs.AnycastObject).Meta.Name)
+		}
+		if !reflect.DeepEqual(names, []string{"dns2", "ntp"}) {
+			t.Errorf("List: got %v", names)
+		}
+
+		peers, err := GetBgpPeers(s)
+		if err != nil {
+			t.Fatalf("GetBgpPeers: %v", err)
+		}
+		if len(peers) != 1 || peers[0].Meta.Name != "laptop" {
+			t.Errorf("GetBgpPeers: got %v", peers)
+		}
+	})
+
+	t.Run("FindNode", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.Put(testNode()); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+
+		for _, host := range []string{"dns1", "dns1.example.net"} {
+			node, err := FindNode(s, host)
+			if err != nil {
+				t.Fatalf("FindNode %s: %v", host, err)
+			}
+			if node.Meta.Name != "dns1" {
+				t.Errorf("FindNode %s: got %s", host, node.Meta.Name)
+			}
+		}
+
+		if _, err := FindNode(s, "dns2"); err == nil {
+			t.Errorf("FindNode: expected an error for an unknown host")
+		}
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.Put(testService("ntp")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+
+		stop := make(chan struct{})
+		events, err := s.Watch(structs.TypeAnycast, stop)
+		if err != nil {
+			t.Fatalf("Watch: %v", err)
+		}
+
+		// Objects which exist when the watch starts are not sent
+		if err = s.Put(testService("dns")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		expectEvent(t, events, Event{
+			Type:    EventPut,
+			ObjType: structs.TypeAnycast,
+			Name:    "dns",
+			Object:  testService("dns"),
+		})
+
+		// Other types are not sent
+		if err = s.Put(testPeer()); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+
+		changed := testService("ntp")
+		changed.Spec.IP = "192.0.2.123"
+		if err = s.Put(changed); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		expectEvent(t, events, Event{
+			Type:    EventPut,
+			ObjType: structs.TypeAnycast,
+			Name:    "ntp",
+			Object:  changed,
+		})
+
+		if err = s.Delete(structs.TypeAnycast, "dns"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		expectEvent(t, events, Event{
+			Type:    EventDelete,
+			ObjType: structs.TypeAnycast,
+			Name:    "dns",
+		})
+
+		close(stop)
+		for range events {
+		}
+	})
+}
+
+func TestBgpPeerUsers(t *testing.T) {
+	s := NewKVStore(NewMemory(), DefaultPrefix)
+	for _, object := range []interface{}{testPeer(), testService("dns"), testService("ntp"), testNode()} {
+		if err := s.Put(object); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	users, err := BgpPeerUsers(s, "laptop")
+	if err != nil {
+		t.Fatalf("BgpPeerUsers: %v", err)
+	}
+	expected := []string{"anycast:dns", "anycast:ntp", "node:dns1"}
+	if !reflect.DeepEqual(users, expected) {
+		t.Errorf("BgpPeerUsers: got %v, want %v", users, expected)
+	}
+
+	if users, err = BgpPeerUsers(s, "lapto"); err != nil || len(users) != 0 {
+		t.Errorf("BgpPeerUsers: got %v, %v", users, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return NewKVStore(NewMemory(), DefaultPrefix)
+	})
+}
+
+// Runs the conformance tests against a live store, eg
+// ANYCAST_TEST_STORE=consul://127.0.0.1:8500. Every test uses its own
+// prefix, which is removed afterwards
+func TestStore(t *testing.T) {
+	location := os.Getenv("ANYCAST_TEST_STORE")
+	if location == "" {
+		t.Skip("ANYCAST_TEST_STORE not set")
+	}
+
+	count := 0
+	testStore(t, func(t *testing.T) Store {
+		count++
+		prefix := fmt.Sprintf("anycast-test-%d-%d", os.Getpid(), count)
+
+		s, err := New(Config{URL: location + "/" + prefix})
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		t.Cleanup(func() {
+			s.(*kvStore).kv.DeleteTree(prefix + "/")
+		})
+
+		return s
+	})
+}
@@ -0,0 +1,155 @@
+package store
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/r3boot/anycast-agent/lib/structs"
+)
+
+// Checks an object against the objects in the store, as done before it is
+// applied: the peers it lists must exist, and its addresses must not be
+// used by another service, peer or node
+func ValidateReferences(s Store, object interface{}) error {
+	if err := ValidateChanges(s, []interface{}{object}, nil); err != nil {
+		return errors.New("ValidateReferences: " + err.Error())
+	}
+
+	return nil
+}
+
+// Checks objects which are applied together, and deleting the objects in
+// deleted (as type:name), against the store. Every applied object must be
+// valid with all changes made, and a deleted peer must not be listed by a
+// service or node which is left
+func ValidateChanges(s Store, applied []interface{}, deleted []string) error {
+	objects := make(map[string]interface{})
+	for _, objType := range []string{structs.TypeBgpPeer, structs.TypeAnycast, structs.TypeNode} {
+		items, err := s.List(objType)
+		if err != nil {
+			return errors.New("ValidateChanges: " + err.Error())
+		}
+		for _, item := range items {
+			_, name, _ := objectName(item)
+			objects[objType+":"+name] = item
+		}
+	}
+
+	for _, id := range deleted {
+		delete(objects, id)
+	}
+	for _, object := range applied {
+		objType, name, ok := objectName(object)
+		if !ok {
+			return errors.New("ValidateChanges: unknown object")
+		}
+		objects[objType+":"+name] = object
+	}
+
+	ids := []string{}
+	for id := range objects {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	others := []interface{}{}
+	for _, id := range ids {
+		others = append(others, objects[id])
+	}
+
+	for _, object := range applied {
+		if err := CheckReferences(object, others); err != nil {
+			return errors.New("ValidateChanges: " + err.Error())
+		}
+	}
+
+	for _, id := range deleted {
+		objType, name := splitID(id)
+		if objType != structs.TypeBgpPeer {
+			continue
+		}
+		if users := peerUsers(others, name); len(users) > 0 {
+			return errors.New("ValidateChanges: bgpPeer " + name + " is used by " + strings.Join(users, ", "))
+		}
+	}
+
+	return nil
+}
+
+// Like ValidateReferences, against others instead of the store. An
+// object in others with the same type and name as object is the version
+// it replaces, and is skipped
+func CheckReferences(object interface{}, others []interface{}) error {
+	objType, name, ok := objectName(object)
+	if !ok {
+		return errors.New("unknown object")
+	}
+	id := objType + ":" + name
+
+	peers := []structs.BgpPeerObject{}
+	for _, other := range others {
+		if peer, ok := other.(structs.BgpPeerObject); ok {
+			peers = append(peers, peer)
+		}
+	}
+
+	switch object := object.(type) {
+	case structs.AnycastObject:
+		if _, err := structs.SelectBgpPeers(object, peers); err != nil {
+			return err
+		}
+	case structs.NodeObject:
+		if _, err := structs.SelectNodeBgpPeers(object, peers); err != nil {
+			return err
+		}
+	}
+
+	for _, ip := range objectAddresses(object) {
+		for _, other := range others {
+			otherType, otherName, _ := objectName(other)
+			if otherType+":"+otherName == id {
+				continue
+			}
+			for _, otherIP := range objectAddresses(other) {
+				if ip.Equal(otherIP) {
+					return errors.New(id + ": " + ip.String() + " is already used by " + otherType + ":" + otherName)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// The addresses of services, peers and nodes which must be unique
+func objectAddresses(object interface{}) []net.IP {
+	var addresses []string
+	switch object := object.(type) {
+	case structs.AnycastObject:
+		addresses = []string{object.Spec.IP, object.Spec.IP6}
+	case structs.BgpPeerObject:
+		addresses = []string{object.Spec.IP, object.Spec.IP6}
+	case structs.NodeObject:
+		addresses = []string{object.Spec.RouterId, object.Spec.NextHop, object.Spec.NextHop6}
+	}
+
+	ips := []net.IP{}
+	for _, address := range addresses {
+		if ip := net.ParseIP(address); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+
+	return ips
+}
+
+// Splits type:name
+func splitID(id string) (string, string) {
+	tokens := strings.SplitN(id, ":", 2)
+	if len(tokens) == 1 {
+		return tokens[0], ""
+	}
+
+	return tokens[0], tokens[1]
+}
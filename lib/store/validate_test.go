@@ -0,0 +1,125 @@
+package store
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/r3boot/anycast-agent/lib/structs"
+)
+
+func TestCheckReferences(t *testing.T) {
+	router := testPeer()
+	router.Meta.Name = "router"
+	router.Spec.IP = "10.0.4.2"
+	router.Spec.IP6 = "2001:db8::2"
+	peers := []interface{}{testPeer(), router}
+
+	ntp := func() structs.AnycastObject {
+		service := testService("ntp")
+		service.Spec.IP = "192.0.2.123"
+		service.Spec.IP6 = "2001:db8:123::123"
+		return service
+	}
+
+	collision := ntp()
+	collision.Spec.IP6 = "2001:DB8:53::53"
+
+	peerCollision := ntp()
+	peerCollision.Spec.IP = "10.0.4.2"
+
+	missingPeer := ntp()
+	missingPeer.Spec.Peers = []string{"laptop", "switch"}
+
+	node := testNode()
+	node.Spec.Peers = []string{"switch"}
+
+	samePeer := router
+	samePeer.Meta.Name = "router2"
+
+	nodeCollision := ntp()
+	nodeCollision.Spec.IP = testNode().Spec.NextHop
+
+	tests := []struct {
+		name   string
+		object interface{}
+		err    string
+	}{
+		{"valid", ntp(), ""},
+		{"replaced", testService("dns"), ""},
+		{"service collision", collision, "anycast:ntp: 2001:db8:53::53 is already used by anycast:dns"},
+		{"peer collision", peerCollision, "anycast:ntp: 10.0.4.2 is already used by bgpPeer:router"},
+		{"missing peer", missingPeer, "switch"},
+		{"node missing peer", node, "switch"},
+		{"peer collides with peer", samePeer, "bgpPeer:router2: 10.0.4.2 is already used by bgpPeer:router"},
+		{"node collision", nodeCollision, "anycast:ntp: 10.0.0.1 is already used by node:dns1"},
+	}
+
+	others := append(peers, testService("dns"), testNode())
+	for _, test := range tests {
+		err := CheckReferences(test.object, others)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%s: expected error containing %q", test.name, test.err)
+		case test.err != "" && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%s: got %v, want an error containing %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestValidateReferences(t *testing.T) {
+	s := NewKVStore(NewMemory(), DefaultPrefix)
+	if err := ValidateReferences(s, testService("dns")); err == nil {
+		t.Errorf("ValidateReferences: expected an error for missing peers")
+	}
+
+	router := testPeer()
+	router.Meta.Name = "router"
+	router.Spec.IP = "10.0.4.2"
+	router.Spec.IP6 = "2001:db8::2"
+	for _, object := range []interface{}{testPeer(), router, testService("dns")} {
+		if err := s.Put(object); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	if err := ValidateReferences(s, testService("dns")); err != nil {
+		t.Errorf("ValidateReferences: %v", err)
+	}
+	if err := ValidateReferences(s, testService("ntp")); err == nil {
+		t.Errorf("ValidateReferences: expected an error for the address of anycast:dns")
+	}
+}
+
+func TestValidateChanges(t *testing.T) {
+	s := NewKVStore(NewMemory(), DefaultPrefix)
+
+	router := testPeer()
+	router.Meta.Name = "router"
+	router.Spec.IP = "10.0.4.2"
+	router.Spec.IP6 = "2001:db8::2"
+
+	// Peers applied with a service count for it
+	if err := ValidateChanges(s, []interface{}{testPeer(), router, testService("dns")}, nil); err != nil {
+		t.Fatalf("ValidateChanges: %v", err)
+	}
+	for _, object := range []interface{}{testPeer(), router, testService("dns")} {
+		if err := s.Put(object); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	if err := ValidateChanges(s, nil, []string{"bgpPeer:router"}); err == nil || !strings.Contains(err.Error(), "anycast:dns") {
+		t.Errorf("ValidateChanges: got %v, want an error for the user of router", err)
+	}
+
+	changed := testService("dns")
+	changed.Spec.Peers = []string{"laptop"}
+	if err := ValidateChanges(s, []interface{}{changed}, []string{"bgpPeer:router"}); err != nil {
+		t.Errorf("ValidateChanges: %v", err)
+	}
+	if err := ValidateChanges(s, nil, []string{"anycast:dns", "bgpPeer:router"}); err != nil {
+		t.Errorf("ValidateChanges: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// Files are read once they are closed after writing, not while they
+	// are being created or written. IN_CREATE is only used for new
+	// directories, which have to be watched as well
+	inotifyMask = syscall.IN_DELETE | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+		syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB
+)
+
+// Signals on the returned channel whenever a file in dir or one of its
+// subdirectories changes. Signals are coalesced, and the channel is closed
+// once stop is closed
+func watchDir(dir string, stop <-chan struct{}) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init: %v", err)
+	}
+
+	if err = addWatches(fd, dir); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// A non-blocking fd goes through the runtime poller, so closing it
+	// ends a pending Read
+	inotify := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-stop
+		inotify.Close()
+	}()
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
+
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := inotify.Read(buf)
+			if err != nil {
+				return
+			}
+
+			changed := false
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+				isDir := event.Mask&syscall.IN_ISDIR != 0
+				if isDir && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+					// Files can be written to the directory before its
+					// watch is added, so it is read again as well
+					addWatches(fd, dir)
+				}
+				if isDir || event.Mask&syscall.IN_CREATE == 0 {
+					changed = true
+				}
+			}
+			if !changed {
+				continue
+			}
+
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return changes, nil
+}
+
+// Watches dir and every directory below it. Directories which are already
+// watched keep their watch
+func addWatches(fd int, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if _, err = syscall.InotifyAddWatch(fd, path, inotifyMask); err != nil {
+			return fmt.Errorf("inotify_add_watch: %v", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package store
+
+import (
+	"errors"
+)
+
+// Without inotify the directory is polled instead
+func watchDir(dir string, stop <-chan struct{}) (<-chan struct{}, error) {
+	return nil, errors.New("inotify is only available on linux")
+}
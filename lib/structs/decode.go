@@ -0,0 +1,373 @@
+package structs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Keys which were renamed so all object types use the same names, by the
+// path of the old key and with the new name. Files with the old keys are
+// still read, with a warning
+var deprecatedKeys = map[string]map[string]string{
+	TypeBgpPeer: {"spec.IP": "ip", "spec.IP6": "ip6"},
+	TypeAnycast: {"spec.asnum": "asNumber"},
+}
+
+var objectTypes = map[string]reflect.Type{
+	TypeBgpPeer: reflect.TypeOf(BgpPeerObject{}),
+	TypeAnycast: reflect.TypeOf(AnycastObject{}),
+	TypeNode:    reflect.TypeOf(NodeObject{}),
+}
+
+// A problem found in a yaml file. Line and Column count from 1, and are 0
+// when they are not known
+type YamlError struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e YamlError) Error() string {
+	position := []string{}
+	if e.File != "" {
+		position = append(position, e.File)
+	}
+	if e.Line > 0 {
+		position = append(position, strconv.Itoa(e.Line))
+		if e.Column > 0 {
+			position = append(position, strconv.Itoa(e.Column))
+		}
+	}
+	if len(position) == 0 {
+		return e.Message
+	}
+
+	return strings.Join(position, ":") + ": " + e.Message
+}
+
+// All problems found in a file, a line each
+type YamlErrors []YamlError
+
+func (e YamlErrors) Error() string {
+	lines := []string{}
+	for _, problem := range e {
+		lines = append(lines, problem.Error())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Reads the single object in a file, and the warnings about deprecated
+// keys in it
+func LoadFromYaml(fname string) (interface{}, []YamlError, error) {
+	objects, warnings, err := LoadAllFromYaml(fname)
+	if err != nil {
+		return nil, warnings, errors.New("LoadFromYaml: " + err.Error())
+	}
+
+	if len(objects) != 1 {
+		return nil, warnings, errors.New("LoadFromYaml: " + fname + ": expected a single object, found " + strconv.Itoa(len(objects)))
+	}
+
+	return objects[0], warnings, nil
+}
+
+// Reads every object of a file with --- separated documents, see
+// DecodeFromYaml
+func LoadAllFromYaml(fname string) ([]interface{}, []YamlError, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, nil, errors.New("LoadAllFromYaml: " + err.Error())
+	}
+
+	objects, warnings, err := DecodeFromYaml(data)
+	for i := range warnings {
+		warnings[i].File = fname
+	}
+	if problems, ok := err.(YamlErrors); ok {
+		for i := range problems {
+			problems[i].File = fname
+		}
+	}
+
+	return objects, warnings, err
+}
+
+// Decodes and validates every object in data, which can hold several ---
+// separated documents. Documents without content are skipped. Unknown
+// keys are refused, deprecated keys give a warning. The error is a
+// YamlErrors with every problem in the first document which has any
+func DecodeFromYaml(data []byte) ([]interface{}, []YamlError, error) {
+	objects := []interface{}{}
+	warnings := []YamlError{}
+
+	for _, document := range splitDocuments(data) {
+		d := &objectDecoder{line: document.line, strict: true}
+		object := d.decode(document.data)
+		warnings = append(warnings, d.warnings...)
+		if len(d.errors) > 0 {
+			return nil, warnings, d.errors
+		}
+		if object != nil {
+			objects = append(objects, object)
+		}
+	}
+
+	return objects, warnings, nil
+}
+
+// Decodes a single object of objType without validating it, the way the
+// objects in the store are read: deprecated keys are renamed, and unknown
+// keys are skipped, so objects written by a newer version can be read
+func UnmarshalObject(objType string, data []byte) (interface{}, error) {
+	d := &objectDecoder{objType: objType, line: 1}
+	object := d.decode(data)
+	if len(d.errors) > 0 {
+		return nil, d.errors
+	}
+	if object == nil {
+		return nil, errors.New("UnmarshalObject: empty document")
+	}
+
+	return object, nil
+}
+
+type yamlDocument struct {
+	data []byte
+	line int
+}
+
+// Splits data on the lines starting with ---. The line of a document is
+// the line of the file it starts on, counting from 1
+func splitDocuments(data []byte) []yamlDocument {
+	documents := []yamlDocument{}
+	lines := strings.SplitAfter(string(data), "\n")
+
+	current := yamlDocument{line: 1}
+	for i, line := range lines {
+		if strings.HasPrefix(line, "---") && strings.TrimSpace(line[3:]) == "" {
+			documents = append(documents, current)
+			current = yamlDocument{line: i + 2}
+			continue
+		}
+		current.data = append(current.data, line...)
+	}
+
+	return append(documents, current)
+}
+
+// Decodes a single document. The positions of the nodes count from the
+// start of the document, line is where it starts in the file. objType is
+// taken from the document if it is not set
+type objectDecoder struct {
+	objType  string
+	line     int
+	strict   bool
+	errors   YamlErrors
+	warnings []YamlError
+}
+
+var (
+	yamlLine      = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+	typeErrorLine = regexp.MustCompile(`^line \d+: (.*)$`)
+)
+
+func (d *objectDecoder) problem(node *yaml.Node, message string) YamlError {
+	return YamlError{Line: d.line + node.Line - 1, Column: node.Column, Message: message}
+}
+
+func (d *objectDecoder) decode(data []byte) interface{} {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		problem := YamlError{Line: d.line, Message: err.Error()}
+		if match := yamlLine.FindStringSubmatch(err.Error()); match != nil {
+			line, _ := strconv.Atoi(match[1])
+			problem = YamlError{Line: d.line + line - 1, Message: match[2]}
+		}
+		d.errors = append(d.errors, problem)
+		return nil
+	}
+	if len(root.Content) == 0 {
+		return nil
+	}
+	node := root.Content[0]
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return nil
+	}
+
+	var te objectTypeExtractor
+	if err := node.Decode(&te); err != nil {
+		d.errors = append(d.errors, d.problem(node, "not an object: "+typeError(err)))
+		return nil
+	}
+
+	if d.objType == "" {
+		if te.ApiVersion != 1 {
+			d.errors = append(d.errors, d.problem(node, "unknown apiVersion: "+strconv.Itoa(te.ApiVersion)))
+			return nil
+		}
+		d.objType = te.Type
+	}
+
+	objType, ok := objectTypes[d.objType]
+	if !ok {
+		d.errors = append(d.errors, d.problem(node, "unknown type: "+d.objType))
+		return nil
+	}
+
+	d.walk(node, objType, "")
+	if len(d.errors) > 0 {
+		return nil
+	}
+
+	value := reflect.New(objType)
+	if err := node.Decode(value.Interface()); err != nil {
+		d.errors = append(d.errors, d.problem(node, typeError(err)))
+		return nil
+	}
+	object := value.Elem().Interface()
+
+	if !d.strict {
+		return object
+	}
+
+	var err error
+	switch object := object.(type) {
+	case BgpPeerObject:
+		err = ValidateBgpPeerYaml(object)
+	case AnycastObject:
+		err = ValidateAnycastYaml(object)
+	case NodeObject:
+		err = ValidateNodeYaml(object)
+	}
+	if err != nil {
+		d.errors = append(d.errors, d.problem(node, err.Error()))
+		return nil
+	}
+
+	return object
+}
+
+// Checks the keys of node against the yaml tags of t, renaming the
+// deprecated ones in place. Values which do not fit their field are
+// reported here, so their position is known
+func (d *objectDecoder) walk(node *yaml.Node, t reflect.Type, path string) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			keyPath := joinPath(path, key.Value)
+
+			if name, ok := deprecatedKeys[d.objType][keyPath]; ok {
+				newPath := joinPath(path, name)
+				if hasKey(node, name) {
+					d.errors = append(d.errors, d.problem(key, "both "+keyPath+" and "+newPath+" are set"))
+					continue
+				}
+				d.warnings = append(d.warnings, d.problem(key, keyPath+" is deprecated, use "+newPath))
+				key.Value = name
+				keyPath = newPath
+			}
+
+			field, ok := fields[key.Value]
+			if !ok {
+				if d.strict {
+					message := "unknown field " + keyPath
+					for name := range fields {
+						if strings.EqualFold(name, key.Value) {
+							message += ", did you mean " + joinPath(path, name) + "?"
+						}
+					}
+					d.errors = append(d.errors, d.problem(key, message))
+				}
+				continue
+			}
+			d.walk(value, field, keyPath)
+		}
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for i, item := range node.Content {
+			d.walk(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			d.walk(node.Content[i+1], t.Elem(), joinPath(path, node.Content[i].Value))
+		}
+	default:
+		if !d.strict {
+			return
+		}
+		if err := node.Decode(reflect.New(t).Interface()); err != nil {
+			d.errors = append(d.errors, d.problem(node, path+": "+typeError(err)))
+		}
+	}
+}
+
+// Returns the types of the fields of a struct by their yaml name
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+
+	return fields
+}
+
+func hasKey(node *yaml.Node, name string) bool {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// Leaves out the line of the error, which is reported as the position of
+// the node instead
+func typeError(err error) string {
+	if typeErr, ok := err.(*yaml.TypeError); ok && len(typeErr.Errors) > 0 {
+		message := typeErr.Errors[0]
+		if match := typeErrorLine.FindStringSubmatch(message); match != nil {
+			return match[1]
+		}
+		return message
+	}
+
+	return err.Error()
+}
@@ -2,11 +2,14 @@ package structs
 
 import (
 	"errors"
-	"io/ioutil"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
-	"gopkg.in/yaml.v2"
+	"github.com/r3boot/anycast-agent/lib/bgp/bfd"
+	"github.com/r3boot/anycast-agent/lib/bgp/bgp2go"
 )
 
 func ValidateBgpPeerYaml(bgpPeer BgpPeerObject) error {
@@ -18,11 +21,56 @@ func ValidateBgpPeerYaml(bgpPeer BgpPeerObject) error {
 		return err
 	}
 
+	if err = ValidateName(bgpPeer.Meta.Name); err != nil {
+		err = errors.New("ValidateBgpPeerYaml: bgpPeer.Meta.Name: " + err.Error())
+		return err
+	}
+
+	if err = ValidateLabels(bgpPeer.Meta.Labels); err != nil {
+		err = errors.New("ValidateBgpPeerYaml: bgpPeer.Meta.Labels: " + err.Error())
+		return err
+	}
+
 	if bgpPeer.Spec.AsNumber == 0 {
 		err = errors.New("ValidateBgpPeerYaml: bgpPeer.Spec.AsNumber not set")
 		return err
 	}
 
+	if err = ValidateAsNumber(bgpPeer.Spec.AsNumber); err != nil {
+		err = errors.New("ValidateBgpPeerYaml: bgpPeer.Spec.AsNumber: " + err.Error())
+		return err
+	}
+
+	if bgpPeer.Spec.LocalAsNumber != 0 {
+		if err = ValidateAsNumber(bgpPeer.Spec.LocalAsNumber); err != nil {
+			err = errors.New("ValidateBgpPeerYaml: bgpPeer.Spec.LocalAsNumber: " + err.Error())
+			return err
+		}
+	}
+
+	if err = ValidateTimers(bgpPeer.Spec.HoldTime, bgpPeer.Spec.Keepalive); err != nil {
+		err = errors.New("ValidateBgpPeerYaml: bgpPeer.Spec: " + err.Error())
+		return err
+	}
+
+	for _, afi := range bgpPeer.Spec.AddressFamilies {
+		switch afi {
+		case AddressFamilyInet, AddressFamilyInet6, AddressFamilyFlow, AddressFamilyFlow6:
+		default:
+			err = errors.New("ValidateBgpPeerYaml: bgpPeer.Spec.AddressFamilies: Unknown address family: " + afi)
+			return err
+		}
+	}
+
+	for _, afi := range bgpPeer.Spec.AddPath {
+		switch afi {
+		case AddressFamilyInet, AddressFamilyInet6:
+		default:
+			err = errors.New("ValidateBgpPeerYaml: bgpPeer.Spec.AddPath: Unsupported address family: " + afi)
+			return err
+		}
+	}
+
 	if bgpPeer.Spec.IP == "" && bgpPeer.Spec.IP6 == "" {
 		err = errors.New("ValidateBgpPeerYaml: neither bgpPeer.Spec.IP or bgpPeer.Spec.IP6 set")
 		return err
@@ -42,61 +90,603 @@ func ValidateBgpPeerYaml(bgpPeer BgpPeerObject) error {
 		}
 	}
 
+	if bgpPeer.Spec.NextHop != "" {
+		if ip := net.ParseIP(bgpPeer.Spec.NextHop); ip == nil || ip.To4() == nil {
+			err = errors.New("ValidateBgpPeerYaml: bgpPeer.Spec.NextHop: Not an ipv4 address: " + bgpPeer.Spec.NextHop)
+			return err
+		}
+	}
+
+	if bgpPeer.Spec.NextHop6 != "" {
+		if ip := net.ParseIP(bgpPeer.Spec.NextHop6); ip == nil || ip.To4() != nil {
+			err = errors.New("ValidateBgpPeerYaml: bgpPeer.Spec.NextHop6: Not an ipv6 address: " + bgpPeer.Spec.NextHop6)
+			return err
+		}
+	}
+
+	if err = ValidateMaxPrefix(bgpPeer.Spec.MaxPrefix); err != nil {
+		err = errors.New("ValidateBgpPeerYaml: bgpPeer.Spec.MaxPrefix: " + err.Error())
+		return err
+	}
+
+	if err = ValidateBfd(bgpPeer.Spec.Bfd); err != nil {
+		err = errors.New("ValidateBgpPeerYaml: bgpPeer.Spec.Bfd: " + err.Error())
+		return err
+	}
+
+	if policy := BuildPolicy(bgpPeer.Spec.Policy.Import); policy != nil {
+		if err = policy.Validate(); err != nil {
+			err = errors.New("ValidateBgpPeerYaml: bgpPeer.Spec.Policy.Import: " + strings.TrimSpace(err.Error()))
+			return err
+		}
+	}
+
+	if policy := BuildPolicy(bgpPeer.Spec.Policy.Export); policy != nil {
+		if err = policy.Validate(); err != nil {
+			err = errors.New("ValidateBgpPeerYaml: bgpPeer.Spec.Policy.Export: " + strings.TrimSpace(err.Error()))
+			return err
+		}
+	}
+
 	return nil
 }
 
-func LoadFromYaml(fname string) (interface{}, error) {
+// Names are used as a part of the consul path, and lists of names are
+// stored comma separated
+func ValidateName(name string) error {
+	if name == "" {
+		return errors.New("empty name")
+	}
+
+	if strings.ContainsAny(name, "/,= \t\n") {
+		return errors.New("invalid character in name: " + name)
+	}
+
+	return nil
+}
+
+func ValidateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if err := ValidateName(key); err != nil {
+			return errors.New("key: " + err.Error())
+		}
+
+		if err := ValidateName(value); err != nil {
+			return errors.New(key + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+func validateNames(names []string) error {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if err := ValidateName(name); err != nil {
+			return err
+		}
+
+		if seen[name] {
+			return errors.New("duplicate name: " + name)
+		}
+		seen[name] = true
+	}
+
+	return nil
+}
+
+func ValidateAnycastYaml(anycast AnycastObject) error {
 	var (
-		te   objectTypeExtractor
-		data []byte
-		err  error
+		err error
 	)
 
-	if data, err = ioutil.ReadFile(fname); err != nil {
-		err = errors.New("LoadFromYaml: " + err.Error())
-		return nil, err
+	if anycast.Meta.Name == "" {
+		err = errors.New("ValidateAnycastYaml: anycast.Meta.Name not set")
+		return err
 	}
 
-	if err = yaml.Unmarshal(data, &te); err != nil {
-		err = errors.New("LoadFromYaml: yaml.Unmarshal() failed: " + err.Error())
-		return nil, err
+	if err = ValidateName(anycast.Meta.Name); err != nil {
+		err = errors.New("ValidateAnycastYaml: anycast.Meta.Name: " + err.Error())
+		return err
 	}
 
-	if te.ApiVersion != 1 {
-		err = errors.New("LoadFromYaml: unknown apiVersion: " + strconv.Itoa(te.ApiVersion))
-		return nil, err
+	if err = ValidateLabels(anycast.Meta.Labels); err != nil {
+		err = errors.New("ValidateAnycastYaml: anycast.Meta.Labels: " + err.Error())
+		return err
 	}
 
-	switch te.Type {
-	case TypeBgpPeer:
-		{
-			var bgpPeer BgpPeerObject
+	if anycast.Spec.AsNumber == 0 {
+		err = errors.New("ValidateAnycastYaml: anycast.Spec.AsNumber not set")
+		return err
+	}
 
-			if err = yaml.Unmarshal(data, &bgpPeer); err != nil {
-				err = errors.New("LoadFromYaml: Failed to unmarshal to bgpPeer: " + err.Error())
-				return nil, err
-			}
+	if err = ValidateAsNumber(anycast.Spec.AsNumber); err != nil {
+		err = errors.New("ValidateAnycastYaml: anycast.Spec.AsNumber: " + err.Error())
+		return err
+	}
+
+	if anycast.Spec.IP == "" && anycast.Spec.IP6 == "" {
+		err = errors.New("ValidateAnycastYaml: neither anycast.Spec.IP or anycast.Spec.IP6 set")
+		return err
+	}
+
+	if anycast.Spec.IP != "" {
+		if err = validateServiceAddress(anycast.Spec.IP, false); err != nil {
+			err = errors.New("ValidateAnycastYaml: anycast.Spec.IP: " + err.Error())
+			return err
+		}
+	}
+
+	if anycast.Spec.IP6 != "" {
+		if err = validateServiceAddress(anycast.Spec.IP6, true); err != nil {
+			err = errors.New("ValidateAnycastYaml: anycast.Spec.IP6: " + err.Error())
+			return err
+		}
+	}
+
+	if strings.TrimSpace(anycast.Spec.HealthCheck) == "" {
+		err = errors.New("ValidateAnycastYaml: anycast.Spec.HealthCheck not set")
+		return err
+	}
+
+	if err = ValidateAnycastPeers(anycast); err != nil {
+		err = errors.New("ValidateAnycastYaml: " + err.Error())
+		return err
+	}
+
+	if err = ValidatePlacement(anycast.Spec.Placement); err != nil {
+		err = errors.New("ValidateAnycastYaml: anycast.Spec.Placement: " + err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// A service address is announced as a host route, so it has to be a
+// single unicast address of the right family
+func validateServiceAddress(address string, ipv6 bool) error {
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return errors.New("Not an ip address: " + address)
+	case ipv6 && ip.To4() != nil:
+		return errors.New("Not an ipv6 address: " + address)
+	case !ipv6 && ip.To4() == nil:
+		return errors.New("Not an ipv4 address: " + address)
+	case ip.IsUnspecified() || ip.IsMulticast():
+		return errors.New("Not a unicast address: " + address)
+	}
+
+	return nil
+}
+
+// Checks that the service does not use one of the addresses of the node
+// it runs on, such as its router id or next hops. Empty addresses are
+// skipped
+func ValidateAnycastAddresses(anycast AnycastObject, addresses []string) error {
+	for _, address := range addresses {
+		nodeIP := net.ParseIP(address)
+		if nodeIP == nil {
+			continue
+		}
 
-			if err = ValidateBgpPeerYaml(bgpPeer); err != nil {
-				err = errors.New("LoadFromYaml: " + err.Error())
-				return nil, err
+		for _, serviceAddress := range []string{anycast.Spec.IP, anycast.Spec.IP6} {
+			if ip := net.ParseIP(serviceAddress); ip != nil && ip.Equal(nodeIP) {
+				return errors.New("ValidateAnycastAddresses: anycast " + anycast.Meta.Name + ": " +
+					serviceAddress + " is an address of the node")
 			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the problems with a valid service which do not stop it from
+// being used
+func AnycastWarnings(anycast AnycastObject) []string {
+	warnings := []string{}
 
-			return bgpPeer, nil
+	if warning := asNumberWarning(anycast.Spec.AsNumber); warning != "" {
+		warnings = append(warnings, "anycast "+anycast.Meta.Name+": asNumber "+
+			strconv.Itoa(anycast.Spec.AsNumber)+" "+warning)
+	}
+
+	return warnings
+}
+
+// Private ASNs (RFC 6996) are fine between the nodes and their routers,
+// but have to be stripped before the routes reach the internet. The
+// reserved ones (RFC 5398, RFC 7300) should not be used at all
+func asNumberWarning(asNumber int) string {
+	asn := int64(asNumber)
+	switch {
+	case asn >= 64496 && asn <= 64511, asn >= 65536 && asn <= 65551:
+		return "is reserved for documentation"
+	case asn == 65535 || asn == 4294967295:
+		return "is reserved"
+	case asn >= 64512 && asn <= 65534, asn >= 4200000000 && asn <= 4294967294:
+		return "is private, the routers have to remove it before announcing the service to the internet"
+	}
+
+	return ""
+}
+
+// Only checks the service itself; whether the peers exist is checked
+// against the peers in consul by SelectBgpPeers. Services placed on
+// nodes can get all their peers from the nodes
+func ValidateAnycastPeers(anycast AnycastObject) error {
+	if len(anycast.Spec.Peers) == 0 && len(anycast.Spec.PeerSelector) == 0 &&
+		!HasPlacement(anycast.Spec.Placement) {
+		return errors.New("neither anycast.Spec.Peers, anycast.Spec.PeerSelector or anycast.Spec.Placement set")
+	}
+
+	if err := validateNames(anycast.Spec.Peers); err != nil {
+		return errors.New("anycast.Spec.Peers: " + err.Error())
+	}
+
+	if err := ValidateLabels(anycast.Spec.PeerSelector); err != nil {
+		return errors.New("anycast.Spec.PeerSelector: " + err.Error())
+	}
+
+	return nil
+}
+
+func HasPlacement(placement PlacementObject) bool {
+	return len(placement.NodeSelector) > 0 || len(placement.Sites) > 0
+}
+
+func ValidatePlacement(placement PlacementObject) error {
+	if err := ValidateLabels(placement.NodeSelector); err != nil {
+		return errors.New("nodeSelector: " + err.Error())
+	}
+
+	if err := validateNames(placement.Sites); err != nil {
+		return errors.New("sites: " + err.Error())
+	}
+
+	if placement.MinNodes < 0 || placement.MaxNodes < 0 {
+		return errors.New("minNodes and maxNodes must not be negative")
+	}
+
+	if placement.MaxNodes > 0 && placement.MaxNodes < placement.MinNodes {
+		return errors.New("maxNodes must not be less than minNodes")
+	}
+
+	return nil
+}
+
+func ValidateNodeYaml(node NodeObject) error {
+	var (
+		err error
+	)
+
+	if err = ValidateName(node.Meta.Name); err != nil {
+		err = errors.New("ValidateNodeYaml: node.Meta.Name: " + err.Error())
+		return err
+	}
+
+	if err = ValidateLabels(node.Meta.Labels); err != nil {
+		err = errors.New("ValidateNodeYaml: node.Meta.Labels: " + err.Error())
+		return err
+	}
+
+	if node.Spec.Hostname != "" {
+		if err = ValidateName(node.Spec.Hostname); err != nil {
+			err = errors.New("ValidateNodeYaml: node.Spec.Hostname: " + err.Error())
+			return err
 		}
-	case TypeAnycast:
-		{
-			var anycast AnycastObject
+	}
+
+	if node.Spec.Site != "" {
+		if err = ValidateName(node.Spec.Site); err != nil {
+			err = errors.New("ValidateNodeYaml: node.Spec.Site: " + err.Error())
+			return err
+		}
+	}
+
+	if node.Spec.RouterId != "" {
+		if ip := net.ParseIP(node.Spec.RouterId); ip == nil || ip.To4() == nil {
+			err = errors.New("ValidateNodeYaml: node.Spec.RouterId: Not an ipv4 address: " + node.Spec.RouterId)
+			return err
+		}
+	}
+
+	if node.Spec.NextHop != "" {
+		if ip := net.ParseIP(node.Spec.NextHop); ip == nil || ip.To4() == nil {
+			err = errors.New("ValidateNodeYaml: node.Spec.NextHop: Not an ipv4 address: " + node.Spec.NextHop)
+			return err
+		}
+	}
+
+	if node.Spec.NextHop6 != "" {
+		if ip := net.ParseIP(node.Spec.NextHop6); ip == nil || ip.To4() != nil {
+			err = errors.New("ValidateNodeYaml: node.Spec.NextHop6: Not an ipv6 address: " + node.Spec.NextHop6)
+			return err
+		}
+	}
+
+	if err = validateNames(node.Spec.Peers); err != nil {
+		err = errors.New("ValidateNodeYaml: node.Spec.Peers: " + err.Error())
+		return err
+	}
 
-			if err = yaml.Unmarshal(data, &anycast); err != nil {
-				err = errors.New("LoadFromYaml: Failed to unmarshal to anycast: " + err.Error())
-				return nil, err
+	if err = ValidateLabels(node.Spec.PeerSelector); err != nil {
+		err = errors.New("ValidateNodeYaml: node.Spec.PeerSelector: " + err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func NodeHostname(node NodeObject) string {
+	if node.Spec.Hostname != "" {
+		return node.Spec.Hostname
+	}
+	return node.Meta.Name
+}
+
+// Returns the labels of the node, including its site and hostname
+func NodeLabels(node NodeObject) map[string]string {
+	labels := make(map[string]string)
+	for key, value := range node.Meta.Labels {
+		labels[key] = value
+	}
+	if node.Spec.Site != "" {
+		labels["site"] = node.Spec.Site
+	}
+	labels["hostname"] = NodeHostname(node)
+
+	return labels
+}
+
+func MatchPlacement(placement PlacementObject, node NodeObject) bool {
+	if !HasPlacement(placement) {
+		return false
+	}
+
+	if len(placement.Sites) > 0 {
+		found := false
+		for _, site := range placement.Sites {
+			if site == node.Spec.Site {
+				found = true
 			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(placement.NodeSelector) > 0 {
+		return MatchLabels(placement.NodeSelector, NodeLabels(node))
+	}
+
+	return true
+}
+
+// Returns the names of the nodes which run the service, sorted. If there
+// are less than MinNodes the selected nodes are returned with an error,
+// and the service must not be run on any of them
+func PlaceService(anycast AnycastObject, nodes []NodeObject) ([]string, error) {
+	placed := []string{}
+	for _, node := range nodes {
+		if MatchPlacement(anycast.Spec.Placement, node) {
+			placed = append(placed, node.Meta.Name)
+		}
+	}
+	sort.Strings(placed)
+
+	placement := anycast.Spec.Placement
+	if placement.MaxNodes > 0 && len(placed) > placement.MaxNodes {
+		placed = placed[:placement.MaxNodes]
+	}
+
+	if len(placed) < placement.MinNodes {
+		return placed, errors.New("PlaceService: " + anycast.Meta.Name + ": " +
+			strconv.Itoa(len(placed)) + " nodes selected, minNodes is " +
+			strconv.Itoa(placement.MinNodes))
+	}
+
+	return placed, nil
+}
+
+// Returns true if the peer has all the labels of the selector. An empty
+// selector matches no peers
+func MatchLabels(selector, labels map[string]string) bool {
+	if len(selector) == 0 {
+		return false
+	}
+
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Peers listed by name must exist; a selector which matches no peer is
+// not an error, since a site could have no routers configured yet
+func selectBgpPeers(names []string, selector map[string]string, peers []BgpPeerObject) ([]BgpPeerObject, error) {
+	byName := make(map[string]BgpPeerObject)
+	for _, peer := range peers {
+		byName[peer.Meta.Name] = peer
+	}
+
+	selected := []BgpPeerObject{}
+	added := make(map[string]bool)
+	missing := []string{}
+	for _, name := range names {
+		peer, ok := byName[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		if !added[name] {
+			selected = append(selected, peer)
+			added[name] = true
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, errors.New("unknown bgpPeers: " + strings.Join(missing, ", "))
+	}
+
+	for _, peer := range peers {
+		if !added[peer.Meta.Name] && MatchLabels(selector, peer.Meta.Labels) {
+			selected = append(selected, peer)
+			added[peer.Meta.Name] = true
+		}
+	}
+
+	return selected, nil
+}
+
+// Returns the peers the service must be announced to
+func SelectBgpPeers(anycast AnycastObject, peers []BgpPeerObject) ([]BgpPeerObject, error) {
+	selected, err := selectBgpPeers(anycast.Spec.Peers, anycast.Spec.PeerSelector, peers)
+	if err != nil {
+		return nil, errors.New("SelectBgpPeers: " + anycast.Meta.Name + ": " + err.Error())
+	}
+	return selected, nil
+}
+
+// Returns the peers all the services on the node are announced to
+func SelectNodeBgpPeers(node NodeObject, peers []BgpPeerObject) ([]BgpPeerObject, error) {
+	selected, err := selectBgpPeers(node.Spec.Peers, node.Spec.PeerSelector, peers)
+	if err != nil {
+		return nil, errors.New("SelectNodeBgpPeers: " + node.Meta.Name + ": " + err.Error())
+	}
+	return selected, nil
+}
+
+// AS_TRANS (RFC 6793) is only used in the OPEN of 4-octet AS speakers
+func ValidateAsNumber(asNumber int) error {
+	if asNumber < 1 || int64(asNumber) > 4294967295 {
+		return errors.New("must be between 1 and 4294967295")
+	}
+
+	if asNumber == bgp2go.AS_TRANS {
+		return errors.New("AS_TRANS (23456) can not be used")
+	}
+
+	return nil
+}
+
+// A hold time of zero uses the default one. Keepalives are sent every
+// third of the hold time, unless a shorter interval is configured
+func ValidateTimers(holdTime, keepalive int) error {
+	if holdTime < 0 || (holdTime > 0 && holdTime < bgp2go.MIN_HOLD_TIME) || holdTime > 65535 {
+		return errors.New("holdTime must be between " + strconv.Itoa(bgp2go.MIN_HOLD_TIME) + " and 65535")
+	}
+
+	if keepalive < 0 {
+		return errors.New("keepalive must not be negative")
+	}
+
+	if holdTime == 0 {
+		holdTime = bgp2go.DEFAULT_HOLD_TIME
+	}
+	if keepalive >= holdTime {
+		return errors.New("keepalive must be less than holdTime")
+	}
+
+	return nil
+}
+
+func ValidateMaxPrefix(maxPrefix MaxPrefixObject) error {
+	if maxPrefix.Limit < 0 {
+		return errors.New("limit must not be negative")
+	}
+
+	if maxPrefix.WarningThreshold < 0 || maxPrefix.WarningThreshold > 100 {
+		return errors.New("warningThreshold must be a percentage between 0 and 100")
+	}
 
-			return anycast, nil
+	switch maxPrefix.Action {
+	case "", MaxPrefixActionLog, MaxPrefixActionTeardown:
+	case MaxPrefixActionRestart:
+		if maxPrefix.RestartInterval <= 0 {
+			return errors.New("restartInterval must be set when action is " + MaxPrefixActionRestart)
 		}
+	default:
+		return errors.New("unknown action: " + maxPrefix.Action)
+	}
+
+	return nil
+}
+
+func ValidateBfd(bfd BfdObject) error {
+	if bfd.MinTx < 0 {
+		return errors.New("minTx must not be negative")
+	}
+
+	if bfd.MinRx < 0 {
+		return errors.New("minRx must not be negative")
+	}
+
+	if bfd.Multiplier < 0 || bfd.Multiplier > 255 {
+		return errors.New("multiplier must not be negative or larger than 255")
+	}
+
+	return nil
+}
+
+// Converts the BFD settings of a peer into the form used by the bfd
+// service, filling in the defaults
+func BuildBfdConfig(bfdObject BfdObject) bfd.Config {
+	cfg := bfd.Config{
+		DesiredMinTx:  time.Duration(BfdDefaultMinTx) * time.Millisecond,
+		RequiredMinRx: time.Duration(BfdDefaultMinRx) * time.Millisecond,
+		DetectMult:    uint8(BfdDefaultMultiplier),
+		Multihop:      bfdObject.Multihop,
+	}
+
+	if bfdObject.MinTx > 0 {
+		cfg.DesiredMinTx = time.Duration(bfdObject.MinTx) * time.Millisecond
+	}
+
+	if bfdObject.MinRx > 0 {
+		cfg.RequiredMinRx = time.Duration(bfdObject.MinRx) * time.Millisecond
+	}
+
+	if bfdObject.Multiplier > 0 {
+		cfg.DetectMult = uint8(bfdObject.Multiplier)
+	}
+
+	return cfg
+}
+
+// Converts policy terms into the form used by the bgp service. Returns nil
+// if there are no terms.
+func BuildPolicy(terms []PolicyTermObject) *bgp2go.Policy {
+	if len(terms) == 0 {
+		return nil
+	}
+
+	policy := &bgp2go.Policy{}
+	for _, term := range terms {
+		policy.Terms = append(policy.Terms, bgp2go.PolicyTerm{
+			Name: term.Name,
+			Match: bgp2go.PolicyMatch{
+				Prefixes:    term.Match.Prefixes,
+				MinLength:   term.Match.MinLength,
+				MaxLength:   term.Match.MaxLength,
+				AFI:         term.Match.AFI,
+				Services:    term.Match.Services,
+				Communities: term.Match.Communities,
+			},
+			Set: bgp2go.PolicySet{
+				Communities:    term.Set.Communities,
+				AddCommunities: term.Set.AddCommunities,
+				Prepend:        term.Set.Prepend,
+				MED:            term.Set.MED,
+				LocalPref:      term.Set.LocalPref,
+				NextHop:        term.Set.NextHop,
+			},
+			Action: term.Action,
+		})
 	}
 
-	err = errors.New("LoadFromYaml: Unknown error")
-	return nil, err
+	return policy
 }
@@ -0,0 +1,303 @@
+package structs
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testPeerYaml = `apiVersion: 1
+type: bgpPeer
+meta:
+  name: laptop
+spec:
+  asNumber: 65342
+  ip: 10.0.4.1
+`
+
+const testServiceYaml = `apiVersion: 1
+type: anycast
+meta:
+  name: dns
+  labels:
+    repo: config
+spec:
+  asNumber: 65342
+  ip: 192.0.2.53
+  healthCheck: dig @127.0.0.1 example.com
+  bgpPeers:
+    - laptop
+`
+
+func TestDecodeFromYaml(t *testing.T) {
+	data := "---\n" + testPeerYaml + "---\n# nothing here\n---\n" + testServiceYaml
+	objects, warnings, err := DecodeFromYaml([]byte(data))
+	if err != nil {
+		t.Fatalf("DecodeFromYaml: %v", err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("DecodeFromYaml: unexpected warnings: %v", warnings)
+	}
+	if len(objects) != 2 {
+		t.Fatalf("DecodeFromYaml: got %d objects, want 2", len(objects))
+	}
+
+	if peer, ok := objects[0].(BgpPeerObject); !ok || peer.Meta.Name != "laptop" {
+		t.Errorf("DecodeFromYaml: got %#v, want bgpPeer laptop", objects[0])
+	}
+	service, ok := objects[1].(AnycastObject)
+	if !ok || service.Meta.Name != "dns" || service.Meta.Labels["repo"] != "config" {
+		t.Errorf("DecodeFromYaml: got %#v, want anycast dns", objects[1])
+	}
+
+	// Errors name the line the document starts on
+	data = testPeerYaml + "---\n" + strings.Replace(testServiceYaml, "apiVersion: 1", "apiVersion: 2", 1)
+	_, _, err = DecodeFromYaml([]byte(data))
+	if err == nil || !strings.HasPrefix(err.Error(), "9:1: unknown apiVersion") {
+		t.Errorf("DecodeFromYaml: got %v, want an error for line 9", err)
+	}
+
+	if objects, _, err = DecodeFromYaml([]byte("\n---\n")); err != nil || len(objects) != 0 {
+		t.Errorf("DecodeFromYaml: got %v, %v for an empty file", objects, err)
+	}
+}
+
+func TestStrictYaml(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		warnings []string
+		errors   []string
+	}{
+		{
+			name: "valid",
+			yaml: testServiceYaml,
+		},
+		{
+			name:   "unknown field",
+			yaml:   strings.Replace(testServiceYaml, "healthCheck:", "healthcheck:", 1),
+			errors: []string{"10:3: unknown field spec.healthcheck, did you mean spec.healthCheck?"},
+		},
+		{
+			name: "every unknown field",
+			yaml: strings.Replace(testServiceYaml, "  labels:", "  label:", 1) + "  typo: true\n",
+			errors: []string{
+				"5:3: unknown field meta.label",
+				"13:3: unknown field spec.typo",
+			},
+		},
+		{
+			name:   "unknown nested field",
+			yaml:   testServiceYaml + "  placement:\n    sites: [ams]\n    minNode: 1\n",
+			errors: []string{"15:5: unknown field spec.placement.minNode"},
+		},
+		{
+			name:   "wrong type",
+			yaml:   strings.Replace(testServiceYaml, "asNumber: 65342", "asNumber: many", 1),
+			errors: []string{"8:13: spec.asNumber: cannot unmarshal !!str `many` into int"},
+		},
+		{
+			name:   "syntax error",
+			yaml:   testServiceYaml + "  ip6: [\n",
+			errors: []string{"13: did not find expected node content"},
+		},
+		{
+			name:     "deprecated asnum",
+			yaml:     strings.Replace(testServiceYaml, "asNumber:", "asnum:", 1),
+			warnings: []string{"8:3: spec.asnum is deprecated, use spec.asNumber"},
+		},
+		{
+			name:     "deprecated IP",
+			yaml:     strings.Replace(testPeerYaml, "ip:", "IP:", 1),
+			warnings: []string{"7:3: spec.IP is deprecated, use spec.ip"},
+		},
+		{
+			name:   "deprecated and new key",
+			yaml:   strings.Replace(testServiceYaml, "asNumber: 65342", "asNumber: 65342\n  asnum: 65342", 1),
+			errors: []string{"9:3: both spec.asnum and spec.asNumber are set"},
+		},
+		{
+			name:   "invalid object",
+			yaml:   strings.Replace(testServiceYaml, "asNumber: 65342", "asNumber: 0", 1),
+			errors: []string{"1:1: ValidateAnycastYaml: anycast.Spec.AsNumber not set"},
+		},
+	}
+
+	for _, test := range tests {
+		objects, warnings, err := DecodeFromYaml([]byte(test.yaml))
+
+		messages := []string{}
+		for _, warning := range warnings {
+			messages = append(messages, warning.Error())
+		}
+		if strings.Join(messages, "\n") != strings.Join(test.warnings, "\n") {
+			t.Errorf("%s: got warnings %q, want %q", test.name, messages, test.warnings)
+		}
+
+		if len(test.errors) == 0 {
+			if err != nil || len(objects) != 1 {
+				t.Errorf("%s: got %v, %v", test.name, objects, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != strings.Join(test.errors, "\n") {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.errors)
+		}
+	}
+
+	// A deprecated key is read into the field it was renamed to
+	objects, _, err := DecodeFromYaml([]byte(strings.Replace(testServiceYaml, "asNumber:", "asnum:", 1)))
+	if err != nil || objects[0].(AnycastObject).Spec.AsNumber != 65342 {
+		t.Errorf("DecodeFromYaml: got %v, %v for asnum", objects, err)
+	}
+
+	// Objects from the store are read without the unknown fields
+	object, err := UnmarshalObject(TypeBgpPeer, []byte(`{"type": "bgpPeer", "generation": 2, "spec": {"IP": "10.0.4.1"}}`))
+	if err != nil || object.(BgpPeerObject).Spec.IP != "10.0.4.1" {
+		t.Errorf("UnmarshalObject: got %v, %v", object, err)
+	}
+}
+
+func TestLoadAllFromYaml(t *testing.T) {
+	file, err := ioutil.TempFile("", "objects*.yaml")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(file.Name())
+	data := testPeerYaml + "---\n" + strings.Replace(testServiceYaml, "asNumber:", "asnum:", 1) + "  typo: 1\n"
+	if _, err = file.WriteString(data); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	file.Close()
+
+	_, warnings, err := LoadAllFromYaml(file.Name())
+	expected := file.Name() + ":21:3: unknown field spec.typo"
+	if err == nil || err.Error() != expected {
+		t.Errorf("LoadAllFromYaml: got %v, want %s", err, expected)
+	}
+	expected = file.Name() + ":16:3: spec.asnum is deprecated, use spec.asNumber"
+	if len(warnings) != 1 || warnings[0].Error() != expected {
+		t.Errorf("LoadAllFromYaml: got warnings %v, want %s", warnings, expected)
+	}
+}
+
+func testAnycast() AnycastObject {
+	return AnycastObject{
+		ApiVersion: 1,
+		Type:       TypeAnycast,
+		Meta:       AnycastMetaObject{Name: "dns"},
+		Spec: AnycastSpecObject{
+			AsNumber:    65001,
+			IP:          "192.0.2.53",
+			IP6:         "2001:db8:53::53",
+			HealthCheck: "dig @127.0.0.1 example.com",
+			Peers:       []string{"laptop"},
+		},
+	}
+}
+
+func TestValidateAnycastYaml(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(anycast *AnycastObject)
+		err    string
+	}{
+		{"valid", func(anycast *AnycastObject) {}, ""},
+		{"ipv4 only", func(anycast *AnycastObject) { anycast.Spec.IP6 = "" }, ""},
+		{"ipv6 only", func(anycast *AnycastObject) { anycast.Spec.IP = "" }, ""},
+		{"placement only", func(anycast *AnycastObject) {
+			anycast.Spec.Peers = nil
+			anycast.Spec.Placement.Sites = []string{"ams"}
+		}, ""},
+		{"no name", func(anycast *AnycastObject) { anycast.Meta.Name = "" }, "anycast.Meta.Name not set"},
+		{"bad name", func(anycast *AnycastObject) { anycast.Meta.Name = "d/ns" }, "anycast.Meta.Name: invalid character"},
+		{"bad label", func(anycast *AnycastObject) { anycast.Meta.Labels = map[string]string{"repo": ""} }, "anycast.Meta.Labels"},
+		{"no asnum", func(anycast *AnycastObject) { anycast.Spec.AsNumber = 0 }, "anycast.Spec.AsNumber not set"},
+		{"negative asnum", func(anycast *AnycastObject) { anycast.Spec.AsNumber = -1 }, "must be between 1 and 4294967295"},
+		{"asnum too large", func(anycast *AnycastObject) { anycast.Spec.AsNumber = 4294967296 }, "must be between 1 and 4294967295"},
+		{"AS_TRANS", func(anycast *AnycastObject) { anycast.Spec.AsNumber = 23456 }, "AS_TRANS"},
+		{"no addresses", func(anycast *AnycastObject) {
+			anycast.Spec.IP = ""
+			anycast.Spec.IP6 = ""
+		}, "neither anycast.Spec.IP or anycast.Spec.IP6 set"},
+		{"ip not an address", func(anycast *AnycastObject) { anycast.Spec.IP = "dns.example.com" }, "anycast.Spec.IP: Not an ip address"},
+		{"ipv6 in ip", func(anycast *AnycastObject) { anycast.Spec.IP = "2001:db8::53" }, "anycast.Spec.IP: Not an ipv4 address"},
+		{"ipv4 in ip6", func(anycast *AnycastObject) { anycast.Spec.IP6 = "192.0.2.53" }, "anycast.Spec.IP6: Not an ipv6 address"},
+		{"prefix in ip", func(anycast *AnycastObject) { anycast.Spec.IP = "192.0.2.0/24" }, "anycast.Spec.IP: Not an ip address"},
+		{"unspecified ip", func(anycast *AnycastObject) { anycast.Spec.IP = "0.0.0.0" }, "Not a unicast address"},
+		{"multicast ip6", func(anycast *AnycastObject) { anycast.Spec.IP6 = "ff02::1" }, "Not a unicast address"},
+		{"no healthcheck", func(anycast *AnycastObject) { anycast.Spec.HealthCheck = " " }, "anycast.Spec.HealthCheck not set"},
+		{"no peers", func(anycast *AnycastObject) { anycast.Spec.Peers = nil }, "neither anycast.Spec.Peers"},
+		{"duplicate peer", func(anycast *AnycastObject) { anycast.Spec.Peers = []string{"laptop", "laptop"} }, "duplicate name"},
+		{"bad placement", func(anycast *AnycastObject) {
+			anycast.Spec.Placement = PlacementObject{Sites: []string{"ams"}, MinNodes: 3, MaxNodes: 2}
+		}, "anycast.Spec.Placement: maxNodes must not be less than minNodes"},
+	}
+
+	for _, test := range tests {
+		anycast := testAnycast()
+		test.change(&anycast)
+
+		err := ValidateAnycastYaml(anycast)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case test.err != "" && err == nil:
+			t.Errorf("%s: expected error containing %q", test.name, test.err)
+		case test.err != "" && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%s: got %v, want an error containing %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestValidateAnycastAddresses(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		valid     bool
+	}{
+		{"no addresses", nil, true},
+		{"other addresses", []string{"10.0.0.1", "10.0.0.1", "2001:db8::a"}, true},
+		{"empty addresses", []string{"", ""}, true},
+		{"router id", []string{"192.0.2.53", "10.0.0.1", ""}, false},
+		{"next hop6", []string{"10.0.0.1", "10.0.0.1", "2001:DB8:53::53"}, false},
+	}
+
+	for _, test := range tests {
+		err := ValidateAnycastAddresses(testAnycast(), test.addresses)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestAnycastWarnings(t *testing.T) {
+	tests := []struct {
+		asNumber int
+		warning  string
+	}{
+		{13335, ""},
+		{4200000000 - 1, ""},
+		{64496, "is reserved for documentation"},
+		{65551, "is reserved for documentation"},
+		{64512, "is private"},
+		{65534, "is private"},
+		{4200000000, "is private"},
+		{65535, "is reserved"},
+		{4294967295, "is reserved"},
+	}
+
+	for _, test := range tests {
+		anycast := testAnycast()
+		anycast.Spec.AsNumber = test.asNumber
+
+		warnings := AnycastWarnings(anycast)
+		switch {
+		case test.warning == "" && len(warnings) != 0:
+			t.Errorf("%d: unexpected warnings: %v", test.asNumber, warnings)
+		case test.warning != "" && (len(warnings) != 1 || !strings.Contains(warnings[0], test.warning)):
+			t.Errorf("%d: got %v, want a warning containing %q", test.asNumber, warnings, test.warning)
+		}
+	}
+}
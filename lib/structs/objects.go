@@ -3,6 +3,26 @@ package structs
 const (
 	TypeBgpPeer string = "bgpPeer"
 	TypeAnycast string = "anycast"
+	TypeNode    string = "node"
+)
+
+const (
+	MaxPrefixActionLog      string = "log"
+	MaxPrefixActionTeardown string = "teardown"
+	MaxPrefixActionRestart  string = "restart"
+)
+
+const (
+	AddressFamilyInet  string = "inet"
+	AddressFamilyInet6 string = "inet6"
+	AddressFamilyFlow  string = "flow"
+	AddressFamilyFlow6 string = "flow6"
+)
+
+const (
+	BfdDefaultMinTx      int = 300
+	BfdDefaultMinRx      int = 300
+	BfdDefaultMultiplier int = 3
 )
 
 type objectTypeExtractor struct {
@@ -10,14 +30,97 @@ type objectTypeExtractor struct {
 	Type       string `yaml:"type"`
 }
 
+// Labels (e.g. site: ams1) are used by services to select their peers
 type BgpPeerMetaObject struct {
-	Name string `yaml:"name"`
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// Limits the number of prefixes accepted from a peer. WarningThreshold is
+// a percentage of Limit, RestartInterval is in minutes.
+type MaxPrefixObject struct {
+	Limit            int    `yaml:"limit"`
+	WarningThreshold int    `yaml:"warningThreshold,omitempty"`
+	Action           string `yaml:"action,omitempty"`
+	RestartInterval  int    `yaml:"restartInterval,omitempty"`
+}
+
+// BFD session to a peer (RFC 5880). Intervals are in milliseconds; unset
+// values use the defaults below.
+type BfdObject struct {
+	Enabled    bool `yaml:"enabled"`
+	MinTx      int  `yaml:"minTx,omitempty"`
+	MinRx      int  `yaml:"minRx,omitempty"`
+	Multiplier int  `yaml:"multiplier,omitempty"`
+	Multihop   bool `yaml:"multihop,omitempty"`
+}
+
+type PolicyMatchObject struct {
+	Prefixes    []string `yaml:"prefixes,omitempty"`
+	MinLength   int      `yaml:"minLength,omitempty"`
+	MaxLength   int      `yaml:"maxLength,omitempty"`
+	AFI         string   `yaml:"afi,omitempty"`
+	Services    []string `yaml:"services,omitempty"`
+	Communities []string `yaml:"communities,omitempty"`
 }
 
+type PolicySetObject struct {
+	Communities    []string `yaml:"communities,omitempty"`
+	AddCommunities []string `yaml:"addCommunities,omitempty"`
+	Prepend        int      `yaml:"prepend,omitempty"`
+	MED            *uint32  `yaml:"med,omitempty"`
+	LocalPref      *uint32  `yaml:"localPref,omitempty"`
+	NextHop        string   `yaml:"nextHop,omitempty"`
+}
+
+// Terms are evaluated in order; the first term with an accept or reject
+// action ends the evaluation. Routes not rejected by any term are accepted.
+type PolicyTermObject struct {
+	Name   string            `yaml:"name,omitempty"`
+	Match  PolicyMatchObject `yaml:"match,omitempty"`
+	Set    PolicySetObject   `yaml:"set,omitempty"`
+	Action string            `yaml:"action,omitempty"`
+}
+
+// Import is applied to the routes received from a peer, export to the
+// routes we announce to it
+type PolicyObject struct {
+	Import []PolicyTermObject `yaml:"import,omitempty"`
+	Export []PolicyTermObject `yaml:"export,omitempty"`
+}
+
+// NextHop and NextHop6 override the next hops announced to the peer,
+// which default to the local address of the session. Flowspec enables
+// the FlowSpec address families, so the peer receives the flow rules
+// injected through aactl.
+//
+// AsNumber is the AS the peer must announce in its OPEN. LocalAsNumber
+// overrides the AS of the anycast service for this peer. HoldTime and
+// Keepalive are in seconds; unset values use the defaults of the BGP
+// speaker. AddressFamilies replaces the families negotiated by default
+// (the one of the session, plus the flow families if Flowspec is set).
+// AddPath lists the families for which every path of a prefix is sent to
+// the peer (RFC 7911), instead of only the best one.
+// A passive peer is never connected to, we only accept its connections.
+// A peer with Shutdown set is configured, but kept administratively down
 type BgpPeerSpecObject struct {
-	AsNumber int    `yaml:"asNumber"`
-	IP       string `yaml:"IP"`
-	IP6      string `yaml:"IP6"`
+	AsNumber        int             `yaml:"asNumber"`
+	LocalAsNumber   int             `yaml:"localAsNumber,omitempty"`
+	IP              string          `yaml:"ip"`
+	IP6             string          `yaml:"ip6"`
+	Description     string          `yaml:"description,omitempty"`
+	HoldTime        int             `yaml:"holdTime,omitempty"`
+	Keepalive       int             `yaml:"keepalive,omitempty"`
+	AddressFamilies []string        `yaml:"addressFamilies,omitempty"`
+	AddPath         []string        `yaml:"addPath,omitempty"`
+	Passive         bool            `yaml:"passive,omitempty"`
+	Shutdown        bool            `yaml:"shutdown,omitempty"`
+	NextHop         string          `yaml:"nextHop,omitempty"`
+	NextHop6        string          `yaml:"nextHop6,omitempty"`
+	MaxPrefix       MaxPrefixObject `yaml:"maxPrefix,omitempty"`
+	Policy          PolicyObject    `yaml:"policy,omitempty"`
+	Bfd             BfdObject       `yaml:"bfd,omitempty"`
+	Flowspec        bool            `yaml:"flowspec,omitempty"`
 }
 
 type BgpPeerObject struct {
@@ -28,15 +131,33 @@ type BgpPeerObject struct {
 }
 
 type AnycastMetaObject struct {
-	Name string `yaml:"name"`
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// Selects the nodes which run a service. A node is selected if its site
+// is one of Sites (when set) and it has all the labels of NodeSelector
+// (when set); without either no node is selected. MaxNodes limits the
+// number of announcing nodes, taking the selected nodes in order of their
+// name. With fewer than MinNodes selected nodes the service is withdrawn
+// from all of them
+type PlacementObject struct {
+	NodeSelector map[string]string `yaml:"nodeSelector,omitempty"`
+	Sites        []string          `yaml:"sites,omitempty"`
+	MinNodes     int               `yaml:"minNodes,omitempty"`
+	MaxNodes     int               `yaml:"maxNodes,omitempty"`
 }
 
+// The service is announced to the peers listed in Peers, and to the peers
+// which have all the labels of PeerSelector
 type AnycastSpecObject struct {
-	AsNumber    int      `yaml:"asnum"`
-	IP          string   `yaml:"ip"`
-	IP6         string   `yaml:"ip6"`
-	HealthCheck string   `yaml:"healthCheck"`
-	Peers       []string `yaml:"bgpPeers"`
+	AsNumber     int               `yaml:"asNumber"`
+	IP           string            `yaml:"ip"`
+	IP6          string            `yaml:"ip6"`
+	HealthCheck  string            `yaml:"healthCheck"`
+	Peers        []string          `yaml:"bgpPeers"`
+	PeerSelector map[string]string `yaml:"peerSelector,omitempty"`
+	Placement    PlacementObject   `yaml:"placement,omitempty"`
 }
 
 type AnycastObject struct {
@@ -45,3 +166,31 @@ type AnycastObject struct {
 	Meta       AnycastMetaObject `yaml:"meta"`
 	Spec       AnycastSpecObject `yaml:"spec"`
 }
+
+// Labels are matched by the node selectors of services, together with the
+// site and hostname of the node
+type NodeMetaObject struct {
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// Hostname defaults to the name of the node. RouterId, NextHop and
+// NextHop6 override the addresses found on the host. The peers selected
+// by Peers and PeerSelector are used in addition to the ones of the
+// services running on the node, e.g. the routers of its site
+type NodeSpecObject struct {
+	Hostname     string            `yaml:"hostname,omitempty"`
+	Site         string            `yaml:"site,omitempty"`
+	RouterId     string            `yaml:"routerId,omitempty"`
+	NextHop      string            `yaml:"nextHop,omitempty"`
+	NextHop6     string            `yaml:"nextHop6,omitempty"`
+	Peers        []string          `yaml:"bgpPeers,omitempty"`
+	PeerSelector map[string]string `yaml:"peerSelector,omitempty"`
+}
+
+type NodeObject struct {
+	ApiVersion int            `yaml:"apiVersion"`
+	Type       string         `yaml:"type"`
+	Meta       NodeMetaObject `yaml:"meta"`
+	Spec       NodeSpecObject `yaml:"spec"`
+}
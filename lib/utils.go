@@ -2,7 +2,9 @@ package lib
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"net"
 	"os"
@@ -67,6 +69,52 @@ func DumpYaml(data interface{}) ([]byte, error) {
 	return output, nil
 }
 
+// Objects only have yaml tags, so they are converted through yaml to keep
+// the field names of the yaml files
+func DumpJson(data interface{}) ([]byte, error) {
+	var (
+		output []byte
+		value  interface{}
+		err    error
+	)
+
+	if output, err = yaml.Marshal(&data); err != nil {
+		err = errors.New("DumpJson: yaml.Marshal() failed: " + err.Error())
+		return nil, err
+	}
+
+	if err = yaml.Unmarshal(output, &value); err != nil {
+		err = errors.New("DumpJson: yaml.Unmarshal() failed: " + err.Error())
+		return nil, err
+	}
+
+	if output, err = json.MarshalIndent(jsonValue(value), "", "  "); err != nil {
+		err = errors.New("DumpJson: json.Marshal() failed: " + err.Error())
+		return nil, err
+	}
+
+	return append(output, '\n'), nil
+}
+
+// yaml decodes mappings into map[interface{}]interface{}, which json can
+// not encode
+func jsonValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		fields := make(map[string]interface{})
+		for key, item := range value {
+			fields[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return fields
+	case []interface{}:
+		for i, item := range value {
+			value[i] = jsonValue(item)
+		}
+	}
+
+	return value
+}
+
 func GetDefaultInterface(af int) (string, error) {
 	var (
 		stdout_buf bytes.Buffer